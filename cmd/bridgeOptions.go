@@ -0,0 +1,155 @@
+//go:build linux
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/q-controller/network-utils/src/utils/network/firewall"
+	"github.com/q-controller/network-utils/src/utils/network/ifc"
+	"github.com/spf13/cobra"
+)
+
+// addBridgeFlags adds the flags selecting the firewall options of a bridge,
+// shared by the commands that install its rules
+func addBridgeFlags(cmd *cobra.Command) {
+	cmd.Flags().Bool("dual-stack", false, "Also allow DHCPv6 and ICMPv6 neighbor discovery from guests")
+	cmd.Flags().Bool("stateful", false, "Only allow return traffic of connections opened by guests and drop other inbound traffic")
+	cmd.Flags().Bool("log", false, "Log guest traffic left to the default policy and the packets dropped by --stateful to NFLOG, see the trace command")
+	cmd.Flags().Uint16("log-group", firewall.DefaultLogGroup, "NFLOG group of the log rules")
+	cmd.Flags().Bool("offload", false, "Offload established connections between the bridge and hostIf to a flowtable")
+	cmd.Flags().String("snat-address", "", "Translate guest traffic to this source address, or to a pool first-last, instead of masquerading")
+	addLimitFlags(cmd)
+}
+
+// bridgeOptionsFromFlags returns the firewall options of the bridge name set
+// by the flags of addBridgeFlags
+func bridgeOptionsFromFlags(cmd *cobra.Command, name string) ([]firewall.BridgeOption, error) {
+	dualStack, dualStackErr := cmd.Flags().GetBool("dual-stack")
+	if dualStackErr != nil {
+		return nil, dualStackErr
+	}
+
+	stateful, statefulErr := cmd.Flags().GetBool("stateful")
+	if statefulErr != nil {
+		return nil, statefulErr
+	}
+
+	logDrops, logDropsErr := cmd.Flags().GetBool("log")
+	if logDropsErr != nil {
+		return nil, logDropsErr
+	}
+
+	logGroup, logGroupErr := cmd.Flags().GetUint16("log-group")
+	if logGroupErr != nil {
+		return nil, logGroupErr
+	}
+
+	offload, offloadErr := cmd.Flags().GetBool("offload")
+	if offloadErr != nil {
+		return nil, offloadErr
+	}
+
+	snatAddress, snatAddressErr := cmd.Flags().GetString("snat-address")
+	if snatAddressErr != nil {
+		return nil, snatAddressErr
+	}
+
+	limits, limitsErr := limitsFromFlags(cmd)
+	if limitsErr != nil {
+		return nil, limitsErr
+	}
+
+	// Offloaded connections skip the forward hook and with it the limits
+	if offload && !limits.IsZero() {
+		return nil, fmt.Errorf("--offload cannot be combined with --limit-pps, --limit-bps or --limit-conns")
+	}
+
+	var opts []firewall.BridgeOption
+	if dualStack {
+		opts = append(opts, firewall.WithDualStack())
+	}
+	if stateful {
+		opts = append(opts, firewall.WithStatefulForwarding())
+	}
+	if logDrops {
+		opts = append(opts, firewall.WithLogging(logGroup))
+	}
+	if offload {
+		opts = append(opts, firewall.WithFlowOffload())
+	}
+	if !limits.IsZero() {
+		opts = append(opts, firewall.WithGuestLimits(limits))
+	}
+
+	// Routed guests keep their addresses, so only translation needs the
+	// subnet of the bridge
+	routed := false
+	if cmd.Flags().Lookup("routed") != nil {
+		var routedErr error
+		if routed, routedErr = cmd.Flags().GetBool("routed"); routedErr != nil {
+			return nil, routedErr
+		}
+	}
+	if routed {
+		if snatAddress != "" {
+			return nil, fmt.Errorf("--snat-address cannot be combined with --routed")
+		}
+		return opts, nil
+	}
+
+	// Only guest traffic is translated. A bridge without IPv4 address has no
+	// subnet to masquerade; masquerading then falls back to any traffic
+	// leaving through hostIf, but the SNAT address is only for the subnet.
+	subnet, subnetErr := bridgeSubnet(cmd, name)
+	switch {
+	case subnetErr == nil:
+		opts = append(opts, firewall.WithSourceSubnet(subnet))
+	case snatAddress != "" || !errors.Is(subnetErr, ifc.ErrNoIPv4Address):
+		return nil, fmt.Errorf("failed to get the subnet of bridge %s: %w", name, subnetErr)
+	}
+	if snatAddress != "" {
+		addrMin, addrMax, rangeErr := parseAddressRange(snatAddress)
+		if rangeErr != nil {
+			return nil, rangeErr
+		}
+		opts = append(opts, firewall.WithSNAT(addrMin, addrMax))
+	}
+	return opts, nil
+}
+
+// bridgeSubnet returns the IPv4 subnet of the bridge name in the namespace
+// selected by --netns
+func bridgeSubnet(cmd *cobra.Command, name string) (*net.IPNet, error) {
+	if cmd.Flags().Lookup("netns") == nil {
+		return ifc.GetIPv4Network(name)
+	}
+	nsName, nsNameErr := cmd.Flags().GetString("netns")
+	if nsNameErr != nil {
+		return nil, nsNameErr
+	}
+	if nsName == "" {
+		return ifc.GetIPv4Network(name)
+	}
+	return ifc.GetIPv4NetworkInNetNS(nsName, name)
+}
+
+// parseAddressRange parses a single address or a range "first-last"
+func parseAddressRange(value string) (net.IP, net.IP, error) {
+	first, last, isRange := strings.Cut(value, "-")
+	addrMin := net.ParseIP(first)
+	if addrMin == nil {
+		return nil, nil, fmt.Errorf("invalid address %s", first)
+	}
+	if !isRange {
+		return addrMin, nil, nil
+	}
+	addrMax := net.ParseIP(last)
+	if addrMax == nil {
+		return nil, nil, fmt.Errorf("invalid address %s", last)
+	}
+	return addrMin, addrMax, nil
+}
@@ -4,8 +4,11 @@ package cmd
 
 import (
 	"fmt"
+	"net"
 
 	"github.com/q-controller/network-utils/src/utils/network/firewall"
+	"github.com/q-controller/network-utils/src/utils/network/ifc"
+	"github.com/q-controller/network-utils/src/utils/network/sysctl"
 	"github.com/spf13/cobra"
 )
 
@@ -26,31 +29,97 @@ var configureBridgeCmd = &cobra.Command{
 			return nftPrefixErr
 		}
 
-		if jumpErr := firewall.AddJumpRule("FORWARD", fmt.Sprintf("%sFORWARD", nftPrefix), "filter"); jumpErr != nil {
-			return jumpErr
+		dualStack, dualStackErr := cmd.Flags().GetBool("dual-stack")
+		if dualStackErr != nil {
+			return dualStackErr
 		}
 
-		if jumpErr := firewall.AddJumpRule("INPUT", fmt.Sprintf("%sINPUT", nftPrefix), "filter"); jumpErr != nil {
-			return jumpErr
+		routed, routedErr := cmd.Flags().GetBool("routed")
+		if routedErr != nil {
+			return routedErr
 		}
 
-		rules, rulesErr := firewall.NewRules(
-			firewall.ForwardOutboundRule(fmt.Sprintf("%sFORWARD", nftPrefix), "filter", hostIf, name),
-			firewall.ForwardReturnTrafficRule(fmt.Sprintf("%sFORWARD", nftPrefix), "filter", hostIf, name),
-			firewall.MasqueradeRule("POSTROUTING", "nat", hostIf),
-			firewall.PortRule(53, "udp", fmt.Sprintf("%sINPUT", nftPrefix), "filter"),
-			firewall.PortRule(67, "udp", fmt.Sprintf("%sINPUT", nftPrefix), "filter"),
-			firewall.PortRule(68, "udp", fmt.Sprintf("%sINPUT", nftPrefix), "filter"),
-			firewall.PortRule(53, "tcp", fmt.Sprintf("%sINPUT", nftPrefix), "filter"),
-			firewall.PortRule(67, "tcp", fmt.Sprintf("%sINPUT", nftPrefix), "filter"),
-			firewall.PortRule(68, "tcp", fmt.Sprintf("%sINPUT", nftPrefix), "filter"),
-		)
+		routes, routesErr := cmd.Flags().GetStringSlice("route")
+		if routesErr != nil {
+			return routesErr
+		}
+
+		setSysctls, setSysctlsErr := cmd.Flags().GetBool("sysctl")
+		if setSysctlsErr != nil {
+			return setSysctlsErr
+		}
+
+		dryRun, dryRunErr := cmd.Flags().GetBool("dry-run")
+		if dryRunErr != nil {
+			return dryRunErr
+		}
 
-		if rulesErr != nil {
-			return rulesErr
+		var guests []*net.IPNet
+		for _, route := range routes {
+			_, guest, parseErr := net.ParseCIDR(route)
+			if parseErr != nil {
+				return parseErr
+			}
+			guests = append(guests, guest)
+		}
+		if len(guests) > 0 && !routed {
+			return fmt.Errorf("--route requires --routed")
 		}
 
-		return firewall.AddRules(rules)
+		opts, optsErr := bridgeOptionsFromFlags(cmd, name)
+		if optsErr != nil {
+			return optsErr
+		}
+		if routed {
+			opts = append(opts, firewall.WithRouting())
+		}
+
+		fw, fwErr := openFirewall(cmd)
+		if fwErr != nil {
+			return fwErr
+		}
+		defer fw.Close()
+
+		if err := fw.Reconcile(firewall.BridgeRuleset(nftPrefix, hostIf, name, opts...)); err != nil {
+			return err
+		}
+		if setSysctls {
+			ns, nsErr := sysctlNamespace(cmd)
+			if nsErr != nil {
+				return nsErr
+			}
+			params := sysctl.BridgeParams(name, hostIf, dualStack)
+			if dryRun {
+				if err := printSysctls(cmd, ns, params); err != nil {
+					return err
+				}
+			} else if err := ns.Apply(name, params); err != nil {
+				return err
+			}
+			// Host-wide, so only reported
+			netfilter, netfilterErr := ns.Check(sysctl.BridgeNetfilterParams(dualStack))
+			if netfilterErr != nil {
+				return netfilterErr
+			}
+			for _, s := range netfilter {
+				if !s.OK() {
+					fmt.Fprintf(cmd.ErrOrStderr(), "Warning: %s is %s, bridged frames pass through iptables; see doctor sysctl\n", s.Name(), s.Current)
+				}
+			}
+		}
+		if !routed {
+			return nil
+		}
+		if dryRun {
+			if err := printSysctls(cmd, sysctl.Host(), ifc.RoutingParams(name, hostIf, guests)); err != nil {
+				return err
+			}
+			for _, command := range ifc.RoutingCommands(name, hostIf, guests) {
+				fmt.Fprintln(cmd.OutOrStdout(), command)
+			}
+			return nil
+		}
+		return ifc.EnableRouting(name, hostIf, guests)
 	},
 }
 
@@ -61,5 +130,15 @@ func init() {
 	configureBridgeCmd.MarkFlagRequired("name")
 	configureBridgeCmd.Flags().String("hostIf", "", "Host interface that the bridge will use")
 	configureBridgeCmd.MarkFlagRequired("hostIf")
-	configureBridgeCmd.Flags().String("nftPrefix", "QEMU-", "Prefix for nftables rules")
+	configureBridgeCmd.Flags().String("nftPrefix", firewall.DefaultPrefix, "Prefix for nftables rules")
+	configureBridgeCmd.Flags().Bool("routed", false, "Forward guest traffic with the guest addresses instead of masquerading, announced on hostIf with proxy ARP")
+	configureBridgeCmd.Flags().StringSlice("route", nil, "Guest address or prefix to route through the bridge, e.g. LAN addresses of guests, may be repeated; requires --routed")
+	configureBridgeCmd.Flags().Bool("sysctl", true, "Enable forwarding and loose rp_filter on the bridge; unconfigure-bridge restores them. bridge-nf-call-iptables is only reported")
+	addBridgeFlags(configureBridgeCmd)
+	addNetNSFlag(configureBridgeCmd)
+	addDryRunFlag(configureBridgeCmd)
+	configureBridgeCmd.Flags().Lookup("dry-run").Usage = "Print the changes as nft, sysctl and ip commands instead of applying them"
+	// Guest routes are only changed in the host namespace
+	configureBridgeCmd.MarkFlagsMutuallyExclusive("routed", "netns")
+	configureBridgeCmd.MarkFlagsMutuallyExclusive("routed", "snat-address")
 }
@@ -0,0 +1,145 @@
+//go:build linux
+
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/q-controller/network-utils/src/utils/network/conntrack"
+	"github.com/spf13/cobra"
+)
+
+var conntrackCmd = &cobra.Command{
+	Use:   "conntrack",
+	Short: "Lists and flushes the connection tracking entries of guests",
+}
+
+var conntrackListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "Lists the conntrack entries matching the filter flags",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		filter, filterErr := conntrackFilter(cmd)
+		if filterErr != nil {
+			return filterErr
+		}
+
+		ct, ctErr := openConntrack(cmd)
+		if ctErr != nil {
+			return ctErr
+		}
+		defer ct.Close()
+
+		entries, entriesErr := ct.List(filter)
+		if entriesErr != nil {
+			return entriesErr
+		}
+
+		w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "PROTO\tSOURCE\tDESTINATION\tTRANSLATED\tPACKETS\tBYTES\tTIMEOUT")
+		for _, e := range entries {
+			translated := "-"
+			if e.Translated() {
+				translated = e.ReplyDestination.String()
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%d\t%s\n", e.Protocol,
+				net.JoinHostPort(e.Source.String(), fmt.Sprint(e.SourcePort)),
+				net.JoinHostPort(e.Destination.String(), fmt.Sprint(e.DestinationPort)),
+				translated, e.Packets, e.Bytes, e.Timeout)
+		}
+		return w.Flush()
+	},
+}
+
+var conntrackFlushCmd = &cobra.Command{
+	Use:   "flush",
+	Short: "Deletes the conntrack entries matching the filter flags, so their next packets are translated by the current rules",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		filter, filterErr := conntrackFilter(cmd)
+		if filterErr != nil {
+			return filterErr
+		}
+		if filter.Source == nil && filter.Interface == "" && filter.Address == nil {
+			return fmt.Errorf("at least one of --bridge, --subnet or --address is required")
+		}
+
+		ct, ctErr := openConntrack(cmd)
+		if ctErr != nil {
+			return ctErr
+		}
+		defer ct.Close()
+
+		deleted, deleteErr := ct.Delete(filter)
+		if deleteErr != nil {
+			return deleteErr
+		}
+		fmt.Fprintf(cmd.OutOrStdout(), "Deleted %d entries\n", deleted)
+		return nil
+	},
+}
+
+// conntrackFilter returns the filter set by the flags of the conntrack commands
+func conntrackFilter(cmd *cobra.Command) (conntrack.Filter, error) {
+	bridge, bridgeErr := cmd.Flags().GetString("bridge")
+	if bridgeErr != nil {
+		return conntrack.Filter{}, bridgeErr
+	}
+	subnet, subnetErr := cmd.Flags().GetString("subnet")
+	if subnetErr != nil {
+		return conntrack.Filter{}, subnetErr
+	}
+	address, addressErr := cmd.Flags().GetString("address")
+	if addressErr != nil {
+		return conntrack.Filter{}, addressErr
+	}
+	translated, translatedErr := cmd.Flags().GetBool("nat")
+	if translatedErr != nil {
+		return conntrack.Filter{}, translatedErr
+	}
+
+	filter := conntrack.Filter{Interface: bridge, Translated: translated}
+	if subnet != "" {
+		if !strings.Contains(subnet, "/") {
+			return conntrack.Filter{}, fmt.Errorf("invalid subnet %s, expected a prefix like 192.168.26.0/24", subnet)
+		}
+		_, source, parseErr := net.ParseCIDR(subnet)
+		if parseErr != nil {
+			return conntrack.Filter{}, parseErr
+		}
+		filter.Source = source
+	}
+	if address != "" {
+		filter.Address = net.ParseIP(address)
+		if filter.Address == nil {
+			return conntrack.Filter{}, fmt.Errorf("invalid address %s", address)
+		}
+	}
+	return filter, nil
+}
+
+// openConntrack returns the conntrack table of the namespace selected by --netns
+func openConntrack(cmd *cobra.Command) (*conntrack.Conntrack, error) {
+	nsName, nsNameErr := cmd.Flags().GetString("netns")
+	if nsNameErr != nil {
+		return nil, nsNameErr
+	}
+	if nsName == "" {
+		return conntrack.Host(), nil
+	}
+	return conntrack.New(conntrack.WithNetNSName(nsName))
+}
+
+func init() {
+	rootCmd.AddCommand(conntrackCmd)
+
+	for _, c := range []*cobra.Command{conntrackListCmd, conntrackFlushCmd} {
+		conntrackCmd.AddCommand(c)
+		c.Flags().String("bridge", "", "Only entries opened by the guests of the bridge, from its subnets except its own addresses")
+		c.Flags().String("subnet", "", "Only entries opened from the subnet")
+		c.Flags().String("address", "", "Only entries with the address on either side, e.g. the old address of a guest")
+		c.Flags().Bool("nat", false, "Only entries whose source was translated")
+		addNetNSFlag(c)
+	}
+}
@@ -3,6 +3,10 @@
 package cmd
 
 import (
+	"fmt"
+	"net"
+
+	"github.com/q-controller/network-utils/src/utils/network/firewall"
 	"github.com/q-controller/network-utils/src/utils/network/ifc"
 	"github.com/spf13/cobra"
 )
@@ -20,10 +24,91 @@ var createTapCmd = &cobra.Command{
 			return bridgeErr
 		}
 
-		return ifc.CreateTap(name, bridgeName)
+		mac, macErr := cmd.Flags().GetString("mac")
+		if macErr != nil {
+			return macErr
+		}
+		ips, ipsErr := cmd.Flags().GetStringSlice("ip")
+		if ipsErr != nil {
+			return ipsErr
+		}
+
+		limits, limitsErr := limitsFromFlags(cmd)
+		if limitsErr != nil {
+			return limitsErr
+		}
+
+		dryRun, dryRunErr := cmd.Flags().GetBool("dry-run")
+		if dryRunErr != nil {
+			return dryRunErr
+		}
+
+		var opts []ifc.TapOption
+		var guest *firewall.Guest
+		if mac != "" {
+			hwAddr, parseErr := net.ParseMAC(mac)
+			if parseErr != nil {
+				return parseErr
+			}
+			var addrs []net.IP
+			for _, ip := range ips {
+				addr := net.ParseIP(ip)
+				if addr == nil {
+					return fmt.Errorf("invalid IP address %s", ip)
+				}
+				addrs = append(addrs, addr)
+			}
+			guest = &firewall.Guest{MAC: hwAddr, Addrs: addrs}
+			opts = append(opts, ifc.WithGuest(hwAddr, addrs...))
+		} else if len(ips) > 0 {
+			return fmt.Errorf("--ip requires --mac")
+		}
+
+		if !limits.IsZero() {
+			opts = append(opts, ifc.WithLimits(limits))
+		}
+
+		if dryRun {
+			return printTap(cmd, name, bridgeName, guest, limits)
+		}
+		return ifc.CreateTap(name, bridgeName, opts...)
 	},
 }
 
+// printTap prints the ip commands creating the tap name, unless it exists,
+// and the nft changes pinning it to guest and limiting it, for a dry run
+func printTap(cmd *cobra.Command, name, bridgeName string, guest *firewall.Guest, limits firewall.Limits) error {
+	exists, existsErr := (ifc.NetlinkBridgeManager{}).Exists(name)
+	if existsErr != nil {
+		return existsErr
+	}
+	if !exists {
+		fmt.Fprintf(cmd.OutOrStdout(), "ip tuntap add dev %s mode tap\n", name)
+		fmt.Fprintf(cmd.OutOrStdout(), "ip link set dev %s master %s\n", name, bridgeName)
+	}
+	fmt.Fprintf(cmd.OutOrStdout(), "ip link set dev %s up\n", name)
+
+	fw, fwErr := openFirewall(cmd)
+	if fwErr != nil {
+		return fwErr
+	}
+	defer fw.Close()
+
+	if guest != nil {
+		desired, desiredErr := firewall.GuardRuleset(firewall.DefaultPrefix, name, *guest)
+		if desiredErr != nil {
+			return desiredErr
+		}
+		if err := fw.Reconcile(desired); err != nil {
+			return err
+		}
+	}
+	if !limits.IsZero() {
+		return fw.Reconcile(firewall.TapLimitRuleset(firewall.DefaultPrefix, name, limits))
+	}
+	return nil
+}
+
 func init() {
 	rootCmd.AddCommand(createTapCmd)
 
@@ -31,4 +116,9 @@ func init() {
 	createTapCmd.MarkFlagRequired("name")
 	createTapCmd.Flags().String("bridge", "", "Name of the bridge to attach the tap device to")
 	createTapCmd.MarkFlagRequired("bridge")
+	createTapCmd.Flags().String("mac", "", "MAC address of the guest; frames with another source MAC are dropped")
+	createTapCmd.Flags().StringSlice("ip", nil, "IPv4 or IPv6 address of the guest, may be repeated; requires --mac")
+	addLimitFlags(createTapCmd)
+	addDryRunFlag(createTapCmd)
+	createTapCmd.Flags().Lookup("dry-run").Usage = "Print the ip and nft commands creating the tap instead of running them"
 }
@@ -0,0 +1,173 @@
+//go:build linux
+
+package cmd
+
+import (
+	"fmt"
+	"slices"
+	"text/tabwriter"
+
+	"github.com/q-controller/network-utils/src/utils/network/firewall"
+	"github.com/q-controller/network-utils/src/utils/network/sysctl"
+	"github.com/spf13/cobra"
+)
+
+var doctorCmd = &cobra.Command{
+	Use:   "doctor",
+	Short: "Checks the host for problems with the guest networking",
+}
+
+var doctorFirewallCmd = &cobra.Command{
+	Use:   "firewall",
+	Short: "Reports the base chains of other firewalls that may override the verdicts of the tool",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		nftPrefix, nftPrefixErr := cmd.Flags().GetString("nftPrefix")
+		if nftPrefixErr != nil {
+			return nftPrefixErr
+		}
+		nsName, nsNameErr := cmd.Flags().GetString("netns")
+		if nsNameErr != nil {
+			return nsNameErr
+		}
+
+		fw, fwErr := openFirewall(cmd)
+		if fwErr != nil {
+			return fwErr
+		}
+		defer fw.Close()
+
+		chains, chainsErr := fw.Diagnose(nftPrefix)
+		if chainsErr != nil {
+			return chainsErr
+		}
+
+		out := cmd.OutOrStdout()
+		w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "HOOK\tFAMILY\tTABLE\tCHAIN\tTYPE\tPRIORITY\tPOLICY\tOWNER\tRISK")
+		var risky []firewall.BaseChain
+		for _, c := range chains {
+			risk := c.Risk
+			if risk == "" {
+				risk = "-"
+			} else {
+				risky = append(risky, c)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\t%s\t%s\t%s\n", c.Hook, c.Family, c.Table, c.Chain, c.Type, c.Priority, c.Policy, c.Owner, risk)
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+
+		if len(risky) > 0 {
+			fmt.Fprintln(out, "\nRemedies:")
+			for _, c := range risky {
+				fmt.Fprintf(out, "  %s %s %s (%s): %s\n", c.Family, c.Table, c.Chain, c.Owner, c.Remedy)
+			}
+		}
+
+		// /proc/net shows the namespace of the process, so the legacy tables
+		// of another namespace are not visible here
+		if nsName == "" {
+			legacy, legacyErr := firewall.LegacyIptablesTables("/proc/net")
+			if legacyErr != nil {
+				return legacyErr
+			}
+			if len(legacy) > 0 {
+				fmt.Fprintf(out, "\niptables-legacy tables %v are loaded. Their rules are invisible to nftables but still apply:\n", legacy)
+				fmt.Fprintln(out, "  migrate them to iptables-nft, or accept the bridge traffic with iptables-legacy -I FORWARD -i <bridge> -j ACCEPT")
+			}
+		}
+		return nil
+	},
+}
+
+var doctorSysctlCmd = &cobra.Command{
+	Use:   "sysctl",
+	Short: "Reports the kernel parameters that stop the guests of a bridge from reaching the network",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		bridge, bridgeErr := cmd.Flags().GetString("bridge")
+		if bridgeErr != nil {
+			return bridgeErr
+		}
+		dualStack, dualStackErr := cmd.Flags().GetBool("dual-stack")
+		if dualStackErr != nil {
+			return dualStackErr
+		}
+		hostIf, hostIfErr := cmd.Flags().GetString("hostIf")
+		if hostIfErr != nil {
+			return hostIfErr
+		}
+
+		ns, nsErr := sysctlNamespace(cmd)
+		if nsErr != nil {
+			return nsErr
+		}
+		statuses, statusesErr := ns.Check(sysctl.BridgeParams(bridge, hostIf, dualStack))
+		if statusesErr != nil {
+			return statusesErr
+		}
+		netfilter, netfilterErr := ns.Check(sysctl.BridgeNetfilterParams(dualStack))
+		if netfilterErr != nil {
+			return netfilterErr
+		}
+
+		out := cmd.OutOrStdout()
+		w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tCURRENT\tWANT\tSTATUS")
+		var wrong, wrongNetfilter []sysctl.Status
+		for _, s := range append(statuses, netfilter...) {
+			current := s.Current
+			if current == "" {
+				current = "-"
+			}
+			status := "ok"
+			if !s.OK() {
+				status = "wrong"
+				if slices.Contains(netfilter, s) {
+					wrongNetfilter = append(wrongNetfilter, s)
+				} else {
+					wrong = append(wrong, s)
+				}
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", s.Name(), current, s.Value, status)
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+
+		if len(wrong) > 0 {
+			fmt.Fprintln(out, "\nRemedies: run configure-bridge, which sets and later restores them, or")
+			for _, s := range wrong {
+				if s.Current == "" {
+					fmt.Fprintf(out, "  %s is missing, check that its interface exists\n", s.Name())
+					continue
+				}
+				fmt.Fprintf(out, "  sysctl -w %s=%s\n", s.Name(), s.Value)
+			}
+		}
+		if len(wrongNetfilter) > 0 {
+			fmt.Fprintln(out, "\nBridged frames pass through iptables, whose FORWARD policy may drop them. These")
+			fmt.Fprintln(out, "parameters apply to every bridge of the host and are never changed; allow the")
+			fmt.Fprintln(out, "bridge in iptables, or if nothing relies on them:")
+			for _, s := range wrongNetfilter {
+				fmt.Fprintf(out, "  sysctl -w %s=%s\n", s.Name(), s.Value)
+			}
+		}
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(doctorCmd)
+	doctorCmd.AddCommand(doctorFirewallCmd)
+
+	doctorFirewallCmd.Flags().String("nftPrefix", firewall.DefaultPrefix, "Prefix for nftables rules")
+	addNetNSFlag(doctorFirewallCmd)
+
+	doctorCmd.AddCommand(doctorSysctlCmd)
+	doctorSysctlCmd.Flags().String("bridge", "", "Bridge whose guests should reach the network")
+	doctorSysctlCmd.Flags().Bool("dual-stack", false, "Also check the parameters IPv6 guests need")
+	doctorSysctlCmd.Flags().String("hostIf", "", "Uplink of the bridge, which must accept router advertisements with --dual-stack")
+	doctorSysctlCmd.MarkFlagRequired("bridge")
+	addNetNSFlag(doctorSysctlCmd)
+}
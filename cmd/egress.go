@@ -0,0 +1,173 @@
+//go:build linux
+
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/q-controller/network-utils/src/utils/network/firewall"
+	"github.com/spf13/cobra"
+)
+
+var egressCmd = &cobra.Command{
+	Use:   "egress",
+	Short: "Manages the destinations guests of a bridge may reach",
+}
+
+var egressPolicyCmd = &cobra.Command{
+	Use:   "policy",
+	Short: "Sets the egress mode of a bridge: allow, deny or off",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		bridgeName, nftPrefix, flagsErr := egressFlags(cmd)
+		if flagsErr != nil {
+			return flagsErr
+		}
+		modeStr, modeErr := cmd.Flags().GetString("mode")
+		if modeErr != nil {
+			return modeErr
+		}
+		mode, parseErr := firewall.ParseEgressMode(modeStr)
+		if parseErr != nil {
+			return parseErr
+		}
+
+		fw, fwErr := openFirewall(cmd)
+		if fwErr != nil {
+			return fwErr
+		}
+		defer fw.Close()
+
+		return fw.Reconcile(firewall.EgressRuleset(nftPrefix, bridgeName, mode))
+	},
+}
+
+var egressAddCmd = &cobra.Command{
+	Use:   "add",
+	Short: "Adds destinations to the egress list of a bridge",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return updateEgress(cmd, (*firewall.Firewall).AddEgressDestinations)
+	},
+}
+
+var egressRemoveCmd = &cobra.Command{
+	Use:   "remove",
+	Short: "Removes destinations from the egress list of a bridge",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return updateEgress(cmd, (*firewall.Firewall).RemoveEgressDestinations)
+	},
+}
+
+var egressListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "Prints the egress list of a bridge",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		bridgeName, nftPrefix, flagsErr := egressFlags(cmd)
+		if flagsErr != nil {
+			return flagsErr
+		}
+
+		fw, fwErr := openFirewall(cmd)
+		if fwErr != nil {
+			return fwErr
+		}
+		defer fw.Close()
+
+		prefixes, ports, listErr := fw.EgressDestinations(nftPrefix, bridgeName)
+		if listErr != nil {
+			return listErr
+		}
+		for _, prefix := range prefixes {
+			fmt.Fprintf(cmd.OutOrStdout(), "cidr %s\n", prefix)
+		}
+		for _, port := range ports {
+			fmt.Fprintf(cmd.OutOrStdout(), "port %d\n", port)
+		}
+		return nil
+	},
+}
+
+func egressFlags(cmd *cobra.Command) (string, string, error) {
+	bridgeName, bridgeErr := cmd.Flags().GetString("bridge")
+	if bridgeErr != nil {
+		return "", "", bridgeErr
+	}
+	nftPrefix, nftPrefixErr := cmd.Flags().GetString("nftPrefix")
+	if nftPrefixErr != nil {
+		return "", "", nftPrefixErr
+	}
+	return bridgeName, nftPrefix, nil
+}
+
+func updateEgress(cmd *cobra.Command, update func(*firewall.Firewall, string, string, []*net.IPNet, []uint16) error) error {
+	bridgeName, nftPrefix, flagsErr := egressFlags(cmd)
+	if flagsErr != nil {
+		return flagsErr
+	}
+	cidrs, cidrsErr := cmd.Flags().GetStringSlice("cidr")
+	if cidrsErr != nil {
+		return cidrsErr
+	}
+	ports, portsErr := cmd.Flags().GetUintSlice("port")
+	if portsErr != nil {
+		return portsErr
+	}
+
+	var prefixes []*net.IPNet
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			if strings.Contains(cidr, ":") {
+				cidr += "/128"
+			} else {
+				cidr += "/32"
+			}
+		}
+		_, prefix, parseErr := net.ParseCIDR(cidr)
+		if parseErr != nil {
+			return parseErr
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	var portNumbers []uint16
+	for _, port := range ports {
+		if port == 0 || port > 65535 {
+			return fmt.Errorf("invalid port %d", port)
+		}
+		portNumbers = append(portNumbers, uint16(port))
+	}
+	if len(prefixes) == 0 && len(portNumbers) == 0 {
+		return fmt.Errorf("at least one --cidr or --port is required")
+	}
+
+	fw, fwErr := openFirewall(cmd)
+	if fwErr != nil {
+		return fwErr
+	}
+	defer fw.Close()
+
+	return update(fw, nftPrefix, bridgeName, prefixes, portNumbers)
+}
+
+func init() {
+	rootCmd.AddCommand(egressCmd)
+
+	for _, c := range []*cobra.Command{egressPolicyCmd, egressAddCmd, egressRemoveCmd, egressListCmd} {
+		egressCmd.AddCommand(c)
+		c.Flags().String("bridge", "", "Name of the bridge")
+		c.MarkFlagRequired("bridge")
+		c.Flags().String("nftPrefix", firewall.DefaultPrefix, "Prefix for nftables rules")
+		addNetNSFlag(c)
+	}
+
+	egressPolicyCmd.Flags().String("mode", "", "allow: only listed addresses on listed ports, deny: all but listed addresses and ports, off: no restriction")
+	egressPolicyCmd.MarkFlagRequired("mode")
+
+	for _, c := range []*cobra.Command{egressAddCmd, egressRemoveCmd} {
+		c.Flags().StringSlice("cidr", nil, "IPv4 or IPv6 address or prefix, may be repeated")
+		c.Flags().UintSlice("port", nil, "TCP/UDP destination port, may be repeated")
+	}
+	for _, c := range []*cobra.Command{egressPolicyCmd, egressAddCmd, egressRemoveCmd} {
+		addDryRunFlag(c)
+	}
+}
@@ -0,0 +1,106 @@
+//go:build linux
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/q-controller/network-utils/src/utils/network/firewall"
+	"github.com/spf13/cobra"
+)
+
+var firewallCmd = &cobra.Command{
+	Use:   "firewall",
+	Short: "Snapshots and restores the firewall state of the tool",
+}
+
+var firewallExportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Writes every table, chain, jump, rule, set and flowtable of the prefix as JSON",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		file, fileErr := cmd.Flags().GetString("file")
+		if fileErr != nil {
+			return fileErr
+		}
+		nftPrefix, nftPrefixErr := cmd.Flags().GetString("nftPrefix")
+		if nftPrefixErr != nil {
+			return nftPrefixErr
+		}
+
+		fw, fwErr := openFirewall(cmd)
+		if fwErr != nil {
+			return fwErr
+		}
+		defer fw.Close()
+
+		doc, docErr := fw.Export(nftPrefix)
+		if docErr != nil {
+			return docErr
+		}
+
+		out := cmd.OutOrStdout()
+		if file != "" {
+			f, createErr := os.Create(file)
+			if createErr != nil {
+				return createErr
+			}
+			defer f.Close()
+			out = f
+		}
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(doc)
+	},
+}
+
+var firewallImportCmd = &cobra.Command{
+	Use:   "import",
+	Short: "Restores the state written by export; whatever the prefix owns beyond it is removed",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		file, fileErr := cmd.Flags().GetString("file")
+		if fileErr != nil {
+			return fileErr
+		}
+
+		var in io.Reader = cmd.InOrStdin()
+		if file != "" {
+			f, openErr := os.Open(file)
+			if openErr != nil {
+				return openErr
+			}
+			defer f.Close()
+			in = f
+		}
+		doc := &firewall.Document{}
+		decoder := json.NewDecoder(in)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(doc); err != nil {
+			return fmt.Errorf("failed to parse document: %w", err)
+		}
+
+		fw, fwErr := openFirewall(cmd)
+		if fwErr != nil {
+			return fwErr
+		}
+		defer fw.Close()
+
+		return fw.Import(doc)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(firewallCmd)
+	firewallCmd.AddCommand(firewallExportCmd)
+	firewallCmd.AddCommand(firewallImportCmd)
+
+	firewallExportCmd.Flags().String("file", "", "File to write the document to instead of stdout")
+	firewallExportCmd.Flags().String("nftPrefix", firewall.DefaultPrefix, "Prefix for nftables rules")
+	addNetNSFlag(firewallExportCmd)
+
+	firewallImportCmd.Flags().String("file", "", "File to read the document from instead of stdin")
+	addNetNSFlag(firewallImportCmd)
+	addDryRunFlag(firewallImportCmd)
+}
@@ -0,0 +1,32 @@
+//go:build linux
+
+package cmd
+
+import (
+	"github.com/q-controller/network-utils/src/utils/network/firewall"
+	"github.com/spf13/cobra"
+)
+
+// addLimitFlags adds the flags limiting the traffic of each guest of a command
+func addLimitFlags(cmd *cobra.Command) {
+	cmd.Flags().Uint64("limit-pps", 0, "Drop the packets a guest sends above this many per second, 0 for no limit")
+	cmd.Flags().Uint64("limit-bps", 0, "Drop the traffic a guest sends above this many bytes per second, 0 for no limit")
+	cmd.Flags().Uint32("limit-conns", 0, "Drop new connections of a guest that has this many open, 0 for no limit")
+}
+
+// limitsFromFlags returns the limits set by the flags of addLimitFlags
+func limitsFromFlags(cmd *cobra.Command) (firewall.Limits, error) {
+	packets, packetsErr := cmd.Flags().GetUint64("limit-pps")
+	if packetsErr != nil {
+		return firewall.Limits{}, packetsErr
+	}
+	bytes, bytesErr := cmd.Flags().GetUint64("limit-bps")
+	if bytesErr != nil {
+		return firewall.Limits{}, bytesErr
+	}
+	connections, connectionsErr := cmd.Flags().GetUint32("limit-conns")
+	if connectionsErr != nil {
+		return firewall.Limits{}, connectionsErr
+	}
+	return firewall.Limits{Packets: packets, Bytes: bytes, Connections: connections}, nil
+}
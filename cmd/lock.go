@@ -0,0 +1,20 @@
+//go:build linux
+
+package cmd
+
+import (
+	"github.com/q-controller/network-utils/src/utils/network/lock"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.PersistentFlags().Duration("lock-timeout", lock.DefaultTimeout, "How long to wait for other network-utils processes changing links or the ruleset")
+	rootCmd.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
+		timeout, timeoutErr := cmd.Flags().GetDuration("lock-timeout")
+		if timeoutErr != nil {
+			return timeoutErr
+		}
+		lock.SetTimeout(timeout)
+		return nil
+	}
+}
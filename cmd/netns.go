@@ -0,0 +1,76 @@
+//go:build linux
+
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/q-controller/network-utils/src/utils/network/firewall"
+	"github.com/q-controller/network-utils/src/utils/network/sysctl"
+	"github.com/spf13/cobra"
+)
+
+// addNetNSFlag adds the --netns flag selecting the namespace whose ruleset a command manages
+func addNetNSFlag(cmd *cobra.Command) {
+	cmd.Flags().String("netns", "", "Named network namespace to manage instead of the host namespace")
+}
+
+// addDryRunFlag adds the --dry-run flag printing the changes of a command instead of applying them
+func addDryRunFlag(cmd *cobra.Command) {
+	cmd.Flags().Bool("dry-run", false, "Print the changes as nft commands instead of applying them")
+}
+
+// openFirewall returns the Firewall of the namespace selected by --netns. With
+// --dry-run its changes are written to the output of cmd instead.
+func openFirewall(cmd *cobra.Command) (*firewall.Firewall, error) {
+	var opts []firewall.FirewallOption
+	if cmd.Flags().Lookup("netns") != nil {
+		nsName, nsNameErr := cmd.Flags().GetString("netns")
+		if nsNameErr != nil {
+			return nil, nsNameErr
+		}
+		if nsName != "" {
+			opts = append(opts, firewall.WithNetNSName(nsName))
+		}
+	}
+	if cmd.Flags().Lookup("dry-run") != nil {
+		dryRun, dryRunErr := cmd.Flags().GetBool("dry-run")
+		if dryRunErr != nil {
+			return nil, dryRunErr
+		}
+		if dryRun {
+			opts = append(opts, firewall.WithDryRun(cmd.OutOrStdout()))
+		}
+	}
+	if len(opts) == 0 {
+		return firewall.Host(), nil
+	}
+	return firewall.New(opts...)
+}
+
+// sysctlNamespace returns the sysctls of the namespace selected by --netns
+func sysctlNamespace(cmd *cobra.Command) (*sysctl.Namespace, error) {
+	nsName, nsNameErr := cmd.Flags().GetString("netns")
+	if nsNameErr != nil {
+		return nil, nsNameErr
+	}
+	if nsName == "" {
+		return sysctl.Host(), nil
+	}
+	return sysctl.NetNS(nsName), nil
+}
+
+// printSysctls prints the parameters of params ns would change as sysctl(8)
+// commands, for a dry run
+func printSysctls(cmd *cobra.Command, ns *sysctl.Namespace, params []sysctl.Param) error {
+	statuses, checkErr := ns.Check(params)
+	if checkErr != nil {
+		return checkErr
+	}
+	for _, s := range statuses {
+		if !s.OK() {
+			fmt.Fprintf(cmd.OutOrStdout(), "sysctl -w %s=%s\n", s.Name(), s.Value)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+//go:build linux
+
+package cmd
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/q-controller/network-utils/src/utils/network/firewall"
+	"github.com/spf13/cobra"
+)
+
+var publishPortCmd = &cobra.Command{
+	Use:   "publish-port",
+	Short: "Publishes a guest port on the host",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		bridgeName, bridgeErr := cmd.Flags().GetString("bridge")
+		if bridgeErr != nil {
+			return bridgeErr
+		}
+		hostPort, hostPortErr := cmd.Flags().GetUint16("host-port")
+		if hostPortErr != nil {
+			return hostPortErr
+		}
+		guestIPStr, guestIPErr := cmd.Flags().GetString("guest-ip")
+		if guestIPErr != nil {
+			return guestIPErr
+		}
+		guestPort, guestPortErr := cmd.Flags().GetUint16("guest-port")
+		if guestPortErr != nil {
+			return guestPortErr
+		}
+		proto, protoErr := cmd.Flags().GetString("proto")
+		if protoErr != nil {
+			return protoErr
+		}
+		nftPrefix, nftPrefixErr := cmd.Flags().GetString("nftPrefix")
+		if nftPrefixErr != nil {
+			return nftPrefixErr
+		}
+		remove, removeErr := cmd.Flags().GetBool("remove")
+		if removeErr != nil {
+			return removeErr
+		}
+
+		guestIP := net.ParseIP(guestIPStr)
+		if guestIP == nil {
+			return fmt.Errorf("invalid guest IP: %s", guestIPStr)
+		}
+		if guestPort == 0 {
+			guestPort = hostPort
+		}
+
+		subnet, subnetErr := bridgeSubnet(cmd, bridgeName)
+		if subnetErr != nil {
+			return fmt.Errorf("failed to get network of bridge %s: %w", bridgeName, subnetErr)
+		}
+		if !subnet.Contains(guestIP) {
+			return fmt.Errorf("guest IP %s is not in network %s of bridge %s", guestIP, subnet, bridgeName)
+		}
+
+		desired := firewall.PortForwardRuleset(nftPrefix, bridgeName, subnet, hostPort, guestIP, guestPort, proto)
+		if remove {
+			desired.Absent = desired.Present
+			desired.Present = nil
+		}
+
+		fw, fwErr := openFirewall(cmd)
+		if fwErr != nil {
+			return fwErr
+		}
+		defer fw.Close()
+
+		return fw.Reconcile(desired)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(publishPortCmd)
+
+	publishPortCmd.Flags().String("bridge", "", "Name of the bridge the guest is attached to")
+	publishPortCmd.MarkFlagRequired("bridge")
+	publishPortCmd.Flags().Uint16("host-port", 0, "Port to publish on the host")
+	publishPortCmd.MarkFlagRequired("host-port")
+	publishPortCmd.Flags().String("guest-ip", "", "IP address of the guest")
+	publishPortCmd.MarkFlagRequired("guest-ip")
+	publishPortCmd.Flags().Uint16("guest-port", 0, "Port of the guest service (defaults to the host port)")
+	publishPortCmd.Flags().String("proto", "tcp", "Protocol of the published port (tcp or udp)")
+	publishPortCmd.Flags().String("nftPrefix", firewall.DefaultPrefix, "Prefix for nftables rules")
+	publishPortCmd.Flags().Bool("remove", false, "Remove a previously published port")
+	addNetNSFlag(publishPortCmd)
+	addDryRunFlag(publishPortCmd)
+}
@@ -0,0 +1,93 @@
+//go:build linux
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+
+	"github.com/q-controller/network-utils/src/utils/network/firewall"
+	"github.com/spf13/cobra"
+)
+
+var secgroupCmd = &cobra.Command{
+	Use:   "secgroup",
+	Short: "Manages the security groups attached to tap devices",
+}
+
+var secgroupApplyCmd = &cobra.Command{
+	Use:   "apply",
+	Short: "Compiles the security groups of a file into the chains of their taps",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		file, fileErr := cmd.Flags().GetString("file")
+		if fileErr != nil {
+			return fileErr
+		}
+		nftPrefix, nftPrefixErr := cmd.Flags().GetString("nftPrefix")
+		if nftPrefixErr != nil {
+			return nftPrefixErr
+		}
+		taps, tapsErr := cmd.Flags().GetStringSlice("tap")
+		if tapsErr != nil {
+			return tapsErr
+		}
+		groupNames, groupNamesErr := cmd.Flags().GetStringSlice("group")
+		if groupNamesErr != nil {
+			return groupNamesErr
+		}
+
+		groups, groupsErr := readSecurityGroups(file)
+		if groupsErr != nil {
+			return groupsErr
+		}
+		for _, name := range groupNames {
+			for _, tap := range groups.TapsUsing(name) {
+				if !slices.Contains(taps, tap) {
+					taps = append(taps, tap)
+				}
+			}
+		}
+		if len(groupNames) > 0 && len(taps) == 0 {
+			return nil
+		}
+
+		fw, fwErr := openFirewall(cmd)
+		if fwErr != nil {
+			return fwErr
+		}
+		defer fw.Close()
+
+		return fw.ApplySecurityGroups(nftPrefix, groups, taps...)
+	},
+}
+
+func readSecurityGroups(file string) (*firewall.SecurityGroups, error) {
+	f, openErr := os.Open(file)
+	if openErr != nil {
+		return nil, openErr
+	}
+	defer f.Close()
+
+	groups := &firewall.SecurityGroups{}
+	decoder := json.NewDecoder(f)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(groups); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", file, err)
+	}
+	return groups, nil
+}
+
+func init() {
+	rootCmd.AddCommand(secgroupCmd)
+	secgroupCmd.AddCommand(secgroupApplyCmd)
+
+	secgroupApplyCmd.Flags().String("file", "", "JSON file with the groups and the taps they are attached to")
+	secgroupApplyCmd.MarkFlagRequired("file")
+	secgroupApplyCmd.Flags().StringSlice("tap", nil, "Only compile this tap, may be repeated; a tap without groups is detached")
+	secgroupApplyCmd.Flags().StringSlice("group", nil, "Only compile the taps using this group, may be repeated")
+	secgroupApplyCmd.Flags().String("nftPrefix", firewall.DefaultPrefix, "Prefix for nftables rules")
+	addNetNSFlag(secgroupApplyCmd)
+	addDryRunFlag(secgroupApplyCmd)
+}
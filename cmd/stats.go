@@ -0,0 +1,49 @@
+//go:build linux
+
+package cmd
+
+import (
+	"fmt"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+)
+
+var statsCmd = &cobra.Command{
+	Use:   "stats",
+	Short: "Prints packet and byte counters of the firewall rules of a bridge",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		bridge, bridgeErr := cmd.Flags().GetString("bridge")
+		if bridgeErr != nil {
+			return bridgeErr
+		}
+
+		fw, fwErr := openFirewall(cmd)
+		if fwErr != nil {
+			return fwErr
+		}
+		defer fw.Close()
+
+		stats, statsErr := fw.Stats()
+		if statsErr != nil {
+			return statsErr
+		}
+
+		w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "BRIDGE\tTAP\tROLE\tRULES\tPACKETS\tBYTES")
+		for _, s := range stats {
+			if bridge != "" && s.Bridge != bridge {
+				continue
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%d\n", s.Bridge, s.Tap, s.Role, s.Rules, s.Packets, s.Bytes)
+		}
+		return w.Flush()
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(statsCmd)
+
+	statsCmd.Flags().String("bridge", "", "Only print the rules of this bridge")
+	addNetNSFlag(statsCmd)
+}
@@ -0,0 +1,42 @@
+//go:build linux
+
+package cmd
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/q-controller/network-utils/src/utils/network/firewall"
+	"github.com/q-controller/network-utils/src/utils/network/nflog"
+	"github.com/spf13/cobra"
+)
+
+var traceCmd = &cobra.Command{
+	Use:   "trace",
+	Short: "Streams guest packets logged by configure-bridge --log",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		group, groupErr := cmd.Flags().GetUint16("group")
+		if groupErr != nil {
+			return groupErr
+		}
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		logger := slog.New(slog.NewTextHandler(cmd.OutOrStdout(), nil))
+		if err := nflog.Run(ctx, group, logger); err != nil && !errors.Is(err, context.Canceled) {
+			return err
+		}
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(traceCmd)
+
+	traceCmd.Flags().Uint16("group", firewall.DefaultLogGroup, "NFLOG group to read")
+}
@@ -0,0 +1,89 @@
+//go:build linux
+
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/q-controller/network-utils/src/utils/network/firewall"
+	"github.com/q-controller/network-utils/src/utils/network/ifc"
+	"github.com/spf13/cobra"
+)
+
+var unconfigureBridgeCmd = &cobra.Command{
+	Use:   "unconfigure-bridge",
+	Short: "removes the firewall rules configure-bridge installed for a bridge",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		name, nameErr := cmd.Flags().GetString("name")
+		if nameErr != nil {
+			return nameErr
+		}
+		hostIf, hostIfErr := cmd.Flags().GetString("hostIf")
+		if hostIfErr != nil {
+			return hostIfErr
+		}
+		nftPrefix, nftPrefixErr := cmd.Flags().GetString("nftPrefix")
+		if nftPrefixErr != nil {
+			return nftPrefixErr
+		}
+		all, allErr := cmd.Flags().GetBool("all")
+		if allErr != nil {
+			return allErr
+		}
+
+		routed, routedErr := cmd.Flags().GetBool("routed")
+		if routedErr != nil {
+			return routedErr
+		}
+
+		dryRun, dryRunErr := cmd.Flags().GetBool("dry-run")
+		if dryRunErr != nil {
+			return dryRunErr
+		}
+
+		if !all && name == "" {
+			return fmt.Errorf("either --name or --all is required")
+		}
+
+		fw, fwErr := openFirewall(cmd)
+		if fwErr != nil {
+			return fwErr
+		}
+		defer fw.Close()
+
+		if all {
+			return fw.PurgePrefix(nftPrefix)
+		}
+		if err := fw.Reconcile(firewall.BridgeTeardown(nftPrefix, hostIf, name)); err != nil {
+			return err
+		}
+		if dryRun {
+			return nil
+		}
+		if routed {
+			if err := ifc.DisableRouting(name, hostIf); err != nil {
+				return err
+			}
+		}
+		ns, nsErr := sysctlNamespace(cmd)
+		if nsErr != nil {
+			return nsErr
+		}
+		return ns.Restore(name)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(unconfigureBridgeCmd)
+
+	unconfigureBridgeCmd.Flags().StringP("name", "n", "", "Name of the bridge to unconfigure")
+	unconfigureBridgeCmd.Flags().String("hostIf", "", "Host interface the bridge used, only needed for rules created by older versions")
+	unconfigureBridgeCmd.Flags().String("nftPrefix", firewall.DefaultPrefix, "Prefix for nftables rules")
+	unconfigureBridgeCmd.Flags().Bool("all", false, "Remove the chains of the prefix with all their rules and every rule of their bridges")
+	unconfigureBridgeCmd.Flags().Bool("routed", false, "Also remove the guest routes of a bridge configured with --routed and restore proxy ARP")
+	unconfigureBridgeCmd.MarkFlagsMutuallyExclusive("name", "all")
+	unconfigureBridgeCmd.MarkFlagsMutuallyExclusive("routed", "all")
+	addNetNSFlag(unconfigureBridgeCmd)
+	addDryRunFlag(unconfigureBridgeCmd)
+	unconfigureBridgeCmd.MarkFlagsMutuallyExclusive("routed", "netns")
+}
@@ -0,0 +1,123 @@
+//go:build linux
+
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/q-controller/network-utils/src/utils/network/firewall"
+	"github.com/q-controller/network-utils/src/utils/network/ifc"
+	"github.com/spf13/cobra"
+)
+
+var watchCmd = &cobra.Command{
+	Use:   "watch",
+	Short: "Moves the rules of a bridge to the default interface whenever it changes",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		bridge, bridgeErr := cmd.Flags().GetString("bridge")
+		if bridgeErr != nil {
+			return bridgeErr
+		}
+
+		nftPrefix, nftPrefixErr := cmd.Flags().GetString("nftPrefix")
+		if nftPrefixErr != nil {
+			return nftPrefixErr
+		}
+
+		opts, optsErr := bridgeOptionsFromFlags(cmd, bridge)
+		if optsErr != nil {
+			return optsErr
+		}
+		if err := checkWatchable(nftPrefix, bridge); err != nil {
+			return err
+		}
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		subscription, subscriptionErr := ifc.SubscribeDefaultInterfaceChanges()
+		if subscriptionErr != nil {
+			return subscriptionErr
+		}
+		defer subscription.Stop()
+
+		logger := slog.New(slog.NewTextHandler(cmd.OutOrStdout(), nil))
+		logger.Info("watching the default interface", "bridge", bridge)
+
+		current := ""
+		for {
+			var next string
+			select {
+			case <-ctx.Done():
+				logger.Info("stopped watching", "bridge", bridge, "interface", current)
+				return nil
+			case iface, ok := <-subscription.InterfaceCh:
+				if !ok {
+					return errors.New("default interface changes are no longer received")
+				}
+				next = iface
+			}
+			if next == current {
+				continue
+			}
+
+			// Also flushes the conntrack entries of guests translated to the old uplink
+			if err := firewall.MoveBridge(nftPrefix, current, next, bridge, opts...); errors.Is(err, firewall.ErrConntrackFlush) {
+				// The rules moved, stale connections time out eventually
+				logger.Warn("failed to flush conntrack entries", "bridge", bridge, "error", err)
+			} else if err != nil {
+				return fmt.Errorf("failed to move the rules of bridge %s from %q to %q: %w", bridge, current, next, err)
+			}
+			if next == "" {
+				logger.Info("default interface lost, removed the bridge rules", "bridge", bridge, "from", current)
+			} else {
+				logger.Info("moved the bridge rules", "bridge", bridge, "from", current, "to", next)
+			}
+
+			current = next
+		}
+	},
+}
+
+// checkWatchable refuses bridges whose rules watch cannot move: those of
+// another prefix, which would end up in two sets of chains, and routed ones,
+// whose guests keep addresses of the network of their uplink and would be
+// masqueraded instead
+func checkWatchable(prefix, bridge string) error {
+	rules, rulesErr := firewall.ListTaggedRules(firewall.Tag{Bridge: bridge})
+	if rulesErr != nil {
+		return rulesErr
+	}
+	forwarded, translated := false, false
+	for _, r := range rules {
+		tag, _ := firewall.RuleTag(r)
+		switch tag.Role {
+		case firewall.RoleForwardOut:
+			if r.Chain.Name != prefix+firewall.ForwardChain {
+				return fmt.Errorf("bridge %s is configured in chain %s, pass its prefix with --nftPrefix", bridge, r.Chain.Name)
+			}
+			forwarded = true
+		case firewall.RoleMasquerade, firewall.RoleSNAT:
+			translated = true
+		}
+	}
+	if forwarded && !translated {
+		return fmt.Errorf("bridge %s is routed, its rules cannot follow the default interface", bridge)
+	}
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(watchCmd)
+
+	watchCmd.Flags().String("bridge", "", "Bridge whose rules follow the default interface")
+	watchCmd.MarkFlagRequired("bridge")
+	watchCmd.Flags().String("nftPrefix", firewall.DefaultPrefix, "Prefix for nftables rules")
+	addBridgeFlags(watchCmd)
+}
@@ -0,0 +1,311 @@
+//go:build linux
+
+// Package conntrack lists and deletes the connection tracking entries of
+// guests, e.g. those that outlived the firewall rules they were created by.
+package conntrack
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"slices"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+// Filter selects conntrack entries. The set fields must all match; an empty
+// Filter matches every entry.
+type Filter struct {
+	// Source matches entries opened from the subnet
+	Source *net.IPNet
+	// Interface matches entries opened from the subnets of the interface,
+	// e.g. by the guests of a bridge, but not from its own addresses, which
+	// are those of the host. Link-local subnets are skipped, as every link
+	// shares them. An interface without other addresses matches no entry.
+	Interface string
+	// Address matches entries with the address on either side, e.g. a guest
+	// whose lease moved it to another address
+	Address net.IP
+	// Translated only matches entries whose source was translated, e.g. by
+	// masquerading
+	Translated bool
+	// ExceptUplink skips the entries translated to an address of the
+	// interface, which can still carry them
+	ExceptUplink string
+	// ExceptRanges skips the entries translated to an address of the
+	// ranges, e.g. a SNAT pool that does not depend on the uplink
+	ExceptRanges []AddressRange
+}
+
+// AddressRange holds the addresses from First to Last. A nil Last holds
+// First only.
+type AddressRange struct {
+	First net.IP
+	Last  net.IP
+}
+
+// Contains reports whether ip is part of r
+func (r AddressRange) Contains(ip net.IP) bool {
+	last := r.Last
+	if last == nil {
+		last = r.First
+	}
+	ip16 := ip.To16()
+	return bytes.Compare(ip16, r.First.To16()) >= 0 && bytes.Compare(ip16, last.To16()) <= 0
+}
+
+// Entry is a conntrack entry. Replies are sent to ReplyDestination, which
+// differs from Source if the source was translated.
+type Entry struct {
+	Protocol         string
+	Source           net.IP
+	Destination      net.IP
+	SourcePort       uint16
+	DestinationPort  uint16
+	ReplySource      net.IP
+	ReplyDestination net.IP
+	Packets          uint64
+	Bytes            uint64
+	Timeout          time.Duration
+}
+
+// Translated reports whether the source of e was translated
+func (e Entry) Translated() bool {
+	return !e.ReplyDestination.Equal(e.Source)
+}
+
+func entryOf(flow *netlink.ConntrackFlow) Entry {
+	protocol, ok := nl.L4ProtoMap[flow.Forward.Protocol]
+	if !ok {
+		protocol = fmt.Sprint(flow.Forward.Protocol)
+	}
+	return Entry{
+		Protocol:         protocol,
+		Source:           flow.Forward.SrcIP,
+		Destination:      flow.Forward.DstIP,
+		SourcePort:       flow.Forward.SrcPort,
+		DestinationPort:  flow.Forward.DstPort,
+		ReplySource:      flow.Reverse.SrcIP,
+		ReplyDestination: flow.Reverse.DstIP,
+		Packets:          flow.Forward.Packets + flow.Reverse.Packets,
+		Bytes:            flow.Forward.Bytes + flow.Reverse.Bytes,
+		Timeout:          time.Duration(flow.TimeOut) * time.Second,
+	}
+}
+
+// matcher is a Filter with its interfaces resolved to addresses
+type matcher struct {
+	none         bool
+	source       *net.IPNet
+	nets         []*net.IPNet
+	notSources   []net.IP
+	address      net.IP
+	translated   bool
+	except       []net.IP
+	exceptRanges []AddressRange
+}
+
+func (m *matcher) MatchConntrackFlow(flow *netlink.ConntrackFlow) bool {
+	if m.none {
+		return false
+	}
+	if m.source != nil && !m.source.Contains(flow.Forward.SrcIP) {
+		return false
+	}
+	if len(m.nets) > 0 && !slices.ContainsFunc(m.nets, func(n *net.IPNet) bool { return n.Contains(flow.Forward.SrcIP) }) {
+		return false
+	}
+	if slices.ContainsFunc(m.notSources, flow.Forward.SrcIP.Equal) {
+		return false
+	}
+	if m.address != nil && !slices.ContainsFunc([]net.IP{flow.Forward.SrcIP, flow.Forward.DstIP, flow.Reverse.SrcIP, flow.Reverse.DstIP}, m.address.Equal) {
+		return false
+	}
+	translated := !flow.Reverse.DstIP.Equal(flow.Forward.SrcIP)
+	if m.translated && !translated {
+		return false
+	}
+	if !translated {
+		return true
+	}
+	return !slices.ContainsFunc(m.except, flow.Reverse.DstIP.Equal) &&
+		!slices.ContainsFunc(m.exceptRanges, func(r AddressRange) bool { return r.Contains(flow.Reverse.DstIP) })
+}
+
+// Conntrack lists and deletes the conntrack entries of a network namespace
+type Conntrack struct {
+	handle *netlink.Handle
+	owned  bool
+}
+
+// Host returns the Conntrack of the namespace of the calling thread
+func Host() *Conntrack {
+	return &Conntrack{handle: &netlink.Handle{}}
+}
+
+// Config holds the network namespace of a Conntrack
+type Config struct {
+	NetNS     int
+	NetNSName string
+}
+
+type Option func(*Config)
+
+// WithNetNS targets the network namespace referenced by fd. The fd is only
+// used while New runs and stays owned by the caller.
+func WithNetNS(fd int) Option {
+	return func(config *Config) {
+		config.NetNS = fd
+	}
+}
+
+// WithNetNSName targets the named network namespace, as created by `ip netns add`
+func WithNetNSName(name string) Option {
+	return func(config *Config) {
+		config.NetNSName = name
+	}
+}
+
+// New returns the Conntrack of the namespace selected by opts, or of the
+// calling thread without them. It must be closed to release its netlink
+// sockets.
+func New(opts ...Option) (*Conntrack, error) {
+	config := &Config{}
+	for _, opt := range opts {
+		opt(config)
+	}
+
+	handle := netns.NsHandle(config.NetNS)
+	if config.NetNSName != "" {
+		named, namedErr := netns.GetFromName(config.NetNSName)
+		if namedErr != nil {
+			return nil, fmt.Errorf("failed to open network namespace %s: %w", config.NetNSName, namedErr)
+		}
+		defer named.Close()
+		handle = named
+	}
+	if handle <= 0 {
+		return Host(), nil
+	}
+
+	nlHandle, nlHandleErr := netlink.NewHandleAt(handle, unix.NETLINK_NETFILTER, unix.NETLINK_ROUTE)
+	if nlHandleErr != nil {
+		return nil, fmt.Errorf("failed to open conntrack of network namespace: %w", nlHandleErr)
+	}
+	return &Conntrack{handle: nlHandle, owned: true}, nil
+}
+
+// Close releases the netlink sockets opened by New
+func (c *Conntrack) Close() {
+	if c.owned {
+		c.handle.Close()
+	}
+}
+
+// addresses returns the addresses assigned to the link name
+func (c *Conntrack) addresses(name string) ([]netlink.Addr, error) {
+	link, linkErr := c.handle.LinkByName(name)
+	if linkErr != nil {
+		return nil, fmt.Errorf("failed to get interface %s: %w", name, linkErr)
+	}
+	addrs, addrsErr := c.handle.AddrList(link, nl.FAMILY_ALL)
+	if addrsErr != nil {
+		return nil, fmt.Errorf("failed to get the addresses of %s: %w", name, addrsErr)
+	}
+	return addrs, nil
+}
+
+// addInterface restricts m to the entries opened from the subnets of addrs
+// but not from addrs themselves. Link-local subnets are not of the interface
+// alone and are skipped.
+func (m *matcher) addInterface(addrs []netlink.Addr) {
+	for _, addr := range addrs {
+		m.notSources = append(m.notSources, addr.IP)
+		if addr.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		m.nets = append(m.nets, &net.IPNet{IP: addr.IP.Mask(addr.Mask), Mask: addr.Mask})
+	}
+	if len(m.nets) == 0 {
+		m.none = true
+	}
+}
+
+// resolve looks up the addresses of the interfaces of filter
+func (c *Conntrack) resolve(filter Filter) (*matcher, error) {
+	m := &matcher{source: filter.Source, address: filter.Address, translated: filter.Translated, exceptRanges: filter.ExceptRanges}
+	if filter.Interface != "" {
+		addrs, addrsErr := c.addresses(filter.Interface)
+		if addrsErr != nil {
+			return nil, addrsErr
+		}
+		m.addInterface(addrs)
+	}
+	if filter.ExceptUplink != "" {
+		// A missing uplink carries nothing
+		if addrs, addrsErr := c.addresses(filter.ExceptUplink); addrsErr == nil {
+			for _, addr := range addrs {
+				m.except = append(m.except, addr.IP)
+			}
+		}
+	}
+	return m, nil
+}
+
+var families = []netlink.InetFamily{unix.AF_INET, unix.AF_INET6}
+
+// List returns the entries of the namespace of the calling thread matching
+// filter
+func List(filter Filter) ([]Entry, error) {
+	return Host().List(filter)
+}
+
+// List returns the entries matching filter
+func (c *Conntrack) List(filter Filter) ([]Entry, error) {
+	m, resolveErr := c.resolve(filter)
+	if resolveErr != nil {
+		return nil, resolveErr
+	}
+	var entries []Entry
+	for _, family := range families {
+		flows, listErr := c.handle.ConntrackTableList(netlink.ConntrackTable, family)
+		if listErr != nil {
+			return nil, fmt.Errorf("failed to list conntrack entries: %w", listErr)
+		}
+		for _, flow := range flows {
+			if m.MatchConntrackFlow(flow) {
+				entries = append(entries, entryOf(flow))
+			}
+		}
+	}
+	return entries, nil
+}
+
+// Delete deletes the entries of the namespace of the calling thread matching
+// filter and returns how many were deleted
+func Delete(filter Filter) (uint, error) {
+	return Host().Delete(filter)
+}
+
+// Delete deletes the entries matching filter and returns how many were
+// deleted. Their next packets create new entries, translated by the current
+// rules.
+func (c *Conntrack) Delete(filter Filter) (uint, error) {
+	m, resolveErr := c.resolve(filter)
+	if resolveErr != nil {
+		return 0, resolveErr
+	}
+	var deleted uint
+	for _, family := range families {
+		n, deleteErr := c.handle.ConntrackDeleteFilters(netlink.ConntrackTable, family, m)
+		deleted += n
+		if deleteErr != nil {
+			return deleted, fmt.Errorf("failed to delete conntrack entries: %w", deleteErr)
+		}
+	}
+	return deleted, nil
+}
@@ -0,0 +1,117 @@
+//go:build linux
+
+package conntrack
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+)
+
+func flow(guest, remote, replyDst string) *netlink.ConntrackFlow {
+	return &netlink.ConntrackFlow{
+		Forward: netlink.IPTuple{SrcIP: net.ParseIP(guest), DstIP: net.ParseIP(remote), Protocol: 6},
+		Reverse: netlink.IPTuple{SrcIP: net.ParseIP(remote), DstIP: net.ParseIP(replyDst), Protocol: 6},
+	}
+}
+
+func TestMatcher(t *testing.T) {
+	_, subnet, err := net.ParseCIDR("192.168.26.0/24")
+	require.NoError(t, err)
+	masqueraded := flow("192.168.26.10", "203.0.113.1", "10.0.0.5")
+	routed := flow("192.168.26.11", "203.0.113.1", "192.168.26.11")
+	host := flow("10.0.0.5", "203.0.113.1", "10.0.0.5")
+
+	all, err := Host().resolve(Filter{})
+	require.NoError(t, err)
+	require.True(t, all.MatchConntrackFlow(host))
+
+	guests, err := Host().resolve(Filter{Source: subnet})
+	require.NoError(t, err)
+	require.True(t, guests.MatchConntrackFlow(masqueraded))
+	require.True(t, guests.MatchConntrackFlow(routed))
+	require.False(t, guests.MatchConntrackFlow(host))
+
+	translated, err := Host().resolve(Filter{Source: subnet, Translated: true})
+	require.NoError(t, err)
+	require.True(t, translated.MatchConntrackFlow(masqueraded))
+	require.False(t, translated.MatchConntrackFlow(routed))
+
+	// The replies of a guest are addressed to it
+	guest, err := Host().resolve(Filter{Address: net.ParseIP("192.168.26.11")})
+	require.NoError(t, err)
+	require.True(t, guest.MatchConntrackFlow(routed))
+	require.False(t, guest.MatchConntrackFlow(masqueraded))
+}
+
+func TestMatcher_ExceptUplink(t *testing.T) {
+	_, subnet, err := net.ParseCIDR("192.168.26.0/24")
+	require.NoError(t, err)
+	m := &matcher{nets: []*net.IPNet{subnet}, translated: true, except: []net.IP{net.ParseIP("172.16.0.9")}}
+
+	require.True(t, m.MatchConntrackFlow(flow("192.168.26.10", "203.0.113.1", "10.0.0.5")))
+	require.False(t, m.MatchConntrackFlow(flow("192.168.26.10", "203.0.113.1", "172.16.0.9")))
+
+	// Nor those translated to a SNAT pool
+	pool := &matcher{translated: true, exceptRanges: []AddressRange{{First: net.ParseIP("203.0.113.5"), Last: net.ParseIP("203.0.113.9")}}}
+	require.False(t, pool.MatchConntrackFlow(flow("192.168.26.10", "198.51.100.1", "203.0.113.7")))
+	require.True(t, pool.MatchConntrackFlow(flow("192.168.26.10", "198.51.100.1", "203.0.113.10")))
+	require.True(t, AddressRange{First: net.ParseIP("203.0.113.5")}.Contains(net.ParseIP("203.0.113.5")))
+
+	// A bridge without addresses has no guests
+	require.False(t, (&matcher{none: true}).MatchConntrackFlow(flow("192.168.26.10", "203.0.113.1", "10.0.0.5")))
+}
+
+func TestMatcher_BridgeAddress(t *testing.T) {
+	_, subnet, err := net.ParseCIDR("192.168.26.0/24")
+	require.NoError(t, err)
+	m := &matcher{nets: []*net.IPNet{subnet}, notSources: []net.IP{net.ParseIP("192.168.26.1")}}
+
+	// Connections the host opened from the address of the bridge are not of guests
+	require.False(t, m.MatchConntrackFlow(flow("192.168.26.1", "192.168.26.10", "192.168.26.1")))
+	require.True(t, m.MatchConntrackFlow(flow("192.168.26.10", "203.0.113.1", "10.0.0.5")))
+}
+
+func TestMatcher_Interface(t *testing.T) {
+	addr := func(cidr string) netlink.Addr {
+		ip, subnet, err := net.ParseCIDR(cidr)
+		require.NoError(t, err)
+		subnet.IP = ip
+		return netlink.Addr{IPNet: subnet}
+	}
+
+	m := &matcher{}
+	m.addInterface([]netlink.Addr{addr("192.168.26.1/24"), addr("fe80::1/64")})
+	require.True(t, m.MatchConntrackFlow(flow("192.168.26.10", "203.0.113.1", "10.0.0.5")))
+	// Every link has fe80::/64; its entries are not of the bridge
+	require.False(t, m.MatchConntrackFlow(flow("fe80::5", "fe80::6", "fe80::5")))
+
+	// A bridge with a link-local address only has no guests
+	m = &matcher{}
+	m.addInterface([]netlink.Addr{addr("fe80::1/64")})
+	require.False(t, m.MatchConntrackFlow(flow("fe80::5", "fe80::6", "fe80::5")))
+
+	// Source and the subnets of the interface must both match
+	_, other, err := net.ParseCIDR("192.168.27.0/24")
+	require.NoError(t, err)
+	m = &matcher{source: other}
+	m.addInterface([]netlink.Addr{addr("192.168.26.1/24")})
+	require.False(t, m.MatchConntrackFlow(flow("192.168.26.10", "203.0.113.1", "10.0.0.5")))
+	require.False(t, m.MatchConntrackFlow(flow("192.168.27.10", "203.0.113.1", "10.0.0.5")))
+
+	_, guests, err := net.ParseCIDR("192.168.26.0/25")
+	require.NoError(t, err)
+	m = &matcher{source: guests}
+	m.addInterface([]netlink.Addr{addr("192.168.26.1/24")})
+	require.True(t, m.MatchConntrackFlow(flow("192.168.26.10", "203.0.113.1", "10.0.0.5")))
+	require.False(t, m.MatchConntrackFlow(flow("192.168.26.200", "203.0.113.1", "10.0.0.5")))
+}
+
+func TestEntryOf(t *testing.T) {
+	entry := entryOf(flow("192.168.26.10", "203.0.113.1", "10.0.0.5"))
+	require.Equal(t, "tcp", entry.Protocol)
+	require.True(t, entry.Translated())
+	require.False(t, entryOf(flow("192.168.26.11", "203.0.113.1", "192.168.26.11")).Translated())
+}
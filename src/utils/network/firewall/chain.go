@@ -7,11 +7,15 @@ import (
 	"fmt"
 
 	"github.com/google/nftables"
+	"github.com/q-controller/network-utils/src/utils/network/lock"
 )
 
 type ChainConfig struct {
-	Name   string
-	Table  string
+	Name  string
+	Table string
+	// Family is the family of Table. If it is zero, the chain is looked up in
+	// the only table of that name, or the one a ruleset declares.
+	Family nftables.TableFamily
 	Create bool
 	// Rich configuration options (optional - for creating new chains)
 	Type     *nftables.ChainType
@@ -23,8 +27,13 @@ type ChainConfig struct {
 type Option func(*ChainConfig)
 
 func NewChain(opts ...Option) (*nftables.Chain, *nftables.Table, error) {
-	conn := getConnection()
+	return Host().NewChain(opts...)
+}
 
+// NewChain looks up a chain of the namespace by family, table and name, and
+// creates it if requested. Without a family, the table name must be unique
+// across families.
+func (f *Firewall) NewChain(opts ...Option) (*nftables.Chain, *nftables.Table, error) {
 	config := &ChainConfig{}
 	for _, opt := range opts {
 		opt(config)
@@ -34,58 +43,27 @@ func NewChain(opts ...Option) (*nftables.Chain, *nftables.Table, error) {
 		return nil, nil, fmt.Errorf("chain name and table must be specified")
 	}
 
-	tables, tablesErr := conn.ListTables()
-	if tablesErr != nil {
-		return nil, nil, tablesErr
-	}
-
-	for _, table := range tables {
-		if table.Name == config.Table {
-			// Table exists, use it
-			chains, chainsErr := conn.ListChains()
-			if chainsErr != nil {
-				return nil, nil, chainsErr
-			}
-
-			for _, ch := range chains {
-				if ch.Name == config.Name {
-					return ch, table, nil // Chain already exists, return it
-				}
-			}
-
-			if config.Create {
-				// Chain does not exist, create it
-				customChain := &nftables.Chain{
-					Name:  config.Name,
-					Table: table,
-				}
-
-				// Apply rich configuration if provided
-				if config.Type != nil {
-					customChain.Type = *config.Type
-				}
-				if config.Hook != nil {
-					customChain.Hooknum = config.Hook
-				}
-				if config.Priority != nil {
-					customChain.Priority = config.Priority
-				}
-				if config.Policy != nil {
-					customChain.Policy = config.Policy
-				}
-
-				customChain = conn.AddChain(customChain)
-				if err := conn.Flush(); err != nil {
-					return nil, nil, err
-				}
-				return customChain, table, nil // New chain created
-			}
-
-			return nil, nil, fmt.Errorf("chain %s does not exist in table %s", config.Name, config.Table)
+	if config.Create {
+		unlock, lockErr := lock.Acquire()
+		if lockErr != nil {
+			return nil, nil, lockErr
 		}
+		defer unlock()
 	}
 
-	return nil, nil, fmt.Errorf("table %s does not exist", config.Table)
+	snap, snapErr := loadSnapshot(f.conn)
+	if snapErr != nil {
+		return nil, nil, snapErr
+	}
+	plan := &Plan{conn: f.conn}
+	chain, table, chainErr := snap.ensureChain(plan, *config)
+	if chainErr != nil {
+		return nil, nil, chainErr
+	}
+	if err := plan.Apply(); err != nil {
+		return nil, nil, err
+	}
+	return chain, table, nil
 }
 
 func WithName(chainName string) Option {
@@ -94,9 +72,10 @@ func WithName(chainName string) Option {
 	}
 }
 
-func WithinTable(tableName string) Option {
+func WithinTable(tableName string, family nftables.TableFamily) Option {
 	return func(config *ChainConfig) {
 		config.Table = tableName // Set the table name for the chain
+		config.Family = family   // Zero matches the only table of that name
 	}
 }
 
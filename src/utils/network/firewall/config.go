@@ -3,61 +3,383 @@
 
 package firewall
 
-func ConfigureFirewall(oldInterface, newInterface, bridgeName string) error {
-	conn := getConnection()
-	if err := CreateStandardFilterTable(conn); err != nil {
-		return err
+import (
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+
+	"github.com/q-controller/network-utils/src/utils/network/conntrack"
+	"github.com/q-controller/network-utils/src/utils/network/lock"
+)
+
+// DefaultPrefix is the prefix of the custom chains created by ConfigureFirewall
+const DefaultPrefix = "QEMU-"
+
+// ErrConntrackFlush is wrapped by the errors of ConfigureFirewall that only
+// failed to flush conntrack entries, after the rules were moved
+var ErrConntrackFlush = errors.New("failed to flush the stale conntrack entries")
+
+// bridgeTables returns the standard tables extended with the prefixed custom
+// FORWARD and INPUT chains.
+func bridgeTables(prefix string) []TableConfig {
+	filter := StandardFilterTable
+	filter.Chains = append(slices.Clone(StandardFilterTable.Chains),
+		ChainConfig{Name: prefix + ForwardChain, Table: FilterTable, Create: true},
+		ChainConfig{Name: prefix + InputChain, Table: FilterTable, Create: true},
+	)
+	return []TableConfig{filter, StandardNATTable}
+}
+
+func bridgeJumps(prefix string) []Jump {
+	return []Jump{
+		{From: ForwardChain, To: prefix + ForwardChain, Table: FilterTable},
+		{From: InputChain, To: prefix + InputChain, Table: FilterTable},
 	}
-	if err := CreateStandardNATTable(conn); err != nil {
-		return err
+}
+
+// BridgeConfig holds the optional behavior of the rules created for a bridge
+type BridgeConfig struct {
+	Stateful  bool
+	DualStack bool
+	Log       bool
+	LogGroup  uint16
+	Subnet    *net.IPNet
+	SNATMin   net.IP
+	SNATMax   net.IP
+	Offload   bool
+	Limits    Limits
+	Routed    bool
+}
+
+type BridgeOption func(*BridgeConfig)
+
+// WithStatefulForwarding only lets return traffic of connections opened by the
+// guests reach the bridge and drops new connections from the uplink.
+func WithStatefulForwarding() BridgeOption {
+	return func(config *BridgeConfig) {
+		config.Stateful = true
 	}
-	if jumpErr := AddJumpRule("FORWARD", "QEMU-FORWARD", FilterTable); jumpErr != nil {
-		return jumpErr
+}
+
+// WithDualStack also allows DHCPv6 and ICMPv6 neighbor discovery from guests
+func WithDualStack() BridgeOption {
+	return func(config *BridgeConfig) {
+		config.DualStack = true
 	}
+}
 
-	if jumpErr := AddJumpRule("INPUT", "QEMU-INPUT", FilterTable); jumpErr != nil {
-		return jumpErr
+// WithLogging sends guest traffic that falls through the custom FORWARD and
+// INPUT chains, and is therefore left to the default policy, to NFLOG group,
+// at most logRate per second. With stateful forwarding the packets its rules
+// drop are logged as well, prefixed with the chain and the reason of the drop.
+func WithLogging(group uint16) BridgeOption {
+	return func(config *BridgeConfig) {
+		config.Log = true
+		config.LogGroup = group
 	}
+}
 
-	if oldInterface != "" {
-		rules, rulesErr := NewRules(
-			ForwardOutboundRule("QEMU-FORWARD", FilterTable, oldInterface, bridgeName),
-			ForwardReturnTrafficRule("QEMU-FORWARD", FilterTable, oldInterface, bridgeName),
-			MasqueradeRule(PostRoutingChain, NATTable, oldInterface),
-			PortRule(53, "udp", "QEMU-INPUT", FilterTable),
-			PortRule(67, "udp", "QEMU-INPUT", FilterTable),
-			PortRule(68, "udp", "QEMU-INPUT", FilterTable),
-			PortRule(53, "tcp", "QEMU-INPUT", FilterTable),
-			PortRule(67, "tcp", "QEMU-INPUT", FilterTable),
-			PortRule(68, "tcp", "QEMU-INPUT", FilterTable),
-		)
-		if rulesErr != nil {
-			return rulesErr
-		}
-		if removeRules := RemoveRules(rules); removeRules != nil {
-			return removeRules
+// WithSourceSubnet only translates traffic from subnet, the network of the
+// bridge, instead of any traffic leaving through the uplink
+func WithSourceSubnet(subnet *net.IPNet) BridgeOption {
+	return func(config *BridgeConfig) {
+		config.Subnet = subnet
+	}
+}
+
+// WithSNAT translates the source of guest traffic to addrMin instead of the
+// address of the uplink. With addrMax guests get an address of the pool from
+// addrMin to addrMax.
+func WithSNAT(addrMin, addrMax net.IP) BridgeOption {
+	return func(config *BridgeConfig) {
+		config.SNATMin = addrMin
+		config.SNATMax = addrMax
+	}
+}
+
+// WithFlowOffload adds established connections between the bridge and the
+// uplink to a flowtable, so their packets take the fast path. Offloaded
+// packets skip the forward hook and with it the guest limits, so
+// ConfigureFirewall refuses it together with WithGuestLimits.
+func WithFlowOffload() BridgeOption {
+	return func(config *BridgeConfig) {
+		config.Offload = true
+	}
+}
+
+// WithRouting forwards guest traffic with the addresses of the guests instead
+// of translating it. Forwarding is stateful: the uplink only reaches guests
+// with return traffic. The uplink must route the guest subnet to the host,
+// see ifc.EnableRouting.
+func WithRouting() BridgeOption {
+	return func(config *BridgeConfig) {
+		config.Routed = true
+	}
+}
+
+// WithGuestLimits limits the traffic every guest forwards through the bridge,
+// metered by its source address. Traffic between guests and to the host is
+// not limited. It cannot be combined with WithFlowOffload.
+func WithGuestLimits(limits Limits) BridgeOption {
+	return func(config *BridgeConfig) {
+		config.Limits = limits
+	}
+}
+
+func newBridgeConfig(opts []BridgeOption) *BridgeConfig {
+	config := &BridgeConfig{}
+	for _, opt := range opts {
+		opt(config)
+	}
+	return config
+}
+
+// BridgeRules returns the rules that let bridgeName reach the outside world
+// through hostIf and let its guests use the DNS and DHCP services of the host.
+// Every rule is tagged with bridgeName and its role.
+func BridgeRules(prefix, hostIf, bridgeName string, opts ...BridgeOption) []NewRule {
+	config := newBridgeConfig(opts)
+
+	forwardChain := prefix + ForwardChain
+	inputChain := prefix + InputChain
+	tag := func(role string, rule NewRule) NewRule {
+		return Tagged(Tag{Bridge: bridgeName, Role: role}, rule)
+	}
+
+	rules := []NewRule{
+		tag(RoleForwardOut, ForwardOutboundRule(forwardChain, FilterTable, hostIf, bridgeName)),
+	}
+	if config.Stateful || config.Routed {
+		dropInvalid := tag(RoleForwardDrop, ForwardDropInvalidRule(forwardChain, FilterTable, hostIf, bridgeName))
+		dropNew := tag(RoleForwardDrop, ForwardDropNewRule(forwardChain, FilterTable, hostIf, bridgeName))
+		if config.Log {
+			dropInvalid = Logged(forwardChain+" drop invalid", config.LogGroup, dropInvalid)
+			dropNew = Logged(forwardChain+" drop new", config.LogGroup, dropNew)
 		}
+		rules = append(rules,
+			tag(RoleForwardReturn, ForwardEstablishedRule(forwardChain, FilterTable, hostIf, bridgeName)),
+			dropInvalid,
+			dropNew,
+		)
+	} else {
+		rules = append(rules, tag(RoleForwardReturn, ForwardReturnTrafficRule(forwardChain, FilterTable, hostIf, bridgeName)))
+	}
+	switch {
+	case config.Routed:
+		// Guests keep their addresses
+	case config.SNATMin != nil:
+		rules = append(rules, tag(RoleSNAT, SNATRule(PostRoutingChain, NATTable, hostIf, config.Subnet, config.SNATMin, config.SNATMax)))
+	default:
+		rules = append(rules, tag(RoleMasquerade, SourceMasqueradeRule(PostRoutingChain, NATTable, hostIf, config.Subnet)))
+	}
+	rules = append(rules,
+		tag(RoleDNS, InterfacePortRule(53, "udp", bridgeName, inputChain, FilterTable)),
+		tag(RoleDHCP, InterfacePortRule(67, "udp", bridgeName, inputChain, FilterTable)),
+		tag(RoleDHCP, InterfacePortRule(68, "udp", bridgeName, inputChain, FilterTable)),
+		tag(RoleDNS, InterfacePortRule(53, "tcp", bridgeName, inputChain, FilterTable)),
+		tag(RoleDHCP, InterfacePortRule(67, "tcp", bridgeName, inputChain, FilterTable)),
+		tag(RoleDHCP, InterfacePortRule(68, "tcp", bridgeName, inputChain, FilterTable)),
+	)
+	if config.DualStack {
+		rules = append(rules,
+			tag(RoleDHCPv6, InterfacePortRule(546, "udp", bridgeName, inputChain, FilterTable)),
+			tag(RoleDHCPv6, InterfacePortRule(547, "udp", bridgeName, inputChain, FilterTable)),
+			tag(RoleND, NeighborDiscoveryRule(inputChain, FilterTable, bridgeName)),
+		)
+	}
+	if config.Offload {
+		flowtable := bridgeFlowtable(prefix, bridgeName)
+		rules = append(rules,
+			tag(RoleFlowOffload, FlowOffloadRule(offloadChain(prefix), FilterTable, bridgeName, hostIf, flowtable)),
+			tag(RoleFlowOffload, FlowOffloadRule(offloadChain(prefix), FilterTable, hostIf, bridgeName, flowtable)),
+		)
+	}
+	if !config.Limits.IsZero() {
+		rules = append(rules, GuestLimitRules(prefix, bridgeName, config.Limits, config.DualStack)...)
+	}
+	if config.Log {
+		rules = append(rules,
+			tag(RoleLogTail, LogRule(forwardChain, FilterTable, bridgeName, "", config.LogGroup)),
+			tag(RoleLogTail, LogRule(forwardChain, FilterTable, "", bridgeName, config.LogGroup)),
+			tag(RoleLogTail, LogRule(inputChain, FilterTable, bridgeName, "", config.LogGroup)),
+		)
+	}
+	return rules
+}
+
+// bridgeTags returns the tags of the rules created by BridgeRules
+func bridgeTags(bridgeName string) []Tag {
+	var tags []Tag
+	for _, role := range []string{RoleForwardOut, RoleForwardReturn, RoleForwardDrop, RoleMasquerade, RoleSNAT, RoleDNS, RoleDHCP, RoleDHCPv6, RoleND, RoleLog, RoleLogTail, RoleFlowOffload, RoleLimit} {
+		tags = append(tags, Tag{Bridge: bridgeName, Role: role})
+	}
+	return tags
+}
+
+// BridgeRuleset returns the desired state for a bridge using hostIf as uplink.
+// Rules of bridgeName that are no longer wanted, e.g. for a previous uplink,
+// are removed.
+func BridgeRuleset(prefix, hostIf, bridgeName string, opts ...BridgeOption) *Ruleset {
+	config := newBridgeConfig(opts)
+	rs := &Ruleset{
+		Tables:  bridgeTables(prefix),
+		Jumps:   bridgeJumps(prefix),
+		Present: BridgeRules(prefix, hostIf, bridgeName, opts...),
+		Prune:   bridgeTags(bridgeName),
+	}
+	rs = withOffload(rs, prefix, hostIf, bridgeName, config.Offload)
+	return withGuestLimits(rs, prefix, bridgeName, config.Limits, config.DualStack)
+}
+
+// withOffload adds the flowtable of bridgeName over hostIf to rs. Without
+// offload the flowtable is removed, and so is the offload chain once no
+// bridge has rules in it.
+func withOffload(rs *Ruleset, prefix, hostIf, bridgeName string, offload bool) *Ruleset {
+	flowtable := FlowtableConfig{Name: bridgeFlowtable(prefix, bridgeName), Table: FilterTable}
+	if offload && hostIf != "" {
+		rs.Tables[0].Chains = append(rs.Tables[0].Chains, offloadChainConfig(prefix))
+		flowtable.Devices = []string{bridgeName, hostIf}
+	} else {
+		flowtable.Absent = true
+		rs.Retire = append(rs.Retire, Jump{To: offloadChain(prefix), Table: FilterTable})
+	}
+	rs.Flowtables = append(rs.Flowtables, flowtable)
+	return rs
+}
+
+// ConfigureFirewall moves the rules of bridgeName from oldInterface to
+// newInterface. Either interface may be empty. Rules tagged with bridgeName
+// are replaced even if oldInterface is unknown. All changes are applied
+// atomically. Afterwards the conntrack entries of guests translated to an
+// address that is not one of newInterface, or of the SNAT pool, are deleted;
+// if that fails, the error wraps ErrConntrackFlush and the rules are in place
+// nonetheless.
+func ConfigureFirewall(oldInterface, newInterface, bridgeName string, opts ...BridgeOption) error {
+	return Host().ConfigureFirewall(oldInterface, newInterface, bridgeName, opts...)
+}
+
+// ConfigureFirewall moves the rules of bridgeName in the namespace from
+// oldInterface to newInterface
+func (f *Firewall) ConfigureFirewall(oldInterface, newInterface, bridgeName string, opts ...BridgeOption) error {
+	return f.MoveBridge(DefaultPrefix, oldInterface, newInterface, bridgeName, opts...)
+}
+
+// MoveBridge is ConfigureFirewall for the chains of prefix
+func MoveBridge(prefix, oldInterface, newInterface, bridgeName string, opts ...BridgeOption) error {
+	return Host().MoveBridge(prefix, oldInterface, newInterface, bridgeName, opts...)
+}
+
+// MoveBridge moves the rules of bridgeName in the chains of prefix of the
+// namespace from oldInterface to newInterface
+func (f *Firewall) MoveBridge(prefix, oldInterface, newInterface, bridgeName string, opts ...BridgeOption) error {
+	config := newBridgeConfig(opts)
+	if config.Offload && !config.Limits.IsZero() {
+		return fmt.Errorf("flow offload of bridge %s would bypass its guest limits", bridgeName)
+	}
+
+	desired := &Ruleset{
+		Tables: bridgeTables(prefix),
+		Jumps:  bridgeJumps(prefix),
+		Prune:  bridgeTags(bridgeName),
+	}
+
+	if oldInterface != "" {
+		desired.Absent = BridgeRules(prefix, oldInterface, bridgeName, opts...)
 	}
 
 	if newInterface != "" {
-		rules, rulesErr := NewRules(
-			ForwardOutboundRule("QEMU-FORWARD", FilterTable, newInterface, bridgeName),
-			ForwardReturnTrafficRule("QEMU-FORWARD", FilterTable, newInterface, bridgeName),
-			MasqueradeRule(PostRoutingChain, NATTable, newInterface),
-			PortRule(53, "udp", "QEMU-INPUT", FilterTable),
-			PortRule(67, "udp", "QEMU-INPUT", FilterTable),
-			PortRule(68, "udp", "QEMU-INPUT", FilterTable),
-			PortRule(53, "tcp", "QEMU-INPUT", FilterTable),
-			PortRule(67, "tcp", "QEMU-INPUT", FilterTable),
-			PortRule(68, "tcp", "QEMU-INPUT", FilterTable),
-		)
+		desired.Present = BridgeRules(prefix, newInterface, bridgeName, opts...)
+	}
+
+	desired = withOffload(desired, prefix, newInterface, bridgeName, config.Offload)
+	if err := f.Reconcile(withGuestLimits(desired, prefix, bridgeName, config.Limits, config.DualStack)); err != nil {
+		return err
+	}
+	if oldInterface == newInterface || f.ct == nil {
+		return nil
+	}
+	// Guests translated to an address of another uplink would keep it until
+	// their connections time out
+	filter := conntrack.Filter{Interface: bridgeName, Translated: true, ExceptUplink: newInterface}
+	if config.SNATMin != nil {
+		filter.ExceptRanges = []conntrack.AddressRange{{First: config.SNATMin, Last: config.SNATMax}}
+	}
+	if _, err := f.ct.Delete(filter); err != nil {
+		return fmt.Errorf("%w of bridge %s: %w", ErrConntrackFlush, bridgeName, err)
+	}
+	return nil
+}
+
+// BridgeTeardown returns the desired state that removes what BridgeRuleset
+// installed for bridgeName, including its egress policy, guest limits and
+// published ports. The prefixed chains and the jumps into them are deleted
+// once no other bridge has rules in them. hostIf may be empty; it is only
+// needed for rules created before rules were tagged.
+func BridgeTeardown(prefix, hostIf, bridgeName string) *Ruleset {
+	rs := &Ruleset{
+		Prune:  append(bridgeTags(bridgeName), Tag{Bridge: bridgeName, Role: RoleEgress}, Tag{Bridge: bridgeName, Role: RolePortForward}),
+		Retire: append([]Jump{egressJump(prefix, bridgeName)}, bridgeJumps(prefix)...),
+		Sets:   egressSetConfigs(prefix, bridgeName, true),
+	}
+	if hostIf != "" {
+		rs.Absent = BridgeRules(prefix, hostIf, bridgeName)
+	}
+	rs = withOffload(rs, prefix, hostIf, bridgeName, false)
+	return withGuestLimits(rs, prefix, bridgeName, Limits{}, false)
+}
+
+// PurgePrefix deletes the chains of prefix with all their rules and the jumps
+// into them, together with every other rule of the bridges that had rules in
+// those chains, e.g. their masquerade and port forwarding rules, and their
+// flowtables, limit sets and egress sets.
+func PurgePrefix(prefix string) error {
+	return Host().PurgePrefix(prefix)
+}
+
+// PurgePrefix deletes the chains of prefix in the namespace
+func (f *Firewall) PurgePrefix(prefix string) error {
+	unlock, lockErr := lock.Acquire()
+	if lockErr != nil {
+		return lockErr
+	}
+	defer unlock()
+
+	snap, snapErr := loadSnapshot(f.conn)
+	if snapErr != nil {
+		return snapErr
+	}
+
+	rs := &Ruleset{Purge: true}
+	bridges := map[string]bool{}
+	for _, jump := range bridgeJumps(prefix) {
+		chain, _, chainErr := snap.resolve(jump.To, jump.Table)
+		if chainErr != nil {
+			continue
+		}
+		rules, rulesErr := snap.rulesOf(chain)
 		if rulesErr != nil {
 			return rulesErr
 		}
-		if removeRules := AddRules(rules); removeRules != nil {
-			return removeRules
+		for _, r := range rules {
+			if tag, ok := RuleTag(r); ok && tag.Bridge != "" && !bridges[tag.Bridge] {
+				bridges[tag.Bridge] = true
+				rs.Prune = append(rs.Prune, Tag{Bridge: tag.Bridge})
+				rs.Retire = append(rs.Retire, egressJump(prefix, tag.Bridge), limitJump(prefix, tag.Bridge))
+				rs.Sets = append(rs.Sets, guestLimitSets(prefix, tag.Bridge, Limits{}, false)...)
+				rs.Sets = append(rs.Sets, egressSetConfigs(prefix, tag.Bridge, true)...)
+				rs.Flowtables = append(rs.Flowtables, FlowtableConfig{Name: bridgeFlowtable(prefix, tag.Bridge), Table: FilterTable, Absent: true})
+			}
 		}
 	}
+	// Egress and limit chains go first, they are referenced from the prefixed chains
+	rs.Retire = append(rs.Retire, bridgeJumps(prefix)...)
+	rs.Retire = append(rs.Retire, Jump{To: offloadChain(prefix), Table: FilterTable})
 
-	return nil
+	plan, planErr := snap.plan(rs)
+	if planErr != nil {
+		return planErr
+	}
+	plan.conn = f.conn
+	return plan.Apply()
 }
@@ -0,0 +1,125 @@
+//go:build linux
+
+package firewall
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestBridgeRuleset_Stateful(t *testing.T) {
+	snap := newSnapshot(nil, nil, nil)
+	_, err := snap.plan(BridgeRuleset(DefaultPrefix, "eth0", "br0"))
+	require.NoError(t, err)
+	commit(snap)
+
+	plan, err := snap.plan(BridgeRuleset(DefaultPrefix, "eth0", "br0", WithStatefulForwarding()))
+	require.NoError(t, err)
+
+	var deleted, added []Tag
+	for _, op := range plan.Operations {
+		tag, _ := RuleTag(op.Rule)
+		switch op.Kind {
+		case OpDeleteRule:
+			deleted = append(deleted, tag)
+		case OpAddRule:
+			added = append(added, tag)
+		}
+	}
+	require.Equal(t, []Tag{{Bridge: "br0", Role: RoleForwardReturn}}, deleted)
+	require.Equal(t, []Tag{
+		{Bridge: "br0", Role: RoleForwardReturn},
+		{Bridge: "br0", Role: RoleForwardDrop},
+		{Bridge: "br0", Role: RoleForwardDrop},
+	}, added)
+
+	// Everything but replies is dropped, except for published ports
+	untracked, err := RenderExprs(plan.Operations[len(plan.Operations)-2].Rule.Exprs, nftables.TableFamilyINet)
+	require.NoError(t, err)
+	require.Equal(t, "iifname \"eth0\" oifname \"br0\" ct state invalid,untracked counter drop", untracked)
+	drop, err := RenderExprs(plan.Operations[len(plan.Operations)-1].Rule.Exprs, nftables.TableFamilyINet)
+	require.NoError(t, err)
+	require.Equal(t, "iifname \"eth0\" oifname \"br0\" ct state != established,related ct status != dnat counter drop", drop)
+}
+
+func TestBridgeRuleset_DualStack(t *testing.T) {
+	snap := newSnapshot(nil, nil, nil)
+	plan, err := snap.plan(BridgeRuleset(DefaultPrefix, "eth0", "br0", WithDualStack()))
+	require.NoError(t, err)
+
+	roles := map[string]int{}
+	for _, op := range plan.Operations {
+		if op.Kind == OpAddRule {
+			tag, _ := RuleTag(op.Rule)
+			roles[tag.Role]++
+		}
+	}
+	require.Equal(t, 2, roles[RoleDHCPv6])
+	require.Equal(t, 1, roles[RoleND])
+}
+
+func TestBridgeRuleset_SNAT(t *testing.T) {
+	snap := newSnapshot(nil, nil, nil)
+	subnet := &net.IPNet{IP: net.IPv4(192, 168, 26, 0).To4(), Mask: net.CIDRMask(24, 32)}
+	_, err := snap.plan(BridgeRuleset(DefaultPrefix, "eth0", "br0", WithSourceSubnet(subnet)))
+	require.NoError(t, err)
+	commit(snap)
+
+	plan, err := snap.plan(BridgeRuleset(DefaultPrefix, "eth0", "br0", WithSourceSubnet(subnet),
+		WithSNAT(net.ParseIP("203.0.113.5"), net.ParseIP("203.0.113.9"))))
+	require.NoError(t, err)
+	require.Len(t, plan.Operations, 2)
+	deleted, _ := RuleTag(plan.Operations[0].Rule)
+	require.Equal(t, OpDeleteRule, plan.Operations[0].Kind)
+	require.Equal(t, Tag{Bridge: "br0", Role: RoleMasquerade}, deleted)
+
+	snat := plan.Operations[1].Rule
+	require.Contains(t, snat.Exprs, &expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{192, 168, 26, 0}})
+	require.Contains(t, snat.Exprs, &expr.NAT{
+		Type:       expr.NATTypeSourceNAT,
+		Family:     unix.NFPROTO_IPV4,
+		RegAddrMin: 1,
+		RegAddrMax: 2,
+		Persistent: true,
+	})
+
+	_, err = snap.plan(BridgeRuleset(DefaultPrefix, "eth0", "br0",
+		WithSNAT(net.ParseIP("203.0.113.9"), net.ParseIP("203.0.113.5"))))
+	require.Error(t, err)
+}
+
+func TestBridgeRuleset_Routed(t *testing.T) {
+	snap := newSnapshot(nil, nil, nil)
+	_, err := snap.plan(BridgeRuleset(DefaultPrefix, "eth0", "br0"))
+	require.NoError(t, err)
+	commit(snap)
+
+	plan, err := snap.plan(BridgeRuleset(DefaultPrefix, "eth0", "br0", WithRouting()))
+	require.NoError(t, err)
+
+	var deleted, added []Tag
+	for _, op := range plan.Operations {
+		tag, _ := RuleTag(op.Rule)
+		switch op.Kind {
+		case OpDeleteRule:
+			deleted = append(deleted, tag)
+		case OpAddRule:
+			added = append(added, tag)
+		}
+	}
+	// Guests are no longer masqueraded and forwarding becomes stateful
+	require.ElementsMatch(t, []Tag{
+		{Bridge: "br0", Role: RoleMasquerade},
+		{Bridge: "br0", Role: RoleForwardReturn},
+	}, deleted)
+	require.Equal(t, []Tag{
+		{Bridge: "br0", Role: RoleForwardReturn},
+		{Bridge: "br0", Role: RoleForwardDrop},
+		{Bridge: "br0", Role: RoleForwardDrop},
+	}, added)
+}
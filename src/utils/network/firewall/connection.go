@@ -7,16 +7,79 @@ import (
 	"sync"
 
 	"github.com/google/nftables"
+	"github.com/q-controller/network-utils/src/utils/network/conntrack"
 )
 
+// Conn is the part of *nftables.Conn the firewall package uses. Changes are
+// buffered until Flush commits them as a single batch.
+type Conn interface {
+	ListTables() ([]*nftables.Table, error)
+	ListChains() ([]*nftables.Chain, error)
+	GetRules(table *nftables.Table, chain *nftables.Chain) ([]*nftables.Rule, error)
+	AddTable(table *nftables.Table) *nftables.Table
+	AddChain(chain *nftables.Chain) *nftables.Chain
+	DelChain(chain *nftables.Chain)
+	AddRule(rule *nftables.Rule) *nftables.Rule
+	InsertRule(rule *nftables.Rule) *nftables.Rule
+	DelRule(rule *nftables.Rule) error
+	GetSets(table *nftables.Table) ([]*nftables.Set, error)
+	GetSetElements(set *nftables.Set) ([]nftables.SetElement, error)
+	AddSet(set *nftables.Set, vals []nftables.SetElement) error
+	DelSet(set *nftables.Set)
+	SetAddElements(set *nftables.Set, vals []nftables.SetElement) error
+	SetDeleteElements(set *nftables.Set, vals []nftables.SetElement) error
+	ListFlowtables(table *nftables.Table) ([]*nftables.Flowtable, error)
+	AddFlowtable(flowtable *nftables.Flowtable) *nftables.Flowtable
+	DelFlowtable(flowtable *nftables.Flowtable)
+	Flush() error
+}
+
+// Conntrack is the part of *conntrack.Conntrack the firewall package uses to
+// delete the connection tracking entries a change of the rules made stale
+type Conntrack interface {
+	Delete(filter conntrack.Filter) (uint, error)
+}
+
 var (
-	singletonConn *nftables.Conn
-	connOnce      sync.Once
+	singletonConn      Conn
+	singletonConntrack Conntrack = conntrack.Host()
+	connOnce           sync.Once
+	connMu             sync.Mutex
 )
 
-func getConnection() *nftables.Conn {
+func getConnection() Conn {
+	connMu.Lock()
+	defer connMu.Unlock()
 	connOnce.Do(func() {
-		singletonConn = &nftables.Conn{}
+		if singletonConn == nil {
+			singletonConn = &nftables.Conn{}
+		}
 	})
 	return singletonConn
 }
+
+// SetConnection replaces the connection used by the package, e.g. with the
+// in-memory fake.Conn in tests. It returns the previous connection.
+func SetConnection(conn Conn) Conn {
+	previous := getConnection()
+	connMu.Lock()
+	defer connMu.Unlock()
+	singletonConn = conn
+	return previous
+}
+
+func getConntrack() Conntrack {
+	connMu.Lock()
+	defer connMu.Unlock()
+	return singletonConntrack
+}
+
+// SetConntrack replaces the conntrack table used by the package, e.g. with a
+// fake in tests. It returns the previous one.
+func SetConntrack(ct Conntrack) Conntrack {
+	connMu.Lock()
+	defer connMu.Unlock()
+	previous := singletonConntrack
+	singletonConntrack = ct
+	return previous
+}
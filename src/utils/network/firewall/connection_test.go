@@ -0,0 +1,272 @@
+//go:build linux
+
+package firewall
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/q-controller/network-utils/src/utils/network/conntrack"
+	"github.com/q-controller/network-utils/src/utils/network/firewall/fake"
+	"github.com/q-controller/network-utils/src/utils/network/lock"
+	"github.com/stretchr/testify/require"
+)
+
+// TestMain points the host-wide lock to a temporary file, so the tests need no
+// access to /run
+func TestMain(m *testing.M) {
+	dir, dirErr := os.MkdirTemp("", "firewall-lock")
+	if dirErr != nil {
+		panic(dirErr)
+	}
+	lock.SetPath(filepath.Join(dir, "network-utils.lock"))
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// useFakeConn makes the package use an empty in-memory ruleset for the test
+func useFakeConn(t *testing.T) *fake.Conn {
+	conn := fake.NewConn()
+	previous := SetConnection(conn)
+	previousConntrack := SetConntrack(&fakeConntrack{})
+	t.Cleanup(func() {
+		SetConnection(previous)
+		SetConntrack(previousConntrack)
+	})
+	return conn
+}
+
+// fakeConntrack records the filters of deleted conntrack entries
+type fakeConntrack struct {
+	filters []conntrack.Filter
+	err     error
+}
+
+func (c *fakeConntrack) Delete(filter conntrack.Filter) (uint, error) {
+	c.filters = append(c.filters, filter)
+	return 0, c.err
+}
+
+func liveRules(t *testing.T, conn Conn, chainName, tableName string) []*nftables.Rule {
+	chain, table, err := (&Firewall{conn: conn}).NewChain(WithName(chainName), WithinTable(tableName, 0))
+	require.NoError(t, err)
+	rules, err := conn.GetRules(table, chain)
+	require.NoError(t, err)
+	return rules
+}
+
+func TestAddJumpRule_InsertsAtHead(t *testing.T) {
+	conn := useFakeConn(t)
+	require.NoError(t, Reconcile(&Ruleset{Tables: bridgeTables(DefaultPrefix)}))
+
+	existing, err := NewRules(PortRule(22, "tcp", ForwardChain, FilterTable))
+	require.NoError(t, err)
+	require.NoError(t, AddRules(existing))
+
+	require.NoError(t, AddJumpRule(ForwardChain, DefaultPrefix+ForwardChain, FilterTable))
+	require.NoError(t, AddJumpRule(ForwardChain, DefaultPrefix+ForwardChain, FilterTable))
+
+	rules := liveRules(t, conn, ForwardChain, FilterTable)
+	require.Len(t, rules, 2)
+	require.Equal(t, []expr.Any{
+		&expr.Counter{},
+		&expr.Verdict{Kind: expr.VerdictJump, Chain: DefaultPrefix + ForwardChain},
+	}, rules[0].Exprs)
+	require.True(t, equalExprs(existing.rules[0].Exprs, rules[1].Exprs))
+
+	// The jump is tagged like those of a Ruleset, so Export sees it
+	to, ok := isJump(rules[0])
+	require.True(t, ok)
+	require.Equal(t, DefaultPrefix+ForwardChain, to)
+	var jumps []JumpDocument
+	for _, td := range exportJSON(t).Tables {
+		jumps = append(jumps, td.Jumps...)
+	}
+	require.Equal(t, []JumpDocument{{From: ForwardChain, To: DefaultPrefix + ForwardChain}}, jumps)
+}
+
+func TestAddRules_Deduplicates(t *testing.T) {
+	conn := useFakeConn(t)
+	require.NoError(t, Reconcile(&Ruleset{Tables: bridgeTables(DefaultPrefix)}))
+
+	rules, err := NewRules(BridgeRules(DefaultPrefix, "eth0", "br0")...)
+	require.NoError(t, err)
+	require.NoError(t, AddRules(rules))
+	require.NoError(t, AddRules(rules))
+
+	require.Len(t, liveRules(t, conn, DefaultPrefix+ForwardChain, FilterTable), 2)
+	require.Len(t, liveRules(t, conn, DefaultPrefix+InputChain, FilterTable), 6)
+	require.Len(t, liveRules(t, conn, PostRoutingChain, NATTable), 1)
+}
+
+func TestAddRules_ListsOncePerChain(t *testing.T) {
+	conn := useFakeConn(t)
+	require.NoError(t, Reconcile(&Ruleset{Tables: bridgeTables(DefaultPrefix)}))
+
+	// Tables and chains once for all builders
+	dumps := conn.Dumps
+	rules, err := NewRules(append(BridgeRules(DefaultPrefix, "eth0", "br0"), PortRule(22, "tcp", InputChain, FilterTable), PortRule(22, "tcp", InputChain, FilterTable))...)
+	require.NoError(t, err)
+	require.Equal(t, dumps+2, conn.Dumps)
+
+	// And the rules of each of the four chains once
+	dumps = conn.Dumps
+	require.NoError(t, AddRules(rules))
+	require.Equal(t, dumps+2+4, conn.Dumps)
+	require.Len(t, liveRules(t, conn, InputChain, FilterTable), 1)
+
+	dumps = conn.Dumps
+	require.NoError(t, RemoveRules(rules))
+	require.Equal(t, dumps+2+4, conn.Dumps)
+	require.Empty(t, liveRules(t, conn, InputChain, FilterTable))
+}
+
+func TestNewChain_MatchesTableFamily(t *testing.T) {
+	conn := useFakeConn(t)
+	// A filter table of another family listed first must not hide the chain
+	require.NoError(t, CreateTableFromConfig(conn, TableConfig{Name: FilterTable, Family: nftables.TableFamilyIPv4}))
+	require.NoError(t, Reconcile(&Ruleset{Tables: bridgeTables(DefaultPrefix)}))
+
+	chain, table, err := NewChain(WithName(DefaultPrefix+ForwardChain), WithinTable(FilterTable, nftables.TableFamilyINet))
+	require.NoError(t, err)
+	require.Equal(t, nftables.TableFamilyINet, table.Family)
+	require.Equal(t, nftables.TableFamilyINet, chain.Table.Family)
+}
+
+func TestNewChain_SameTableInTwoFamilies(t *testing.T) {
+	conn := useFakeConn(t)
+	for _, family := range []nftables.TableFamily{nftables.TableFamilyIPv4, nftables.TableFamilyINet} {
+		require.NoError(t, CreateTableFromConfig(conn, TableConfig{
+			Name:   FilterTable,
+			Family: family,
+			Chains: []ChainConfig{{Name: ForwardChain, Create: true}},
+		}))
+	}
+
+	for _, family := range []nftables.TableFamily{nftables.TableFamilyIPv4, nftables.TableFamilyINet} {
+		chain, table, err := NewChain(WithName(ForwardChain), WithinTable(FilterTable, family))
+		require.NoError(t, err)
+		require.Equal(t, family, table.Family)
+		require.Equal(t, family, chain.Table.Family)
+
+		created, _, err := NewChain(WithName("QEMU-TEST"), WithinTable(FilterTable, family), Create())
+		require.NoError(t, err)
+		require.Equal(t, family, created.Table.Family)
+	}
+
+	// Without a family the table name is ambiguous
+	_, _, err := NewChain(WithName(ForwardChain), WithinTable(FilterTable, 0))
+	require.Error(t, err)
+	_, _, err = NewChain(WithName("QEMU-OTHER"), WithinTable(FilterTable, 0), Create())
+	require.Error(t, err)
+	require.NotContains(t, chainNames(t, conn), "QEMU-OTHER")
+}
+
+func TestCreateTableFromConfig_SingleBatch(t *testing.T) {
+	conn := useFakeConn(t)
+	require.NoError(t, EnsureStandardFirewallInfrastructure(conn))
+	require.Equal(t, 2, conn.Flushes)
+	require.Subset(t, chainNames(t, conn), []string{InputChain, ForwardChain, OutputChain, PreroutingChain, PostRoutingChain})
+
+	require.NoError(t, EnsureStandardFirewallInfrastructure(conn))
+	require.Len(t, chainNames(t, conn), 6)
+}
+
+func TestEnsureChain_QueuesNothing(t *testing.T) {
+	conn := useFakeConn(t)
+	require.NoError(t, CreateStandardFilterTable(conn))
+
+	snap, err := loadSnapshot(conn)
+	require.NoError(t, err)
+	plan := &Plan{conn: conn}
+	chain, _, err := snap.ensureChain(plan, ChainConfig{Name: "QEMU-TEST", Table: FilterTable, Create: true})
+	require.NoError(t, err)
+	require.Equal(t, []Operation{{Kind: OpAddChain, Chain: chain}}, plan.Operations)
+
+	// The chain is only created by the plan, not by another flush of the
+	// shared connection
+	require.NoError(t, conn.Flush())
+	require.NotContains(t, chainNames(t, conn), "QEMU-TEST")
+	require.NoError(t, plan.Apply())
+	require.Contains(t, chainNames(t, conn), "QEMU-TEST")
+}
+
+func TestConfigureFirewall_SwitchInterface(t *testing.T) {
+	conn := useFakeConn(t)
+	require.NoError(t, ConfigureFirewall("", "eth0", "br0"))
+	require.Equal(t, 1, conn.Flushes)
+
+	require.NoError(t, ConfigureFirewall("eth0", "wlan0", "br0"))
+	require.Equal(t, 2, conn.Flushes)
+
+	desired, err := NewRules(BridgeRules(DefaultPrefix, "wlan0", "br0")...)
+	require.NoError(t, err)
+	tagged, err := ListTaggedRules(Tag{Bridge: "br0"})
+	require.NoError(t, err)
+	require.Len(t, tagged, len(desired.rules))
+	for _, rule := range desired.rules {
+		require.True(t, containsRule(tagged, rule))
+	}
+
+	// Jumps are not duplicated by the second run
+	require.Len(t, liveRules(t, conn, ForwardChain, FilterTable), 1)
+	require.Len(t, liveRules(t, conn, InputChain, FilterTable), 1)
+
+	// Nothing to do once the rules are in place
+	require.NoError(t, ConfigureFirewall("wlan0", "wlan0", "br0"))
+	require.Equal(t, 2, conn.Flushes)
+
+	// Guests masqueraded to eth0 are translated again
+	require.Equal(t, []conntrack.Filter{
+		{Interface: "br0", Translated: true, ExceptUplink: "eth0"},
+		{Interface: "br0", Translated: true, ExceptUplink: "wlan0"},
+	}, getConntrack().(*fakeConntrack).filters)
+}
+
+func TestConfigureFirewall_RejectsOffloadWithLimits(t *testing.T) {
+	conn := useFakeConn(t)
+	require.Error(t, ConfigureFirewall("", "eth0", "br0", WithFlowOffload(), WithGuestLimits(Limits{Packets: 1000})))
+	require.Zero(t, conn.Flushes)
+}
+
+func TestMoveBridge_Prefix(t *testing.T) {
+	conn := useFakeConn(t)
+	require.NoError(t, MoveBridge("VM-", "", "eth0", "br0"))
+	require.NoError(t, MoveBridge("VM-", "eth0", "wlan0", "br0"))
+
+	require.Contains(t, chainNames(t, conn), "VM-"+ForwardChain)
+	require.NotContains(t, chainNames(t, conn), DefaultPrefix+ForwardChain)
+	tagged, err := ListTaggedRules(Tag{Bridge: "br0", Role: RoleForwardOut})
+	require.NoError(t, err)
+	require.Len(t, tagged, 1)
+	require.Equal(t, "VM-"+ForwardChain, tagged[0].Chain.Name)
+}
+
+func TestConfigureFirewall_ConntrackFlushFails(t *testing.T) {
+	useFakeConn(t)
+	getConntrack().(*fakeConntrack).err = errors.New("netlink error")
+
+	require.ErrorIs(t, ConfigureFirewall("", "eth0", "br0"), ErrConntrackFlush)
+	tagged, err := ListTaggedRules(Tag{Bridge: "br0", Role: RoleForwardOut})
+	require.NoError(t, err)
+	require.Len(t, tagged, 1)
+}
+
+func TestConfigureFirewall_KeepsSNATPoolConnections(t *testing.T) {
+	useFakeConn(t)
+	addrMin, addrMax := net.ParseIP("203.0.113.5"), net.ParseIP("203.0.113.9")
+	require.NoError(t, ConfigureFirewall("eth0", "wlan0", "br0", WithSNAT(addrMin, addrMax)))
+
+	require.Equal(t, []conntrack.Filter{{
+		Interface:    "br0",
+		Translated:   true,
+		ExceptUplink: "wlan0",
+		ExceptRanges: []conntrack.AddressRange{{First: addrMin, Last: addrMax}},
+	}}, getConntrack().(*fakeConntrack).filters)
+}
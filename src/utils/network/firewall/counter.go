@@ -0,0 +1,97 @@
+//go:build linux
+
+package firewall
+
+import (
+	"cmp"
+	"slices"
+
+	"github.com/google/nftables/expr"
+)
+
+// RuleStats holds the packets and bytes matched by the rules of one bridge or
+// tap with the same role
+type RuleStats struct {
+	Bridge  string
+	Tap     string
+	Role    string
+	Rules   int
+	Packets uint64
+	Bytes   uint64
+}
+
+// isStatement reports whether e acts on a packet instead of matching it
+func isStatement(e expr.Any) bool {
+	switch e.(type) {
+	case *expr.Verdict, *expr.Masq, *expr.NAT, *expr.Immediate, *expr.Log, *expr.FlowOffload:
+		return true
+	default:
+		return false
+	}
+}
+
+// withCounter adds a counter in front of the trailing statements of exprs, so
+// it counts the packets the rule acts on.
+func withCounter(exprs []expr.Any) []expr.Any {
+	if slices.ContainsFunc(exprs, func(e expr.Any) bool {
+		_, ok := e.(*expr.Counter)
+		return ok
+	}) {
+		return exprs
+	}
+
+	at := len(exprs)
+	for at > 0 && isStatement(exprs[at-1]) {
+		at--
+	}
+	// [ counter pkts 0 bytes 0 ]
+	return slices.Insert(slices.Clone(exprs), at, expr.Any(&expr.Counter{}))
+}
+
+// sameMatch reports whether two rules match the same packets and do the same,
+// ignoring counters. Rules created before counters were added still match.
+func sameMatch(a, b []expr.Any) bool {
+	isCounter := func(e expr.Any) bool {
+		_, ok := e.(*expr.Counter)
+		return ok
+	}
+	return equalExprs(slices.DeleteFunc(slices.Clone(a), isCounter), slices.DeleteFunc(slices.Clone(b), isCounter))
+}
+
+// Stats returns the counters of the tagged rules of the host namespace
+func Stats() ([]RuleStats, error) {
+	return Host().Stats()
+}
+
+// Stats returns the counters of the tagged rules of the namespace summed up
+// per bridge, tap and role, sorted in that order.
+func (f *Firewall) Stats() ([]RuleStats, error) {
+	rules, rulesErr := f.ListTaggedRules(Tag{})
+	if rulesErr != nil {
+		return nil, rulesErr
+	}
+
+	var result []RuleStats
+	index := map[Tag]int{}
+	for _, r := range rules {
+		tag, _ := RuleTag(r)
+		i, ok := index[tag]
+		if !ok {
+			i = len(result)
+			index[tag] = i
+			result = append(result, RuleStats{Bridge: tag.Bridge, Tap: tag.Tap, Role: tag.Role})
+		}
+		result[i].Rules++
+		for _, e := range r.Exprs {
+			if counter, ok := e.(*expr.Counter); ok {
+				result[i].Packets += counter.Packets
+				result[i].Bytes += counter.Bytes
+			}
+		}
+	}
+
+	slices.SortFunc(result, func(a, b RuleStats) int {
+		return cmp.Or(cmp.Compare(a.Bridge, b.Bridge), cmp.Compare(a.Tap, b.Tap), cmp.Compare(a.Role, b.Role))
+	})
+	return result, nil
+}
@@ -0,0 +1,65 @@
+//go:build linux
+
+package firewall
+
+import (
+	"testing"
+
+	"github.com/google/nftables/expr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithCounter_BeforeStatements(t *testing.T) {
+	exprs := []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 1},
+		&expr.Immediate{Register: 1, Data: []byte{10, 0, 0, 1}},
+		&expr.NAT{Type: expr.NATTypeDestNAT},
+	}
+	counted := withCounter(exprs)
+	require.Len(t, counted, 4)
+	require.IsType(t, &expr.Counter{}, counted[1])
+	require.Len(t, exprs, 3)
+
+	require.Equal(t, counted, withCounter(counted))
+}
+
+func TestStats(t *testing.T) {
+	conn := useFakeConn(t)
+	require.NoError(t, Reconcile(BridgeRuleset(DefaultPrefix, "eth0", "br0")))
+
+	// Simulate traffic through the masquerade rule
+	for _, r := range liveRules(t, conn, PostRoutingChain, NATTable) {
+		for _, e := range r.Exprs {
+			if counter, ok := e.(*expr.Counter); ok {
+				counter.Packets, counter.Bytes = 3, 180
+			}
+		}
+	}
+
+	stats, err := Stats()
+	require.NoError(t, err)
+	require.Equal(t, []RuleStats{
+		{Bridge: "", Role: RoleJump, Rules: 2},
+		{Bridge: "br0", Role: RoleDHCP, Rules: 4},
+		{Bridge: "br0", Role: RoleDNS, Rules: 2},
+		{Bridge: "br0", Role: RoleForwardOut, Rules: 1},
+		{Bridge: "br0", Role: RoleForwardReturn, Rules: 1},
+		{Bridge: "br0", Role: RoleMasquerade, Rules: 1, Packets: 3, Bytes: 180},
+	}, stats)
+
+	// Counters do not make rules differ
+	require.NoError(t, Reconcile(BridgeRuleset(DefaultPrefix, "eth0", "br0")))
+	require.Equal(t, 1, conn.Flushes)
+}
+
+func TestStats_PerBridge(t *testing.T) {
+	conn := useFakeConn(t)
+	require.NoError(t, Reconcile(BridgeRuleset(DefaultPrefix, "eth0", "br0")))
+	require.NoError(t, Reconcile(BridgeRuleset(DefaultPrefix, "eth0", "br1")))
+
+	// Every bridge counts only the DNS and DHCP requests of its own guests
+	for _, r := range liveRules(t, conn, DefaultPrefix+InputChain, FilterTable) {
+		tag, _ := RuleTag(r)
+		require.Equal(t, &expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte(tag.Bridge + "\x00")}, r.Exprs[1], tag.Role)
+	}
+}
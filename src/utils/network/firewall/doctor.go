@@ -0,0 +1,339 @@
+//go:build linux
+
+package firewall
+
+import (
+	"bufio"
+	"cmp"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+)
+
+// Owners of the base chains found by Diagnose
+const (
+	OwnerTool        = "network-utils"
+	OwnerDocker      = "docker"
+	OwnerUFW         = "ufw"
+	OwnerFirewalld   = "firewalld"
+	OwnerIptablesNFT = "iptables-nft"
+	OwnerNftables    = "nftables"
+)
+
+// iptablesTables are the tables iptables-nft creates in the ip and ip6 families
+var iptablesTables = []string{"filter", "nat", "mangle", "raw", "security"}
+
+// BaseChain describes a base chain on one of the hooks the tool attaches to.
+// Risk explains how the chain may override the verdicts of the tool and is
+// empty if it cannot; Remedy suggests how to let the guest traffic pass.
+type BaseChain struct {
+	Family   string
+	Table    string
+	Chain    string
+	Type     string
+	Hook     string
+	Priority int32
+	Policy   string
+	Owner    string
+	Risk     string
+	Remedy   string
+}
+
+// familyName returns the name nft uses for family
+func familyName(family nftables.TableFamily) string {
+	switch family {
+	case nftables.TableFamilyINet:
+		return "inet"
+	case nftables.TableFamilyIPv4:
+		return "ip"
+	case nftables.TableFamilyIPv6:
+		return "ip6"
+	case nftables.TableFamilyARP:
+		return "arp"
+	case nftables.TableFamilyNetdev:
+		return "netdev"
+	case nftables.TableFamilyBridge:
+		return "bridge"
+	default:
+		return "unspec"
+	}
+}
+
+// diagnosedHook returns the name of the hook of chain if the tool attaches to
+// it in the family of the chain
+func diagnosedHook(chain *nftables.Chain) (string, bool) {
+	if chain.Hooknum == nil {
+		return "", false
+	}
+	switch chain.Table.Family {
+	case nftables.TableFamilyINet, nftables.TableFamilyIPv4, nftables.TableFamilyIPv6, nftables.TableFamilyBridge:
+	default:
+		// netdev and arp number their hooks differently
+		return "", false
+	}
+	switch *chain.Hooknum {
+	case *nftables.ChainHookInput:
+		return "input", true
+	case *nftables.ChainHookForward:
+		return "forward", true
+	case *nftables.ChainHookPostrouting:
+		return "postrouting", true
+	default:
+		return "", false
+	}
+}
+
+// Diagnose lists the base chains of the host namespace that may override the
+// verdicts of the chains of prefix
+func Diagnose(prefix string) ([]BaseChain, error) {
+	return Host().Diagnose(prefix)
+}
+
+// Diagnose enumerates the base chains on the input, forward and postrouting
+// hooks of every family and priority, sorted by hook, family and priority.
+// A verdict of the tool's chains only ends their own base chain: another base
+// chain on the same hook still sees the packet and may drop it, whatever its
+// priority. A nat chain running before the tool's one may translate guest
+// traffic first.
+func (f *Firewall) Diagnose(prefix string) ([]BaseChain, error) {
+	chains, chainsErr := f.conn.ListChains()
+	if chainsErr != nil {
+		return nil, chainsErr
+	}
+
+	rules := map[chainKey][]*nftables.Rule{}
+	rulesOf := func(chain *nftables.Chain) ([]*nftables.Rule, error) {
+		key := keyOf(chain)
+		if cached, ok := rules[key]; ok {
+			return cached, nil
+		}
+		chainRules, rulesErr := f.conn.GetRules(chain.Table, chain)
+		if rulesErr != nil {
+			return nil, rulesErr
+		}
+		rules[key] = chainRules
+		return chainRules, nil
+	}
+
+	var result []BaseChain
+	for _, chain := range chains {
+		hook, ok := diagnosedHook(chain)
+		if !ok {
+			continue
+		}
+
+		reached, reachErr := reachableRules(chains, chain, rulesOf)
+		if reachErr != nil {
+			return nil, reachErr
+		}
+		report := BaseChain{
+			Family: familyName(chain.Table.Family),
+			Table:  chain.Table.Name,
+			Chain:  chain.Name,
+			Type:   string(chain.Type),
+			Hook:   hook,
+			Policy: "accept",
+			Owner:  chainOwner(prefix, chain, reached),
+		}
+		if chain.Priority != nil {
+			report.Priority = int32(*chain.Priority)
+		}
+		if chain.Policy != nil && *chain.Policy == nftables.ChainPolicyDrop {
+			report.Policy = "drop"
+		}
+		// The rules the tool adds to a shared base chain, e.g. its nat rules,
+		// cannot override it, but the other rules of the chain can
+		if !strings.HasPrefix(chain.Name, prefix) {
+			report.Risk = chainRisk(report, foreignRules(prefix, reached))
+			if report.Risk != "" {
+				report.Remedy = chainRemedy(report)
+			}
+		}
+		result = append(result, report)
+	}
+
+	hookOrder := []string{"input", "forward", "postrouting"}
+	slices.SortFunc(result, func(a, b BaseChain) int {
+		return cmp.Or(
+			cmp.Compare(slices.Index(hookOrder, a.Hook), slices.Index(hookOrder, b.Hook)),
+			cmp.Compare(a.Family, b.Family),
+			cmp.Compare(a.Priority, b.Priority),
+			cmp.Compare(a.Table, b.Table),
+			cmp.Compare(a.Chain, b.Chain),
+		)
+	})
+	return result, nil
+}
+
+// reachableRules returns the rules of chain and of the chains it jumps or goes
+// to, keyed by the name of their chain
+func reachableRules(chains []*nftables.Chain, chain *nftables.Chain, rulesOf func(*nftables.Chain) ([]*nftables.Rule, error)) (map[string][]*nftables.Rule, error) {
+	reached := map[string][]*nftables.Rule{}
+	queue := []*nftables.Chain{chain}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		if _, ok := reached[current.Name]; ok {
+			continue
+		}
+		chainRules, rulesErr := rulesOf(current)
+		if rulesErr != nil {
+			return nil, rulesErr
+		}
+		reached[current.Name] = chainRules
+
+		for _, r := range chainRules {
+			for _, e := range r.Exprs {
+				verdict, ok := e.(*expr.Verdict)
+				if !ok || (verdict.Kind != expr.VerdictJump && verdict.Kind != expr.VerdictGoto) {
+					continue
+				}
+				i := slices.IndexFunc(chains, func(ch *nftables.Chain) bool {
+					return ch.Name == verdict.Chain && ch.Table.Name == chain.Table.Name && ch.Table.Family == chain.Table.Family
+				})
+				if i >= 0 {
+					queue = append(queue, chains[i])
+				}
+			}
+		}
+	}
+	return reached, nil
+}
+
+// foreignRules returns the rules of reached that the tool did not add, i.e.
+// the untagged rules of the chains not named with prefix
+func foreignRules(prefix string, reached map[string][]*nftables.Rule) map[string][]*nftables.Rule {
+	foreign := map[string][]*nftables.Rule{}
+	for name, chainRules := range reached {
+		if strings.HasPrefix(name, prefix) {
+			continue
+		}
+		foreign[name] = slices.DeleteFunc(slices.Clone(chainRules), func(r *nftables.Rule) bool {
+			_, ok := RuleTag(r)
+			return ok
+		})
+	}
+	return foreign
+}
+
+// chainOwner guesses the tool that created chain from its name, its table and
+// the chains it reaches. The rules the tool tags in shared base chains do not
+// make it their owner.
+func chainOwner(prefix string, chain *nftables.Chain, reached map[string][]*nftables.Rule) string {
+	reaches := func(match func(name string) bool) bool {
+		for name := range reached {
+			if match(name) {
+				return true
+			}
+		}
+		return false
+	}
+
+	switch {
+	case strings.HasPrefix(chain.Name, prefix) || reaches(func(name string) bool { return strings.HasPrefix(name, prefix) }):
+		return OwnerTool
+	case chain.Table.Name == TapTable && chain.Table.Family == nftables.TableFamilyBridge:
+		// The tap chains dispatch through verdict maps instead of jumps
+		return OwnerTool
+	case chain.Table.Name == "firewalld":
+		return OwnerFirewalld
+	case reaches(func(name string) bool { return strings.HasPrefix(name, "DOCKER") }):
+		return OwnerDocker
+	case reaches(func(name string) bool { return strings.HasPrefix(name, "ufw") }):
+		return OwnerUFW
+	case (chain.Table.Family == nftables.TableFamilyIPv4 || chain.Table.Family == nftables.TableFamilyIPv6) &&
+		slices.Contains(iptablesTables, chain.Table.Name) && chain.Name == strings.ToUpper(chain.Name):
+		return OwnerIptablesNFT
+	default:
+		return OwnerNftables
+	}
+}
+
+// chainRisk explains how a base chain that reached the given rules may
+// override the verdicts of the tool
+func chainRisk(report BaseChain, reached map[string][]*nftables.Rule) string {
+	var drops, translates bool
+	for _, chainRules := range reached {
+		for _, r := range chainRules {
+			for _, e := range r.Exprs {
+				switch e := e.(type) {
+				case *expr.Verdict:
+					drops = drops || e.Kind == expr.VerdictDrop
+				case *expr.Reject:
+					drops = true
+				case *expr.Masq, *expr.NAT:
+					translates = true
+				}
+			}
+		}
+	}
+
+	switch {
+	case report.Policy == "drop":
+		return "drops the guest traffic it does not accept itself"
+	case drops:
+		return "may drop or reject guest traffic"
+	case translates && report.Hook == "postrouting" && report.Priority <= int32(*nftables.ChainPriorityNATSource):
+		return "may translate guest traffic before the tool's nat chain"
+	default:
+		return ""
+	}
+}
+
+// chainRemedy suggests how to keep a risky base chain from dropping or
+// translating guest traffic. <bridge> stands for the configured bridge.
+func chainRemedy(report BaseChain) string {
+	if report.Hook == "postrouting" && report.Policy != "drop" {
+		return "exclude the bridge subnet from the translations of " + report.Family + " " + report.Table + " " + report.Chain
+	}
+	switch report.Owner {
+	case OwnerDocker:
+		return "iptables -I DOCKER-USER -i <bridge> -j ACCEPT; iptables -I DOCKER-USER -o <bridge> -j ACCEPT"
+	case OwnerUFW:
+		return "ufw route allow in on <bridge>; ufw route allow out on <bridge>"
+	case OwnerFirewalld:
+		return "firewall-cmd --permanent --zone=trusted --add-interface=<bridge> && firewall-cmd --reload"
+	case OwnerIptablesNFT:
+		return "iptables -I " + report.Chain + " -i <bridge> -j ACCEPT; iptables -I " + report.Chain + " -o <bridge> -j ACCEPT"
+	default:
+		return "accept traffic of <bridge> at the head of " + report.Family + " " + report.Table + " " + report.Chain
+	}
+}
+
+// LegacyIptablesTables returns the iptables-legacy tables loaded in the
+// namespace whose /proc/net is procNet, e.g. "ip filter". Their rules are
+// invisible to nftables but still see every packet.
+func LegacyIptablesTables(procNet string) ([]string, error) {
+	var result []string
+	for _, source := range []struct{ family, file string }{
+		{"ip", "ip_tables_names"},
+		{"ip6", "ip6_tables_names"},
+	} {
+		f, openErr := os.Open(filepath.Join(procNet, source.file))
+		if errors.Is(openErr, fs.ErrNotExist) {
+			// The module is not loaded, so there are no tables
+			continue
+		}
+		if openErr != nil {
+			return nil, openErr
+		}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if name := strings.TrimSpace(scanner.Text()); name != "" {
+				result = append(result, source.family+" "+name)
+			}
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	slices.Sort(result)
+	return result, nil
+}
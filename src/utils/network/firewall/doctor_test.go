@@ -0,0 +1,103 @@
+//go:build linux
+
+package firewall
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiagnose(t *testing.T) {
+	conn := useFakeConn(t)
+	require.NoError(t, Reconcile(BridgeRuleset(DefaultPrefix, "eth0", "br0")))
+
+	drop := nftables.ChainPolicyDrop
+	docker := conn.AddTable(&nftables.Table{Name: FilterTable, Family: nftables.TableFamilyIPv4})
+	forward := conn.AddChain(&nftables.Chain{
+		Name: ForwardChain, Table: docker, Type: nftables.ChainTypeFilter,
+		Hooknum: nftables.ChainHookForward, Priority: nftables.ChainPriorityFilter, Policy: &drop,
+	})
+	conn.AddChain(&nftables.Chain{Name: "DOCKER-USER", Table: docker})
+	conn.AddRule(&nftables.Rule{Table: docker, Chain: forward, Exprs: []expr.Any{&expr.Verdict{Kind: expr.VerdictJump, Chain: "DOCKER-USER"}}})
+
+	user := conn.AddTable(&nftables.Table{Name: "user", Family: nftables.TableFamilyINet})
+	conn.AddChain(&nftables.Chain{
+		Name: "input", Table: user, Type: nftables.ChainTypeFilter,
+		Hooknum: nftables.ChainHookInput, Priority: nftables.ChainPriorityFilter,
+	})
+	require.NoError(t, conn.Flush())
+
+	chains, err := Diagnose(DefaultPrefix)
+	require.NoError(t, err)
+	byChain := map[string]BaseChain{}
+	for _, c := range chains {
+		byChain[c.Family+" "+c.Table+" "+c.Chain] = c
+	}
+
+	own := byChain["inet filter "+ForwardChain]
+	require.Equal(t, OwnerTool, own.Owner)
+	require.Empty(t, own.Risk)
+	// The nat chain is shared with iptables-nft; the rules of the tool in it
+	// are no risk
+	require.Empty(t, byChain["ip nat "+PostRoutingChain].Risk)
+
+	foreign := byChain["ip filter "+ForwardChain]
+	require.Equal(t, OwnerDocker, foreign.Owner)
+	require.Equal(t, "forward", foreign.Hook)
+	require.Equal(t, "drop", foreign.Policy)
+	require.NotEmpty(t, foreign.Risk)
+	require.Contains(t, foreign.Remedy, "DOCKER-USER")
+
+	// A chain that only accepts cannot override the tool
+	accepting := byChain["inet user input"]
+	require.Equal(t, OwnerNftables, accepting.Owner)
+	require.Empty(t, accepting.Risk)
+}
+
+func TestDiagnose_ForeignMasquerade(t *testing.T) {
+	conn := useFakeConn(t)
+	require.NoError(t, Reconcile(BridgeRuleset(DefaultPrefix, "eth0", "br0")))
+
+	// Docker masquerades its own subnet next to the tagged rule of the tool
+	chains, err := conn.ListChains()
+	require.NoError(t, err)
+	i := slices.IndexFunc(chains, func(ch *nftables.Chain) bool {
+		return ch.Name == PostRoutingChain && ch.Table.Name == NATTable
+	})
+	require.GreaterOrEqual(t, i, 0)
+	postrouting := chains[i]
+	conn.InsertRule(&nftables.Rule{Table: postrouting.Table, Chain: postrouting, Exprs: []expr.Any{&expr.Masq{}}})
+	require.NoError(t, conn.Flush())
+
+	tagged, err := ListTaggedRules(Tag{Bridge: "br0", Role: RoleMasquerade})
+	require.NoError(t, err)
+	require.Len(t, tagged, 1)
+
+	report, err := Diagnose(DefaultPrefix)
+	require.NoError(t, err)
+	i = slices.IndexFunc(report, func(c BaseChain) bool {
+		return c.Table == NATTable && c.Chain == PostRoutingChain
+	})
+	require.GreaterOrEqual(t, i, 0)
+	require.NotEqual(t, OwnerTool, report[i].Owner)
+	require.Equal(t, "may translate guest traffic before the tool's nat chain", report[i].Risk)
+	require.Contains(t, report[i].Remedy, "exclude the bridge subnet")
+}
+
+func TestLegacyIptablesTables(t *testing.T) {
+	dir := t.TempDir()
+	tables, err := LegacyIptablesTables(dir)
+	require.NoError(t, err)
+	require.Empty(t, tables)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "ip_tables_names"), []byte("nat\nfilter\n"), 0o644))
+	tables, err = LegacyIptablesTables(dir)
+	require.NoError(t, err)
+	require.Equal(t, []string{"ip filter", "ip nat"}, tables)
+}
@@ -0,0 +1,103 @@
+//go:build linux
+
+package firewall
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/google/nftables"
+)
+
+// dryRunConn reads the live ruleset through Conn but keeps the changes queued
+// on it. Flush writes them to w as `nft -f` input instead of committing them.
+type dryRunConn struct {
+	Conn
+	w       io.Writer
+	pending []Operation
+}
+
+// DryRun returns a connection that reads through conn and writes the batches
+// it would commit to w as nft syntax
+func DryRun(conn Conn, w io.Writer) Conn {
+	return &dryRunConn{Conn: conn, w: w}
+}
+
+func (c *dryRunConn) queue(op Operation) {
+	c.pending = append(c.pending, op)
+}
+
+func (c *dryRunConn) AddTable(table *nftables.Table) *nftables.Table {
+	c.queue(Operation{Kind: OpAddTable, Table: table})
+	return table
+}
+
+func (c *dryRunConn) AddChain(chain *nftables.Chain) *nftables.Chain {
+	c.queue(Operation{Kind: OpAddChain, Chain: chain})
+	return chain
+}
+
+func (c *dryRunConn) DelChain(chain *nftables.Chain) {
+	c.queue(Operation{Kind: OpDeleteChain, Chain: chain})
+}
+
+func (c *dryRunConn) AddRule(rule *nftables.Rule) *nftables.Rule {
+	c.queue(Operation{Kind: OpAddRule, Rule: rule})
+	return rule
+}
+
+func (c *dryRunConn) InsertRule(rule *nftables.Rule) *nftables.Rule {
+	c.queue(Operation{Kind: OpInsertRule, Rule: rule})
+	return rule
+}
+
+func (c *dryRunConn) DelRule(rule *nftables.Rule) error {
+	if rule.Handle == 0 {
+		return fmt.Errorf("cannot delete rule without handle in chain %s", rule.Chain.Name)
+	}
+	c.queue(Operation{Kind: OpDeleteRule, Rule: rule})
+	return nil
+}
+
+func (c *dryRunConn) AddSet(set *nftables.Set, vals []nftables.SetElement) error {
+	c.queue(Operation{Kind: OpAddSet, Set: set})
+	if len(vals) > 0 {
+		c.queue(Operation{Kind: OpAddElements, Set: set, Elements: vals})
+	}
+	return nil
+}
+
+func (c *dryRunConn) DelSet(set *nftables.Set) {
+	c.queue(Operation{Kind: OpDeleteSet, Set: set})
+}
+
+func (c *dryRunConn) SetAddElements(set *nftables.Set, vals []nftables.SetElement) error {
+	c.queue(Operation{Kind: OpAddElements, Set: set, Elements: vals})
+	return nil
+}
+
+func (c *dryRunConn) SetDeleteElements(set *nftables.Set, vals []nftables.SetElement) error {
+	c.queue(Operation{Kind: OpDeleteElements, Set: set, Elements: vals})
+	return nil
+}
+
+func (c *dryRunConn) AddFlowtable(flowtable *nftables.Flowtable) *nftables.Flowtable {
+	c.queue(Operation{Kind: OpAddFlowtable, Flowtable: flowtable})
+	return flowtable
+}
+
+func (c *dryRunConn) DelFlowtable(flowtable *nftables.Flowtable) {
+	c.queue(Operation{Kind: OpDeleteFlowtable, Flowtable: flowtable})
+}
+
+// Flush writes the queued changes and drops them
+func (c *dryRunConn) Flush() error {
+	plan := &Plan{Operations: c.pending}
+	c.pending = nil
+	text, renderErr := plan.Render()
+	if renderErr != nil {
+		return renderErr
+	}
+	_, writeErr := io.WriteString(c.w, text)
+	return writeErr
+}
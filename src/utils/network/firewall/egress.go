@@ -0,0 +1,450 @@
+//go:build linux
+
+package firewall
+
+import (
+	"fmt"
+	"net"
+	"slices"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/q-controller/network-utils/src/utils/network/lock"
+	"golang.org/x/sys/unix"
+)
+
+// EgressMode selects how the destinations of the egress sets of a bridge are used
+type EgressMode int
+
+const (
+	// EgressOff lets guests reach any destination
+	EgressOff EgressMode = iota
+	// EgressAllow only lets guests reach the listed destinations
+	EgressAllow
+	// EgressDeny lets guests reach any destination except the listed ones
+	EgressDeny
+)
+
+func (m EgressMode) String() string {
+	switch m {
+	case EgressOff:
+		return "off"
+	case EgressAllow:
+		return "allow"
+	case EgressDeny:
+		return "deny"
+	default:
+		return fmt.Sprintf("EgressMode(%d)", int(m))
+	}
+}
+
+// ParseEgressMode parses the name of an EgressMode
+func ParseEgressMode(mode string) (EgressMode, error) {
+	for _, m := range []EgressMode{EgressOff, EgressAllow, EgressDeny} {
+		if m.String() == mode {
+			return m, nil
+		}
+	}
+	return EgressOff, fmt.Errorf("unknown egress mode %q", mode)
+}
+
+// egressChain returns the chain holding the egress rules of bridgeName
+func egressChain(prefix, bridgeName string) string {
+	return prefix + "EGRESS-" + bridgeName
+}
+
+// egressSets returns the names of the IPv4 prefix set, the IPv6 prefix set and
+// the port set of bridgeName
+func egressSets(prefix, bridgeName string) (string, string, string) {
+	chain := egressChain(prefix, bridgeName)
+	return chain + "-addr", chain + "-addr6", chain + "-port"
+}
+
+// egressSetConfigs returns the sets of bridgeName, which must not exist with
+// absent
+func egressSetConfigs(prefix, bridgeName string, absent bool) []SetConfig {
+	addrSet, addr6Set, portSet := egressSets(prefix, bridgeName)
+	return []SetConfig{
+		{Name: addrSet, Table: FilterTable, KeyType: nftables.TypeIPAddr, Interval: true, Absent: absent},
+		{Name: addr6Set, Table: FilterTable, KeyType: nftables.TypeIP6Addr, Interval: true, Absent: absent},
+		{Name: portSet, Table: FilterTable, KeyType: nftables.TypeInetService, Absent: absent},
+	}
+}
+
+func egressJump(prefix, bridgeName string) Jump {
+	return Jump{From: prefix + ForwardChain, To: egressChain(prefix, bridgeName), Table: FilterTable}
+}
+
+// fromInterface returns the expressions matching traffic from bridgeName
+func fromInterface(bridgeName string) []expr.Any {
+	return []expr.Any{
+		// [ meta load iifname => reg 1 ]
+		&expr.Meta{Key: expr.MetaKeyIIFNAME, Register: 1},
+		// [ cmp eq reg 1 bridgeName ]
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte(bridgeName + "\x00")},
+	}
+}
+
+// destinationInSet returns the expressions matching packets of family, IPv4 or
+// IPv6, whose destination address is in the interval set setName
+func destinationInSet(family byte, setName string) []expr.Any {
+	offset, size := uint32(16), uint32(net.IPv4len)
+	if family == unix.NFPROTO_IPV6 {
+		offset, size = 24, net.IPv6len
+	}
+	return []expr.Any{
+		// [ meta load nfproto => reg 1 ]
+		&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+		// [ cmp eq reg 1 family ]
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{family}},
+		// [ payload load daddr => reg 1 ]
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: offset, Len: size},
+		// [ lookup reg 1 set setName ]
+		&expr.Lookup{SourceRegister: 1, SetName: setName},
+	}
+}
+
+// destinationPortInSet returns the expressions matching proto packets whose
+// destination port is in the set setName
+func destinationPortInSet(proto, setName string) ([]expr.Any, error) {
+	protoNum := protocolNumber(proto)
+	if protoNum == 0 {
+		return nil, fmt.Errorf("unsupported protocol %s", proto)
+	}
+	return []expr.Any{
+		// [ meta load l4proto => reg 1 ]
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		// [ cmp eq reg 1 protocol number ]
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{protoNum}},
+		// [ payload load 2b @ transport header + 2 => reg 1 ]
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+		// [ lookup reg 1 set setName ]
+		&expr.Lookup{SourceRegister: 1, SetName: setName},
+	}, nil
+}
+
+// EgressAddressRule applies verdict to traffic from bridgeName to an address
+// of family, IPv4 or IPv6, in the interval set setName.
+func EgressAddressRule(chainName, tableName, bridgeName, setName string, family byte, verdict expr.VerdictKind) NewRule {
+	return func(rules *Rules) error {
+		chain, table, chainErr := rules.chain(chainName, tableName)
+		if chainErr != nil {
+			return chainErr
+		}
+
+		exprs := append(fromInterface(bridgeName), destinationInSet(family, setName)...)
+		// [ immediate verdict ]
+		exprs = append(exprs, &expr.Verdict{Kind: verdict})
+
+		rules.rules = append(rules.rules, &nftables.Rule{
+			Table: table,
+			Chain: chain,
+			Exprs: exprs,
+		})
+		return nil
+	}
+}
+
+// EgressPortRule applies verdict to proto traffic from bridgeName to a
+// destination port in the set setName.
+func EgressPortRule(chainName, tableName, bridgeName, setName, proto string, verdict expr.VerdictKind) NewRule {
+	return func(rules *Rules) error {
+		chain, table, chainErr := rules.chain(chainName, tableName)
+		if chainErr != nil {
+			return chainErr
+		}
+		match, matchErr := destinationPortInSet(proto, setName)
+		if matchErr != nil {
+			return matchErr
+		}
+
+		exprs := append(fromInterface(bridgeName), match...)
+		// [ immediate verdict ]
+		exprs = append(exprs, &expr.Verdict{Kind: verdict})
+
+		rules.rules = append(rules.rules, &nftables.Rule{
+			Table: table,
+			Chain: chain,
+			Exprs: exprs,
+		})
+		return nil
+	}
+}
+
+// EgressDestinationRule applies verdict to proto traffic from bridgeName to an
+// address of family in the interval set addrSet on a port in the set portSet.
+// Both have to match.
+func EgressDestinationRule(chainName, tableName, bridgeName, addrSet string, family byte, portSet, proto string, verdict expr.VerdictKind) NewRule {
+	return func(rules *Rules) error {
+		chain, table, chainErr := rules.chain(chainName, tableName)
+		if chainErr != nil {
+			return chainErr
+		}
+		match, matchErr := destinationPortInSet(proto, portSet)
+		if matchErr != nil {
+			return matchErr
+		}
+
+		exprs := append(fromInterface(bridgeName), destinationInSet(family, addrSet)...)
+		exprs = append(exprs, match...)
+		// [ immediate verdict ]
+		exprs = append(exprs, &expr.Verdict{Kind: verdict})
+
+		rules.rules = append(rules.rules, &nftables.Rule{
+			Table: table,
+			Chain: chain,
+			Exprs: exprs,
+		})
+		return nil
+	}
+}
+
+// EgressEstablishedRule returns traffic from bridgeName that belongs to known
+// connections, e.g. replies to published ports, to the calling chain.
+func EgressEstablishedRule(chainName, tableName, bridgeName string) NewRule {
+	return func(rules *Rules) error {
+		chain, table, chainErr := rules.chain(chainName, tableName)
+		if chainErr != nil {
+			return chainErr
+		}
+
+		exprs := []expr.Any{
+			// [ meta load iifname => reg 1 ]
+			&expr.Meta{Key: expr.MetaKeyIIFNAME, Register: 1},
+			// [ cmp eq reg 1 bridgeName ]
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte(bridgeName + "\x00")},
+		}
+		exprs = append(exprs, ctState(expr.CtStateBitESTABLISHED|expr.CtStateBitRELATED)...)
+		// [ immediate verdict RETURN ]
+		exprs = append(exprs, &expr.Verdict{Kind: expr.VerdictReturn})
+
+		rules.rules = append(rules.rules, &nftables.Rule{
+			Table: table,
+			Chain: chain,
+			Exprs: exprs,
+		})
+		return nil
+	}
+}
+
+// EgressDropRule drops all traffic from bridgeName
+func EgressDropRule(chainName, tableName, bridgeName string) NewRule {
+	return func(rules *Rules) error {
+		chain, table, chainErr := rules.chain(chainName, tableName)
+		if chainErr != nil {
+			return chainErr
+		}
+
+		rules.rules = append(rules.rules, &nftables.Rule{
+			Table: table,
+			Chain: chain,
+			Exprs: []expr.Any{
+				// [ meta load iifname => reg 1 ]
+				&expr.Meta{Key: expr.MetaKeyIIFNAME, Register: 1},
+				// [ cmp eq reg 1 bridgeName ]
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte(bridgeName + "\x00")},
+				// [ immediate verdict DROP ]
+				&expr.Verdict{Kind: expr.VerdictDrop},
+			},
+		})
+		return nil
+	}
+}
+
+// EgressRules returns the rules enforcing mode for the guests of bridgeName.
+// In allow mode traffic to a listed address on a listed port returns to the
+// FORWARD chain of the prefix, everything else is dropped. In deny mode
+// traffic to a listed address or to a listed port is dropped.
+func EgressRules(prefix, bridgeName string, mode EgressMode) []NewRule {
+	chain := egressChain(prefix, bridgeName)
+	addrSet, addr6Set, portSet := egressSets(prefix, bridgeName)
+	tag := func(rule NewRule) NewRule {
+		return Tagged(Tag{Bridge: bridgeName, Role: RoleEgress}, rule)
+	}
+
+	switch mode {
+	case EgressAllow:
+		return []NewRule{
+			tag(EgressEstablishedRule(chain, FilterTable, bridgeName)),
+			tag(EgressDestinationRule(chain, FilterTable, bridgeName, addrSet, unix.NFPROTO_IPV4, portSet, "tcp", expr.VerdictReturn)),
+			tag(EgressDestinationRule(chain, FilterTable, bridgeName, addrSet, unix.NFPROTO_IPV4, portSet, "udp", expr.VerdictReturn)),
+			tag(EgressDestinationRule(chain, FilterTable, bridgeName, addr6Set, unix.NFPROTO_IPV6, portSet, "tcp", expr.VerdictReturn)),
+			tag(EgressDestinationRule(chain, FilterTable, bridgeName, addr6Set, unix.NFPROTO_IPV6, portSet, "udp", expr.VerdictReturn)),
+			tag(EgressDropRule(chain, FilterTable, bridgeName)),
+		}
+	case EgressDeny:
+		return []NewRule{
+			tag(EgressAddressRule(chain, FilterTable, bridgeName, addrSet, unix.NFPROTO_IPV4, expr.VerdictDrop)),
+			tag(EgressAddressRule(chain, FilterTable, bridgeName, addr6Set, unix.NFPROTO_IPV6, expr.VerdictDrop)),
+			tag(EgressPortRule(chain, FilterTable, bridgeName, portSet, "tcp", expr.VerdictDrop)),
+			tag(EgressPortRule(chain, FilterTable, bridgeName, portSet, "udp", expr.VerdictDrop)),
+		}
+	default:
+		return nil
+	}
+}
+
+// EgressRuleset returns the desired state enforcing mode for the guests of
+// bridgeName. The destinations live in named sets that are kept when the mode
+// changes between allow and deny; EgressOff removes the rules, the egress
+// chain and the sets.
+func EgressRuleset(prefix, bridgeName string, mode EgressMode) *Ruleset {
+	prune := []Tag{{Bridge: bridgeName, Role: RoleEgress}}
+	if mode == EgressOff {
+		return &Ruleset{
+			Sets:   egressSetConfigs(prefix, bridgeName, true),
+			Prune:  prune,
+			Retire: []Jump{egressJump(prefix, bridgeName)},
+		}
+	}
+
+	tables := bridgeTables(prefix)
+	tables[0].Chains = append(tables[0].Chains, ChainConfig{Name: egressChain(prefix, bridgeName), Table: FilterTable, Create: true})
+	return &Ruleset{
+		Tables:  tables,
+		Sets:    egressSetConfigs(prefix, bridgeName, false),
+		Jumps:   append(bridgeJumps(prefix), egressJump(prefix, bridgeName)),
+		Present: EgressRules(prefix, bridgeName, mode),
+		Prune:   prune,
+	}
+}
+
+// AddEgressDestinations adds prefixes and ports to the egress sets of bridgeName
+func AddEgressDestinations(prefix, bridgeName string, prefixes []*net.IPNet, ports []uint16) error {
+	return Host().AddEgressDestinations(prefix, bridgeName, prefixes, ports)
+}
+
+// RemoveEgressDestinations removes prefixes and ports from the egress sets of bridgeName
+func RemoveEgressDestinations(prefix, bridgeName string, prefixes []*net.IPNet, ports []uint16) error {
+	return Host().RemoveEgressDestinations(prefix, bridgeName, prefixes, ports)
+}
+
+// EgressDestinations returns the prefixes and ports in the egress sets of bridgeName
+func EgressDestinations(prefix, bridgeName string) ([]*net.IPNet, []uint16, error) {
+	return Host().EgressDestinations(prefix, bridgeName)
+}
+
+// AddEgressDestinations adds prefixes and ports to the egress sets of
+// bridgeName in the namespace. The rules are not touched. Prefixes that
+// overlap each other or the listed ones are merged with them.
+func (f *Firewall) AddEgressDestinations(prefix, bridgeName string, prefixes []*net.IPNet, ports []uint16) error {
+	return f.updateEgress(prefix, bridgeName, prefixes, ports, mergeIntervals, f.conn.SetAddElements)
+}
+
+// RemoveEgressDestinations removes prefixes and ports from the egress sets of
+// bridgeName in the namespace. Removing a prefix from a larger listed one
+// keeps the rest of it.
+func (f *Firewall) RemoveEgressDestinations(prefix, bridgeName string, prefixes []*net.IPNet, ports []uint16) error {
+	return f.updateEgress(prefix, bridgeName, prefixes, ports, subtractIntervals, f.conn.SetDeleteElements)
+}
+
+// updateEgress replaces the listed address intervals of the egress sets with
+// combine of them and prefixes, and updates the port set with ports
+func (f *Firewall) updateEgress(prefix, bridgeName string, prefixes []*net.IPNet, ports []uint16,
+	combine func(live, given []interval) []interval, update func(*nftables.Set, []nftables.SetElement) error) error {
+	unlock, lockErr := lock.Acquire()
+	if lockErr != nil {
+		return lockErr
+	}
+	defer unlock()
+
+	addrName, addr6Name, portName := egressSets(prefix, bridgeName)
+
+	given := map[string][]interval{}
+	for _, p := range prefixes {
+		iv, ivErr := prefixInterval(p)
+		if ivErr != nil {
+			return ivErr
+		}
+		name := addrName
+		if p.IP.To4() == nil {
+			name = addr6Name
+		}
+		given[name] = append(given[name], iv)
+	}
+
+	for _, name := range []string{addrName, addr6Name} {
+		if len(given[name]) == 0 {
+			continue
+		}
+		addrSet, addrErr := f.lookupSet(FilterTable, name)
+		if addrErr != nil {
+			return fmt.Errorf("egress policy of bridge %s is not configured: %w", bridgeName, addrErr)
+		}
+		live, liveErr := f.conn.GetSetElements(addrSet)
+		if liveErr != nil {
+			return liveErr
+		}
+		ipv6 := addrSet.KeyType == nftables.TypeIP6Addr
+		desired := intervalElements(combine(elementIntervals(live, ipv6), given[name]), ipv6)
+
+		// Stale elements go first, so the new ones never overlap them
+		var stale, added []nftables.SetElement
+		for _, e := range live {
+			if !slices.ContainsFunc(desired, func(d nftables.SetElement) bool { return sameElementKey(d, e) }) {
+				stale = append(stale, e)
+			}
+		}
+		for _, e := range desired {
+			if !slices.ContainsFunc(live, func(l nftables.SetElement) bool { return sameElementKey(l, e) }) {
+				added = append(added, e)
+			}
+		}
+		if len(stale) > 0 {
+			if err := f.conn.SetDeleteElements(addrSet, stale); err != nil {
+				return err
+			}
+		}
+		if len(added) > 0 {
+			if err := f.conn.SetAddElements(addrSet, added); err != nil {
+				return err
+			}
+		}
+	}
+	if len(ports) > 0 {
+		portSet, portErr := f.lookupSet(FilterTable, portName)
+		if portErr != nil {
+			return fmt.Errorf("egress policy of bridge %s is not configured: %w", bridgeName, portErr)
+		}
+		if err := update(portSet, portElements(ports)); err != nil {
+			return err
+		}
+	}
+	return f.conn.Flush()
+}
+
+// EgressDestinations returns the prefixes and ports in the egress sets of
+// bridgeName in the namespace
+func (f *Firewall) EgressDestinations(prefix, bridgeName string) ([]*net.IPNet, []uint16, error) {
+	addrName, addr6Name, portName := egressSets(prefix, bridgeName)
+
+	var prefixes []*net.IPNet
+	for _, name := range []string{addrName, addr6Name} {
+		addrSet, addrErr := f.lookupSet(FilterTable, name)
+		if addrErr != nil {
+			return nil, nil, addrErr
+		}
+		addrElements, addrElementsErr := f.conn.GetSetElements(addrSet)
+		if addrElementsErr != nil {
+			return nil, nil, addrElementsErr
+		}
+		prefixes = append(prefixes, elementPrefixes(addrElements, addrSet.KeyType == nftables.TypeIP6Addr)...)
+	}
+
+	portSet, portErr := f.lookupSet(FilterTable, portName)
+	if portErr != nil {
+		return nil, nil, portErr
+	}
+	portElements, portElementsErr := f.conn.GetSetElements(portSet)
+	if portElementsErr != nil {
+		return nil, nil, portElementsErr
+	}
+
+	var ports []uint16
+	for _, e := range portElements {
+		if len(e.Key) >= 2 {
+			ports = append(ports, uint16(e.Key[0])<<8|uint16(e.Key[1]))
+		}
+	}
+	return prefixes, ports, nil
+}
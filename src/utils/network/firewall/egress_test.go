@@ -0,0 +1,152 @@
+//go:build linux
+
+package firewall
+
+import (
+	"math/big"
+	"net"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/stretchr/testify/require"
+)
+
+func mustCIDR(t *testing.T, cidr string) *net.IPNet {
+	_, prefix, err := net.ParseCIDR(cidr)
+	require.NoError(t, err)
+	return prefix
+}
+
+func TestPrefixElements_RoundTrip(t *testing.T) {
+	for _, cidr := range []string{"10.0.0.0/8", "192.168.26.10/32", "0.0.0.0/0", "255.255.255.0/24"} {
+		elements, err := prefixElements(mustCIDR(t, cidr))
+		require.NoError(t, err)
+		require.Equal(t, []*net.IPNet{mustCIDR(t, cidr)}, elementPrefixes(elements, false), cidr)
+	}
+	for _, cidr := range []string{"fd00::/64", "2001:db8::1/128", "::/0", "ffff::/16"} {
+		elements, err := prefixElements(mustCIDR(t, cidr))
+		require.NoError(t, err)
+		require.Equal(t, []*net.IPNet{mustCIDR(t, cidr)}, elementPrefixes(elements, true), cidr)
+	}
+}
+
+func TestElementPrefixes_Range(t *testing.T) {
+	// 10.0.1.0 up to 10.0.3.255 is not a single prefix
+	iv := interval{start: big.NewInt(0x0a000100), end: big.NewInt(0x0a000400)}
+	require.Equal(t, []*net.IPNet{mustCIDR(t, "10.0.1.0/24"), mustCIDR(t, "10.0.2.0/23")}, elementPrefixes(intervalElements([]interval{iv}, false), false))
+}
+
+func TestEgressDestinations_Overlapping(t *testing.T) {
+	conn := useFakeConn(t)
+	require.NoError(t, Reconcile(BridgeRuleset(DefaultPrefix, "eth0", "br0")))
+	require.NoError(t, Reconcile(EgressRuleset(DefaultPrefix, "br0", EgressAllow)))
+	addrElements := func() []nftables.SetElement {
+		set, err := Host().lookupSet(FilterTable, DefaultPrefix+"EGRESS-br0-addr")
+		require.NoError(t, err)
+		elements, err := conn.GetSetElements(set)
+		require.NoError(t, err)
+		return elements
+	}
+
+	// A prefix inside another one is merged with it, in the same call or later
+	require.NoError(t, AddEgressDestinations(DefaultPrefix, "br0", []*net.IPNet{mustCIDR(t, "10.0.0.0/16"), mustCIDR(t, "10.0.1.0/24")}, nil))
+	require.NoError(t, AddEgressDestinations(DefaultPrefix, "br0", []*net.IPNet{mustCIDR(t, "10.0.2.0/24")}, nil))
+	require.Len(t, addrElements(), 2)
+	prefixes, _, err := EgressDestinations(DefaultPrefix, "br0")
+	require.NoError(t, err)
+	require.Equal(t, []*net.IPNet{mustCIDR(t, "10.0.0.0/16")}, prefixes)
+
+	// Adjacent prefixes are joined and listed as the fewest prefixes
+	require.NoError(t, AddEgressDestinations(DefaultPrefix, "br0", []*net.IPNet{mustCIDR(t, "10.1.0.0/16"), mustCIDR(t, "10.2.0.0/16")}, nil))
+	require.Len(t, addrElements(), 2)
+	prefixes, _, err = EgressDestinations(DefaultPrefix, "br0")
+	require.NoError(t, err)
+	require.Equal(t, []*net.IPNet{mustCIDR(t, "10.0.0.0/15"), mustCIDR(t, "10.2.0.0/16")}, prefixes)
+
+	// Removing a prefix from a larger one keeps the rest of it
+	require.NoError(t, RemoveEgressDestinations(DefaultPrefix, "br0", []*net.IPNet{mustCIDR(t, "10.0.1.0/24")}, nil))
+	prefixes, _, err = EgressDestinations(DefaultPrefix, "br0")
+	require.NoError(t, err)
+	require.Equal(t, []*net.IPNet{
+		mustCIDR(t, "10.0.0.0/24"),
+		mustCIDR(t, "10.0.2.0/23"),
+		mustCIDR(t, "10.0.4.0/22"),
+		mustCIDR(t, "10.0.8.0/21"),
+		mustCIDR(t, "10.0.16.0/20"),
+		mustCIDR(t, "10.0.32.0/19"),
+		mustCIDR(t, "10.0.64.0/18"),
+		mustCIDR(t, "10.0.128.0/17"),
+		mustCIDR(t, "10.1.0.0/16"),
+		mustCIDR(t, "10.2.0.0/16"),
+	}, prefixes)
+}
+
+func TestEgressRuleset(t *testing.T) {
+	conn := useFakeConn(t)
+	require.NoError(t, Reconcile(BridgeRuleset(DefaultPrefix, "eth0", "br0")))
+	require.NoError(t, Reconcile(EgressRuleset(DefaultPrefix, "br0", EgressAllow)))
+
+	forward := liveRules(t, conn, DefaultPrefix+ForwardChain, FilterTable)
+	require.True(t, hasJump(forward[:1], egressChain(DefaultPrefix, "br0")))
+	egress := liveRules(t, conn, egressChain(DefaultPrefix, "br0"), FilterTable)
+	require.Len(t, egress, 6)
+	last := egress[len(egress)-1].Exprs
+	require.Equal(t, &expr.Verdict{Kind: expr.VerdictDrop}, last[len(last)-1])
+
+	// Allowed traffic has to go to a listed address on a listed port
+	text, err := RenderExprs(egress[1].Exprs, egress[1].Table.Family)
+	require.NoError(t, err)
+	require.Equal(t, `iifname "br0" meta nfproto ipv4 ip daddr @QEMU-EGRESS-br0-addr meta l4proto tcp tcp dport @QEMU-EGRESS-br0-port counter return`, text)
+
+	// Destinations change without touching the rules
+	flushes := conn.Flushes
+	mirror := mustCIDR(t, "203.0.113.0/24")
+	mirror6 := mustCIDR(t, "2001:db8:26::/48")
+	require.NoError(t, AddEgressDestinations(DefaultPrefix, "br0", []*net.IPNet{mirror, mustCIDR(t, "198.51.100.7/32"), mirror6}, []uint16{53}))
+	require.NoError(t, RemoveEgressDestinations(DefaultPrefix, "br0", []*net.IPNet{mustCIDR(t, "198.51.100.7/32")}, nil))
+	require.Equal(t, flushes+2, conn.Flushes)
+	require.Len(t, liveRules(t, conn, egressChain(DefaultPrefix, "br0"), FilterTable), 6)
+
+	prefixes, ports, err := EgressDestinations(DefaultPrefix, "br0")
+	require.NoError(t, err)
+	require.Equal(t, []*net.IPNet{mirror, mirror6}, prefixes)
+	require.Equal(t, []uint16{53}, ports)
+
+	// Switching the mode keeps the destinations
+	require.NoError(t, Reconcile(EgressRuleset(DefaultPrefix, "br0", EgressDeny)))
+	egress = liveRules(t, conn, egressChain(DefaultPrefix, "br0"), FilterTable)
+	require.Len(t, egress, 4)
+	prefixes, _, err = EgressDestinations(DefaultPrefix, "br0")
+	require.NoError(t, err)
+	require.Equal(t, []*net.IPNet{mirror, mirror6}, prefixes)
+
+	// Listed IPv6 destinations are denied as well
+	text, err = RenderExprs(egress[1].Exprs, egress[1].Table.Family)
+	require.NoError(t, err)
+	require.Equal(t, `iifname "br0" meta nfproto ipv6 ip6 daddr @QEMU-EGRESS-br0-addr6 counter drop`, text)
+
+	require.NoError(t, Reconcile(EgressRuleset(DefaultPrefix, "br0", EgressOff)))
+	require.NotContains(t, chainNames(t, conn), egressChain(DefaultPrefix, "br0"))
+	require.False(t, hasJump(liveRules(t, conn, DefaultPrefix+ForwardChain, FilterTable), egressChain(DefaultPrefix, "br0")))
+	_, _, err = EgressDestinations(DefaultPrefix, "br0")
+	require.ErrorIs(t, err, errNotExist)
+}
+
+func TestEgressDestinations_NotConfigured(t *testing.T) {
+	useFakeConn(t)
+	require.NoError(t, Reconcile(BridgeRuleset(DefaultPrefix, "eth0", "br0")))
+	require.Error(t, AddEgressDestinations(DefaultPrefix, "br0", nil, []uint16{443}))
+}
+
+func TestBridgeTeardown_RemovesEgress(t *testing.T) {
+	conn := useFakeConn(t)
+	require.NoError(t, Reconcile(BridgeRuleset(DefaultPrefix, "eth0", "br0")))
+	require.NoError(t, Reconcile(EgressRuleset(DefaultPrefix, "br0", EgressAllow)))
+
+	require.NoError(t, Reconcile(BridgeTeardown(DefaultPrefix, "", "br0")))
+	require.NotContains(t, chainNames(t, conn), egressChain(DefaultPrefix, "br0"))
+	require.NotContains(t, chainNames(t, conn), DefaultPrefix+ForwardChain)
+	_, _, err := EgressDestinations(DefaultPrefix, "br0")
+	require.ErrorIs(t, err, errNotExist)
+}
@@ -0,0 +1,601 @@
+//go:build linux
+
+package firewall
+
+import (
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/google/nftables/userdata"
+	"github.com/q-controller/network-utils/src/utils/network/lock"
+)
+
+// DocumentVersion is the version of the schema written by Export. Import
+// refuses documents of other versions.
+const DocumentVersion = 2
+
+// Document is the JSON form of everything a prefix owns: its chains with all
+// their rules, the jumps into them, the tagged rules in other chains of the
+// bridges and taps with rules in its chains or referring to its sets, and its
+// named sets and flowtables.
+type Document struct {
+	Version int             `json:"version"`
+	Prefix  string          `json:"prefix"`
+	Tables  []TableDocument `json:"tables"`
+}
+
+// TableDocument holds the owned parts of a table
+type TableDocument struct {
+	Name       string              `json:"name"`
+	Family     string              `json:"family"`
+	Chains     []ChainDocument     `json:"chains,omitempty"`
+	Jumps      []JumpDocument      `json:"jumps,omitempty"`
+	Sets       []SetDocument       `json:"sets,omitempty"`
+	Flowtables []FlowtableDocument `json:"flowtables,omitempty"`
+}
+
+// ChainDocument describes a chain. Base chains have a type, hook, priority and
+// policy.
+type ChainDocument struct {
+	Name     string         `json:"name"`
+	Type     string         `json:"type,omitempty"`
+	Hook     string         `json:"hook,omitempty"`
+	Priority *int32         `json:"priority,omitempty"`
+	Policy   string         `json:"policy,omitempty"`
+	Rules    []RuleDocument `json:"rules,omitempty"`
+}
+
+// JumpDocument is a jump from a chain into a chain of the same table
+type JumpDocument struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// RuleDocument is a rule with its comment, usually a tag. Counters are written
+// as zero so that documents of the same ruleset are equal.
+type RuleDocument struct {
+	Comment string       `json:"comment,omitempty"`
+	Exprs   []Expression `json:"exprs"`
+}
+
+// SetDocument describes a named set or map with its elements. The elements
+// of dynamic sets are added by rules and not part of the document; Timeout is
+// in seconds.
+type SetDocument struct {
+	Name     string            `json:"name"`
+	KeyType  string            `json:"keyType"`
+	DataType string            `json:"dataType,omitempty"`
+	Interval bool              `json:"interval,omitempty"`
+	IsMap    bool              `json:"isMap,omitempty"`
+	Dynamic  bool              `json:"dynamic,omitempty"`
+	Timeout  int64             `json:"timeout,omitempty"`
+	Elements []ElementDocument `json:"elements,omitempty"`
+}
+
+// ElementDocument is a set element with its key and map value in hex
+type ElementDocument struct {
+	Key         string      `json:"key"`
+	IntervalEnd bool        `json:"intervalEnd,omitempty"`
+	Value       string      `json:"value,omitempty"`
+	Verdict     *Expression `json:"verdict,omitempty"`
+}
+
+// FlowtableDocument describes a flowtable and its devices
+type FlowtableDocument struct {
+	Name    string   `json:"name"`
+	Devices []string `json:"devices"`
+}
+
+// namedHook is a hook of the ip, ip6, inet and bridge families with its name
+type namedHook struct {
+	name string
+	hook *nftables.ChainHook
+}
+
+var hookNames = []namedHook{
+	{"prerouting", nftables.ChainHookPrerouting},
+	{"input", nftables.ChainHookInput},
+	{"forward", nftables.ChainHookForward},
+	{"output", nftables.ChainHookOutput},
+	{"postrouting", nftables.ChainHookPostrouting},
+}
+
+// setDatatypes are the set datatypes a document can name
+var setDatatypes = []nftables.SetDatatype{
+	nftables.TypeVerdict, nftables.TypeInteger, nftables.TypeString, nftables.TypeLLAddr,
+	nftables.TypeIPAddr, nftables.TypeIP6Addr, nftables.TypeEtherAddr, nftables.TypeEtherType,
+	nftables.TypeInetProto, nftables.TypeInetService, nftables.TypeMark, nftables.TypeIFIndex,
+	nftables.TypeIFName, nftables.TypeCTState,
+}
+
+// parseFamily returns the family named by familyName
+func parseFamily(name string) (nftables.TableFamily, error) {
+	for _, family := range []nftables.TableFamily{
+		nftables.TableFamilyINet, nftables.TableFamilyIPv4, nftables.TableFamilyIPv6,
+		nftables.TableFamilyARP, nftables.TableFamilyNetdev, nftables.TableFamilyBridge,
+	} {
+		if familyName(family) == name {
+			return family, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown table family %q", name)
+}
+
+// parseSetDatatype returns the datatype with the name written by Export, which
+// joins the types of a concatenation with " . "
+func parseSetDatatype(name string) (nftables.SetDatatype, error) {
+	var types []nftables.SetDatatype
+	for _, part := range strings.Split(name, " . ") {
+		i := slices.IndexFunc(setDatatypes, func(dt nftables.SetDatatype) bool { return dt.Name == part })
+		if i < 0 {
+			return nftables.TypeInvalid, fmt.Errorf("unknown set datatype %q", part)
+		}
+		types = append(types, setDatatypes[i])
+	}
+	if len(types) == 1 {
+		return types[0], nil
+	}
+	return nftables.ConcatSetType(types...)
+}
+
+// ownedRule reports whether a tagged rule outside the chains of prefix
+// belongs to it: its bridge or tap has rules in those chains, or it refers to
+// a set or flowtable of prefix, like the dispatch rules of the taps table
+func ownedRule(rule *nftables.Rule, prefix string, owners map[Tag]bool) bool {
+	tag, tagged := RuleTag(rule)
+	if !tagged {
+		return false
+	}
+	if (tag.Bridge != "" || tag.Tap != "") && owners[Tag{Bridge: tag.Bridge, Tap: tag.Tap}] {
+		return true
+	}
+	for _, e := range rule.Exprs {
+		switch e := e.(type) {
+		case *expr.Lookup:
+			if strings.HasPrefix(e.SetName, prefix) {
+				return true
+			}
+		case *expr.Dynset:
+			if strings.HasPrefix(e.SetName, prefix) {
+				return true
+			}
+		case *expr.FlowOffload:
+			if strings.HasPrefix(e.Name, prefix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// exportedExprs returns the expressions of a rule without runtime state:
+// counters are reset and set references only keep their names
+func exportedExprs(exprs []expr.Any) []Expression {
+	result := make([]Expression, 0, len(exprs))
+	for _, e := range exprs {
+		switch e := e.(type) {
+		case *expr.Counter:
+			result = append(result, Expression{&expr.Counter{}})
+		case *expr.Lookup:
+			lookup := *e
+			lookup.SetID = 0
+			result = append(result, Expression{&lookup})
+		case *expr.Dynset:
+			dynset := *e
+			dynset.SetID = 0
+			result = append(result, Expression{&dynset})
+		default:
+			result = append(result, Expression{e})
+		}
+	}
+	return result
+}
+
+func documentExprs(exprs []Expression) []expr.Any {
+	result := make([]expr.Any, 0, len(exprs))
+	for _, e := range exprs {
+		result = append(result, e.Any)
+	}
+	return result
+}
+
+// isJump reports whether rule is a jump added by a Ruleset and returns its target
+func isJump(rule *nftables.Rule) (string, bool) {
+	tag, ok := RuleTag(rule)
+	if !ok || tag.Role != RoleJump {
+		return "", false
+	}
+	for _, e := range rule.Exprs {
+		if verdict, ok := e.(*expr.Verdict); ok && verdict.Kind == expr.VerdictJump {
+			return verdict.Chain, true
+		}
+	}
+	return "", false
+}
+
+// Export returns the document of everything prefix owns in the host namespace
+func Export(prefix string) (*Document, error) {
+	return Host().Export(prefix)
+}
+
+// Export returns the document of everything prefix owns in the namespace.
+// Chains, sets and flowtables named with prefix are owned as a whole; of
+// other chains only the tagged rules are.
+func (f *Firewall) Export(prefix string) (*Document, error) {
+	tables, tablesErr := f.conn.ListTables()
+	if tablesErr != nil {
+		return nil, unavailable(tablesErr)
+	}
+	chains, chainsErr := f.conn.ListChains()
+	if chainsErr != nil {
+		return nil, chainsErr
+	}
+
+	// Tags do not carry the prefix: the bridges and taps with rules in its
+	// chains are those of the prefix
+	rulesOf := map[chainKey][]*nftables.Rule{}
+	owners := map[Tag]bool{}
+	for _, chain := range chains {
+		rules, rulesErr := f.conn.GetRules(chain.Table, chain)
+		if rulesErr != nil {
+			return nil, rulesErr
+		}
+		rulesOf[keyOf(chain)] = rules
+		if !strings.HasPrefix(chain.Name, prefix) {
+			continue
+		}
+		for _, rule := range rules {
+			if tag, tagged := RuleTag(rule); tagged {
+				owners[Tag{Bridge: tag.Bridge, Tap: tag.Tap}] = true
+			}
+		}
+	}
+
+	doc := &Document{Version: DocumentVersion, Prefix: prefix, Tables: []TableDocument{}}
+	for _, table := range tables {
+		td := TableDocument{Name: table.Name, Family: familyName(table.Family)}
+
+		for _, chain := range chains {
+			if chain.Table.Name != table.Name || chain.Table.Family != table.Family {
+				continue
+			}
+			rules := rulesOf[keyOf(chain)]
+
+			owned := strings.HasPrefix(chain.Name, prefix)
+			cd := exportedChain(chain)
+			for _, rule := range rules {
+				if to, ok := isJump(rule); ok {
+					if strings.HasPrefix(to, prefix) {
+						td.Jumps = append(td.Jumps, JumpDocument{From: chain.Name, To: to})
+						owned = true
+					}
+					continue
+				}
+				comment, _ := userdata.GetString(rule.UserData, userdata.TypeComment)
+				if !strings.HasPrefix(chain.Name, prefix) && !ownedRule(rule, prefix, owners) {
+					continue
+				}
+				cd.Rules = append(cd.Rules, RuleDocument{Comment: comment, Exprs: exportedExprs(rule.Exprs)})
+				owned = true
+			}
+			if owned {
+				td.Chains = append(td.Chains, cd)
+			}
+		}
+
+		sets, setsErr := f.conn.GetSets(table)
+		if setsErr != nil {
+			return nil, setsErr
+		}
+		for _, set := range sets {
+			if !strings.HasPrefix(set.Name, prefix) {
+				continue
+			}
+			sd, setErr := f.exportedSet(set)
+			if setErr != nil {
+				return nil, setErr
+			}
+			td.Sets = append(td.Sets, sd)
+		}
+
+		flowtables, flowtablesErr := f.conn.ListFlowtables(table)
+		if flowtablesErr != nil {
+			return nil, flowtablesErr
+		}
+		for _, ft := range flowtables {
+			if strings.HasPrefix(ft.Name, prefix) {
+				td.Flowtables = append(td.Flowtables, FlowtableDocument{Name: ft.Name, Devices: slices.Clone(ft.Devices)})
+			}
+		}
+
+		if len(td.Chains) > 0 || len(td.Sets) > 0 || len(td.Flowtables) > 0 {
+			doc.Tables = append(doc.Tables, td)
+		}
+	}
+	return doc, nil
+}
+
+func exportedChain(chain *nftables.Chain) ChainDocument {
+	cd := ChainDocument{Name: chain.Name}
+	if chain.Hooknum == nil {
+		return cd
+	}
+	cd.Type = string(chain.Type)
+	for _, h := range hookNames {
+		if *h.hook == *chain.Hooknum {
+			cd.Hook = h.name
+		}
+	}
+	if chain.Priority != nil {
+		priority := int32(*chain.Priority)
+		cd.Priority = &priority
+	}
+	cd.Policy = "accept"
+	if chain.Policy != nil && *chain.Policy == nftables.ChainPolicyDrop {
+		cd.Policy = "drop"
+	}
+	return cd
+}
+
+func (f *Firewall) exportedSet(set *nftables.Set) (SetDocument, error) {
+	sd := SetDocument{Name: set.Name, KeyType: set.KeyType.Name, Interval: set.Interval, IsMap: set.IsMap, Dynamic: set.Dynamic}
+	if set.IsMap {
+		sd.DataType = set.DataType.Name
+	}
+	if set.HasTimeout {
+		sd.Timeout = int64(set.Timeout / time.Second)
+	}
+	if set.Dynamic {
+		return sd, nil
+	}
+	elements, elementsErr := f.conn.GetSetElements(set)
+	if elementsErr != nil {
+		return SetDocument{}, elementsErr
+	}
+	for _, e := range elements {
+		ed := ElementDocument{Key: hex.EncodeToString(e.Key), IntervalEnd: e.IntervalEnd, Value: hex.EncodeToString(e.Val)}
+		if e.VerdictData != nil {
+			ed.Verdict = &Expression{e.VerdictData}
+		}
+		sd.Elements = append(sd.Elements, ed)
+	}
+	return sd, nil
+}
+
+// chainConfig returns the configuration creating the chain of cd
+func (cd ChainDocument) chainConfig(table string) (ChainConfig, error) {
+	config := ChainConfig{Name: cd.Name, Table: table, Create: true}
+	if cd.Hook == "" {
+		return config, nil
+	}
+	i := slices.IndexFunc(hookNames, func(h namedHook) bool { return h.name == cd.Hook })
+	if i < 0 {
+		return ChainConfig{}, fmt.Errorf("unknown hook %q of chain %s", cd.Hook, cd.Name)
+	}
+	chainType := nftables.ChainType(cd.Type)
+	config.Type = &chainType
+	config.Hook = hookNames[i].hook
+	if cd.Priority != nil {
+		config.Priority = nftables.ChainPriorityRef(nftables.ChainPriority(*cd.Priority))
+	}
+	policy := nftables.ChainPolicyAccept
+	if cd.Policy == "drop" {
+		policy = nftables.ChainPolicyDrop
+	}
+	config.Policy = &policy
+	return config, nil
+}
+
+// setElements returns the elements of sd
+func (sd SetDocument) setElements() ([]nftables.SetElement, error) {
+	var result []nftables.SetElement
+	for _, ed := range sd.Elements {
+		key, keyErr := hex.DecodeString(ed.Key)
+		if keyErr != nil {
+			return nil, fmt.Errorf("invalid key of set %s: %w", sd.Name, keyErr)
+		}
+		element := nftables.SetElement{Key: key, IntervalEnd: ed.IntervalEnd}
+		if ed.Value != "" {
+			value, valueErr := hex.DecodeString(ed.Value)
+			if valueErr != nil {
+				return nil, fmt.Errorf("invalid value of set %s: %w", sd.Name, valueErr)
+			}
+			element.Val = value
+		}
+		if ed.Verdict != nil {
+			verdict, ok := ed.Verdict.Any.(*expr.Verdict)
+			if !ok {
+				return nil, fmt.Errorf("invalid verdict of set %s", sd.Name)
+			}
+			element.VerdictData = verdict
+		}
+		result = append(result, element)
+	}
+	return result, nil
+}
+
+// documentRule returns a rule adding rd to chainName
+func documentRule(chainName, tableName string, rd RuleDocument) NewRule {
+	return func(rules *Rules) error {
+		chain, table, chainErr := rules.chain(chainName, tableName)
+		if chainErr != nil {
+			return chainErr
+		}
+
+		rule := &nftables.Rule{
+			Table: table,
+			Chain: chain,
+			Exprs: documentExprs(rd.Exprs),
+		}
+		if rd.Comment != "" {
+			rule.UserData = userdata.AppendString(nil, userdata.TypeComment, rd.Comment)
+		}
+		rules.rules = append(rules.rules, rule)
+		return nil
+	}
+}
+
+// jumpRule returns the jump rule a Ruleset adds for jump
+func jumpRule(jump Jump) NewRule {
+	return documentRule(jump.From, jump.Table, RuleDocument{
+		Comment: Tag{Role: RoleJump}.String(),
+		Exprs:   []Expression{{&expr.Counter{}}, {&expr.Verdict{Kind: expr.VerdictJump, Chain: jump.To}}},
+	})
+}
+
+// Ruleset returns the desired state restoring doc over live, the document of
+// what the prefix of doc owns now. Chains, jumps, tagged rules, set elements
+// and flowtables of live that doc lacks are removed.
+func (doc *Document) Ruleset(live *Document) (*Ruleset, error) {
+	if doc.Version != DocumentVersion {
+		return nil, fmt.Errorf("unsupported document version %d, expected %d", doc.Version, DocumentVersion)
+	}
+
+	type jumpKey struct {
+		table    chainKey
+		from, to string
+	}
+
+	rs := &Ruleset{Purge: true}
+	chains := map[chainKey]bool{}
+	jumps := map[jumpKey]bool{}
+	sets := map[setKey]bool{}
+	flowtables := map[setKey]bool{}
+	for _, td := range doc.Tables {
+		family, familyErr := parseFamily(td.Family)
+		if familyErr != nil {
+			return nil, familyErr
+		}
+		tc := TableConfig{Name: td.Name, Family: family}
+		for _, cd := range td.Chains {
+			config, configErr := cd.chainConfig(td.Name)
+			if configErr != nil {
+				return nil, configErr
+			}
+			tc.Chains = append(tc.Chains, config)
+			chains[chainKey{family: family, table: td.Name, chain: cd.Name}] = true
+			for _, rd := range cd.Rules {
+				rs.Present = append(rs.Present, documentRule(cd.Name, td.Name, rd))
+			}
+		}
+		rs.Tables = append(rs.Tables, tc)
+
+		for _, jd := range td.Jumps {
+			rs.Jumps = append(rs.Jumps, Jump{From: jd.From, To: jd.To, Table: td.Name})
+			jumps[jumpKey{table: chainKey{family: family, table: td.Name}, from: jd.From, to: jd.To}] = true
+		}
+
+		for _, sd := range td.Sets {
+			keyType, keyErr := parseSetDatatype(sd.KeyType)
+			if keyErr != nil {
+				return nil, keyErr
+			}
+			config := SetConfig{
+				Name:     sd.Name,
+				Table:    td.Name,
+				KeyType:  keyType,
+				Interval: sd.Interval,
+				IsMap:    sd.IsMap,
+				Dynamic:  sd.Dynamic,
+				Timeout:  time.Duration(sd.Timeout) * time.Second,
+			}
+			if sd.IsMap {
+				dataType, dataErr := parseSetDatatype(sd.DataType)
+				if dataErr != nil {
+					return nil, dataErr
+				}
+				config.DataType = dataType
+			}
+			elements, elementsErr := sd.setElements()
+			if elementsErr != nil {
+				return nil, elementsErr
+			}
+			rs.Sets = append(rs.Sets, config)
+			rs.Elements = append(rs.Elements, SetElements{Set: sd.Name, Table: td.Name, Elements: elements})
+			sets[setKey{table: chainKey{family: family, table: td.Name}, name: sd.Name}] = true
+		}
+
+		for _, fd := range td.Flowtables {
+			rs.Flowtables = append(rs.Flowtables, FlowtableConfig{Name: fd.Name, Table: td.Name, Devices: slices.Clone(fd.Devices)})
+			flowtables[setKey{table: chainKey{family: family, table: td.Name}, name: fd.Name}] = true
+		}
+	}
+
+	for _, td := range live.Tables {
+		family, familyErr := parseFamily(td.Family)
+		if familyErr != nil {
+			return nil, familyErr
+		}
+		for _, cd := range td.Chains {
+			for _, rd := range cd.Rules {
+				if tag, err := ParseTag(rd.Comment); err == nil {
+					rs.Prune = append(rs.Prune, tag)
+				}
+			}
+			if strings.HasPrefix(cd.Name, live.Prefix) && !chains[chainKey{family: family, table: td.Name, chain: cd.Name}] {
+				rs.Retire = append(rs.Retire, Jump{To: cd.Name, Table: td.Name})
+			}
+		}
+		for _, jd := range td.Jumps {
+			if !jumps[jumpKey{table: chainKey{family: family, table: td.Name}, from: jd.From, to: jd.To}] {
+				rs.Absent = append(rs.Absent, jumpRule(Jump{From: jd.From, To: jd.To, Table: td.Name}))
+			}
+		}
+
+		for _, sd := range td.Sets {
+			stale, elementsErr := sd.setElements()
+			if elementsErr != nil {
+				return nil, elementsErr
+			}
+			if sets[setKey{table: chainKey{family: family, table: td.Name}, name: sd.Name}] {
+				stale = slices.DeleteFunc(stale, func(e nftables.SetElement) bool {
+					return slices.ContainsFunc(rs.Elements, func(se SetElements) bool {
+						return se.Table == td.Name && se.Set == sd.Name && slices.ContainsFunc(se.Elements, func(d nftables.SetElement) bool {
+							return sameElementKey(d, e)
+						})
+					})
+				})
+			}
+			if len(stale) > 0 {
+				rs.Elements = append(rs.Elements, SetElements{Set: sd.Name, Table: td.Name, Elements: stale, Absent: true})
+			}
+		}
+
+		for _, fd := range td.Flowtables {
+			if !flowtables[setKey{table: chainKey{family: family, table: td.Name}, name: fd.Name}] {
+				rs.Flowtables = append(rs.Flowtables, FlowtableConfig{Name: fd.Name, Table: td.Name, Absent: true})
+			}
+		}
+	}
+	return rs, nil
+}
+
+// Import restores doc in the host namespace
+func Import(doc *Document) error {
+	return Host().Import(doc)
+}
+
+// Import brings what the prefix of doc owns in the namespace back to doc in a
+// single batch. Whatever the prefix owns beyond doc is removed.
+func (f *Firewall) Import(doc *Document) error {
+	unlock, lockErr := lock.Acquire()
+	if lockErr != nil {
+		return lockErr
+	}
+	defer unlock()
+
+	live, liveErr := f.Export(doc.Prefix)
+	if liveErr != nil {
+		return liveErr
+	}
+	rs, rsErr := doc.Ruleset(live)
+	if rsErr != nil {
+		return rsErr
+	}
+	return f.Reconcile(rs)
+}
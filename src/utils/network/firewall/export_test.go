@@ -0,0 +1,180 @@
+//go:build linux
+
+package firewall
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/google/nftables/expr"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+// exportJSON exports prefix and passes the document through JSON
+func exportJSON(t *testing.T) *Document {
+	doc, err := Export(DefaultPrefix)
+	require.NoError(t, err)
+	data, err := json.Marshal(doc)
+	require.NoError(t, err)
+	decoded := &Document{}
+	require.NoError(t, json.Unmarshal(data, decoded))
+	return decoded
+}
+
+func TestExportImport_RoundTrip(t *testing.T) {
+	useFakeConn(t)
+	require.NoError(t, Reconcile(BridgeRuleset(DefaultPrefix, "eth0", "br0", WithFlowOffload(), WithSourceSubnet(mustCIDR(t, "192.168.26.0/24")))))
+	require.NoError(t, Reconcile(EgressRuleset(DefaultPrefix, "br0", EgressAllow)))
+	require.NoError(t, AddEgressDestinations(DefaultPrefix, "br0", []*net.IPNet{mustCIDR(t, "203.0.113.0/24")}, []uint16{53}))
+	require.NoError(t, ApplySecurityGroups(DefaultPrefix, testGroups()))
+
+	snapshot := exportJSON(t)
+	require.Equal(t, DocumentVersion, snapshot.Version)
+	require.NotEmpty(t, snapshot.Tables)
+
+	// Changes after the snapshot are rolled back
+	require.NoError(t, Reconcile(BridgeRuleset(DefaultPrefix, "eth0", "br1")))
+	require.NoError(t, RemoveEgressDestinations(DefaultPrefix, "br0", nil, []uint16{53}))
+	require.NoError(t, AddEgressDestinations(DefaultPrefix, "br0", []*net.IPNet{mustCIDR(t, "198.51.100.0/24")}, nil))
+	groups := testGroups()
+	delete(groups.Attachments, "tap1")
+	require.NoError(t, ApplySecurityGroups(DefaultPrefix, groups))
+	require.NotEqual(t, snapshot, exportJSON(t))
+
+	require.NoError(t, Import(snapshot))
+	require.Equal(t, snapshot, exportJSON(t))
+}
+
+func TestImport_RestoresPurgedPrefix(t *testing.T) {
+	conn := useFakeConn(t)
+	require.NoError(t, Reconcile(BridgeRuleset(DefaultPrefix, "eth0", "br0")))
+	snapshot := exportJSON(t)
+
+	require.NoError(t, PurgePrefix(DefaultPrefix))
+	require.NotContains(t, chainNames(t, conn), DefaultPrefix+ForwardChain)
+
+	require.NoError(t, Import(snapshot))
+	require.Equal(t, snapshot, exportJSON(t))
+	tagged, err := ListTaggedRules(Tag{Bridge: "br0"})
+	require.NoError(t, err)
+	require.Len(t, tagged, 9)
+
+	flushes := conn.Flushes
+	require.NoError(t, Import(snapshot))
+	require.Equal(t, flushes, conn.Flushes)
+}
+
+func TestImport_RejectsOtherVersions(t *testing.T) {
+	useFakeConn(t)
+	require.Error(t, Import(&Document{Version: DocumentVersion + 1, Prefix: DefaultPrefix}))
+}
+
+func TestExpression_Schema(t *testing.T) {
+	exprs := []Expression{
+		{&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: []byte{0x0a, 0x00}}},
+		{&expr.Log{Key: 1 << unix.NFTA_LOG_PREFIX, Data: []byte("drop new")}},
+		{&expr.Verdict{Kind: expr.VerdictJump, Chain: "QEMU-LIMIT"}},
+	}
+	data, err := json.Marshal(exprs)
+	require.NoError(t, err)
+	require.JSONEq(t, `[
+		{"expr":"cmp","op":1,"sreg":1,"data":"0a00"},
+		{"expr":"log","key":4,"level":0,"flags":0,"group":0,"snaplen":0,"qthreshold":0,"prefix":"drop new"},
+		{"expr":"verdict","kind":-3,"chain":"QEMU-LIMIT"}
+	]`, string(data))
+
+	var decoded []Expression
+	require.NoError(t, json.Unmarshal(data, &decoded))
+	require.Equal(t, exprs, decoded)
+
+	require.Error(t, json.Unmarshal([]byte(`{"expr":"quota"}`), &Expression{}))
+	_, err = json.Marshal(Expression{&expr.Quota{}})
+	require.Error(t, err)
+}
+
+func TestExportImport_PublishedPort(t *testing.T) {
+	useFakeConn(t)
+	subnet := mustCIDR(t, "192.168.26.0/24")
+	require.NoError(t, Reconcile(BridgeRuleset(DefaultPrefix, "eth0", "br0", WithSourceSubnet(subnet))))
+	require.NoError(t, Reconcile(PortForwardRuleset(DefaultPrefix, "br0", subnet, 2222, net.ParseIP("192.168.26.10"), 22, "tcp")))
+
+	snapshot := exportJSON(t)
+	require.NoError(t, Reconcile(&Ruleset{Prune: []Tag{{Bridge: "br0", Role: RolePortForward}}}))
+	require.NotEqual(t, snapshot, exportJSON(t))
+
+	require.NoError(t, Import(snapshot))
+	require.Equal(t, snapshot, exportJSON(t))
+}
+
+// TestExpression_PackageTypes checks that every expression type built by the
+// package has a schema
+func TestExpression_PackageTypes(t *testing.T) {
+	encodable := map[string]expr.Any{
+		"Bitwise":     &expr.Bitwise{},
+		"Cmp":         &expr.Cmp{},
+		"Connlimit":   &expr.Connlimit{},
+		"Counter":     &expr.Counter{},
+		"Ct":          &expr.Ct{},
+		"Dynset":      &expr.Dynset{},
+		"Fib":         &expr.Fib{},
+		"FlowOffload": &expr.FlowOffload{},
+		"Immediate":   &expr.Immediate{},
+		"Limit":       &expr.Limit{},
+		"Log":         &expr.Log{},
+		"Lookup":      &expr.Lookup{},
+		"Masq":        &expr.Masq{},
+		"Meta":        &expr.Meta{},
+		"NAT":         &expr.NAT{},
+		"Payload":     &expr.Payload{},
+		"Reject":      &expr.Reject{},
+		"Verdict":     &expr.Verdict{},
+	}
+	for name, e := range encodable {
+		data, err := json.Marshal(Expression{e})
+		require.NoError(t, err, name)
+		var decoded Expression
+		require.NoError(t, json.Unmarshal(data, &decoded), name)
+		require.IsType(t, e, decoded.Any, name)
+	}
+
+	sources, err := filepath.Glob("*.go")
+	require.NoError(t, err)
+	built := regexp.MustCompile(`&expr\.([A-Z]\w*)\{`)
+	for _, source := range sources {
+		if strings.HasSuffix(source, "_test.go") || source == "expression.go" {
+			continue
+		}
+		content, err := os.ReadFile(source)
+		require.NoError(t, err)
+		for _, match := range built.FindAllStringSubmatch(string(content), -1) {
+			require.Contains(t, encodable, match[1], "%s builds expr.%s", source, match[1])
+		}
+	}
+}
+
+func TestExport_OtherPrefix(t *testing.T) {
+	useFakeConn(t)
+	require.NoError(t, Reconcile(BridgeRuleset("VM-", "eth0", "br1")))
+	other, err := Export("VM-")
+	require.NoError(t, err)
+	require.NoError(t, Reconcile(BridgeRuleset(DefaultPrefix, "eth0", "br0")))
+
+	// The nat rules of br1 are not part of the default prefix
+	doc := exportJSON(t)
+	data, err := json.Marshal(doc)
+	require.NoError(t, err)
+	require.Contains(t, string(data), "bridge=br0")
+	require.NotContains(t, string(data), "bridge=br1")
+
+	// Restoring it leaves the other prefix alone
+	require.NoError(t, Import(doc))
+	still, err := Export("VM-")
+	require.NoError(t, err)
+	require.Equal(t, other, still)
+}
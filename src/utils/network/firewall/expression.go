@@ -0,0 +1,412 @@
+//go:build linux
+
+package firewall
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/google/nftables/expr"
+)
+
+// Expression wraps an expression to encode it as a JSON object. The object
+// names the expression in "expr", the name the kernel uses, next to the
+// fields of its schema below. Operators, keys and bases hold the values of
+// the kernel, registers its register numbers, byte fields are written in hex
+// and timeouts in seconds. Changing a schema changes DocumentVersion.
+type Expression struct {
+	expr.Any
+}
+
+// hexBytes is a byte field written in hex
+type hexBytes []byte
+
+func (b hexBytes) MarshalText() ([]byte, error) {
+	return []byte(hex.EncodeToString(b)), nil
+}
+
+func (b *hexBytes) UnmarshalText(text []byte) error {
+	decoded, err := hex.DecodeString(string(text))
+	if err != nil {
+		return err
+	}
+	*b = decoded
+	return nil
+}
+
+type bitwiseSchema struct {
+	SourceRegister uint32   `json:"sreg"`
+	DestRegister   uint32   `json:"dreg"`
+	Len            uint32   `json:"len"`
+	Mask           hexBytes `json:"mask"`
+	Xor            hexBytes `json:"xor"`
+}
+
+type cmpSchema struct {
+	Op       uint32   `json:"op"`
+	Register uint32   `json:"sreg"`
+	Data     hexBytes `json:"data"`
+}
+
+type connlimitSchema struct {
+	Count uint32 `json:"count"`
+	Flags uint32 `json:"flags"`
+}
+
+// counterSchema has no fields, counters are not part of the document
+type counterSchema struct{}
+
+type ctSchema struct {
+	Key            uint32 `json:"key"`
+	Register       uint32 `json:"reg"`
+	SourceRegister bool   `json:"sourceReg,omitempty"`
+	Direction      uint32 `json:"dir"`
+}
+
+type dynsetSchema struct {
+	Set        string       `json:"set"`
+	Operation  uint32       `json:"op"`
+	SrcRegKey  uint32       `json:"sregKey"`
+	SrcRegData uint32       `json:"sregData,omitempty"`
+	Timeout    int64        `json:"timeout,omitempty"`
+	Invert     bool         `json:"invert,omitempty"`
+	Exprs      []Expression `json:"exprs,omitempty"`
+}
+
+type fibSchema struct {
+	Register       uint32 `json:"dreg"`
+	ResultOIF      bool   `json:"resultOif,omitempty"`
+	ResultOIFNAME  bool   `json:"resultOifname,omitempty"`
+	ResultADDRTYPE bool   `json:"resultAddrtype,omitempty"`
+	FlagSADDR      bool   `json:"saddr,omitempty"`
+	FlagDADDR      bool   `json:"daddr,omitempty"`
+	FlagMARK       bool   `json:"mark,omitempty"`
+	FlagIIF        bool   `json:"iif,omitempty"`
+	FlagOIF        bool   `json:"oif,omitempty"`
+	FlagPRESENT    bool   `json:"present,omitempty"`
+}
+
+type flowSchema struct {
+	Flowtable string `json:"flowtable"`
+}
+
+type immediateSchema struct {
+	Register uint32   `json:"dreg"`
+	Data     hexBytes `json:"data"`
+}
+
+type limitSchema struct {
+	Type  uint32 `json:"type"`
+	Rate  uint64 `json:"rate"`
+	Unit  uint64 `json:"unit"`
+	Burst uint32 `json:"burst"`
+	Over  bool   `json:"over,omitempty"`
+}
+
+type logSchema struct {
+	Key        uint32 `json:"key"`
+	Level      uint32 `json:"level"`
+	Flags      uint32 `json:"flags"`
+	Group      uint16 `json:"group"`
+	Snaplen    uint32 `json:"snaplen"`
+	QThreshold uint16 `json:"qthreshold"`
+	Prefix     string `json:"prefix"`
+}
+
+type lookupSchema struct {
+	Set            string `json:"set"`
+	SourceRegister uint32 `json:"sreg"`
+	DestRegister   uint32 `json:"dreg,omitempty"`
+	IsDestRegSet   bool   `json:"isDregSet,omitempty"`
+	Invert         bool   `json:"invert,omitempty"`
+}
+
+type masqSchema struct {
+	Random      bool   `json:"random,omitempty"`
+	FullyRandom bool   `json:"fullyRandom,omitempty"`
+	Persistent  bool   `json:"persistent,omitempty"`
+	ToPorts     bool   `json:"toPorts,omitempty"`
+	RegProtoMin uint32 `json:"regProtoMin,omitempty"`
+	RegProtoMax uint32 `json:"regProtoMax,omitempty"`
+}
+
+type metaSchema struct {
+	Key            uint32 `json:"key"`
+	Register       uint32 `json:"reg"`
+	SourceRegister bool   `json:"sourceReg,omitempty"`
+}
+
+type natSchema struct {
+	Type        uint32 `json:"type"`
+	Family      uint32 `json:"family"`
+	RegAddrMin  uint32 `json:"regAddrMin,omitempty"`
+	RegAddrMax  uint32 `json:"regAddrMax,omitempty"`
+	RegProtoMin uint32 `json:"regProtoMin,omitempty"`
+	RegProtoMax uint32 `json:"regProtoMax,omitempty"`
+	Random      bool   `json:"random,omitempty"`
+	FullyRandom bool   `json:"fullyRandom,omitempty"`
+	Persistent  bool   `json:"persistent,omitempty"`
+	Prefix      bool   `json:"prefix,omitempty"`
+	Specified   bool   `json:"specified,omitempty"`
+}
+
+type payloadSchema struct {
+	OperationType  uint32 `json:"op"`
+	Base           uint32 `json:"base"`
+	Offset         uint32 `json:"offset"`
+	Len            uint32 `json:"len"`
+	DestRegister   uint32 `json:"dreg,omitempty"`
+	SourceRegister uint32 `json:"sreg,omitempty"`
+	CsumType       uint32 `json:"csumType,omitempty"`
+	CsumOffset     uint32 `json:"csumOffset,omitempty"`
+	CsumFlags      uint32 `json:"csumFlags,omitempty"`
+}
+
+type rejectSchema struct {
+	Type uint32 `json:"type"`
+	Code uint8  `json:"code"`
+}
+
+type verdictSchema struct {
+	Kind  int64  `json:"kind"`
+	Chain string `json:"chain,omitempty"`
+}
+
+// encodeExpression returns the name and the schema of e
+func encodeExpression(e expr.Any) (string, any, error) {
+	switch e := e.(type) {
+	case *expr.Bitwise:
+		return "bitwise", bitwiseSchema{e.SourceRegister, e.DestRegister, e.Len, e.Mask, e.Xor}, nil
+	case *expr.Cmp:
+		return "cmp", cmpSchema{uint32(e.Op), e.Register, e.Data}, nil
+	case *expr.Connlimit:
+		return "connlimit", connlimitSchema{e.Count, e.Flags}, nil
+	case *expr.Counter:
+		return "counter", counterSchema{}, nil
+	case *expr.Ct:
+		return "ct", ctSchema{uint32(e.Key), e.Register, e.SourceRegister, e.Direction}, nil
+	case *expr.Dynset:
+		nested := make([]Expression, 0, len(e.Exprs))
+		for _, n := range e.Exprs {
+			nested = append(nested, Expression{n})
+		}
+		return "dynset", dynsetSchema{
+			Set:        e.SetName,
+			Operation:  e.Operation,
+			SrcRegKey:  e.SrcRegKey,
+			SrcRegData: e.SrcRegData,
+			Timeout:    int64(e.Timeout / time.Second),
+			Invert:     e.Invert,
+			Exprs:      nested,
+		}, nil
+	case *expr.Fib:
+		return "fib", fibSchema{
+			e.Register, e.ResultOIF, e.ResultOIFNAME, e.ResultADDRTYPE,
+			e.FlagSADDR, e.FlagDADDR, e.FlagMARK, e.FlagIIF, e.FlagOIF, e.FlagPRESENT,
+		}, nil
+	case *expr.FlowOffload:
+		return "flow", flowSchema{e.Name}, nil
+	case *expr.Immediate:
+		return "immediate", immediateSchema{e.Register, e.Data}, nil
+	case *expr.Limit:
+		return "limit", limitSchema{uint32(e.Type), e.Rate, uint64(e.Unit), e.Burst, e.Over}, nil
+	case *expr.Log:
+		return "log", logSchema{e.Key, uint32(e.Level), uint32(e.Flags), e.Group, e.Snaplen, e.QThreshold, string(e.Data)}, nil
+	case *expr.Lookup:
+		return "lookup", lookupSchema{e.SetName, e.SourceRegister, e.DestRegister, e.IsDestRegSet, e.Invert}, nil
+	case *expr.Masq:
+		return "masq", masqSchema{e.Random, e.FullyRandom, e.Persistent, e.ToPorts, e.RegProtoMin, e.RegProtoMax}, nil
+	case *expr.Meta:
+		return "meta", metaSchema{uint32(e.Key), e.Register, e.SourceRegister}, nil
+	case *expr.NAT:
+		return "nat", natSchema{
+			uint32(e.Type), e.Family, e.RegAddrMin, e.RegAddrMax, e.RegProtoMin, e.RegProtoMax,
+			e.Random, e.FullyRandom, e.Persistent, e.Prefix, e.Specified,
+		}, nil
+	case *expr.Payload:
+		return "payload", payloadSchema{
+			uint32(e.OperationType), uint32(e.Base), e.Offset, e.Len, e.DestRegister, e.SourceRegister,
+			uint32(e.CsumType), e.CsumOffset, e.CsumFlags,
+		}, nil
+	case *expr.Reject:
+		return "reject", rejectSchema{e.Type, e.Code}, nil
+	case *expr.Verdict:
+		return "verdict", verdictSchema{int64(e.Kind), e.Chain}, nil
+	}
+	return "", nil, fmt.Errorf("unsupported expression %T", e)
+}
+
+// decodeSchema decodes data into the schema S and converts it with fn
+func decodeSchema[S any](data []byte, fn func(S) expr.Any) (expr.Any, error) {
+	var s S
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, err
+	}
+	return fn(s), nil
+}
+
+// decodeExpression returns the expression name with the schema in data
+func decodeExpression(name string, data []byte) (expr.Any, error) {
+	switch name {
+	case "bitwise":
+		return decodeSchema(data, func(s bitwiseSchema) expr.Any {
+			return &expr.Bitwise{SourceRegister: s.SourceRegister, DestRegister: s.DestRegister, Len: s.Len, Mask: s.Mask, Xor: s.Xor}
+		})
+	case "cmp":
+		return decodeSchema(data, func(s cmpSchema) expr.Any {
+			return &expr.Cmp{Op: expr.CmpOp(s.Op), Register: s.Register, Data: s.Data}
+		})
+	case "connlimit":
+		return decodeSchema(data, func(s connlimitSchema) expr.Any {
+			return &expr.Connlimit{Count: s.Count, Flags: s.Flags}
+		})
+	case "counter":
+		return decodeSchema(data, func(counterSchema) expr.Any {
+			return &expr.Counter{}
+		})
+	case "ct":
+		return decodeSchema(data, func(s ctSchema) expr.Any {
+			return &expr.Ct{Key: expr.CtKey(s.Key), Register: s.Register, SourceRegister: s.SourceRegister, Direction: s.Direction}
+		})
+	case "dynset":
+		return decodeSchema(data, func(s dynsetSchema) expr.Any {
+			var nested []expr.Any
+			for _, n := range s.Exprs {
+				nested = append(nested, n.Any)
+			}
+			return &expr.Dynset{
+				SetName:    s.Set,
+				Operation:  s.Operation,
+				SrcRegKey:  s.SrcRegKey,
+				SrcRegData: s.SrcRegData,
+				Timeout:    time.Duration(s.Timeout) * time.Second,
+				Invert:     s.Invert,
+				Exprs:      nested,
+			}
+		})
+	case "fib":
+		return decodeSchema(data, func(s fibSchema) expr.Any {
+			return &expr.Fib{
+				Register:       s.Register,
+				ResultOIF:      s.ResultOIF,
+				ResultOIFNAME:  s.ResultOIFNAME,
+				ResultADDRTYPE: s.ResultADDRTYPE,
+				FlagSADDR:      s.FlagSADDR,
+				FlagDADDR:      s.FlagDADDR,
+				FlagMARK:       s.FlagMARK,
+				FlagIIF:        s.FlagIIF,
+				FlagOIF:        s.FlagOIF,
+				FlagPRESENT:    s.FlagPRESENT,
+			}
+		})
+	case "flow":
+		return decodeSchema(data, func(s flowSchema) expr.Any {
+			return &expr.FlowOffload{Name: s.Flowtable}
+		})
+	case "immediate":
+		return decodeSchema(data, func(s immediateSchema) expr.Any {
+			return &expr.Immediate{Register: s.Register, Data: s.Data}
+		})
+	case "limit":
+		return decodeSchema(data, func(s limitSchema) expr.Any {
+			return &expr.Limit{Type: expr.LimitType(s.Type), Rate: s.Rate, Unit: expr.LimitTime(s.Unit), Burst: s.Burst, Over: s.Over}
+		})
+	case "log":
+		return decodeSchema(data, func(s logSchema) expr.Any {
+			return &expr.Log{
+				Key:        s.Key,
+				Level:      expr.LogLevel(s.Level),
+				Flags:      expr.LogFlags(s.Flags),
+				Group:      s.Group,
+				Snaplen:    s.Snaplen,
+				QThreshold: s.QThreshold,
+				Data:       []byte(s.Prefix),
+			}
+		})
+	case "lookup":
+		return decodeSchema(data, func(s lookupSchema) expr.Any {
+			return &expr.Lookup{SetName: s.Set, SourceRegister: s.SourceRegister, DestRegister: s.DestRegister, IsDestRegSet: s.IsDestRegSet, Invert: s.Invert}
+		})
+	case "masq":
+		return decodeSchema(data, func(s masqSchema) expr.Any {
+			return &expr.Masq{Random: s.Random, FullyRandom: s.FullyRandom, Persistent: s.Persistent, ToPorts: s.ToPorts, RegProtoMin: s.RegProtoMin, RegProtoMax: s.RegProtoMax}
+		})
+	case "meta":
+		return decodeSchema(data, func(s metaSchema) expr.Any {
+			return &expr.Meta{Key: expr.MetaKey(s.Key), Register: s.Register, SourceRegister: s.SourceRegister}
+		})
+	case "nat":
+		return decodeSchema(data, func(s natSchema) expr.Any {
+			return &expr.NAT{
+				Type:        expr.NATType(s.Type),
+				Family:      s.Family,
+				RegAddrMin:  s.RegAddrMin,
+				RegAddrMax:  s.RegAddrMax,
+				RegProtoMin: s.RegProtoMin,
+				RegProtoMax: s.RegProtoMax,
+				Random:      s.Random,
+				FullyRandom: s.FullyRandom,
+				Persistent:  s.Persistent,
+				Prefix:      s.Prefix,
+				Specified:   s.Specified,
+			}
+		})
+	case "payload":
+		return decodeSchema(data, func(s payloadSchema) expr.Any {
+			return &expr.Payload{
+				OperationType:  expr.PayloadOperationType(s.OperationType),
+				Base:           expr.PayloadBase(s.Base),
+				Offset:         s.Offset,
+				Len:            s.Len,
+				DestRegister:   s.DestRegister,
+				SourceRegister: s.SourceRegister,
+				CsumType:       expr.PayloadCsumType(s.CsumType),
+				CsumOffset:     s.CsumOffset,
+				CsumFlags:      s.CsumFlags,
+			}
+		})
+	case "reject":
+		return decodeSchema(data, func(s rejectSchema) expr.Any {
+			return &expr.Reject{Type: s.Type, Code: s.Code}
+		})
+	case "verdict":
+		return decodeSchema(data, func(s verdictSchema) expr.Any {
+			return &expr.Verdict{Kind: expr.VerdictKind(s.Kind), Chain: s.Chain}
+		})
+	}
+	return nil, fmt.Errorf("unsupported expression %q", name)
+}
+
+func (e Expression) MarshalJSON() ([]byte, error) {
+	name, schema, encodeErr := encodeExpression(e.Any)
+	if encodeErr != nil {
+		return nil, encodeErr
+	}
+	fields, marshalErr := json.Marshal(schema)
+	if marshalErr != nil {
+		return nil, marshalErr
+	}
+	object := map[string]json.RawMessage{}
+	if err := json.Unmarshal(fields, &object); err != nil {
+		return nil, err
+	}
+	object["expr"], _ = json.Marshal(name)
+	return json.Marshal(object)
+}
+
+func (e *Expression) UnmarshalJSON(data []byte) error {
+	var object struct {
+		Expr string `json:"expr"`
+	}
+	if err := json.Unmarshal(data, &object); err != nil {
+		return err
+	}
+	decoded, decodeErr := decodeExpression(object.Expr, data)
+	if decodeErr != nil {
+		return fmt.Errorf("invalid expression %q: %w", object.Expr, decodeErr)
+	}
+	e.Any = decoded
+	return nil
+}
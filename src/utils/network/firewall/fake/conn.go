@@ -0,0 +1,487 @@
+//go:build linux
+
+// Package fake provides an in-memory nftables connection for tests. It models
+// tables, chains, rule handles and rule order, and applies buffered changes
+// atomically on Flush like the kernel does.
+package fake
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+type chain struct {
+	chain *nftables.Chain
+	rules []*nftables.Rule
+}
+
+type set struct {
+	set      *nftables.Set
+	elements []nftables.SetElement
+}
+
+type table struct {
+	table      *nftables.Table
+	chains     []*chain
+	sets       []*set
+	flowtables []*nftables.Flowtable
+}
+
+type state struct {
+	tables []*table
+	handle uint64
+}
+
+// Conn is an in-memory replacement for *nftables.Conn
+type Conn struct {
+	mu      sync.Mutex
+	state   state
+	pending []func(*state) error
+
+	// Flushes counts the batches that were committed successfully
+	Flushes int
+	// Dumps counts the requests reading the ruleset, each a netlink round
+	// trip on a real connection
+	Dumps int
+}
+
+func NewConn() *Conn {
+	return &Conn{}
+}
+
+func (s *state) clone() state {
+	result := state{handle: s.handle}
+	for _, t := range s.tables {
+		tc := &table{table: t.table, flowtables: slices.Clone(t.flowtables)}
+		for _, ch := range t.chains {
+			tc.chains = append(tc.chains, &chain{chain: ch.chain, rules: slices.Clone(ch.rules)})
+		}
+		for _, st := range t.sets {
+			tc.sets = append(tc.sets, &set{set: st.set, elements: slices.Clone(st.elements)})
+		}
+		result.tables = append(result.tables, tc)
+	}
+	return result
+}
+
+func (s *state) table(name string, family nftables.TableFamily) *table {
+	for _, t := range s.tables {
+		if t.table.Name == name && t.table.Family == family {
+			return t
+		}
+	}
+	return nil
+}
+
+func (s *state) chain(t *nftables.Table, name string) (*chain, error) {
+	tbl := s.table(t.Name, t.Family)
+	if tbl == nil {
+		return nil, fmt.Errorf("table %s: %w", t.Name, unix.ENOENT)
+	}
+	for _, ch := range tbl.chains {
+		if ch.chain.Name == name {
+			return ch, nil
+		}
+	}
+	return nil, fmt.Errorf("chain %s: %w", name, unix.ENOENT)
+}
+
+func (s *state) set(t *nftables.Table, name string) (*set, error) {
+	tbl := s.table(t.Name, t.Family)
+	if tbl == nil {
+		return nil, fmt.Errorf("table %s: %w", t.Name, unix.ENOENT)
+	}
+	for _, st := range tbl.sets {
+		if st.set.Name == name {
+			return st, nil
+		}
+	}
+	return nil, fmt.Errorf("set %s: %w", name, unix.ENOENT)
+}
+
+func elementIndex(elements []nftables.SetElement, element nftables.SetElement) int {
+	return slices.IndexFunc(elements, func(e nftables.SetElement) bool {
+		return slices.Equal(e.Key, element.Key) && e.IntervalEnd == element.IntervalEnd
+	})
+}
+
+func ruleIndex(rules []*nftables.Rule, handle uint64) int {
+	return slices.IndexFunc(rules, func(r *nftables.Rule) bool {
+		return r.Handle == handle
+	})
+}
+
+func (c *Conn) queue(op func(*state) error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pending = append(c.pending, op)
+}
+
+func (c *Conn) ListTables() ([]*nftables.Table, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Dumps++
+	var result []*nftables.Table
+	for _, t := range c.state.tables {
+		result = append(result, &nftables.Table{Name: t.table.Name, Family: t.table.Family})
+	}
+	return result, nil
+}
+
+func (c *Conn) ListChains() ([]*nftables.Chain, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Dumps++
+	var result []*nftables.Chain
+	for _, t := range c.state.tables {
+		for _, ch := range t.chains {
+			copied := *ch.chain
+			copied.Table = &nftables.Table{Name: t.table.Name, Family: t.table.Family}
+			result = append(result, &copied)
+		}
+	}
+	return result, nil
+}
+
+// GetRules returns the rules of a chain in order. Like the kernel, the
+// returned rules carry their table on the rule and not on the chain.
+func (c *Conn) GetRules(t *nftables.Table, ch *nftables.Chain) ([]*nftables.Rule, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Dumps++
+	existing, chainErr := c.state.chain(t, ch.Name)
+	if chainErr != nil {
+		return nil, chainErr
+	}
+	var result []*nftables.Rule
+	for _, r := range existing.rules {
+		result = append(result, &nftables.Rule{
+			Table:    &nftables.Table{Name: t.Name, Family: t.Family},
+			Chain:    &nftables.Chain{Name: ch.Name},
+			Handle:   r.Handle,
+			Exprs:    slices.Clone(r.Exprs),
+			UserData: slices.Clone(r.UserData),
+		})
+	}
+	return result, nil
+}
+
+func (c *Conn) AddTable(t *nftables.Table) *nftables.Table {
+	c.queue(func(s *state) error {
+		if s.table(t.Name, t.Family) == nil {
+			s.tables = append(s.tables, &table{table: &nftables.Table{Name: t.Name, Family: t.Family}})
+		}
+		return nil
+	})
+	return t
+}
+
+func (c *Conn) AddChain(ch *nftables.Chain) *nftables.Chain {
+	c.queue(func(s *state) error {
+		tbl := s.table(ch.Table.Name, ch.Table.Family)
+		if tbl == nil {
+			return fmt.Errorf("table %s: %w", ch.Table.Name, unix.ENOENT)
+		}
+		if _, err := s.chain(ch.Table, ch.Name); err == nil {
+			return nil
+		}
+		copied := *ch
+		tbl.chains = append(tbl.chains, &chain{chain: &copied})
+		return nil
+	})
+	return ch
+}
+
+func (c *Conn) DelChain(ch *nftables.Chain) {
+	c.queue(func(s *state) error {
+		tbl := s.table(ch.Table.Name, ch.Table.Family)
+		if tbl == nil {
+			return fmt.Errorf("table %s: %w", ch.Table.Name, unix.ENOENT)
+		}
+		idx := slices.IndexFunc(tbl.chains, func(existing *chain) bool {
+			return existing.chain.Name == ch.Name
+		})
+		if idx < 0 {
+			return fmt.Errorf("chain %s: %w", ch.Name, unix.ENOENT)
+		}
+		if len(tbl.chains[idx].rules) > 0 {
+			return fmt.Errorf("chain %s: %w", ch.Name, unix.EBUSY)
+		}
+		tbl.chains = slices.Delete(tbl.chains, idx, idx+1)
+		return nil
+	})
+}
+
+// newRule queues a rule that is placed by place, or replaces the rule with the
+// same handle.
+func (c *Conn) newRule(r *nftables.Rule, place func(rules []*nftables.Rule, rule *nftables.Rule) ([]*nftables.Rule, error)) *nftables.Rule {
+	c.queue(func(s *state) error {
+		existing, chainErr := s.chain(r.Table, r.Chain.Name)
+		if chainErr != nil {
+			return chainErr
+		}
+		if r.Handle != 0 {
+			idx := ruleIndex(existing.rules, r.Handle)
+			if idx < 0 {
+				return fmt.Errorf("rule %d: %w", r.Handle, unix.ENOENT)
+			}
+			copied := *existing.rules[idx]
+			copied.Exprs = r.Exprs
+			copied.UserData = r.UserData
+			existing.rules[idx] = &copied
+			return nil
+		}
+
+		s.handle++
+		rule := &nftables.Rule{Handle: s.handle, Exprs: r.Exprs, UserData: r.UserData}
+		rules, placeErr := place(existing.rules, rule)
+		if placeErr != nil {
+			return placeErr
+		}
+		existing.rules = rules
+		return nil
+	})
+	return r
+}
+
+// AddRule appends a rule, or places it after the rule at Position
+func (c *Conn) AddRule(r *nftables.Rule) *nftables.Rule {
+	return c.newRule(r, func(rules []*nftables.Rule, rule *nftables.Rule) ([]*nftables.Rule, error) {
+		if r.Position == 0 {
+			return append(rules, rule), nil
+		}
+		idx := ruleIndex(rules, r.Position)
+		if idx < 0 {
+			return nil, fmt.Errorf("rule %d: %w", r.Position, unix.ENOENT)
+		}
+		return slices.Insert(rules, idx+1, rule), nil
+	})
+}
+
+// InsertRule prepends a rule, or places it before the rule at Position
+func (c *Conn) InsertRule(r *nftables.Rule) *nftables.Rule {
+	return c.newRule(r, func(rules []*nftables.Rule, rule *nftables.Rule) ([]*nftables.Rule, error) {
+		idx := 0
+		if r.Position != 0 {
+			idx = ruleIndex(rules, r.Position)
+			if idx < 0 {
+				return nil, fmt.Errorf("rule %d: %w", r.Position, unix.ENOENT)
+			}
+		}
+		return slices.Insert(rules, idx, rule), nil
+	})
+}
+
+func (c *Conn) DelRule(r *nftables.Rule) error {
+	if r.Handle == 0 {
+		return fmt.Errorf("rule's handle cannot be 0")
+	}
+	c.queue(func(s *state) error {
+		existing, chainErr := s.chain(r.Table, r.Chain.Name)
+		if chainErr != nil {
+			return chainErr
+		}
+		idx := ruleIndex(existing.rules, r.Handle)
+		if idx < 0 {
+			return fmt.Errorf("rule %d: %w", r.Handle, unix.ENOENT)
+		}
+		existing.rules = slices.Delete(existing.rules, idx, idx+1)
+		return nil
+	})
+	return nil
+}
+
+func (c *Conn) GetSets(t *nftables.Table) ([]*nftables.Set, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Dumps++
+	tbl := c.state.table(t.Name, t.Family)
+	if tbl == nil {
+		return nil, fmt.Errorf("table %s: %w", t.Name, unix.ENOENT)
+	}
+	var result []*nftables.Set
+	for _, st := range tbl.sets {
+		copied := *st.set
+		copied.Table = &nftables.Table{Name: t.Name, Family: t.Family}
+		result = append(result, &copied)
+	}
+	return result, nil
+}
+
+func (c *Conn) GetSetElements(s *nftables.Set) ([]nftables.SetElement, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Dumps++
+	existing, setErr := c.state.set(s.Table, s.Name)
+	if setErr != nil {
+		return nil, setErr
+	}
+	return slices.Clone(existing.elements), nil
+}
+
+func (c *Conn) AddSet(s *nftables.Set, vals []nftables.SetElement) error {
+	c.queue(func(st *state) error {
+		tbl := st.table(s.Table.Name, s.Table.Family)
+		if tbl == nil {
+			return fmt.Errorf("table %s: %w", s.Table.Name, unix.ENOENT)
+		}
+		if _, err := st.set(s.Table, s.Name); err != nil {
+			copied := *s
+			tbl.sets = append(tbl.sets, &set{set: &copied})
+		}
+		return nil
+	})
+	return c.SetAddElements(s, vals)
+}
+
+func (c *Conn) DelSet(s *nftables.Set) {
+	c.queue(func(st *state) error {
+		if _, err := st.set(s.Table, s.Name); err != nil {
+			return err
+		}
+		tbl := st.table(s.Table.Name, s.Table.Family)
+		tbl.sets = slices.DeleteFunc(tbl.sets, func(existing *set) bool {
+			return existing.set.Name == s.Name
+		})
+		return nil
+	})
+}
+
+func (c *Conn) SetAddElements(s *nftables.Set, vals []nftables.SetElement) error {
+	if len(vals) == 0 {
+		return nil
+	}
+	c.queue(func(st *state) error {
+		existing, setErr := st.set(s.Table, s.Name)
+		if setErr != nil {
+			return setErr
+		}
+		for _, v := range vals {
+			if elementIndex(existing.elements, v) < 0 {
+				existing.elements = append(existing.elements, v)
+			}
+		}
+		return nil
+	})
+	return nil
+}
+
+func (c *Conn) SetDeleteElements(s *nftables.Set, vals []nftables.SetElement) error {
+	c.queue(func(st *state) error {
+		existing, setErr := st.set(s.Table, s.Name)
+		if setErr != nil {
+			return setErr
+		}
+		for _, v := range vals {
+			idx := elementIndex(existing.elements, v)
+			if idx < 0 {
+				return fmt.Errorf("element %x: %w", v.Key, unix.ENOENT)
+			}
+			existing.elements = slices.Delete(existing.elements, idx, idx+1)
+		}
+		return nil
+	})
+	return nil
+}
+
+func (c *Conn) ListFlowtables(t *nftables.Table) ([]*nftables.Flowtable, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Dumps++
+	tbl := c.state.table(t.Name, t.Family)
+	if tbl == nil {
+		return nil, fmt.Errorf("table %s: %w", t.Name, unix.ENOENT)
+	}
+	var result []*nftables.Flowtable
+	for _, ft := range tbl.flowtables {
+		copied := *ft
+		copied.Table = &nftables.Table{Name: t.Name, Family: t.Family}
+		copied.Devices = slices.Clone(ft.Devices)
+		result = append(result, &copied)
+	}
+	return result, nil
+}
+
+// AddFlowtable creates a flowtable or, like the kernel, adds the devices of f
+// to an existing one
+func (c *Conn) AddFlowtable(f *nftables.Flowtable) *nftables.Flowtable {
+	c.queue(func(s *state) error {
+		tbl := s.table(f.Table.Name, f.Table.Family)
+		if tbl == nil {
+			return fmt.Errorf("table %s: %w", f.Table.Name, unix.ENOENT)
+		}
+		idx := slices.IndexFunc(tbl.flowtables, func(existing *nftables.Flowtable) bool {
+			return existing.Name == f.Name
+		})
+		if idx < 0 {
+			copied := *f
+			copied.Devices = slices.Clone(f.Devices)
+			tbl.flowtables = append(tbl.flowtables, &copied)
+			return nil
+		}
+		updated := *tbl.flowtables[idx]
+		updated.Devices = slices.Clone(updated.Devices)
+		for _, dev := range f.Devices {
+			if !slices.Contains(updated.Devices, dev) {
+				updated.Devices = append(updated.Devices, dev)
+			}
+		}
+		tbl.flowtables[idx] = &updated
+		return nil
+	})
+	return f
+}
+
+// DelFlowtable deletes a flowtable. Like the kernel, it refuses flowtables
+// that rules still offload to.
+func (c *Conn) DelFlowtable(f *nftables.Flowtable) {
+	c.queue(func(s *state) error {
+		tbl := s.table(f.Table.Name, f.Table.Family)
+		if tbl == nil {
+			return fmt.Errorf("table %s: %w", f.Table.Name, unix.ENOENT)
+		}
+		idx := slices.IndexFunc(tbl.flowtables, func(existing *nftables.Flowtable) bool {
+			return existing.Name == f.Name
+		})
+		if idx < 0 {
+			return fmt.Errorf("flowtable %s: %w", f.Name, unix.ENOENT)
+		}
+		for _, ch := range tbl.chains {
+			for _, r := range ch.rules {
+				for _, e := range r.Exprs {
+					if offload, ok := e.(*expr.FlowOffload); ok && offload.Name == f.Name {
+						return fmt.Errorf("flowtable %s: %w", f.Name, unix.EBUSY)
+					}
+				}
+			}
+		}
+		tbl.flowtables = slices.Delete(tbl.flowtables, idx, idx+1)
+		return nil
+	})
+}
+
+// Flush applies the buffered changes. If one of them fails, none is applied.
+func (c *Conn) Flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	pending := c.pending
+	c.pending = nil
+	if len(pending) == 0 {
+		return nil
+	}
+
+	next := c.state.clone()
+	for _, op := range pending {
+		if err := op(&next); err != nil {
+			return err
+		}
+	}
+	c.state = next
+	c.Flushes++
+	return nil
+}
@@ -0,0 +1,81 @@
+//go:build linux
+
+package fake
+
+import (
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/stretchr/testify/require"
+)
+
+func setup(t *testing.T) (*Conn, *nftables.Table, *nftables.Chain) {
+	conn := NewConn()
+	table := conn.AddTable(&nftables.Table{Name: "filter", Family: nftables.TableFamilyIPv4})
+	chain := conn.AddChain(&nftables.Chain{Name: "FORWARD", Table: table})
+	require.NoError(t, conn.Flush())
+	return conn, table, chain
+}
+
+func verdict(kind expr.VerdictKind) []expr.Any {
+	return []expr.Any{&expr.Verdict{Kind: kind}}
+}
+
+func kinds(t *testing.T, conn *Conn, table *nftables.Table, chain *nftables.Chain) []expr.VerdictKind {
+	rules, err := conn.GetRules(table, chain)
+	require.NoError(t, err)
+	var result []expr.VerdictKind
+	for _, r := range rules {
+		result = append(result, r.Exprs[0].(*expr.Verdict).Kind)
+	}
+	return result
+}
+
+func TestConn_RuleOrder(t *testing.T) {
+	conn, table, chain := setup(t)
+	conn.AddRule(&nftables.Rule{Table: table, Chain: chain, Exprs: verdict(expr.VerdictAccept)})
+	conn.InsertRule(&nftables.Rule{Table: table, Chain: chain, Exprs: verdict(expr.VerdictDrop)})
+	require.NoError(t, conn.Flush())
+	require.Equal(t, []expr.VerdictKind{expr.VerdictDrop, expr.VerdictAccept}, kinds(t, conn, table, chain))
+
+	rules, err := conn.GetRules(table, chain)
+	require.NoError(t, err)
+	require.Nil(t, rules[0].Chain.Table)
+	require.Equal(t, table.Name, rules[0].Table.Name)
+
+	// A handle replaces the rule, a position places the rule next to it
+	conn.InsertRule(&nftables.Rule{Table: table, Chain: chain, Handle: rules[0].Handle, Exprs: verdict(expr.VerdictReturn)})
+	conn.AddRule(&nftables.Rule{Table: table, Chain: chain, Position: rules[0].Handle, Exprs: verdict(expr.VerdictContinue)})
+	require.NoError(t, conn.Flush())
+	require.Equal(t, []expr.VerdictKind{expr.VerdictReturn, expr.VerdictContinue, expr.VerdictAccept}, kinds(t, conn, table, chain))
+
+	require.NoError(t, conn.DelRule(rules[1]))
+	require.NoError(t, conn.Flush())
+	require.Equal(t, []expr.VerdictKind{expr.VerdictReturn, expr.VerdictContinue}, kinds(t, conn, table, chain))
+}
+
+func TestConn_FlushIsAtomic(t *testing.T) {
+	conn, table, chain := setup(t)
+	conn.AddRule(&nftables.Rule{Table: table, Chain: chain, Exprs: verdict(expr.VerdictAccept)})
+	conn.AddTable(&nftables.Table{Name: "nat", Family: nftables.TableFamilyIPv4})
+	conn.AddRule(&nftables.Rule{Table: table, Chain: &nftables.Chain{Name: "MISSING"}, Exprs: verdict(expr.VerdictAccept)})
+	require.Error(t, conn.Flush())
+	require.Equal(t, 1, conn.Flushes)
+
+	tables, err := conn.ListTables()
+	require.NoError(t, err)
+	require.Len(t, tables, 1)
+	require.Empty(t, kinds(t, conn, table, chain))
+
+	// The failed batch is discarded
+	require.NoError(t, conn.Flush())
+	require.Equal(t, 1, conn.Flushes)
+}
+
+func TestConn_DelRuleMissingHandle(t *testing.T) {
+	conn, table, chain := setup(t)
+	require.Error(t, conn.DelRule(&nftables.Rule{Table: table, Chain: chain}))
+	require.NoError(t, conn.DelRule(&nftables.Rule{Table: table, Chain: chain, Handle: 42}))
+	require.Error(t, conn.Flush())
+}
@@ -0,0 +1,139 @@
+//go:build linux
+
+package firewall
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/google/nftables"
+	"github.com/q-controller/network-utils/src/utils/network/conntrack"
+	"github.com/vishvananda/netns"
+)
+
+// Firewall manages the nftables ruleset of a single network namespace. The
+// package-level functions operate on the ruleset of the host namespace.
+type Firewall struct {
+	conn  Conn
+	owned *nftables.Conn
+	// ct is nil for dry runs and custom connections
+	ct      Conntrack
+	ownedCT *conntrack.Conntrack
+}
+
+// FirewallConfig holds the target of a Firewall
+type FirewallConfig struct {
+	NetNS     int
+	NetNSName string
+	Conn      Conn
+	DryRun    io.Writer
+}
+
+type FirewallOption func(*FirewallConfig)
+
+// WithNetNS targets the network namespace referenced by fd. The fd is only
+// used while New runs and stays owned by the caller.
+func WithNetNS(fd int) FirewallOption {
+	return func(config *FirewallConfig) {
+		config.NetNS = fd
+	}
+}
+
+// WithNetNSName targets the named network namespace, as created by `ip netns add`
+func WithNetNSName(name string) FirewallOption {
+	return func(config *FirewallConfig) {
+		config.NetNSName = name
+	}
+}
+
+// WithConnection uses conn instead of a new netlink connection
+func WithConnection(conn Conn) FirewallOption {
+	return func(config *FirewallConfig) {
+		config.Conn = conn
+	}
+}
+
+// WithDryRun writes the changes of the Firewall to w as `nft -f` input
+// instead of committing them. The live ruleset is still read.
+func WithDryRun(w io.Writer) FirewallOption {
+	return func(config *FirewallConfig) {
+		config.DryRun = w
+	}
+}
+
+// Host returns the Firewall of the host namespace
+func Host() *Firewall {
+	return &Firewall{conn: getConnection(), ct: getConntrack()}
+}
+
+// New returns a Firewall for the namespace selected by opts. Without a
+// namespace option it targets the namespace of the calling thread. The
+// Firewall must be closed to release its netlink socket.
+func New(opts ...FirewallOption) (*Firewall, error) {
+	config := &FirewallConfig{}
+	for _, opt := range opts {
+		opt(config)
+	}
+
+	fw, fwErr := newFirewall(config)
+	if fwErr != nil {
+		return nil, fwErr
+	}
+	if config.DryRun != nil {
+		fw.conn = DryRun(fw.conn, config.DryRun)
+		fw.ct = nil
+	}
+	return fw, nil
+}
+
+func newFirewall(config *FirewallConfig) (*Firewall, error) {
+	if config.Conn != nil {
+		return &Firewall{conn: config.Conn}, nil
+	}
+
+	fd := config.NetNS
+	if config.NetNSName != "" {
+		handle, handleErr := netns.GetFromName(config.NetNSName)
+		if handleErr != nil {
+			return nil, fmt.Errorf("failed to open network namespace %s: %w", config.NetNSName, handleErr)
+		}
+		defer handle.Close()
+		fd = int(handle)
+	}
+
+	// A lasting connection opens its socket in the namespace right away, so
+	// the namespace fd is not needed afterwards.
+	connOpts := []nftables.ConnOption{nftables.AsLasting()}
+	if fd > 0 {
+		connOpts = append(connOpts, nftables.WithNetNSFd(fd))
+	}
+	conn, connErr := nftables.New(connOpts...)
+	if connErr != nil {
+		return nil, connErr
+	}
+	if fd <= 0 {
+		return &Firewall{conn: conn, owned: conn, ct: getConntrack()}, nil
+	}
+	ct, ctErr := conntrack.New(conntrack.WithNetNS(fd))
+	if ctErr != nil {
+		conn.CloseLasting()
+		return nil, ctErr
+	}
+	return &Firewall{conn: conn, owned: conn, ct: ct, ownedCT: ct}, nil
+}
+
+// Close releases the netlink sockets opened by New
+func (f *Firewall) Close() error {
+	if f.ownedCT != nil {
+		f.ownedCT.Close()
+	}
+	if f.owned == nil {
+		return nil
+	}
+	return f.owned.CloseLasting()
+}
+
+// Conn returns the connection of the Firewall
+func (f *Firewall) Conn() Conn {
+	return f.conn
+}
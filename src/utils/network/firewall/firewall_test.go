@@ -0,0 +1,62 @@
+//go:build linux
+
+package firewall
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/q-controller/network-utils/src/utils/network/firewall/fake"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+// noNftablesConn behaves like a kernel without nf_tables, which rejects the
+// messages of the subsystem as invalid
+type noNftablesConn struct {
+	*fake.Conn
+}
+
+func (noNftablesConn) ListTables() ([]*nftables.Table, error) {
+	return nil, fmt.Errorf("netlink receive: %w", unix.EINVAL)
+}
+
+func TestFirewall_NamespacesAreIndependent(t *testing.T) {
+	host := useFakeConn(t)
+	nsConn := fake.NewConn()
+	ns, err := New(WithConnection(nsConn))
+	require.NoError(t, err)
+	defer ns.Close()
+
+	require.NoError(t, ns.Reconcile(BridgeRuleset(DefaultPrefix, "eth0", "br0")))
+	require.Equal(t, 0, host.Flushes)
+
+	tagged, err := ns.ListTaggedRules(Tag{Bridge: "br0"})
+	require.NoError(t, err)
+	require.NotEmpty(t, tagged)
+
+	tagged, err = ListTaggedRules(Tag{Bridge: "br0"})
+	require.NoError(t, err)
+	require.Empty(t, tagged)
+
+	// Builders resolve chains in the namespace of their Firewall
+	_, err = NewRules(PortRule(22, "tcp", DefaultPrefix+InputChain, FilterTable))
+	require.Error(t, err)
+	rules, err := ns.NewRules(PortRule(22, "tcp", DefaultPrefix+InputChain, FilterTable))
+	require.NoError(t, err)
+	require.NoError(t, ns.AddRules(rules))
+	require.Len(t, liveRules(t, nsConn, DefaultPrefix+InputChain, FilterTable), 7)
+}
+
+func TestFirewall_Unavailable(t *testing.T) {
+	fw, err := New(WithConnection(noNftablesConn{fake.NewConn()}))
+	require.NoError(t, err)
+
+	err = fw.Reconcile(TapTeardown(DefaultPrefix, "tap0"))
+	require.ErrorIs(t, err, ErrUnavailable)
+	require.ErrorIs(t, err, unix.EINVAL)
+
+	_, err = fw.Export(DefaultPrefix)
+	require.ErrorIs(t, err, ErrUnavailable)
+}
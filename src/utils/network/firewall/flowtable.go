@@ -0,0 +1,172 @@
+//go:build linux
+
+package firewall
+
+import (
+	"errors"
+	"slices"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+)
+
+// FlowtableConfig describes a flowtable of a table that offloads the
+// connections between Devices. With Absent it must not exist.
+type FlowtableConfig struct {
+	Name    string
+	Table   string
+	Devices []string
+	Absent  bool
+}
+
+// offloadChain returns the base chain holding the flow offload rules of prefix
+func offloadChain(prefix string) string {
+	return prefix + "OFFLOAD"
+}
+
+// bridgeFlowtable returns the flowtable of bridgeName
+func bridgeFlowtable(prefix, bridgeName string) string {
+	return prefix + "FT-" + bridgeName
+}
+
+// offloadChainConfig returns the base chain of the flow offload rules. It sees
+// forwarded packets right before the filter chains, so established
+// connections are offloaded no matter which rule accepts them.
+func offloadChainConfig(prefix string) ChainConfig {
+	return ChainConfig{
+		Name:     offloadChain(prefix),
+		Table:    FilterTable,
+		Create:   true,
+		Type:     &[]nftables.ChainType{nftables.ChainTypeFilter}[0],
+		Hook:     nftables.ChainHookForward,
+		Priority: nftables.ChainPriorityRef(*nftables.ChainPriorityFilter - 1),
+		Policy:   getChainPolicyAccept(),
+	}
+}
+
+// FlowOffloadRule adds established connections from inIf to outIf to the
+// flowtable, so their packets bypass the forward path from then on
+func FlowOffloadRule(chainName, tableName, inIf, outIf, flowtable string) NewRule {
+	return func(rules *Rules) error {
+		chain, table, chainErr := rules.chain(chainName, tableName)
+		if chainErr != nil {
+			return chainErr
+		}
+
+		exprs := []expr.Any{
+			// [ meta load iifname => reg 1 ]
+			&expr.Meta{Key: expr.MetaKeyIIFNAME, Register: 1},
+			// [ cmp eq reg 1 inIf ]
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte(inIf + "\x00")},
+			// [ meta load oifname => reg 1 ]
+			&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 1},
+			// [ cmp eq reg 1 outIf ]
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte(outIf + "\x00")},
+		}
+		exprs = append(exprs, ctState(expr.CtStateBitESTABLISHED)...)
+		// [ flow_offload flowtable ]
+		exprs = append(exprs, &expr.FlowOffload{Name: flowtable})
+
+		rules.rules = append(rules.rules, &nftables.Rule{
+			Table: table,
+			Chain: chain,
+			Exprs: exprs,
+		})
+		return nil
+	}
+}
+
+func (s *snapshot) flowtablesOf(table *nftables.Table) ([]*nftables.Flowtable, error) {
+	key := tableKeyOf(table)
+	if flowtables, ok := s.flowtables[key]; ok {
+		return flowtables, nil
+	}
+
+	var flowtables []*nftables.Flowtable
+	if s.live[key] && s.conn != nil {
+		listed, listErr := s.conn.ListFlowtables(table)
+		if listErr != nil {
+			return nil, listErr
+		}
+		flowtables = listed
+	}
+	s.flowtables[key] = flowtables
+	return flowtables, nil
+}
+
+// addFlowtable plans the creation of a flowtable. A live flowtable with other
+// devices is deleted and created again, because devices cannot be removed
+// from a flowtable.
+func (s *snapshot) addFlowtable(p *Plan, config FlowtableConfig) error {
+	table, tableErr := s.resolveTable(config.Table)
+	if tableErr != nil {
+		return tableErr
+	}
+	flowtables, listErr := s.flowtablesOf(table)
+	if listErr != nil {
+		return listErr
+	}
+
+	if i := slices.IndexFunc(flowtables, func(ft *nftables.Flowtable) bool { return ft.Name == config.Name }); i >= 0 {
+		if sameDevices(flowtables[i].Devices, config.Devices) {
+			return nil
+		}
+		if err := s.deleteFlowtable(p, config); err != nil {
+			return err
+		}
+		flowtables = s.flowtables[tableKeyOf(table)]
+	}
+
+	flowtable := &nftables.Flowtable{
+		Table:    table,
+		Name:     config.Name,
+		Hooknum:  nftables.FlowtableHookIngress,
+		Priority: nftables.FlowtablePriorityFilter,
+		Devices:  slices.Clone(config.Devices),
+	}
+	s.flowtables[tableKeyOf(table)] = append(flowtables, flowtable)
+	p.Operations = append(p.Operations, Operation{Kind: OpAddFlowtable, Flowtable: flowtable})
+	return nil
+}
+
+// deleteFlowtable plans the deletion of a flowtable and of the rules
+// offloading to it. Missing flowtables are deleted already.
+func (s *snapshot) deleteFlowtable(p *Plan, config FlowtableConfig) error {
+	table, tableErr := s.resolveTable(config.Table)
+	if errors.Is(tableErr, errNotExist) {
+		return nil
+	}
+	if tableErr != nil {
+		return tableErr
+	}
+	flowtables, listErr := s.flowtablesOf(table)
+	if listErr != nil {
+		return listErr
+	}
+	i := slices.IndexFunc(flowtables, func(ft *nftables.Flowtable) bool { return ft.Name == config.Name })
+	if i < 0 {
+		return nil
+	}
+
+	for _, chain := range s.chains {
+		if chain.Table.Name != table.Name || chain.Table.Family != table.Family {
+			continue
+		}
+		if err := s.deleteWhere(p, chain, func(er *nftables.Rule) bool {
+			return slices.ContainsFunc(er.Exprs, func(e expr.Any) bool {
+				offload, ok := e.(*expr.FlowOffload)
+				return ok && offload.Name == config.Name
+			})
+		}); err != nil {
+			return err
+		}
+	}
+
+	p.Operations = append(p.Operations, Operation{Kind: OpDeleteFlowtable, Flowtable: flowtables[i]})
+	s.flowtables[tableKeyOf(table)] = slices.Delete(slices.Clone(flowtables), i, i+1)
+	return nil
+}
+
+func sameDevices(a, b []string) bool {
+	return slices.Equal(slices.Sorted(slices.Values(a)), slices.Sorted(slices.Values(b)))
+}
@@ -0,0 +1,56 @@
+//go:build linux
+
+package firewall
+
+import (
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/stretchr/testify/require"
+)
+
+func flowtableDevices(t *testing.T, conn Conn) map[string][]string {
+	flowtables, err := conn.ListFlowtables(&nftables.Table{Name: FilterTable, Family: nftables.TableFamilyINet})
+	require.NoError(t, err)
+	result := map[string][]string{}
+	for _, ft := range flowtables {
+		result[ft.Name] = ft.Devices
+	}
+	return result
+}
+
+func TestBridgeRuleset_FlowOffload(t *testing.T) {
+	conn := useFakeConn(t)
+	require.NoError(t, Reconcile(BridgeRuleset(DefaultPrefix, "eth0", "br0", WithFlowOffload())))
+
+	flowtable := bridgeFlowtable(DefaultPrefix, "br0")
+	require.Equal(t, map[string][]string{flowtable: {"br0", "eth0"}}, flowtableDevices(t, conn))
+	require.Len(t, liveRules(t, conn, offloadChain(DefaultPrefix), FilterTable), 2)
+
+	flushes := conn.Flushes
+	require.NoError(t, Reconcile(BridgeRuleset(DefaultPrefix, "eth0", "br0", WithFlowOffload())))
+	require.Equal(t, flushes, conn.Flushes)
+
+	// A new uplink needs a new flowtable, devices cannot be removed
+	require.NoError(t, ConfigureFirewall("eth0", "wlan0", "br0", WithFlowOffload()))
+	require.Equal(t, map[string][]string{flowtable: {"br0", "wlan0"}}, flowtableDevices(t, conn))
+	require.Len(t, liveRules(t, conn, offloadChain(DefaultPrefix), FilterTable), 2)
+
+	require.NoError(t, Reconcile(BridgeRuleset(DefaultPrefix, "wlan0", "br0")))
+	require.Empty(t, flowtableDevices(t, conn))
+	require.NotContains(t, chainNames(t, conn), offloadChain(DefaultPrefix))
+}
+
+func TestBridgeTeardown_RemovesFlowtable(t *testing.T) {
+	conn := useFakeConn(t)
+	require.NoError(t, Reconcile(BridgeRuleset(DefaultPrefix, "eth0", "br0", WithFlowOffload())))
+	require.NoError(t, Reconcile(BridgeRuleset(DefaultPrefix, "eth1", "br1", WithFlowOffload())))
+
+	require.NoError(t, Reconcile(BridgeTeardown(DefaultPrefix, "eth0", "br0")))
+	require.Equal(t, map[string][]string{bridgeFlowtable(DefaultPrefix, "br1"): {"br1", "eth1"}}, flowtableDevices(t, conn))
+	require.Contains(t, chainNames(t, conn), offloadChain(DefaultPrefix))
+
+	require.NoError(t, PurgePrefix(DefaultPrefix))
+	require.Empty(t, flowtableDevices(t, conn))
+	require.NotContains(t, chainNames(t, conn), offloadChain(DefaultPrefix))
+}
@@ -5,15 +5,13 @@ package firewall
 
 import (
 	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
 	"github.com/google/nftables/expr"
 )
 
 func ForwardOutboundRule(chainName, tableName, hostIf, internalIf string) NewRule {
 	return func(rules *Rules) error {
-		chain, table, chainErr := NewChain(
-			WithName(chainName),
-			WithinTable(tableName),
-		)
+		chain, table, chainErr := rules.chain(chainName, tableName)
 		if chainErr != nil {
 			return chainErr
 		}
@@ -42,10 +40,7 @@ func ForwardOutboundRule(chainName, tableName, hostIf, internalIf string) NewRul
 
 func ForwardReturnTrafficRule(chainName, tableName, hostIf, internalIf string) NewRule {
 	return func(rules *Rules) error {
-		chain, table, chainErr := NewChain(
-			WithName(chainName),
-			WithinTable(tableName),
-		)
+		chain, table, chainErr := rules.chain(chainName, tableName)
 		if chainErr != nil {
 			return chainErr
 		}
@@ -71,3 +66,139 @@ func ForwardReturnTrafficRule(chainName, tableName, hostIf, internalIf string) N
 		return nil
 	}
 }
+
+// ctState returns the expressions matching connections in any of the given
+// conntrack states
+func ctState(states uint32) []expr.Any {
+	return []expr.Any{
+		// [ ct load state => reg 1 ]
+		&expr.Ct{Register: 1, Key: expr.CtKeySTATE},
+		// [ bitwise reg 1 = (reg 1 & states) ^ 0 ]
+		&expr.Bitwise{
+			SourceRegister: 1,
+			DestRegister:   1,
+			Len:            4,
+			Mask:           binaryutil.NativeEndian.PutUint32(states),
+			Xor:            binaryutil.NativeEndian.PutUint32(0),
+		},
+		// [ cmp neq reg 1 0 ]
+		&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(0)},
+	}
+}
+
+// ForwardEstablishedRule accepts traffic from hostIf to internalIf only if it
+// belongs to a connection that was opened from internalIf.
+func ForwardEstablishedRule(chainName, tableName, hostIf, internalIf string) NewRule {
+	return func(rules *Rules) error {
+		chain, table, chainErr := rules.chain(chainName, tableName)
+		if chainErr != nil {
+			return chainErr
+		}
+
+		exprs := []expr.Any{
+			// [ meta load iifname => reg 1 ]
+			&expr.Meta{Key: expr.MetaKeyIIFNAME, Register: 1},
+			// [ cmp eq reg 1 interfaceB ]
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte(hostIf + "\x00")},
+			// [ meta load oifname => reg 1 ]
+			&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 1},
+			// [ cmp eq reg 1 interfaceA ]
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte(internalIf + "\x00")},
+		}
+		exprs = append(exprs, ctState(expr.CtStateBitESTABLISHED|expr.CtStateBitRELATED)...)
+		// [ immediate verdict ACCEPT ]
+		exprs = append(exprs, &expr.Verdict{Kind: expr.VerdictAccept})
+
+		rules.rules = append(rules.rules, &nftables.Rule{
+			Table: table,
+			Chain: chain,
+			Exprs: exprs,
+		})
+		return nil
+	}
+}
+
+// notCtState returns the expressions matching packets in none of the given
+// conntrack states
+func notCtState(states uint32) []expr.Any {
+	exprs := ctState(states)
+	// [ cmp eq reg 1 0 ]
+	exprs[len(exprs)-1] = &expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(0)}
+	return exprs
+}
+
+// forwardInterfaces returns the expressions matching packets forwarded from
+// inIf to outIf
+func forwardInterfaces(inIf, outIf string) []expr.Any {
+	return []expr.Any{
+		// [ meta load iifname => reg 1 ]
+		&expr.Meta{Key: expr.MetaKeyIIFNAME, Register: 1},
+		// [ cmp eq reg 1 interfaceB ]
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte(inIf + "\x00")},
+		// [ meta load oifname => reg 1 ]
+		&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 1},
+		// [ cmp eq reg 1 interfaceA ]
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte(outIf + "\x00")},
+	}
+}
+
+// ForwardDropInvalidRule drops invalid and untracked packets from hostIf to
+// internalIf. They have no conntrack status ForwardDropNewRule could check for
+// destination NAT, so it does not match them.
+func ForwardDropInvalidRule(chainName, tableName, hostIf, internalIf string) NewRule {
+	return func(rules *Rules) error {
+		chain, table, chainErr := rules.chain(chainName, tableName)
+		if chainErr != nil {
+			return chainErr
+		}
+
+		exprs := append(forwardInterfaces(hostIf, internalIf), ctState(expr.CtStateBitINVALID|expr.CtStateBitUNTRACKED)...)
+		// [ immediate verdict DROP ]
+		exprs = append(exprs, &expr.Verdict{Kind: expr.VerdictDrop})
+
+		rules.rules = append(rules.rules, &nftables.Rule{
+			Table: table,
+			Chain: chain,
+			Exprs: exprs,
+		})
+		return nil
+	}
+}
+
+// ForwardDropNewRule drops everything from hostIf to internalIf that does not
+// belong to a connection opened from internalIf, so hosts on the uplink cannot
+// reach guests directly. Connections to published ports were destination-NATed
+// and are left alone.
+func ForwardDropNewRule(chainName, tableName, hostIf, internalIf string) NewRule {
+	return func(rules *Rules) error {
+		chain, table, chainErr := rules.chain(chainName, tableName)
+		if chainErr != nil {
+			return chainErr
+		}
+
+		exprs := append(forwardInterfaces(hostIf, internalIf), notCtState(expr.CtStateBitESTABLISHED|expr.CtStateBitRELATED)...)
+		exprs = append(exprs,
+			// [ ct load status => reg 1 ]
+			&expr.Ct{Register: 1, Key: expr.CtKeySTATUS},
+			// [ bitwise reg 1 = (reg 1 & dnat) ^ 0 ]
+			&expr.Bitwise{
+				SourceRegister: 1,
+				DestRegister:   1,
+				Len:            4,
+				Mask:           binaryutil.NativeEndian.PutUint32(ipsDstNAT),
+				Xor:            binaryutil.NativeEndian.PutUint32(0),
+			},
+			// [ cmp eq reg 1 0 ]
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(0)},
+			// [ immediate verdict DROP ]
+			&expr.Verdict{Kind: expr.VerdictDrop},
+		)
+
+		rules.rules = append(rules.rules, &nftables.Rule{
+			Table: table,
+			Chain: chain,
+			Exprs: exprs,
+		})
+		return nil
+	}
+}
@@ -0,0 +1,200 @@
+//go:build linux
+
+package firewall
+
+import (
+	"fmt"
+	"net"
+	"slices"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+// Guest is the identity a tap is pinned to: the MAC address of its guest and
+// the IPv4 and IPv6 addresses assigned to it, e.g. by the DHCP server.
+type Guest struct {
+	MAC   net.HardwareAddr
+	Addrs []net.IP
+}
+
+// guardChain returns the chain checking the frames sent by the guest of tap
+func guardChain(prefix, tap string) string {
+	return prefix + "GUARD-" + tap
+}
+
+// guardMap returns the verdict map from the input interface of a frame to the
+// guard chain of its tap
+func guardMap(prefix string) string {
+	return prefix + "TAP-GUARD"
+}
+
+// etherSource returns the expressions matching the source MAC of a frame
+func etherSource(mac net.HardwareAddr) []expr.Any {
+	return []expr.Any{
+		// [ payload load 6b @ link header + 6 => reg 1 ]
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseLLHeader, Offset: 6, Len: 6},
+		// [ cmp eq reg 1 mac ]
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte(mac)},
+	}
+}
+
+// arpSender returns the expressions matching the sender hardware and IPv4
+// address of an ARP packet
+func arpSender(mac net.HardwareAddr, ip net.IP) []expr.Any {
+	return append(etherType(unix.ETH_P_ARP),
+		// [ payload load 6b @ network header + 8 => reg 1 ]
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 8, Len: 6},
+		// [ cmp eq reg 1 mac ]
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte(mac)},
+		// [ payload load 4b @ network header + 14 => reg 1 ]
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 14, Len: 4},
+		// [ cmp eq reg 1 ip ]
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte(ip.To4())},
+	)
+}
+
+// hostPrefix returns the prefix holding only ip
+func hostPrefix(ip net.IP) *net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip.To16(), Mask: net.CIDRMask(128, 128)}
+}
+
+// linkLocal returns the IPv6 link-local address derived from mac (RFC 4291,
+// modified EUI-64)
+func linkLocal(mac net.HardwareAddr) net.IP {
+	ip := net.ParseIP("fe80::")
+	ip[8] = mac[0] ^ 0x02
+	copy(ip[9:11], mac[1:3])
+	ip[11], ip[12] = 0xff, 0xfe
+	copy(ip[13:16], mac[3:6])
+	return ip
+}
+
+// GuardRules returns the rules that only let the guest of tap send frames
+// with its own MAC address and, if the guest has addresses, only ARP and IP
+// packets from these addresses. DHCP requests and the unspecified address of
+// duplicate address detection are allowed as well, and so is the link-local
+// address derived from the MAC unless the addresses include a link-local one.
+// Every other frame is dropped.
+func GuardRules(prefix, tap string, guest Guest) ([]NewRule, error) {
+	if len(guest.MAC) != 6 {
+		return nil, fmt.Errorf("invalid MAC address %q of tap %s", guest.MAC, tap)
+	}
+	chain := guardChain(prefix, tap)
+	tag := func(role string, rule NewRule) NewRule {
+		return Tagged(Tag{Tap: tap, Role: role}, rule)
+	}
+	allow := func(match ...[]expr.Any) NewRule {
+		exprs := etherSource(guest.MAC)
+		for _, m := range match {
+			exprs = append(exprs, m...)
+		}
+		return tag(RoleGuard, returnRule(chain, TapTable, exprs))
+	}
+
+	var rules []NewRule
+	if len(guest.Addrs) == 0 {
+		// Only the MAC address is pinned
+		rules = append(rules,
+			allow(etherType(unix.ETH_P_IP)),
+			allow(etherType(unix.ETH_P_IPV6)),
+			allow(etherType(unix.ETH_P_ARP), []expr.Any{
+				// [ payload load 6b @ network header + 8 => reg 1 ]
+				&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 8, Len: 6},
+				// [ cmp eq reg 1 mac ]
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte(guest.MAC)},
+			}),
+		)
+	}
+
+	dhcp, dhcpErr := destinationPort("udp", 67)
+	if dhcpErr != nil {
+		return nil, dhcpErr
+	}
+	unspecified4, _ := etherPrefix(hostPrefix(net.IPv4zero), true)
+	unspecified6, _ := etherPrefix(hostPrefix(net.IPv6unspecified), true)
+	rules = append(rules,
+		// ARP probes and DHCP requests are sent before the guest has an address
+		allow(arpSender(guest.MAC, net.IPv4zero)),
+		allow(unspecified4, dhcp),
+		allow(unspecified6),
+	)
+	addrs := guest.Addrs
+	if !slices.ContainsFunc(addrs, func(ip net.IP) bool { return ip.To4() == nil && ip.IsLinkLocalUnicast() }) {
+		addrs = append(slices.Clone(addrs), linkLocal(guest.MAC))
+	}
+	for _, ip := range addrs {
+		match, matchErr := etherPrefix(hostPrefix(ip), true)
+		if matchErr != nil {
+			return nil, matchErr
+		}
+		rules = append(rules, allow(match))
+		if ip.To4() != nil {
+			rules = append(rules, allow(arpSender(guest.MAC, ip)))
+		}
+	}
+	return append(rules, tag(RoleGuardDrop, TapDropRule(chain, TapTable))), nil
+}
+
+// guardTags returns the tags of the rules created by GuardRules
+func guardTags(tap string) []Tag {
+	return []Tag{{Tap: tap, Role: RoleGuard}, {Tap: tap, Role: RoleGuardDrop}}
+}
+
+// GuardRuleset returns the desired state pinning tap to guest. Frames entering
+// the bridge from tap reach its guard chain through a verdict map.
+func GuardRuleset(prefix, tap string, guest Guest) (*Ruleset, error) {
+	rules, rulesErr := GuardRules(prefix, tap, guest)
+	if rulesErr != nil {
+		return nil, rulesErr
+	}
+
+	table := StandardTapTable
+	table.Chains = append(slices.Clone(StandardTapTable.Chains), ChainConfig{Name: guardChain(prefix, tap), Table: TapTable, Create: true})
+	dispatch := Tagged(Tag{Role: RoleTapDispatch}, InterfaceMapRule(PreroutingChain, TapTable, expr.MetaKeyIIFNAME, guardMap(prefix)))
+	return &Ruleset{
+		Tables: []TableConfig{table},
+		Sets: []SetConfig{
+			{Name: guardMap(prefix), Table: TapTable, KeyType: nftables.TypeIFName, DataType: nftables.TypeVerdict, IsMap: true},
+		},
+		Present: append([]NewRule{dispatch}, rules...),
+		Prune:   guardTags(tap),
+		Elements: []SetElements{{
+			Set:   guardMap(prefix),
+			Table: TapTable,
+			Elements: []nftables.SetElement{{
+				Key:         ifnameKey(tap),
+				VerdictData: &expr.Verdict{Kind: expr.VerdictJump, Chain: guardChain(prefix, tap)},
+			}},
+		}},
+	}, nil
+}
+
+// GuardTeardown returns the desired state without the guard chain of tap
+func GuardTeardown(prefix, tap string) *Ruleset {
+	return &Ruleset{
+		Prune: guardTags(tap),
+		Elements: []SetElements{{
+			Set:      guardMap(prefix),
+			Table:    TapTable,
+			Elements: []nftables.SetElement{{Key: ifnameKey(tap)}},
+			Absent:   true,
+		}},
+		Retire: []Jump{{To: guardChain(prefix, tap), Table: TapTable}},
+	}
+}
+
+// TapTeardown returns the desired state without the guard and the limit chain
+// of tap, so both are removed in one transaction
+func TapTeardown(prefix, tap string) *Ruleset {
+	guard, limit := GuardTeardown(prefix, tap), TapLimitTeardown(prefix, tap)
+	return &Ruleset{
+		Prune:    append(guard.Prune, limit.Prune...),
+		Elements: append(guard.Elements, limit.Elements...),
+		Retire:   append(guard.Retire, limit.Retire...),
+	}
+}
@@ -0,0 +1,101 @@
+//go:build linux
+
+package firewall
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/google/nftables/expr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGuardRuleset(t *testing.T) {
+	conn := useFakeConn(t)
+	mac, err := net.ParseMAC("2e:c8:40:59:7d:16")
+	require.NoError(t, err)
+
+	desired, err := GuardRuleset(DefaultPrefix, "tap0", Guest{MAC: mac, Addrs: []net.IP{net.ParseIP("192.168.26.10")}})
+	require.NoError(t, err)
+	require.NoError(t, Reconcile(desired))
+
+	chain := guardChain(DefaultPrefix, "tap0")
+	require.Equal(t, map[string]string{"tap0": chain}, mapTargets(t, conn, guardMap(DefaultPrefix)))
+	require.Len(t, liveRules(t, conn, PreroutingChain, TapTable), 1)
+	// ARP probe, DHCP, DAD, the address and its ARP, the link-local address
+	// and the drop
+	rules := liveRules(t, conn, chain, TapTable)
+	require.Len(t, rules, 7)
+
+	// A new address replaces the old one in front of the drop
+	desired, err = GuardRuleset(DefaultPrefix, "tap0", Guest{MAC: mac, Addrs: []net.IP{net.ParseIP("192.168.26.11")}})
+	require.NoError(t, err)
+	require.NoError(t, Reconcile(desired))
+	rules = liveRules(t, conn, chain, TapTable)
+	require.Len(t, rules, 7)
+	last := rules[len(rules)-1].Exprs
+	require.Equal(t, &expr.Verdict{Kind: expr.VerdictDrop}, last[len(last)-1])
+
+	require.NoError(t, Reconcile(GuardTeardown(DefaultPrefix, "tap0")))
+	require.NotContains(t, chainNames(t, conn), chain)
+	require.Empty(t, mapTargets(t, conn, guardMap(DefaultPrefix)))
+
+	// Tearing down a tap without guard chain is a no-op
+	flushes := conn.Flushes
+	require.NoError(t, Reconcile(GuardTeardown(DefaultPrefix, "tap1")))
+	require.Equal(t, flushes, conn.Flushes)
+}
+
+func TestGuardRules_InvalidMAC(t *testing.T) {
+	_, err := GuardRules(DefaultPrefix, "tap0", Guest{})
+	require.Error(t, err)
+}
+
+func TestGuardRules_LinkLocal(t *testing.T) {
+	mac, err := net.ParseMAC("2e:c8:40:59:7d:16")
+	require.NoError(t, err)
+	require.Equal(t, net.ParseIP("fe80::2cc8:40ff:fe59:7d16"), linkLocal(mac))
+
+	conn := useFakeConn(t)
+	sources := func(guest Guest) []string {
+		desired, err := GuardRuleset(DefaultPrefix, "tap0", guest)
+		require.NoError(t, err)
+		require.NoError(t, Reconcile(desired))
+		var texts []string
+		for _, r := range liveRules(t, conn, guardChain(DefaultPrefix, "tap0"), TapTable) {
+			text, err := RenderExprs(r.Exprs, r.Table.Family)
+			require.NoError(t, err)
+			texts = append(texts, text)
+		}
+		return texts
+	}
+
+	// Only the link-local address derived from the MAC is allowed
+	texts := sources(Guest{MAC: mac, Addrs: []net.IP{net.ParseIP("192.168.26.10")}})
+	require.Contains(t, strings.Join(texts, "\n"), "ip6 saddr fe80::2cc8:40ff:fe59:7d16/128 ")
+	require.NotContains(t, strings.Join(texts, "\n"), "fe80::/10")
+
+	// A configured link-local address replaces it
+	texts = sources(Guest{MAC: mac, Addrs: []net.IP{net.ParseIP("fe80::26")}})
+	require.Contains(t, strings.Join(texts, "\n"), "ip6 saddr fe80::26/128 ")
+	require.NotContains(t, strings.Join(texts, "\n"), "fe80::2cc8:40ff:fe59:7d16")
+}
+
+func TestTapTeardown(t *testing.T) {
+	conn := useFakeConn(t)
+	mac, err := net.ParseMAC("2e:c8:40:59:7d:16")
+	require.NoError(t, err)
+	desired, err := GuardRuleset(DefaultPrefix, "tap0", Guest{MAC: mac})
+	require.NoError(t, err)
+	require.NoError(t, Reconcile(desired))
+	require.NoError(t, Reconcile(TapLimitRuleset(DefaultPrefix, "tap0", Limits{Packets: 1000})))
+
+	flushes := conn.Flushes
+	require.NoError(t, Reconcile(TapTeardown(DefaultPrefix, "tap0")))
+	require.Equal(t, flushes+1, conn.Flushes)
+	require.NotContains(t, chainNames(t, conn), guardChain(DefaultPrefix, "tap0"))
+	require.NotContains(t, chainNames(t, conn), limitChain(DefaultPrefix, "tap0"))
+	require.Empty(t, mapTargets(t, conn, guardMap(DefaultPrefix)))
+	require.Empty(t, mapTargets(t, conn, limitMap(DefaultPrefix)))
+}
@@ -6,62 +6,43 @@ package firewall
 import (
 	"fmt"
 
-	"github.com/google/nftables"
-	"github.com/google/nftables/expr"
+	"github.com/q-controller/network-utils/src/utils/network/lock"
 )
 
 func AddJumpRule(fromChainName, toChainName, tableName string) error {
-	fromChain, table, fromChainErr := NewChain(
-		WithName(fromChainName),
-		WithinTable(tableName),
-		Create(),
-	)
-	if fromChainErr != nil {
-		return fmt.Errorf("failed to create or get chain %s: %w", fromChainName, fromChainErr)
-	}
-
-	toChain, _, toChainErr := NewChain(
-		WithName(toChainName),
-		WithinTable(tableName),
-		Create(),
-	)
-	if toChainErr != nil {
-		return fmt.Errorf("failed to create or get chain %s: %w", toChainName, toChainErr)
-	}
+	return Host().AddJumpRule(fromChainName, toChainName, tableName)
+}
 
-	rules, rulesErr := getConnection().GetRules(table, fromChain)
-	if rulesErr != nil {
-		return rulesErr
+// AddJumpRule inserts a jump from fromChainName to toChainName at the head of
+// fromChainName unless one exists. Both chains are created if missing. The
+// jump is planned like the Jumps of a Ruleset, so it is tagged and counted.
+func (f *Firewall) AddJumpRule(fromChainName, toChainName, tableName string) error {
+	unlock, lockErr := lock.Acquire()
+	if lockErr != nil {
+		return lockErr
 	}
+	defer unlock()
 
-	// Check if jump to customChain already exists anywhere in FORWARD chain
-	for _, r := range rules {
-		for _, e := range r.Exprs {
-			if jump, ok := e.(*expr.Verdict); ok && jump.Kind == expr.VerdictJump && jump.Chain == toChain.Name {
-				// Jump already present, no insertion needed
-				return nil
-			}
-		}
+	snap, snapErr := loadSnapshot(f.conn)
+	if snapErr != nil {
+		return snapErr
 	}
 
-	var firstRuleHandle uint32
-	if len(rules) > 0 {
-		firstRuleHandle = uint32(rules[0].Handle)
+	plan := &Plan{conn: f.conn}
+	_, table, fromChainErr := snap.ensureChain(plan, ChainConfig{Name: fromChainName, Table: tableName, Create: true})
+	if fromChainErr != nil {
+		return fmt.Errorf("failed to create or get chain %s: %w", fromChainName, fromChainErr)
 	}
-
-	jumpRule := &nftables.Rule{
-		Table: table,
-		Chain: fromChain,
-		Exprs: []expr.Any{
-			&expr.Verdict{Kind: expr.VerdictJump, Chain: toChain.Name},
-		},
+	if _, _, err := snap.ensureChain(plan, ChainConfig{Name: toChainName, Table: tableName, Family: table.Family, Create: true}); err != nil {
+		return fmt.Errorf("failed to create or get chain %s: %w", toChainName, err)
 	}
 
-	if firstRuleHandle != 0 {
-		jumpRule.Handle = uint64(firstRuleHandle)
+	// The chains resolve in the family of the table found above
+	snap.families[tableName] = table.Family
+	jumps, jumpsErr := snap.plan(&Ruleset{Jumps: []Jump{{From: fromChainName, To: toChainName, Table: tableName}}})
+	if jumpsErr != nil {
+		return jumpsErr
 	}
-
-	getConnection().InsertRule(jumpRule)
-
-	return getConnection().Flush()
+	plan.Operations = append(plan.Operations, jumps.Operations...)
+	return plan.Apply()
 }
@@ -0,0 +1,349 @@
+//go:build linux
+
+package firewall
+
+import (
+	"net"
+	"slices"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+// Limits caps the traffic a single guest sends: Packets and Bytes per second
+// and the number of Connections it has open at once. Zero fields do not limit.
+type Limits struct {
+	Packets     uint64
+	Bytes       uint64
+	Connections uint32
+}
+
+// IsZero reports whether l limits nothing
+func (l Limits) IsZero() bool {
+	return l == Limits{}
+}
+
+// limitPacketBurst is the burst of packet rate limits. The kernel reports it
+// for limits created without one, so it is set explicitly.
+const limitPacketBurst = 5
+
+// limitTimeout is how long the rate of a guest address is metered after its
+// last packet
+const limitTimeout = time.Minute
+
+// limitChain returns the chain holding the limits of a bridge or of a tap
+func limitChain(prefix, name string) string {
+	return prefix + "LIMIT-" + name
+}
+
+// limitMap returns the verdict map from the input interface of a frame to the
+// limit chain of its tap
+func limitMap(prefix string) string {
+	return prefix + "TAP-LIMIT"
+}
+
+// limitSet returns the dynamic set metering kind, "pkts", "bytes" or "conns",
+// per source address of family for the guests of bridgeName
+func limitSet(prefix, bridgeName, kind string, family byte) string {
+	name := limitChain(prefix, bridgeName) + "-" + kind
+	if family == unix.NFPROTO_IPV6 {
+		name += "6"
+	}
+	return name
+}
+
+func limitJump(prefix, bridgeName string) Jump {
+	return Jump{From: prefix + ForwardChain, To: limitChain(prefix, bridgeName), Table: FilterTable}
+}
+
+// rateOver returns the limit matching traffic above rate bytes, or packets,
+// per second
+func rateOver(rate uint64, bytes bool) *expr.Limit {
+	if bytes {
+		return &expr.Limit{Type: expr.LimitTypePktBytes, Rate: rate, Over: true, Unit: expr.LimitTimeSecond}
+	}
+	return &expr.Limit{Type: expr.LimitTypePkts, Rate: rate, Over: true, Unit: expr.LimitTimeSecond, Burst: limitPacketBurst}
+}
+
+// connectionsOver returns the connlimit matching more than count connections
+func connectionsOver(count uint32) *expr.Connlimit {
+	return &expr.Connlimit{Count: count, Flags: expr.NFT_CONNLIMIT_F_INV}
+}
+
+// sourceAddress returns the expressions matching packets of family, IPv4 or
+// IPv6, and loading their source address
+func sourceAddress(family byte) []expr.Any {
+	offset, size := uint32(12), uint32(net.IPv4len)
+	if family == unix.NFPROTO_IPV6 {
+		offset, size = 8, net.IPv6len
+	}
+	return []expr.Any{
+		// [ meta load nfproto => reg 1 ]
+		&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+		// [ cmp eq reg 1 family ]
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{family}},
+		// [ payload load source address => reg 1 ]
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: offset, Len: size},
+	}
+}
+
+// SourceRateLimitRule drops the packets of family from bridgeName once their
+// source address sends more than rate bytes, or packets, per second. The rate
+// of every address is metered in the dynamic set setName.
+func SourceRateLimitRule(chainName, tableName, bridgeName, setName string, family byte, rate uint64, bytes bool) NewRule {
+	return func(rules *Rules) error {
+		chain, table, chainErr := rules.chain(chainName, tableName)
+		if chainErr != nil {
+			return chainErr
+		}
+
+		exprs := []expr.Any{
+			// [ meta load iifname => reg 1 ]
+			&expr.Meta{Key: expr.MetaKeyIIFNAME, Register: 1},
+			// [ cmp eq reg 1 bridgeName ]
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte(bridgeName + "\x00")},
+		}
+		exprs = append(exprs, sourceAddress(family)...)
+		exprs = append(exprs,
+			// [ dynset update reg_key 1 set setName timeout limit ]
+			&expr.Dynset{
+				SrcRegKey: 1,
+				SetName:   setName,
+				Operation: unix.NFT_DYNSET_OP_UPDATE,
+				Timeout:   limitTimeout,
+				Exprs:     []expr.Any{rateOver(rate, bytes)},
+			},
+			// [ immediate verdict DROP ]
+			&expr.Verdict{Kind: expr.VerdictDrop},
+		)
+
+		rules.rules = append(rules.rules, &nftables.Rule{
+			Table: table,
+			Chain: chain,
+			Exprs: exprs,
+		})
+		return nil
+	}
+}
+
+// SourceConnectionLimitRule drops new connections of family from bridgeName
+// once their source address has count connections open. The connections of
+// every address are counted in the dynamic set setName.
+func SourceConnectionLimitRule(chainName, tableName, bridgeName, setName string, family byte, count uint32) NewRule {
+	return func(rules *Rules) error {
+		chain, table, chainErr := rules.chain(chainName, tableName)
+		if chainErr != nil {
+			return chainErr
+		}
+
+		exprs := []expr.Any{
+			// [ meta load iifname => reg 1 ]
+			&expr.Meta{Key: expr.MetaKeyIIFNAME, Register: 1},
+			// [ cmp eq reg 1 bridgeName ]
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte(bridgeName + "\x00")},
+		}
+		exprs = append(exprs, ctState(expr.CtStateBitNEW)...)
+		exprs = append(exprs, sourceAddress(family)...)
+		exprs = append(exprs,
+			// [ dynset add reg_key 1 set setName connlimit ]
+			&expr.Dynset{
+				SrcRegKey: 1,
+				SetName:   setName,
+				Operation: unix.NFT_DYNSET_OP_ADD,
+				Exprs:     []expr.Any{connectionsOver(count)},
+			},
+			// [ immediate verdict DROP ]
+			&expr.Verdict{Kind: expr.VerdictDrop},
+		)
+
+		rules.rules = append(rules.rules, &nftables.Rule{
+			Table: table,
+			Chain: chain,
+			Exprs: exprs,
+		})
+		return nil
+	}
+}
+
+// RateLimitRule drops the traffic of a chain above rate bytes, or packets,
+// per second
+func RateLimitRule(chainName, tableName string, rate uint64, bytes bool) NewRule {
+	return func(rules *Rules) error {
+		chain, table, chainErr := rules.chain(chainName, tableName)
+		if chainErr != nil {
+			return chainErr
+		}
+
+		rules.rules = append(rules.rules, &nftables.Rule{
+			Table: table,
+			Chain: chain,
+			Exprs: []expr.Any{
+				// [ limit rate over rate/second ]
+				rateOver(rate, bytes),
+				// [ immediate verdict DROP ]
+				&expr.Verdict{Kind: expr.VerdictDrop},
+			},
+		})
+		return nil
+	}
+}
+
+// ConnectionLimitRule drops new connections of a chain once count
+// connections it saw are open
+func ConnectionLimitRule(chainName, tableName string, count uint32) NewRule {
+	return func(rules *Rules) error {
+		chain, table, chainErr := rules.chain(chainName, tableName)
+		if chainErr != nil {
+			return chainErr
+		}
+
+		exprs := ctState(expr.CtStateBitNEW)
+		exprs = append(exprs,
+			// [ connlimit count over count ]
+			connectionsOver(count),
+			// [ immediate verdict DROP ]
+			&expr.Verdict{Kind: expr.VerdictDrop},
+		)
+
+		rules.rules = append(rules.rules, &nftables.Rule{
+			Table: table,
+			Chain: chain,
+			Exprs: exprs,
+		})
+		return nil
+	}
+}
+
+// limitFamilies returns the address families limited per guest address: IPv4
+// and, with dualStack, IPv6
+func limitFamilies(dualStack bool) []byte {
+	if dualStack {
+		return []byte{unix.NFPROTO_IPV4, unix.NFPROTO_IPV6}
+	}
+	return []byte{unix.NFPROTO_IPV4}
+}
+
+// guestLimitSets returns the dynamic sets of the limits of bridgeName. The
+// sets of limits that are off are absent.
+func guestLimitSets(prefix, bridgeName string, limits Limits, dualStack bool) []SetConfig {
+	var sets []SetConfig
+	for _, family := range []byte{unix.NFPROTO_IPV4, unix.NFPROTO_IPV6} {
+		keyType := nftables.TypeIPAddr
+		if family == unix.NFPROTO_IPV6 {
+			keyType = nftables.TypeIP6Addr
+		}
+		off := !slices.Contains(limitFamilies(dualStack), family)
+		sets = append(sets,
+			SetConfig{Name: limitSet(prefix, bridgeName, "pkts", family), Table: FilterTable, KeyType: keyType, Dynamic: true, Timeout: limitTimeout, Absent: off || limits.Packets == 0},
+			SetConfig{Name: limitSet(prefix, bridgeName, "bytes", family), Table: FilterTable, KeyType: keyType, Dynamic: true, Timeout: limitTimeout, Absent: off || limits.Bytes == 0},
+			SetConfig{Name: limitSet(prefix, bridgeName, "conns", family), Table: FilterTable, KeyType: keyType, Dynamic: true, Absent: off || limits.Connections == 0},
+		)
+	}
+	return sets
+}
+
+// GuestLimitRules returns the rules enforcing limits on every guest of
+// bridgeName by its source address, for IPv6 guests as well with dualStack.
+// The rules only see traffic forwarded through the chains of prefix.
+func GuestLimitRules(prefix, bridgeName string, limits Limits, dualStack bool) []NewRule {
+	chain := limitChain(prefix, bridgeName)
+	tag := func(rule NewRule) NewRule {
+		return Tagged(Tag{Bridge: bridgeName, Role: RoleLimit}, rule)
+	}
+
+	var rules []NewRule
+	for _, family := range limitFamilies(dualStack) {
+		if limits.Connections > 0 {
+			rules = append(rules, tag(SourceConnectionLimitRule(chain, FilterTable, bridgeName, limitSet(prefix, bridgeName, "conns", family), family, limits.Connections)))
+		}
+		if limits.Packets > 0 {
+			rules = append(rules, tag(SourceRateLimitRule(chain, FilterTable, bridgeName, limitSet(prefix, bridgeName, "pkts", family), family, limits.Packets, false)))
+		}
+		if limits.Bytes > 0 {
+			rules = append(rules, tag(SourceRateLimitRule(chain, FilterTable, bridgeName, limitSet(prefix, bridgeName, "bytes", family), family, limits.Bytes, true)))
+		}
+	}
+	return rules
+}
+
+// withGuestLimits adds the limit chain of bridgeName, its sets and the jump
+// into it to rs. Without limits the chain and its sets are removed.
+func withGuestLimits(rs *Ruleset, prefix, bridgeName string, limits Limits, dualStack bool) *Ruleset {
+	rs.Sets = append(rs.Sets, guestLimitSets(prefix, bridgeName, limits, dualStack)...)
+	if limits.IsZero() {
+		// The limit chain goes before the prefixed FORWARD chain jumping into it
+		rs.Retire = append([]Jump{limitJump(prefix, bridgeName)}, rs.Retire...)
+		return rs
+	}
+	rs.Tables[0].Chains = append(rs.Tables[0].Chains, ChainConfig{Name: limitChain(prefix, bridgeName), Table: FilterTable, Create: true})
+	rs.Jumps = append(rs.Jumps, limitJump(prefix, bridgeName))
+	return rs
+}
+
+// TapLimitRules returns the rules enforcing limits on the frames tap sends.
+// They see every frame before the bridge forwards it, so frames to other
+// guests of the bridge and to the DHCP and DNS services of the host count
+// towards the limits as well, unlike with GuestLimitRules.
+func TapLimitRules(prefix, tap string, limits Limits) []NewRule {
+	chain := limitChain(prefix, tap)
+	tag := func(rule NewRule) NewRule {
+		return Tagged(Tag{Tap: tap, Role: RoleLimit}, rule)
+	}
+
+	var rules []NewRule
+	if limits.Connections > 0 {
+		rules = append(rules, tag(ConnectionLimitRule(chain, TapTable, limits.Connections)))
+	}
+	if limits.Packets > 0 {
+		rules = append(rules, tag(RateLimitRule(chain, TapTable, limits.Packets, false)))
+	}
+	if limits.Bytes > 0 {
+		rules = append(rules, tag(RateLimitRule(chain, TapTable, limits.Bytes, true)))
+	}
+	return rules
+}
+
+// TapLimitRuleset returns the desired state enforcing limits on the frames
+// tap sends. Frames entering the bridge from tap reach its limit chain through
+// a verdict map. Without limits it is the TapLimitTeardown of tap.
+func TapLimitRuleset(prefix, tap string, limits Limits) *Ruleset {
+	if limits.IsZero() {
+		return TapLimitTeardown(prefix, tap)
+	}
+
+	table := StandardTapTable
+	table.Chains = append(slices.Clone(StandardTapTable.Chains), ChainConfig{Name: limitChain(prefix, tap), Table: TapTable, Create: true})
+	dispatch := Tagged(Tag{Role: RoleTapDispatch}, InterfaceMapRule(PreroutingChain, TapTable, expr.MetaKeyIIFNAME, limitMap(prefix)))
+	return &Ruleset{
+		Tables: []TableConfig{table},
+		Sets: []SetConfig{
+			{Name: limitMap(prefix), Table: TapTable, KeyType: nftables.TypeIFName, DataType: nftables.TypeVerdict, IsMap: true},
+		},
+		Present: append([]NewRule{dispatch}, TapLimitRules(prefix, tap, limits)...),
+		Prune:   []Tag{{Tap: tap, Role: RoleLimit}},
+		Elements: []SetElements{{
+			Set:   limitMap(prefix),
+			Table: TapTable,
+			Elements: []nftables.SetElement{{
+				Key:         ifnameKey(tap),
+				VerdictData: &expr.Verdict{Kind: expr.VerdictJump, Chain: limitChain(prefix, tap)},
+			}},
+		}},
+	}
+}
+
+// TapLimitTeardown returns the desired state without the limit chain of tap
+func TapLimitTeardown(prefix, tap string) *Ruleset {
+	return &Ruleset{
+		Prune: []Tag{{Tap: tap, Role: RoleLimit}},
+		Elements: []SetElements{{
+			Set:      limitMap(prefix),
+			Table:    TapTable,
+			Elements: []nftables.SetElement{{Key: ifnameKey(tap)}},
+			Absent:   true,
+		}},
+		Retire: []Jump{{To: limitChain(prefix, tap), Table: TapTable}},
+	}
+}
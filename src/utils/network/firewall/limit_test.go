@@ -0,0 +1,120 @@
+//go:build linux
+
+package firewall
+
+import (
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func setNames(t *testing.T, conn Conn, tableName string, family nftables.TableFamily) []string {
+	sets, err := conn.GetSets(&nftables.Table{Name: tableName, Family: family})
+	require.NoError(t, err)
+	var names []string
+	for _, set := range sets {
+		names = append(names, set.Name)
+	}
+	return names
+}
+
+func TestBridgeRuleset_GuestLimits(t *testing.T) {
+	conn := useFakeConn(t)
+	limits := Limits{Packets: 1000, Connections: 64}
+	require.NoError(t, Reconcile(BridgeRuleset(DefaultPrefix, "eth0", "br0", WithGuestLimits(limits))))
+
+	chain := limitChain(DefaultPrefix, "br0")
+	forward := liveRules(t, conn, DefaultPrefix+ForwardChain, FilterTable)
+	require.True(t, hasJump(forward[:1], chain))
+	require.Len(t, liveRules(t, conn, chain, FilterTable), 2)
+	require.ElementsMatch(t, []string{chain + "-pkts", chain + "-conns"}, setNames(t, conn, FilterTable, nftables.TableFamilyINet))
+
+	// Listed rules with dynamic set expressions match the desired ones
+	flushes := conn.Flushes
+	require.NoError(t, Reconcile(BridgeRuleset(DefaultPrefix, "eth0", "br0", WithGuestLimits(limits))))
+	require.Equal(t, flushes, conn.Flushes)
+
+	// IPv6 guests are limited with their own sets
+	require.NoError(t, Reconcile(BridgeRuleset(DefaultPrefix, "eth0", "br0", WithGuestLimits(Limits{Bytes: 1 << 20}), WithDualStack())))
+	require.Len(t, liveRules(t, conn, chain, FilterTable), 2)
+	require.ElementsMatch(t, []string{chain + "-bytes", chain + "-bytes6"}, setNames(t, conn, FilterTable, nftables.TableFamilyINet))
+
+	require.NoError(t, Reconcile(BridgeRuleset(DefaultPrefix, "eth0", "br0")))
+	require.NotContains(t, chainNames(t, conn), chain)
+	require.Empty(t, setNames(t, conn, FilterTable, nftables.TableFamilyINet))
+}
+
+func TestBridgeTeardown_GuestLimits(t *testing.T) {
+	conn := useFakeConn(t)
+	require.NoError(t, Reconcile(BridgeRuleset(DefaultPrefix, "eth0", "br0", WithGuestLimits(Limits{Connections: 64}))))
+
+	require.NoError(t, Reconcile(BridgeTeardown(DefaultPrefix, "eth0", "br0")))
+	require.NotContains(t, chainNames(t, conn), limitChain(DefaultPrefix, "br0"))
+	require.NotContains(t, chainNames(t, conn), DefaultPrefix+ForwardChain)
+	require.Empty(t, setNames(t, conn, FilterTable, nftables.TableFamilyINet))
+}
+
+func TestPurgePrefix_GuestLimits(t *testing.T) {
+	conn := useFakeConn(t)
+	require.NoError(t, Reconcile(BridgeRuleset(DefaultPrefix, "eth0", "br0", WithGuestLimits(Limits{Packets: 1000}))))
+
+	require.NoError(t, PurgePrefix(DefaultPrefix))
+	require.NotContains(t, chainNames(t, conn), limitChain(DefaultPrefix, "br0"))
+	require.Empty(t, setNames(t, conn, FilterTable, nftables.TableFamilyINet))
+}
+
+func TestPlan_RenderGuestLimits(t *testing.T) {
+	useFakeConn(t)
+	plan, err := BridgeRuleset(DefaultPrefix, "eth0", "br0", WithGuestLimits(Limits{Packets: 1000, Connections: 64})).Plan()
+	require.NoError(t, err)
+	text, err := plan.Render()
+	require.NoError(t, err)
+
+	require.Contains(t, text, "add set inet filter QEMU-LIMIT-br0-pkts { type ipv4_addr; flags dynamic,timeout; timeout 60s; }\n")
+	require.Contains(t, text, "add set inet filter QEMU-LIMIT-br0-conns { type ipv4_addr; flags dynamic; }\n")
+	require.Contains(t, text, "add rule inet filter QEMU-LIMIT-br0 iifname \"br0\" ct state new meta nfproto ipv4 add @QEMU-LIMIT-br0-conns { ip saddr ct count over 64 } counter drop")
+	require.Contains(t, text, "add rule inet filter QEMU-LIMIT-br0 iifname \"br0\" meta nfproto ipv4 update @QEMU-LIMIT-br0-pkts { ip saddr timeout 60s limit rate over 1000/second burst 5 packets } counter drop")
+}
+
+func TestTapLimitRuleset(t *testing.T) {
+	conn := useFakeConn(t)
+	require.NoError(t, Reconcile(TapLimitRuleset(DefaultPrefix, "tap0", Limits{Bytes: 1 << 20, Connections: 16})))
+
+	chain := limitChain(DefaultPrefix, "tap0")
+	require.Equal(t, map[string]string{"tap0": chain}, mapTargets(t, conn, limitMap(DefaultPrefix)))
+	require.Len(t, liveRules(t, conn, PreroutingChain, TapTable), 1)
+	require.Len(t, liveRules(t, conn, chain, TapTable), 2)
+
+	// A new rate replaces the old one
+	require.NoError(t, Reconcile(TapLimitRuleset(DefaultPrefix, "tap0", Limits{Packets: 500})))
+	rules := liveRules(t, conn, chain, TapTable)
+	require.Len(t, rules, 1)
+	require.Equal(t, rateOver(500, false), rules[0].Exprs[0])
+
+	// Without limits the chain is removed
+	require.NoError(t, Reconcile(TapLimitRuleset(DefaultPrefix, "tap0", Limits{})))
+	require.NotContains(t, chainNames(t, conn), chain)
+	require.Empty(t, mapTargets(t, conn, limitMap(DefaultPrefix)))
+}
+
+func TestGuestLimitRules_Families(t *testing.T) {
+	require.Len(t, GuestLimitRules(DefaultPrefix, "br0", Limits{Packets: 1, Bytes: 1, Connections: 1}, false), 3)
+	require.Len(t, GuestLimitRules(DefaultPrefix, "br0", Limits{Packets: 1, Bytes: 1, Connections: 1}, true), 6)
+	require.Empty(t, GuestLimitRules(DefaultPrefix, "br0", Limits{}, true))
+	require.Equal(t, "QEMU-LIMIT-br0-conns6", limitSet(DefaultPrefix, "br0", "conns", unix.NFPROTO_IPV6))
+}
+
+func TestPlan_RenderTapLimits(t *testing.T) {
+	useFakeConn(t)
+	plan, err := TapLimitRuleset(DefaultPrefix, "tap0", Limits{Packets: 1000, Connections: 16}).Plan()
+	require.NoError(t, err)
+	text, err := plan.Render()
+	require.NoError(t, err)
+
+	// Every frame of the tap is limited, whatever its destination
+	require.Contains(t, text, "add rule bridge taps PREROUTING iifname vmap @QEMU-TAP-LIMIT counter")
+	require.Contains(t, text, "add rule bridge taps QEMU-LIMIT-tap0 ct state new ct count over 16 counter drop")
+	require.Contains(t, text, "add rule bridge taps QEMU-LIMIT-tap0 limit rate over 1000/second burst 5 packets counter drop")
+}
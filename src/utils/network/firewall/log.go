@@ -0,0 +1,134 @@
+//go:build linux
+
+package firewall
+
+import (
+	"slices"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+// DefaultLogGroup is the NFLOG group log rules send packets to
+const DefaultLogGroup uint16 = 100
+
+// logRate is the number of packets per second a log rule sends at most, with
+// a burst of logBurst, so a flood of dropped packets does not flood the log
+const (
+	logRate  = 10
+	logBurst = 5
+)
+
+// LogRule sends packets that reach it to NFLOG group, at most logRate per
+// second, prefixed with the name of the chain. Only packets entering through
+// inIf or leaving through outIf are logged; an empty interface matches any.
+func LogRule(chainName, tableName, inIf, outIf string, group uint16) NewRule {
+	return func(rules *Rules) error {
+		chain, table, chainErr := rules.chain(chainName, tableName)
+		if chainErr != nil {
+			return chainErr
+		}
+
+		var exprs []expr.Any
+		if inIf != "" {
+			exprs = append(exprs,
+				// [ meta load iifname => reg 1 ]
+				&expr.Meta{Key: expr.MetaKeyIIFNAME, Register: 1},
+				// [ cmp eq reg 1 inIf ]
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte(inIf + "\x00")},
+			)
+		}
+		if outIf != "" {
+			exprs = append(exprs,
+				// [ meta load oifname => reg 1 ]
+				&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 1},
+				// [ cmp eq reg 1 outIf ]
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte(outIf + "\x00")},
+			)
+		}
+		exprs = append(exprs, logExprs(chainName, group)...)
+
+		rules.rules = append(rules.rules, &nftables.Rule{
+			Table: table,
+			Chain: chain,
+			Exprs: exprs,
+		})
+		return nil
+	}
+}
+
+// logExprs returns the rate-limited log statement of a log rule
+func logExprs(prefix string, group uint16) []expr.Any {
+	return []expr.Any{
+		// [ limit rate 10/second burst 5 packets ]
+		&expr.Limit{Type: expr.LimitTypePkts, Rate: logRate, Unit: expr.LimitTimeSecond, Burst: logBurst},
+		// [ log prefix prefix group group ]
+		&expr.Log{
+			Key:   1<<unix.NFTA_LOG_GROUP | 1<<unix.NFTA_LOG_PREFIX,
+			Group: group,
+			Data:  []byte(prefix),
+		},
+	}
+}
+
+// Logged precedes every rule of rule that drops packets with a rule sending
+// the same packets to NFLOG group, prefixed with prefix, e.g. the chain and
+// the reason of the drop. The log rules are tagged like the drop rules with
+// the role RoleLog. Drop rules whose match changes state, like limits, are
+// not logged, as the log rule would change it as well.
+func Logged(prefix string, group uint16, rule NewRule) NewRule {
+	return func(rules *Rules) error {
+		start := len(rules.rules)
+		if err := rule(rules); err != nil {
+			return err
+		}
+
+		built := slices.Clone(rules.rules[start:])
+		rules.rules = rules.rules[:start]
+		for _, r := range built {
+			if match, ok := dropMatch(r.Exprs); ok {
+				exprs := append(slices.Clone(match), logExprs(prefix, group)...)
+				logRule := &nftables.Rule{Table: r.Table, Chain: r.Chain, Exprs: exprs}
+				if tag, tagged := RuleTag(r); tagged {
+					tag.Role = RoleLog
+					logRule.UserData = tag.userData()
+					logRule.Exprs = withCounter(logRule.Exprs)
+				}
+				rules.rules = append(rules.rules, logRule)
+			}
+			rules.rules = append(rules.rules, r)
+		}
+		return nil
+	}
+}
+
+// dropMatch returns the match of a rule dropping packets, without its counter.
+// Matches that change state are not returned.
+func dropMatch(exprs []expr.Any) ([]expr.Any, bool) {
+	if len(exprs) == 0 {
+		return nil, false
+	}
+	if v, ok := exprs[len(exprs)-1].(*expr.Verdict); !ok || v.Kind != expr.VerdictDrop {
+		return nil, false
+	}
+
+	var match []expr.Any
+	for _, e := range exprs[:len(exprs)-1] {
+		switch e.(type) {
+		case *expr.Counter:
+		case *expr.Limit, *expr.Connlimit, *expr.Dynset, *expr.Quota:
+			return nil, false
+		default:
+			match = append(match, e)
+		}
+	}
+	return match, true
+}
+
+// isTailRule reports whether rule is one of the fall-through log or catch-all
+// drop rules that have to stay at the end of their chain
+func isTailRule(rule *nftables.Rule) bool {
+	tag, ok := RuleTag(rule)
+	return ok && (tag.Role == RoleLogTail || tag.Role == RoleTapDrop || tag.Role == RoleGuardDrop)
+}
@@ -0,0 +1,107 @@
+//go:build linux
+
+package firewall
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/google/nftables/expr"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogged_BeforeDrops(t *testing.T) {
+	conn := useFakeConn(t)
+	require.NoError(t, Reconcile(BridgeRuleset(DefaultPrefix, "eth0", "br0", WithStatefulForwarding())))
+
+	// Enabling logging later puts every log rule right in front of its drop
+	require.NoError(t, Reconcile(BridgeRuleset(DefaultPrefix, "eth0", "br0", WithStatefulForwarding(), WithLogging(DefaultLogGroup))))
+
+	var roles []string
+	var logs []string
+	for _, r := range liveRules(t, conn, DefaultPrefix+ForwardChain, FilterTable) {
+		tag, _ := RuleTag(r)
+		roles = append(roles, tag.Role)
+		if tag.Role == RoleLog {
+			text, err := RenderExprs(r.Exprs, r.Table.Family)
+			require.NoError(t, err)
+			logs = append(logs, text)
+		}
+	}
+	require.Equal(t, []string{RoleForwardOut, RoleForwardReturn, RoleLog, RoleForwardDrop, RoleLog, RoleForwardDrop, RoleLogTail, RoleLogTail}, roles)
+	require.Equal(t, []string{
+		`iifname "eth0" oifname "br0" ct state invalid,untracked limit rate 10/second burst 5 packets counter log prefix "QEMU-FORWARD drop invalid" group 100`,
+		`iifname "eth0" oifname "br0" ct state != established,related ct status != dnat limit rate 10/second burst 5 packets counter log prefix "QEMU-FORWARD drop new" group 100`,
+	}, logs)
+
+	// Disabling logging prunes the log rules
+	require.NoError(t, Reconcile(BridgeRuleset(DefaultPrefix, "eth0", "br0", WithStatefulForwarding())))
+	tagged, err := ListTaggedRules(Tag{Bridge: "br0", Role: RoleLog})
+	require.NoError(t, err)
+	require.Empty(t, tagged)
+}
+
+func TestLogRule_FallThrough(t *testing.T) {
+	conn := useFakeConn(t)
+	require.NoError(t, Reconcile(BridgeRuleset(DefaultPrefix, "eth0", "br0", WithLogging(DefaultLogGroup))))
+
+	// Without stateful forwarding traffic left to the policy is logged
+	tails := func(chain string) []string {
+		var logs []string
+		for _, r := range liveRules(t, conn, chain, FilterTable) {
+			if tag, _ := RuleTag(r); tag.Role == RoleLogTail {
+				text, err := RenderExprs(r.Exprs, r.Table.Family)
+				require.NoError(t, err)
+				logs = append(logs, text)
+			}
+		}
+		return logs
+	}
+	require.Equal(t, []string{
+		`iifname "br0" limit rate 10/second burst 5 packets counter log prefix "QEMU-FORWARD" group 100`,
+		`oifname "br0" limit rate 10/second burst 5 packets counter log prefix "QEMU-FORWARD" group 100`,
+	}, tails(DefaultPrefix+ForwardChain))
+	require.Equal(t, []string{
+		`iifname "br0" limit rate 10/second burst 5 packets counter log prefix "QEMU-INPUT" group 100`,
+	}, tails(DefaultPrefix+InputChain))
+
+	// Rules added later stay in front of the fall-through log rules, next to
+	// the log rules of the drops
+	require.NoError(t, Reconcile(BridgeRuleset(DefaultPrefix, "eth0", "br0", WithStatefulForwarding(), WithDualStack(), WithLogging(DefaultLogGroup))))
+	var roles []string
+	for _, r := range liveRules(t, conn, DefaultPrefix+ForwardChain, FilterTable) {
+		tag, _ := RuleTag(r)
+		roles = append(roles, tag.Role)
+	}
+	require.Equal(t, []string{RoleForwardOut, RoleForwardReturn, RoleLog, RoleForwardDrop, RoleLog, RoleForwardDrop, RoleLogTail, RoleLogTail}, roles)
+
+	roles = nil
+	for _, r := range liveRules(t, conn, DefaultPrefix+InputChain, FilterTable) {
+		tag, _ := RuleTag(r)
+		roles = append(roles, tag.Role)
+	}
+	require.Equal(t, RoleLogTail, roles[len(roles)-1])
+	require.Contains(t, roles, RoleND)
+
+	// Disabling logging prunes them
+	require.NoError(t, Reconcile(BridgeRuleset(DefaultPrefix, "eth0", "br0")))
+	tagged, err := ListTaggedRules(Tag{Bridge: "br0", Role: RoleLogTail})
+	require.NoError(t, err)
+	require.Empty(t, tagged)
+}
+
+func TestDropMatch(t *testing.T) {
+	drop := &expr.Verdict{Kind: expr.VerdictDrop}
+	match := ctState(expr.CtStateBitNEW)
+
+	got, ok := dropMatch(withCounter(append(slices.Clone(match), drop)))
+	require.True(t, ok)
+	require.Equal(t, match, got)
+
+	// Logging a limit would take from its tokens
+	_, ok = dropMatch(append(slices.Clone(match), rateOver(100, false), drop))
+	require.False(t, ok)
+
+	_, ok = dropMatch(append(slices.Clone(match), &expr.Verdict{Kind: expr.VerdictAccept}))
+	require.False(t, ok)
+}
@@ -4,34 +4,110 @@
 package firewall
 
 import (
+	"bytes"
+	"fmt"
+	"net"
+
 	"github.com/google/nftables"
 	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
 )
 
 func MasqueradeRule(chainName, tableName, interfaceName string) NewRule {
+	return SourceMasqueradeRule(chainName, tableName, interfaceName, nil)
+}
+
+// SourceMasqueradeRule is like MasqueradeRule, restricted to packets coming
+// from source. A nil source matches any address.
+func SourceMasqueradeRule(chainName, tableName, interfaceName string, source *net.IPNet) NewRule {
 	return func(rules *Rules) error {
-		chain, table, chainErr := NewChain(
-			WithName(chainName),
-			WithinTable(tableName),
-		)
+		chain, table, chainErr := rules.chain(chainName, tableName)
 		if chainErr != nil {
 			return chainErr
 		}
+		exprs, matchErr := outgoingFrom(interfaceName, source)
+		if matchErr != nil {
+			return matchErr
+		}
+		// [ immediate verdict MASQUERADE ]
+		exprs = append(exprs, &expr.Masq{})
 
 		masqRule := &nftables.Rule{
 			Table: table,
 			Chain: chain,
-			Exprs: []expr.Any{
-				// [ meta load oifname => reg 1 ]
-				&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 1},
-				// [ cmp eq reg 1 lanInterface ]
-				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte(interfaceName + "\x00")},
-				// [ immediate verdict MASQUERADE ]
-				&expr.Masq{},
-			},
+			Exprs: exprs,
 		}
 
 		rules.rules = append(rules.rules, masqRule)
 		return nil
 	}
 }
+
+// SNATRule translates the source of IPv4 packets leaving through
+// interfaceName to addrMin, or to an address of the pool from addrMin to
+// addrMax. A guest keeps its pool address across connections. Only packets
+// from source are translated; a nil source matches any address.
+func SNATRule(chainName, tableName, interfaceName string, source *net.IPNet, addrMin, addrMax net.IP) NewRule {
+	return func(rules *Rules) error {
+		chain, table, chainErr := rules.chain(chainName, tableName)
+		if chainErr != nil {
+			return chainErr
+		}
+		exprs, matchErr := outgoingFrom(interfaceName, source)
+		if matchErr != nil {
+			return matchErr
+		}
+		minIP := addrMin.To4()
+		if minIP == nil {
+			return fmt.Errorf("SNAT address %s is not an IPv4 address", addrMin)
+		}
+
+		// [ immediate reg 1 addrMin ]
+		exprs = append(exprs, &expr.Immediate{Register: 1, Data: minIP})
+		snat := &expr.NAT{
+			Type:       expr.NATTypeSourceNAT,
+			Family:     unix.NFPROTO_IPV4,
+			RegAddrMin: 1,
+		}
+		if addrMax != nil {
+			maxIP := addrMax.To4()
+			if maxIP == nil || bytes.Compare(maxIP, minIP) < 0 {
+				return fmt.Errorf("invalid SNAT address range %s-%s", addrMin, addrMax)
+			}
+			exprs = append(exprs,
+				// [ immediate reg 2 addrMax ]
+				&expr.Immediate{Register: 2, Data: maxIP},
+			)
+			snat.RegAddrMax = 2
+			snat.Persistent = true
+		}
+		// [ nat snat ip addr_min reg 1 addr_max reg 2 ]
+		exprs = append(exprs, snat)
+
+		rules.rules = append(rules.rules, &nftables.Rule{
+			Table: table,
+			Chain: chain,
+			Exprs: exprs,
+		})
+		return nil
+	}
+}
+
+// outgoingFrom returns the expressions matching packets leaving through
+// interfaceName from source
+func outgoingFrom(interfaceName string, source *net.IPNet) ([]expr.Any, error) {
+	exprs := []expr.Any{
+		// [ meta load oifname => reg 1 ]
+		&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 1},
+		// [ cmp eq reg 1 lanInterface ]
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte(interfaceName + "\x00")},
+	}
+	if source != nil {
+		match, matchErr := sourcePrefix(source)
+		if matchErr != nil {
+			return nil, matchErr
+		}
+		exprs = append(exprs, match...)
+	}
+	return exprs, nil
+}
@@ -4,8 +4,19 @@
 package firewall
 
 import (
+	"fmt"
+	"net"
+
 	"github.com/google/nftables"
 	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+// ICMPv6 types of router and neighbor discovery (RFC 4861)
+const (
+	icmpv6RouterSolicit  = 133
+	icmpv6RouterAdvert   = 134
+	icmpv6NeighborAdvert = 136
 )
 
 // Helper function to convert protocol string to protocol number
@@ -25,58 +36,176 @@ func htons(port uint16) []byte {
 	return []byte{byte(port >> 8), byte(port & 0xff)}
 }
 
+// destinationPort returns the expressions matching the transport protocol and
+// the destination port of a packet, independent of the network protocol.
+func destinationPort(proto string, port uint16) ([]expr.Any, error) {
+	protoNum := protocolNumber(proto)
+	if protoNum == 0 {
+		return nil, fmt.Errorf("unsupported protocol %s", proto)
+	}
+
+	return []expr.Any{
+		// [ meta load l4proto => reg 1 ]
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		// [ cmp eq reg 1 protocol number ]
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{protoNum}},
+		// [ payload load 2b @ transport header + 2 => reg 1 ]
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+		// [ cmp eq reg 1 port number ]
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: htons(port)},
+	}, nil
+}
+
+// sourcePrefix returns the expressions matching the source address of a
+// packet against prefix, for IPv4 as well as IPv6 prefixes.
+func sourcePrefix(prefix *net.IPNet) ([]expr.Any, error) {
+	nfproto := byte(unix.NFPROTO_IPV4)
+	offset := uint32(12) // src IP offset (IPv4)
+	ip := prefix.IP.To4()
+	if ip == nil || len(prefix.Mask) != net.IPv4len {
+		nfproto = unix.NFPROTO_IPV6
+		offset = 8 // src IP offset (IPv6)
+		ip = prefix.IP.To16()
+		if ip == nil || len(prefix.Mask) != net.IPv6len {
+			return nil, fmt.Errorf("invalid source prefix %s", prefix)
+		}
+	}
+	size := uint32(len(ip))
+
+	return []expr.Any{
+		// [ meta load nfproto => reg 1 ]
+		&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+		// [ cmp eq reg 1 family ]
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{nfproto}},
+		// [ payload load src IP => reg 1 ]
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: offset, Len: size},
+		// [ bitwise reg 1 = (reg 1 & mask) ^ 0 ]
+		&expr.Bitwise{
+			SourceRegister: 1,
+			DestRegister:   1,
+			Len:            size,
+			Mask:           []byte(prefix.Mask),
+			Xor:            make([]byte, size),
+		},
+		// [ cmp eq reg 1 network ]
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: ip.Mask(prefix.Mask)},
+	}, nil
+}
+
+// inputInterface returns the expressions matching packets that arrived on the
+// interface name
+func inputInterface(name string) []expr.Any {
+	return []expr.Any{
+		// [ meta load iifname => reg 1 ]
+		&expr.Meta{Key: expr.MetaKeyIIFNAME, Register: 1},
+		// [ cmp eq reg 1 interface ]
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte(name + "\x00")},
+	}
+}
+
+// PortRule accepts packets to port of the given transport protocol. It matches
+// IPv4 and IPv6 packets alike.
 func PortRule(port uint16, proto, chainName, tableName string) NewRule {
+	return SourcePortRule(port, proto, nil, chainName, tableName)
+}
+
+// InterfacePortRule is like PortRule, restricted to packets arriving on iface,
+// e.g. a bridge, so the rule and its counter belong to that interface.
+func InterfacePortRule(port uint16, proto, iface, chainName, tableName string) NewRule {
+	return portRule(port, proto, iface, nil, chainName, tableName)
+}
+
+// SourcePortRule is like PortRule, restricted to packets coming from source.
+// A nil source matches any address.
+func SourcePortRule(port uint16, proto string, source *net.IPNet, chainName, tableName string) NewRule {
+	return portRule(port, proto, "", source, chainName, tableName)
+}
+
+// portRule accepts packets to port arriving on iface from source. An empty
+// iface and a nil source match any.
+func portRule(port uint16, proto, iface string, source *net.IPNet, chainName, tableName string) NewRule {
 	return func(rules *Rules) error {
-		chain, table, chainErr := NewChain(
-			WithName(chainName),
-			WithinTable(tableName),
-		)
+		chain, table, chainErr := rules.chain(chainName, tableName)
 		if chainErr != nil {
 			return chainErr
 		}
 
-		masqRule := &nftables.Rule{
+		var exprs []expr.Any
+		if iface != "" {
+			exprs = append(exprs, inputInterface(iface)...)
+		}
+		if source != nil {
+			match, matchErr := sourcePrefix(source)
+			if matchErr != nil {
+				return matchErr
+			}
+			exprs = append(exprs, match...)
+		}
+
+		match, matchErr := destinationPort(proto, port)
+		if matchErr != nil {
+			return matchErr
+		}
+		exprs = append(exprs, match...)
+		// [ immediate verdict ACCEPT ]
+		exprs = append(exprs, &expr.Verdict{Kind: expr.VerdictAccept})
+
+		rules.rules = append(rules.rules, &nftables.Rule{
 			Table: table,
 			Chain: chain,
-			Exprs: []expr.Any{
-				// [ payload load 4b from network header to reg 1 ] (protocol)
-				&expr.Payload{
-					DestRegister: 1,
-					Base:         expr.PayloadBaseNetworkHeader,
-					Offset:       9, // IP protocol field offset
-					Len:          1,
-				},
-				// [ cmp eq reg 1 protocol number ]
-				&expr.Cmp{
-					Op:       expr.CmpOpEq,
-					Register: 1,
-					Data:     []byte{protocolNumber(proto)},
-				},
-				// [ payload load 2b from transport header port to reg 1 ]
-				&expr.Payload{
-					DestRegister: 1,
-					Base:         expr.PayloadBaseTransportHeader,
-					Offset:       2, // destination port offset
-					Len:          2,
-				},
-				// [ cmp eq reg 1 port number ]
-				&expr.Cmp{
-					Op:       expr.CmpOpEq,
-					Register: 1,
-					Data:     htons(port),
-				},
-				// [ payload load 4b from network header src IP to reg 1 ]
-				&expr.Payload{
-					DestRegister: 1,
-					Base:         expr.PayloadBaseNetworkHeader,
-					Offset:       12, // src IP offset (IPv4)
-					Len:          4,
-				},
-				&expr.Verdict{Kind: expr.VerdictAccept},
-			},
+			Exprs: exprs,
+		})
+		return nil
+	}
+}
+
+// NeighborDiscoveryRule accepts the ICMPv6 router solicitations and the
+// neighbor solicitations and advertisements IPv6 guests need to find the host.
+// Router advertisements are not accepted, so guests cannot pose as routers.
+// An empty iface matches messages arriving on any interface.
+func NeighborDiscoveryRule(chainName, tableName, iface string) NewRule {
+	return func(rules *Rules) error {
+		chain, table, chainErr := rules.chain(chainName, tableName)
+		if chainErr != nil {
+			return chainErr
 		}
 
-		rules.rules = append(rules.rules, masqRule)
+		var exprs []expr.Any
+		if iface != "" {
+			exprs = append(exprs, inputInterface(iface)...)
+		}
+		exprs = append(exprs, neighborDiscovery(false)...)
+		// [ immediate verdict ACCEPT ]
+		exprs = append(exprs, &expr.Verdict{Kind: expr.VerdictAccept})
+
+		rules.rules = append(rules.rules, &nftables.Rule{
+			Table: table,
+			Chain: chain,
+			Exprs: exprs,
+		})
 		return nil
 	}
 }
+
+// neighborDiscovery returns the expressions matching ICMPv6 router and
+// neighbor discovery messages. Router advertisements only match if
+// routerAdvert is set, e.g. for messages sent to guests.
+func neighborDiscovery(routerAdvert bool) []expr.Any {
+	exprs := []expr.Any{
+		// [ meta load l4proto => reg 1 ]
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		// [ cmp eq reg 1 ipv6-icmp ]
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.IPPROTO_ICMPV6}},
+		// [ payload load 1b @ transport header + 0 => reg 1 ] (icmpv6 type)
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 0, Len: 1},
+		// [ cmp gte reg 1 nd-router-solicit ]
+		&expr.Cmp{Op: expr.CmpOpGte, Register: 1, Data: []byte{icmpv6RouterSolicit}},
+		// [ cmp lte reg 1 nd-neighbor-advert ]
+		&expr.Cmp{Op: expr.CmpOpLte, Register: 1, Data: []byte{icmpv6NeighborAdvert}},
+	}
+	if !routerAdvert {
+		// [ cmp neq reg 1 nd-router-advert ]
+		exprs = append(exprs, &expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: []byte{icmpv6RouterAdvert}})
+	}
+	return exprs
+}
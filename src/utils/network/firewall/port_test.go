@@ -0,0 +1,81 @@
+//go:build linux
+
+package firewall
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/nftables/expr"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func buildRules(t *testing.T, newRules ...NewRule) []*Rules {
+	t.Helper()
+	snap := newSnapshot(nil, nil, nil)
+	_, err := snap.plan(&Ruleset{Tables: bridgeTables(DefaultPrefix)})
+	require.NoError(t, err)
+
+	var result []*Rules
+	for _, newRule := range newRules {
+		rules := &Rules{resolve: snap.resolve}
+		require.NoError(t, newRule(rules))
+		result = append(result, rules)
+	}
+	return result
+}
+
+func TestPortRule_NoNetworkHeader(t *testing.T) {
+	built := buildRules(t, PortRule(53, "udp", "QEMU-INPUT", FilterTable))
+	require.Len(t, built[0].rules, 1)
+
+	for _, e := range built[0].rules[0].Exprs {
+		if payload, ok := e.(*expr.Payload); ok {
+			require.Equal(t, expr.PayloadBaseTransportHeader, payload.Base)
+		}
+	}
+	require.Equal(t, &expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1}, built[0].rules[0].Exprs[0])
+}
+
+func TestSourcePortRule_Families(t *testing.T) {
+	_, v4, _ := net.ParseCIDR("192.168.26.0/24")
+	_, v6, _ := net.ParseCIDR("fd00:26::/64")
+	built := buildRules(t,
+		SourcePortRule(53, "udp", v4, "QEMU-INPUT", FilterTable),
+		SourcePortRule(53, "udp", v6, "QEMU-INPUT", FilterTable),
+	)
+
+	tests := []struct {
+		rules   *Rules
+		nfproto byte
+		offset  uint32
+		network []byte
+	}{
+		{built[0], unix.NFPROTO_IPV4, 12, net.ParseIP("192.168.26.0").To4()},
+		{built[1], unix.NFPROTO_IPV6, 8, net.ParseIP("fd00:26::")},
+	}
+
+	for _, tt := range tests {
+		exprs := tt.rules.rules[0].Exprs
+		require.Equal(t, []byte{tt.nfproto}, exprs[1].(*expr.Cmp).Data)
+		require.Equal(t, tt.offset, exprs[2].(*expr.Payload).Offset)
+		require.Equal(t, tt.network, exprs[4].(*expr.Cmp).Data)
+	}
+}
+
+func TestSourcePortRule_InvalidProtocol(t *testing.T) {
+	snap := newSnapshot(nil, nil, nil)
+	_, err := snap.plan(&Ruleset{
+		Tables:  bridgeTables(DefaultPrefix),
+		Present: []NewRule{PortRule(53, "icmp", "QEMU-INPUT", FilterTable)},
+	})
+	require.EqualError(t, err, "unsupported protocol icmp")
+}
+
+func TestNeighborDiscoveryRule_NoRouterAdvertisements(t *testing.T) {
+	built := buildRules(t, NeighborDiscoveryRule("QEMU-INPUT", FilterTable, "br0"))
+	text, err := RenderExprs(built[0].rules[0].Exprs, built[0].rules[0].Table.Family)
+	require.NoError(t, err)
+	require.Equal(t, "iifname \"br0\" meta l4proto icmpv6 icmpv6 type >= 133 icmpv6 type <= 136 icmpv6 type != 134 accept", text)
+}
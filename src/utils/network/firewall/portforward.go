@@ -0,0 +1,222 @@
+//go:build linux
+
+package firewall
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+// ipsDstNAT is the IPS_DST_NAT bit of the conntrack status
+const ipsDstNAT uint32 = 1 << 5
+
+func guestIPv4(guestIP net.IP) ([]byte, error) {
+	ip := guestIP.To4()
+	if ip == nil {
+		return nil, fmt.Errorf("guest IP %s is not an IPv4 address", guestIP)
+	}
+	return ip, nil
+}
+
+// ctStatusDNAT returns the expressions matching connections that were
+// destination-NATed
+func ctStatusDNAT() []expr.Any {
+	return []expr.Any{
+		// [ ct load status => reg 1 ]
+		&expr.Ct{Register: 1, Key: expr.CtKeySTATUS},
+		// [ bitwise reg 1 = (reg 1 & dnat) ^ 0 ]
+		&expr.Bitwise{
+			SourceRegister: 1,
+			DestRegister:   1,
+			Len:            4,
+			Mask:           binaryutil.NativeEndian.PutUint32(ipsDstNAT),
+			Xor:            binaryutil.NativeEndian.PutUint32(0),
+		},
+		// [ cmp neq reg 1 0 ]
+		&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(0)},
+	}
+}
+
+// PortForwardRule publishes hostPort on every local address of the host as
+// guestPort of guestIP. Connections from other machines and from guests are
+// translated in PREROUTING, connections made by the host itself in OUTPUT.
+func PortForwardRule(hostPort uint16, guestIP net.IP, guestPort uint16, proto string) NewRule {
+	return func(rules *Rules) error {
+		ip, ipErr := guestIPv4(guestIP)
+		if ipErr != nil {
+			return ipErr
+		}
+		match, matchErr := destinationPort(proto, hostPort)
+		if matchErr != nil {
+			return matchErr
+		}
+
+		dnat := []expr.Any{
+			// [ immediate reg 1 guestIP ]
+			&expr.Immediate{Register: 1, Data: ip},
+			// [ immediate reg 2 guestPort ]
+			&expr.Immediate{Register: 2, Data: htons(guestPort)},
+			// [ nat dnat ip addr_min reg 1 proto_min reg 2 ]
+			&expr.NAT{
+				Type:        expr.NATTypeDestNAT,
+				Family:      unix.NFPROTO_IPV4,
+				RegAddrMin:  1,
+				RegProtoMin: 2,
+				Specified:   true,
+			},
+		}
+
+		for _, chainName := range []string{PreroutingChain, OutputChain} {
+			chain, table, chainErr := rules.chain(chainName, NATTable)
+			if chainErr != nil {
+				return chainErr
+			}
+
+			exprs := []expr.Any{
+				// [ fib daddr type => reg 1 ]
+				&expr.Fib{Register: 1, FlagDADDR: true, ResultADDRTYPE: true},
+				// [ cmp eq reg 1 local ]
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(unix.RTN_LOCAL)},
+			}
+			if chainName == OutputChain {
+				exprs = append(exprs,
+					// [ payload load 1b @ network header + 16 => reg 1 ]
+					&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 16, Len: 1},
+					// [ cmp neq reg 1 127 ] - loopback cannot be routed to a guest
+					&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: []byte{127}},
+				)
+			}
+			exprs = append(exprs, match...)
+			exprs = append(exprs, dnat...)
+
+			rules.rules = append(rules.rules, &nftables.Rule{
+				Table: table,
+				Chain: chain,
+				Exprs: exprs,
+			})
+		}
+
+		return nil
+	}
+}
+
+// PortForwardAcceptRule accepts forwarded connections that were translated by
+// PortForwardRule to guestPort of guestIP.
+func PortForwardAcceptRule(chainName, tableName string, guestIP net.IP, guestPort uint16, proto string) NewRule {
+	return func(rules *Rules) error {
+		chain, table, chainErr := rules.chain(chainName, tableName)
+		if chainErr != nil {
+			return chainErr
+		}
+		ip, ipErr := guestIPv4(guestIP)
+		if ipErr != nil {
+			return ipErr
+		}
+		match, matchErr := destinationPort(proto, guestPort)
+		if matchErr != nil {
+			return matchErr
+		}
+
+		exprs := []expr.Any{
+			// [ meta load nfproto => reg 1 ]
+			&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+			// [ cmp eq reg 1 ipv4 ]
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.NFPROTO_IPV4}},
+			// [ payload load 4b @ network header + 16 => reg 1 ]
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 16, Len: 4},
+			// [ cmp eq reg 1 guestIP ]
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: ip},
+		}
+		exprs = append(exprs, match...)
+		exprs = append(exprs, ctStatusDNAT()...)
+		// [ immediate verdict ACCEPT ]
+		exprs = append(exprs, &expr.Verdict{Kind: expr.VerdictAccept})
+
+		rules.rules = append(rules.rules, &nftables.Rule{
+			Table: table,
+			Chain: chain,
+			Exprs: exprs,
+		})
+		return nil
+	}
+}
+
+// HairpinRule masquerades connections from guests of subnet that were
+// translated to guestPort of guestIP, so the replies of a guest on the same
+// bridge go back through the host instead of directly to the client.
+func HairpinRule(chainName, tableName string, subnet *net.IPNet, guestIP net.IP, guestPort uint16, proto string) NewRule {
+	return func(rules *Rules) error {
+		chain, table, chainErr := rules.chain(chainName, tableName)
+		if chainErr != nil {
+			return chainErr
+		}
+		ip, ipErr := guestIPv4(guestIP)
+		if ipErr != nil {
+			return ipErr
+		}
+		network := subnet.IP.To4()
+		if network == nil || len(subnet.Mask) != net.IPv4len {
+			return fmt.Errorf("subnet %s is not an IPv4 network", subnet)
+		}
+		match, matchErr := destinationPort(proto, guestPort)
+		if matchErr != nil {
+			return matchErr
+		}
+
+		exprs := []expr.Any{
+			// [ payload load 4b @ network header + 12 => reg 1 ]
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 12, Len: 4},
+			// [ bitwise reg 1 = (reg 1 & mask) ^ 0 ]
+			&expr.Bitwise{
+				SourceRegister: 1,
+				DestRegister:   1,
+				Len:            4,
+				Mask:           []byte(subnet.Mask),
+				Xor:            []byte{0, 0, 0, 0},
+			},
+			// [ cmp eq reg 1 subnet ]
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: network.Mask(subnet.Mask)},
+			// [ payload load 4b @ network header + 16 => reg 1 ]
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 16, Len: 4},
+			// [ cmp eq reg 1 guestIP ]
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: ip},
+		}
+		exprs = append(exprs, match...)
+		exprs = append(exprs, ctStatusDNAT()...)
+		// [ masq ]
+		exprs = append(exprs, &expr.Masq{})
+
+		rules.rules = append(rules.rules, &nftables.Rule{
+			Table: table,
+			Chain: chain,
+			Exprs: exprs,
+		})
+		return nil
+	}
+}
+
+// PortForwardRules returns the DNAT, FORWARD accept and hairpin rules that
+// publish hostPort as guestPort of guestIP, a guest in subnet of bridgeName.
+func PortForwardRules(prefix, bridgeName string, subnet *net.IPNet, hostPort uint16, guestIP net.IP, guestPort uint16, proto string) []NewRule {
+	tag := Tag{Bridge: bridgeName, Role: RolePortForward}
+	return []NewRule{
+		Tagged(tag, PortForwardRule(hostPort, guestIP, guestPort, proto)),
+		Tagged(tag, PortForwardAcceptRule(prefix+ForwardChain, FilterTable, guestIP, guestPort, proto)),
+		Tagged(tag, HairpinRule(PostRoutingChain, NATTable, subnet, guestIP, guestPort, proto)),
+	}
+}
+
+// PortForwardRuleset returns the desired state publishing hostPort as
+// guestPort of guestIP
+func PortForwardRuleset(prefix, bridgeName string, subnet *net.IPNet, hostPort uint16, guestIP net.IP, guestPort uint16, proto string) *Ruleset {
+	return &Ruleset{
+		Tables:  bridgeTables(prefix),
+		Jumps:   bridgeJumps(prefix),
+		Present: PortForwardRules(prefix, bridgeName, subnet, hostPort, guestIP, guestPort, proto),
+	}
+}
@@ -0,0 +1,43 @@
+//go:build linux
+
+package firewall
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPortForwardRuleset(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("192.168.26.0/24")
+	guestIP := net.ParseIP("192.168.26.10")
+	snap := newSnapshot(nil, nil, nil)
+
+	desired := PortForwardRuleset(DefaultPrefix, "br0", subnet, 2222, guestIP, 22, "tcp")
+	plan, err := snap.plan(desired)
+	require.NoError(t, err)
+
+	var chains []string
+	for _, op := range plan.Operations {
+		if op.Kind == OpAddRule {
+			chains = append(chains, op.Rule.Chain.Name)
+		}
+	}
+	require.Equal(t, []string{PreroutingChain, OutputChain, "QEMU-FORWARD", PostRoutingChain}, chains)
+
+	plan, err = snap.plan(desired)
+	require.NoError(t, err)
+	require.Empty(t, plan.Operations)
+}
+
+func TestPortForwardRule_Invalid(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("192.168.26.0/24")
+	snap := newSnapshot(nil, nil, nil)
+
+	_, err := snap.plan(PortForwardRuleset(DefaultPrefix, "br0", subnet, 2222, net.ParseIP("fd00::10"), 22, "tcp"))
+	require.EqualError(t, err, "guest IP fd00::10 is not an IPv4 address")
+
+	_, err = snap.plan(PortForwardRuleset(DefaultPrefix, "br0", subnet, 2222, net.ParseIP("192.168.26.10"), 22, "sctp"))
+	require.EqualError(t, err, "unsupported protocol sctp")
+}
@@ -0,0 +1,738 @@
+//go:build linux
+
+package firewall
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"github.com/google/nftables/userdata"
+	"golang.org/x/sys/unix"
+)
+
+// valueKind tells how the data compared with a register is written
+type valueKind int
+
+const (
+	kindRaw valueKind = iota
+	kindString
+	kindIPv4
+	kindIPv6
+	kindEther
+	kindPort
+	kindInteger
+	kindNFProto
+	kindL4Proto
+	kindEtherType
+	kindCtState
+	kindCtStatus
+	kindAddrType
+)
+
+// operand is the content of a register: the nft expression that loaded it,
+// the kind of its value and, for immediates, the value itself
+type operand struct {
+	text string
+	kind valueKind
+	mask []byte
+	data []byte
+}
+
+// payloadField names a header field loaded by a payload expression. Fields of
+// the network and transport headers depend on the protocol matched before.
+type payloadField struct {
+	base     expr.PayloadBase
+	offset   uint32
+	len      uint32
+	protocol string
+	text     string
+	kind     valueKind
+}
+
+var payloadFields = []payloadField{
+	{expr.PayloadBaseLLHeader, 0, 6, "", "ether daddr", kindEther},
+	{expr.PayloadBaseLLHeader, 6, 6, "", "ether saddr", kindEther},
+	{expr.PayloadBaseLLHeader, 12, 2, "", "ether type", kindEtherType},
+	{expr.PayloadBaseNetworkHeader, 9, 1, "ip", "ip protocol", kindL4Proto},
+	{expr.PayloadBaseNetworkHeader, 12, 4, "ip", "ip saddr", kindIPv4},
+	{expr.PayloadBaseNetworkHeader, 16, 4, "ip", "ip daddr", kindIPv4},
+	{expr.PayloadBaseNetworkHeader, 6, 1, "ip6", "ip6 nexthdr", kindL4Proto},
+	{expr.PayloadBaseNetworkHeader, 8, 16, "ip6", "ip6 saddr", kindIPv6},
+	{expr.PayloadBaseNetworkHeader, 24, 16, "ip6", "ip6 daddr", kindIPv6},
+	{expr.PayloadBaseNetworkHeader, 8, 6, "arp", "arp saddr ether", kindEther},
+	{expr.PayloadBaseNetworkHeader, 14, 4, "arp", "arp saddr ip", kindIPv4},
+	{expr.PayloadBaseNetworkHeader, 18, 6, "arp", "arp daddr ether", kindEther},
+	{expr.PayloadBaseNetworkHeader, 24, 4, "arp", "arp daddr ip", kindIPv4},
+	{expr.PayloadBaseTransportHeader, 0, 2, "tcp", "tcp sport", kindPort},
+	{expr.PayloadBaseTransportHeader, 2, 2, "tcp", "tcp dport", kindPort},
+	{expr.PayloadBaseTransportHeader, 0, 2, "udp", "udp sport", kindPort},
+	{expr.PayloadBaseTransportHeader, 2, 2, "udp", "udp dport", kindPort},
+	{expr.PayloadBaseTransportHeader, 0, 1, "icmp", "icmp type", kindInteger},
+	{expr.PayloadBaseTransportHeader, 0, 1, "icmpv6", "icmpv6 type", kindInteger},
+	{expr.PayloadBaseTransportHeader, 0, 2, "", "th sport", kindPort},
+	{expr.PayloadBaseTransportHeader, 2, 2, "", "th dport", kindPort},
+}
+
+var metaKeys = map[expr.MetaKey]operand{
+	expr.MetaKeyIIFNAME:  {text: "iifname", kind: kindString},
+	expr.MetaKeyOIFNAME:  {text: "oifname", kind: kindString},
+	expr.MetaKeyIIF:      {text: "iif", kind: kindInteger},
+	expr.MetaKeyOIF:      {text: "oif", kind: kindInteger},
+	expr.MetaKeyL4PROTO:  {text: "meta l4proto", kind: kindL4Proto},
+	expr.MetaKeyNFPROTO:  {text: "meta nfproto", kind: kindNFProto},
+	expr.MetaKeyPROTOCOL: {text: "meta protocol", kind: kindEtherType},
+	expr.MetaKeyMARK:     {text: "meta mark", kind: kindInteger},
+	expr.MetaKeyPKTTYPE:  {text: "meta pkttype", kind: kindInteger},
+}
+
+var ctKeys = map[expr.CtKey]operand{
+	expr.CtKeySTATE:  {text: "ct state", kind: kindCtState},
+	expr.CtKeySTATUS: {text: "ct status", kind: kindCtStatus},
+	expr.CtKeyMARK:   {text: "ct mark", kind: kindInteger},
+	expr.CtKeyHELPER: {text: "ct helper", kind: kindString},
+}
+
+var cmpOps = map[expr.CmpOp]string{
+	expr.CmpOpEq:  "",
+	expr.CmpOpNeq: "!= ",
+	expr.CmpOpLt:  "< ",
+	expr.CmpOpLte: "<= ",
+	expr.CmpOpGt:  "> ",
+	expr.CmpOpGte: ">= ",
+}
+
+// flagNames are the names of the bits of the bitmask kinds
+var flagNames = map[valueKind][]struct {
+	bit  uint32
+	name string
+}{
+	kindCtState: {
+		{expr.CtStateBitINVALID, "invalid"},
+		{expr.CtStateBitESTABLISHED, "established"},
+		{expr.CtStateBitRELATED, "related"},
+		{expr.CtStateBitNEW, "new"},
+		{expr.CtStateBitUNTRACKED, "untracked"},
+	},
+	kindCtStatus: {
+		{1, "expected"},
+		{2, "seen-reply"},
+		{4, "assured"},
+		{8, "confirmed"},
+		{16, "snat"},
+		{32, "dnat"},
+		{512, "dying"},
+	},
+}
+
+var l4Protos = map[byte]string{
+	unix.IPPROTO_ICMP:   "icmp",
+	unix.IPPROTO_TCP:    "tcp",
+	unix.IPPROTO_UDP:    "udp",
+	unix.IPPROTO_ICMPV6: "icmpv6",
+}
+
+var etherTypes = map[uint16]string{
+	unix.ETH_P_IP:   "ip",
+	unix.ETH_P_ARP:  "arp",
+	unix.ETH_P_IPV6: "ip6",
+}
+
+var addrTypes = map[uint32]string{
+	unix.RTN_UNICAST:   "unicast",
+	unix.RTN_LOCAL:     "local",
+	unix.RTN_BROADCAST: "broadcast",
+	unix.RTN_ANYCAST:   "anycast",
+	unix.RTN_MULTICAST: "multicast",
+}
+
+// formatValue writes data the way nft expects it after an operand of kind
+func formatValue(kind valueKind, data []byte) string {
+	switch kind {
+	case kindString:
+		return strconv.Quote(strings.TrimRight(string(data), "\x00"))
+	case kindIPv4, kindIPv6:
+		return net.IP(data).String()
+	case kindEther:
+		return net.HardwareAddr(data).String()
+	case kindPort:
+		if len(data) == 2 {
+			return strconv.Itoa(int(binary.BigEndian.Uint16(data)))
+		}
+	case kindInteger:
+		switch len(data) {
+		case 1:
+			return strconv.Itoa(int(data[0]))
+		case 2:
+			return strconv.Itoa(int(binary.BigEndian.Uint16(data)))
+		case 4:
+			return strconv.FormatUint(uint64(binaryutil.NativeEndian.Uint32(data)), 10)
+		}
+	case kindNFProto:
+		if len(data) == 1 {
+			switch data[0] {
+			case unix.NFPROTO_IPV4:
+				return "ipv4"
+			case unix.NFPROTO_IPV6:
+				return "ipv6"
+			}
+		}
+	case kindL4Proto:
+		if len(data) == 1 {
+			if name, ok := l4Protos[data[0]]; ok {
+				return name
+			}
+			return strconv.Itoa(int(data[0]))
+		}
+	case kindEtherType:
+		if len(data) == 2 {
+			if name, ok := etherTypes[binary.BigEndian.Uint16(data)]; ok {
+				return name
+			}
+		}
+	case kindAddrType:
+		if len(data) == 4 {
+			if name, ok := addrTypes[binaryutil.NativeEndian.Uint32(data)]; ok {
+				return name
+			}
+		}
+	case kindCtState, kindCtStatus:
+		if len(data) == 4 {
+			bits := binaryutil.NativeEndian.Uint32(data)
+			var names []string
+			for _, flag := range flagNames[kind] {
+				if bits&flag.bit != 0 {
+					names = append(names, flag.name)
+					bits &^= flag.bit
+				}
+			}
+			if bits == 0 && len(names) > 0 {
+				return strings.Join(names, ",")
+			}
+		}
+	}
+	return fmt.Sprintf("0x%x", data)
+}
+
+// prefixLength returns the length of mask if it is a network mask
+func prefixLength(mask []byte) (int, bool) {
+	ones, bits := net.IPMask(mask).Size()
+	return ones, bits != 0
+}
+
+// renderMatch renders a comparison of op with data
+func renderMatch(op operand, cmpOp expr.CmpOp, data []byte) string {
+	prefix := cmpOps[cmpOp]
+	if op.mask == nil {
+		return op.text + " " + prefix + formatValue(op.kind, data)
+	}
+
+	zero := !slices.ContainsFunc(data, func(b byte) bool { return b != 0 })
+	switch {
+	case (op.kind == kindCtState || op.kind == kindCtStatus) && zero && cmpOp == expr.CmpOpNeq:
+		// [ bitwise reg 1 = (reg 1 & flags) ^ 0 ] [ cmp neq reg 1 0 ]
+		return op.text + " " + formatValue(op.kind, op.mask)
+	case (op.kind == kindCtState || op.kind == kindCtStatus) && zero && cmpOp == expr.CmpOpEq:
+		return op.text + " != " + formatValue(op.kind, op.mask)
+	case op.kind == kindIPv4 || op.kind == kindIPv6:
+		if ones, ok := prefixLength(op.mask); ok {
+			return op.text + " " + prefix + formatValue(op.kind, data) + "/" + strconv.Itoa(ones)
+		}
+	}
+	if prefix == "" {
+		prefix = "== "
+	}
+	return fmt.Sprintf("%s & 0x%x %s%s", op.text, op.mask, prefix, formatValue(op.kind, data))
+}
+
+// payloadOperand returns the operand loaded by p after protocol was matched
+func payloadOperand(p *expr.Payload, protocol string) operand {
+	for _, field := range payloadFields {
+		if field.base == p.Base && field.offset == p.Offset && field.len == p.Len &&
+			(field.protocol == "" || field.protocol == protocol) {
+			return operand{text: field.text, kind: field.kind}
+		}
+	}
+
+	base := map[expr.PayloadBase]string{
+		expr.PayloadBaseLLHeader:        "ll",
+		expr.PayloadBaseNetworkHeader:   "nh",
+		expr.PayloadBaseTransportHeader: "th",
+	}[p.Base]
+	kind := kindRaw
+	if p.Len <= 2 {
+		kind = kindPort
+	}
+	if p.Len == 1 {
+		kind = kindInteger
+	}
+	return operand{text: fmt.Sprintf("@%s,%d,%d", base, p.Offset*8, p.Len*8), kind: kind}
+}
+
+// fibOperand returns the operand loaded by f
+func fibOperand(f *expr.Fib) operand {
+	var flags []string
+	for _, flag := range []struct {
+		set  bool
+		name string
+	}{
+		{f.FlagSADDR, "saddr"}, {f.FlagDADDR, "daddr"}, {f.FlagMARK, "mark"}, {f.FlagIIF, "iif"}, {f.FlagOIF, "oif"},
+	} {
+		if flag.set {
+			flags = append(flags, flag.name)
+		}
+	}
+	text := "fib " + strings.Join(flags, " . ")
+	switch {
+	case f.ResultADDRTYPE:
+		return operand{text: text + " type", kind: kindAddrType}
+	case f.ResultOIFNAME:
+		return operand{text: text + " oifname", kind: kindString}
+	default:
+		return operand{text: text + " oif", kind: kindInteger}
+	}
+}
+
+// renderVerdict renders a verdict statement
+func renderVerdict(v *expr.Verdict) (string, error) {
+	switch v.Kind {
+	case expr.VerdictAccept:
+		return "accept", nil
+	case expr.VerdictDrop:
+		return "drop", nil
+	case expr.VerdictReturn:
+		return "return", nil
+	case expr.VerdictContinue:
+		return "continue", nil
+	case expr.VerdictJump:
+		return "jump " + v.Chain, nil
+	case expr.VerdictGoto:
+		return "goto " + v.Chain, nil
+	default:
+		return "", fmt.Errorf("unsupported verdict %d", v.Kind)
+	}
+}
+
+// renderAddress renders the address range and port range loaded into the
+// registers of a nat statement
+func renderAddress(regs map[uint32]operand, family uint32, addrMin, addrMax, protoMin, protoMax uint32) string {
+	var sb strings.Builder
+	kind := kindIPv4
+	if family == unix.NFPROTO_IPV6 {
+		kind = kindIPv6
+	}
+	if addrMin != 0 {
+		sb.WriteString(formatValue(kind, regs[addrMin].data))
+		if addrMax != 0 && addrMax != addrMin {
+			sb.WriteString("-" + formatValue(kind, regs[addrMax].data))
+		}
+	}
+	if protoMin != 0 {
+		sb.WriteString(":" + formatValue(kindPort, regs[protoMin].data))
+		if protoMax != 0 && protoMax != protoMin {
+			sb.WriteString("-" + formatValue(kindPort, regs[protoMax].data))
+		}
+	}
+	return sb.String()
+}
+
+func natFlags(persistent, random, fullyRandom bool) string {
+	var flags []string
+	if persistent {
+		flags = append(flags, "persistent")
+	}
+	if random {
+		flags = append(flags, "random")
+	}
+	if fullyRandom {
+		flags = append(flags, "fully-random")
+	}
+	if len(flags) == 0 {
+		return ""
+	}
+	return " " + strings.Join(flags, ",")
+}
+
+func limitUnit(unit expr.LimitTime) string {
+	switch unit {
+	case expr.LimitTimeMinute:
+		return "minute"
+	case expr.LimitTimeHour:
+		return "hour"
+	case expr.LimitTimeDay:
+		return "day"
+	case expr.LimitTimeWeek:
+		return "week"
+	default:
+		return "second"
+	}
+}
+
+func over(o bool) string {
+	if o {
+		return "over "
+	}
+	return ""
+}
+
+// RenderExprs renders the expressions of a rule as the statements of an nft
+// rule. Registers are followed from the expressions loading them to the
+// comparisons and statements using them; header fields without a name are
+// written as raw payload expressions.
+func RenderExprs(exprs []expr.Any, family nftables.TableFamily) (string, error) {
+	regs := map[uint32]operand{}
+	// The ip and ip6 families only see packets of their own protocol
+	protocol := map[nftables.TableFamily]string{
+		nftables.TableFamilyIPv4: "ip",
+		nftables.TableFamilyIPv6: "ip6",
+	}[family]
+	var out []string
+	for _, e := range exprs {
+		switch e := e.(type) {
+		case *expr.Meta:
+			op, ok := metaKeys[e.Key]
+			if !ok || e.SourceRegister {
+				return "", fmt.Errorf("unsupported meta key %d", e.Key)
+			}
+			regs[e.Register] = op
+		case *expr.Ct:
+			op, ok := ctKeys[e.Key]
+			if !ok || e.SourceRegister {
+				return "", fmt.Errorf("unsupported ct key %d", e.Key)
+			}
+			regs[e.Register] = op
+		case *expr.Payload:
+			if e.OperationType != expr.PayloadLoad {
+				return "", fmt.Errorf("unsupported payload write")
+			}
+			regs[e.DestRegister] = payloadOperand(e, protocol)
+		case *expr.Fib:
+			regs[e.Register] = fibOperand(e)
+		case *expr.Bitwise:
+			op := regs[e.SourceRegister]
+			op.mask = e.Mask
+			regs[e.DestRegister] = op
+		case *expr.Immediate:
+			regs[e.Register] = operand{data: e.Data}
+		case *expr.Cmp:
+			op := regs[e.Register]
+			out = append(out, renderMatch(op, e.Op, e.Data))
+			if e.Op == expr.CmpOpEq && op.mask == nil {
+				switch op.kind {
+				case kindNFProto:
+					protocol = map[string]string{"ipv4": "ip", "ipv6": "ip6"}[formatValue(op.kind, e.Data)]
+				case kindL4Proto, kindEtherType:
+					protocol = formatValue(op.kind, e.Data)
+				}
+			}
+		case *expr.Range:
+			op := regs[e.Register]
+			out = append(out, op.text+" "+cmpOps[e.Op]+formatValue(op.kind, e.FromData)+"-"+formatValue(op.kind, e.ToData))
+		case *expr.Lookup:
+			op := regs[e.SourceRegister]
+			switch {
+			case e.IsDestRegSet && e.DestRegister == 0:
+				out = append(out, op.text+" vmap @"+e.SetName)
+			case e.IsDestRegSet:
+				regs[e.DestRegister] = operand{text: op.text + " map @" + e.SetName}
+			case e.Invert:
+				out = append(out, op.text+" != @"+e.SetName)
+			default:
+				out = append(out, op.text+" @"+e.SetName)
+			}
+		case *expr.Dynset:
+			nested, nestedErr := RenderExprs(e.Exprs, family)
+			if nestedErr != nil {
+				return "", nestedErr
+			}
+			verb := map[uint32]string{unix.NFT_DYNSET_OP_ADD: "add", unix.NFT_DYNSET_OP_UPDATE: "update"}[e.Operation]
+			element := regs[e.SrcRegKey].text
+			if e.Timeout != 0 {
+				element += fmt.Sprintf(" timeout %ds", int(e.Timeout.Seconds()))
+			}
+			if nested != "" {
+				element += " " + nested
+			}
+			out = append(out, fmt.Sprintf("%s @%s { %s }", verb, e.SetName, element))
+		case *expr.Counter:
+			out = append(out, "counter")
+		case *expr.Log:
+			statement := "log"
+			if e.Key&(1<<unix.NFTA_LOG_PREFIX) != 0 {
+				statement += " prefix " + strconv.Quote(string(e.Data))
+			}
+			if e.Key&(1<<unix.NFTA_LOG_GROUP) != 0 {
+				statement += " group " + strconv.Itoa(int(e.Group))
+			}
+			out = append(out, statement)
+		case *expr.Limit:
+			unit := "/" + limitUnit(e.Unit)
+			if e.Type == expr.LimitTypePktBytes {
+				unit = " bytes" + unit
+			}
+			statement := fmt.Sprintf("limit rate %s%d%s", over(e.Over), e.Rate, unit)
+			if e.Burst != 0 {
+				statement += fmt.Sprintf(" burst %d packets", e.Burst)
+				if e.Type == expr.LimitTypePktBytes {
+					statement = strings.TrimSuffix(statement, " packets") + " bytes"
+				}
+			}
+			out = append(out, statement)
+		case *expr.Connlimit:
+			out = append(out, fmt.Sprintf("ct count %s%d", over(e.Flags&expr.NFT_CONNLIMIT_F_INV != 0), e.Count))
+		case *expr.Quota:
+			out = append(out, fmt.Sprintf("quota %s%d bytes", over(e.Over), e.Bytes))
+		case *expr.Notrack:
+			out = append(out, "notrack")
+		case *expr.Objref:
+			if e.Type != int(nftables.ObjTypeCtHelper) {
+				return "", fmt.Errorf("unsupported object reference type %d", e.Type)
+			}
+			out = append(out, "ct helper set "+strconv.Quote(e.Name))
+		case *expr.Verdict:
+			verdict, verdictErr := renderVerdict(e)
+			if verdictErr != nil {
+				return "", verdictErr
+			}
+			out = append(out, verdict)
+		case *expr.Reject:
+			out = append(out, "reject")
+		case *expr.Masq:
+			out = append(out, "masquerade"+natFlags(e.Persistent, e.Random, e.FullyRandom))
+		case *expr.NAT:
+			verb := "snat"
+			if e.Type == expr.NATTypeDestNAT {
+				verb = "dnat"
+			}
+			if family == nftables.TableFamilyINet || family == nftables.TableFamilyBridge {
+				verb += map[uint32]string{unix.NFPROTO_IPV4: " ip", unix.NFPROTO_IPV6: " ip6"}[e.Family]
+			}
+			to := renderAddress(regs, e.Family, e.RegAddrMin, e.RegAddrMax, e.RegProtoMin, e.RegProtoMax)
+			out = append(out, verb+" to "+to+natFlags(e.Persistent, e.Random, e.FullyRandom))
+		case *expr.FlowOffload:
+			out = append(out, "flow add @"+e.Name)
+		default:
+			return "", fmt.Errorf("unsupported expression %T", e)
+		}
+	}
+	return strings.Join(out, " "), nil
+}
+
+// ruleSpec returns the family, table and chain a rule is added to
+func ruleSpec(rule *nftables.Rule) string {
+	return familyName(rule.Table.Family) + " " + rule.Table.Name + " " + rule.Chain.Name
+}
+
+// renderRule renders the body of rule followed by its comment
+func renderRule(rule *nftables.Rule) (string, error) {
+	body, bodyErr := RenderExprs(rule.Exprs, rule.Table.Family)
+	if bodyErr != nil {
+		return "", fmt.Errorf("failed to render rule of chain %s: %w", rule.Chain.Name, bodyErr)
+	}
+	if comment, ok := userdata.GetString(rule.UserData, userdata.TypeComment); ok {
+		body += " comment " + strconv.Quote(comment)
+	}
+	return body, nil
+}
+
+// renderChain renders the declaration of chain, with type, hook, priority
+// and policy for base chains
+func renderChain(chain *nftables.Chain) string {
+	spec := familyName(chain.Table.Family) + " " + chain.Table.Name + " " + chain.Name
+	if chain.Hooknum == nil {
+		return spec
+	}
+	hook := ""
+	for _, h := range hookNames {
+		if *h.hook == *chain.Hooknum {
+			hook = h.name
+		}
+	}
+	priority := 0
+	if chain.Priority != nil {
+		priority = int(*chain.Priority)
+	}
+	policy := "accept"
+	if chain.Policy != nil && *chain.Policy == nftables.ChainPolicyDrop {
+		policy = "drop"
+	}
+	return fmt.Sprintf("%s { type %s hook %s priority %d; policy %s; }", spec, chain.Type, hook, priority, policy)
+}
+
+// keyKind returns the kind of the values of a set datatype
+func keyKind(dt nftables.SetDatatype) valueKind {
+	switch dt.Name {
+	case nftables.TypeIPAddr.Name:
+		return kindIPv4
+	case nftables.TypeIP6Addr.Name:
+		return kindIPv6
+	case nftables.TypeInetService.Name:
+		return kindPort
+	case nftables.TypeIFName.Name:
+		return kindString
+	case nftables.TypeEtherAddr.Name:
+		return kindEther
+	case nftables.TypeInetProto.Name:
+		return kindL4Proto
+	case nftables.TypeMark.Name, nftables.TypeInteger.Name:
+		return kindInteger
+	default:
+		return kindRaw
+	}
+}
+
+// renderElements renders elements of set. The elements of interval sets are
+// written as ranges from a start to the element ending its interval.
+func renderElements(set *nftables.Set, elements []nftables.SetElement) (string, error) {
+	kind := keyKind(set.KeyType)
+	var out []string
+	for _, e := range elements {
+		if e.IntervalEnd {
+			continue
+		}
+		text := formatValue(kind, e.Key)
+		if set.Interval {
+			start := new(big.Int).SetBytes(e.Key)
+			var end *big.Int
+			for _, other := range elements {
+				if o := new(big.Int).SetBytes(other.Key); other.IntervalEnd && o.Cmp(start) > 0 && (end == nil || o.Cmp(end) < 0) {
+					end = o
+				}
+			}
+			last := new(big.Int).Lsh(big.NewInt(1), uint(8*len(e.Key)))
+			if end != nil {
+				last = end
+			}
+			last.Sub(last, big.NewInt(1))
+			if last.Cmp(start) != 0 {
+				text += "-" + formatValue(kind, last.FillBytes(make([]byte, len(e.Key))))
+			}
+		}
+		switch {
+		case e.VerdictData != nil:
+			verdict, verdictErr := renderVerdict(e.VerdictData)
+			if verdictErr != nil {
+				return "", verdictErr
+			}
+			text += " : " + verdict
+		case set.IsMap:
+			text += " : " + formatValue(keyKind(set.DataType), e.Val)
+		}
+		out = append(out, text)
+	}
+	return "{ " + strings.Join(out, ", ") + " }", nil
+}
+
+// renderSet renders the declaration of set
+func renderSet(set *nftables.Set) string {
+	spec := familyName(set.Table.Family) + " " + set.Table.Name + " " + set.Name
+	if set.IsMap {
+		return fmt.Sprintf("map %s { type %s : %s; }", spec, set.KeyType.Name, set.DataType.Name)
+	}
+	var flags []string
+	if set.Interval {
+		flags = append(flags, "interval")
+	}
+	if set.Dynamic {
+		flags = append(flags, "dynamic")
+	}
+	if set.HasTimeout {
+		flags = append(flags, "timeout")
+	}
+	decl := "type " + set.KeyType.Name + ";"
+	if len(flags) > 0 {
+		decl += " flags " + strings.Join(flags, ",") + ";"
+	}
+	if set.HasTimeout && set.Timeout != 0 {
+		decl += fmt.Sprintf(" timeout %ds;", int(set.Timeout.Seconds()))
+	}
+	return fmt.Sprintf("set %s { %s }", spec, decl)
+}
+
+// Render returns the rules as `nft -f` input appending them to their chains
+func (r *Rules) Render() (string, error) {
+	var sb strings.Builder
+	for _, rule := range r.rules {
+		body, bodyErr := renderRule(rule)
+		if bodyErr != nil {
+			return "", bodyErr
+		}
+		fmt.Fprintf(&sb, "add rule %s %s\n", ruleSpec(rule), body)
+	}
+	return sb.String(), nil
+}
+
+// Render returns the operations of the plan as `nft -f` input. Applied with
+// `nft -f`, the text makes the same changes as Apply in a single transaction.
+func (p *Plan) Render() (string, error) {
+	var sb strings.Builder
+	for _, op := range p.Operations {
+		line, lineErr := renderOperation(op)
+		if lineErr != nil {
+			return "", lineErr
+		}
+		sb.WriteString(line + "\n")
+	}
+	return sb.String(), nil
+}
+
+func renderOperation(op Operation) (string, error) {
+	switch op.Kind {
+	case OpAddTable:
+		return "add table " + familyName(op.Table.Family) + " " + op.Table.Name, nil
+	case OpAddChain:
+		return "add chain " + renderChain(op.Chain), nil
+	case OpDeleteChain:
+		return "delete chain " + familyName(op.Chain.Table.Family) + " " + op.Chain.Table.Name + " " + op.Chain.Name, nil
+	case OpAddRule, OpInsertRule:
+		body, bodyErr := renderRule(op.Rule)
+		if bodyErr != nil {
+			return "", bodyErr
+		}
+		verb, position := "add", ""
+		if op.Kind == OpInsertRule {
+			verb = "insert"
+		}
+		switch {
+		case op.Kind == OpInsertRule && op.Rule.Handle != 0:
+			verb, position = "replace", fmt.Sprintf(" handle %d", op.Rule.Handle)
+		case op.Rule.Position != 0:
+			position = fmt.Sprintf(" position %d", op.Rule.Position)
+		}
+		return fmt.Sprintf("%s rule %s%s %s", verb, ruleSpec(op.Rule), position, body), nil
+	case OpDeleteRule:
+		return fmt.Sprintf("delete rule %s handle %d", ruleSpec(op.Rule), op.Rule.Handle), nil
+	case OpAddSet:
+		return "add " + renderSet(op.Set), nil
+	case OpDeleteSet:
+		return "delete set " + familyName(op.Set.Table.Family) + " " + op.Set.Table.Name + " " + op.Set.Name, nil
+	case OpAddElements, OpDeleteElements:
+		elements, elementsErr := renderElements(op.Set, op.Elements)
+		if elementsErr != nil {
+			return "", elementsErr
+		}
+		verb := "add"
+		if op.Kind == OpDeleteElements {
+			verb = "delete"
+		}
+		return fmt.Sprintf("%s element %s %s %s %s", verb, familyName(op.Set.Table.Family), op.Set.Table.Name, op.Set.Name, elements), nil
+	case OpAddFlowtable:
+		priority := 0
+		if op.Flowtable.Priority != nil {
+			priority = int(*op.Flowtable.Priority)
+		}
+		return fmt.Sprintf("add flowtable %s %s %s { hook ingress priority %d; devices = { %s }; }",
+			familyName(op.Flowtable.Table.Family), op.Flowtable.Table.Name, op.Flowtable.Name, priority, strings.Join(op.Flowtable.Devices, ", ")), nil
+	case OpDeleteFlowtable:
+		return fmt.Sprintf("delete flowtable %s %s %s", familyName(op.Flowtable.Table.Family), op.Flowtable.Table.Name, op.Flowtable.Name), nil
+	default:
+		return "", fmt.Errorf("unsupported operation %s", op.Kind)
+	}
+}
@@ -0,0 +1,70 @@
+//go:build linux
+
+package firewall
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPlan_Render(t *testing.T) {
+	useFakeConn(t)
+	plan, err := BridgeRuleset(DefaultPrefix, "eth0", "br0", WithFlowOffload(), WithStatefulForwarding()).Plan()
+	require.NoError(t, err)
+	text, err := plan.Render()
+	require.NoError(t, err)
+
+	lines := strings.Split(text, "\n")
+	require.Contains(t, lines, "add table inet filter")
+	require.Contains(t, lines, "add chain inet filter FORWARD { type filter hook forward priority 0; policy accept; }")
+	require.Contains(t, lines, "add chain ip nat POSTROUTING { type nat hook postrouting priority 100; policy accept; }")
+	require.Contains(t, lines, "add flowtable inet filter QEMU-FT-br0 { hook ingress priority 0; devices = { br0, eth0 }; }")
+	require.Contains(t, lines, "insert rule inet filter FORWARD counter jump QEMU-FORWARD comment \"network-utils:role=jump\"")
+	require.Contains(t, lines, "add rule inet filter QEMU-FORWARD iifname \"eth0\" oifname \"br0\" ct state established,related counter accept comment \"network-utils:bridge=br0:role=forward-return\"")
+	require.Contains(t, lines, "add rule inet filter QEMU-INPUT iifname \"br0\" meta l4proto udp udp dport 67 counter accept comment \"network-utils:bridge=br0:role=dhcp\"")
+	require.Contains(t, lines, "add rule inet filter QEMU-OFFLOAD iifname \"br0\" oifname \"eth0\" ct state established counter flow add @QEMU-FT-br0 comment \"network-utils:bridge=br0:role=offload\"")
+}
+
+func TestPlan_RenderPortForward(t *testing.T) {
+	useFakeConn(t)
+	plan, err := PortForwardRuleset(DefaultPrefix, "br0", mustCIDR(t, "192.168.26.0/24"), 2222, net.ParseIP("192.168.26.10"), 22, "tcp").Plan()
+	require.NoError(t, err)
+	text, err := plan.Render()
+	require.NoError(t, err)
+
+	require.Contains(t, text, "add rule ip nat PREROUTING fib daddr type local meta l4proto tcp tcp dport 2222 counter dnat to 192.168.26.10:22")
+	require.Contains(t, text, "add rule ip nat POSTROUTING ip saddr 192.168.26.0/24 ip daddr 192.168.26.10 meta l4proto tcp tcp dport 22 ct status dnat counter masquerade")
+}
+
+func TestRules_Render(t *testing.T) {
+	useFakeConn(t)
+	require.NoError(t, Reconcile(BridgeRuleset(DefaultPrefix, "eth0", "br0")))
+	rules, err := NewRules(ForwardOutboundRule(DefaultPrefix+ForwardChain, FilterTable, "eth0", "br0"))
+	require.NoError(t, err)
+	text, err := rules.Render()
+	require.NoError(t, err)
+	require.Equal(t, "add rule inet filter QEMU-FORWARD iifname \"br0\" oifname \"eth0\" accept\n", text)
+}
+
+func TestDryRun_LeavesRulesetUntouched(t *testing.T) {
+	conn := useFakeConn(t)
+	require.NoError(t, Reconcile(BridgeRuleset(DefaultPrefix, "eth0", "br0")))
+	flushes := conn.Flushes
+
+	var out bytes.Buffer
+	fw, err := New(WithConnection(conn), WithDryRun(&out))
+	require.NoError(t, err)
+	require.NoError(t, fw.Reconcile(BridgeTeardown(DefaultPrefix, "eth0", "br0")))
+	require.Equal(t, flushes, conn.Flushes)
+	require.Contains(t, chainNames(t, conn), DefaultPrefix+ForwardChain)
+	require.Contains(t, out.String(), "delete chain inet filter QEMU-FORWARD\n")
+
+	// Nothing to change renders nothing
+	out.Reset()
+	require.NoError(t, fw.Reconcile(BridgeRuleset(DefaultPrefix, "eth0", "br0")))
+	require.Empty(t, out.String())
+}
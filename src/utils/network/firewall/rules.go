@@ -8,16 +8,29 @@ import (
 
 	"github.com/google/nftables"
 	"github.com/google/nftables/expr"
+	"github.com/q-controller/network-utils/src/utils/network/lock"
 )
 
 type Rules struct {
-	rules []*nftables.Rule
+	rules    []*nftables.Rule
+	firewall *Firewall
+	resolve  func(chainName, tableName string) (*nftables.Chain, *nftables.Table, error)
 }
 
 type NewRule func(*Rules) error
 
 func NewRules(rules ...NewRule) (*Rules, error) {
-	r := &Rules{}
+	return Host().NewRules(rules...)
+}
+
+// NewRules builds rules against the chains of the namespace. The chains are
+// listed once and shared by every builder.
+func (f *Firewall) NewRules(rules ...NewRule) (*Rules, error) {
+	snap, snapErr := loadSnapshot(f.conn)
+	if snapErr != nil {
+		return nil, snapErr
+	}
+	r := &Rules{firewall: f, resolve: snap.resolve}
 	for _, rule := range rules {
 		if err := rule(r); err != nil {
 			return nil, err
@@ -26,37 +39,95 @@ func NewRules(rules ...NewRule) (*Rules, error) {
 	return r, nil
 }
 
+// chain looks up the chain a rule is built for. Rules built for a Ruleset are
+// resolved against its planned state, those of NewRules against the chains
+// listed when it started, everything else against the kernel.
+func (r *Rules) chain(chainName, tableName string) (*nftables.Chain, *nftables.Table, error) {
+	if r.resolve != nil {
+		return r.resolve(chainName, tableName)
+	}
+	f := r.firewall
+	if f == nil {
+		f = Host()
+	}
+	return f.NewChain(
+		WithName(chainName),
+		WithinTable(tableName, 0),
+	)
+}
+
 func AddRules(rules *Rules) error {
-	conn := getConnection()
+	return Host().AddRules(rules)
+}
+
+// AddRules appends the rules that are not yet part of their chains
+func (f *Firewall) AddRules(rules *Rules) error {
+	unlock, lockErr := lock.Acquire()
+	if lockErr != nil {
+		return lockErr
+	}
+	defer unlock()
+
+	conn := f.conn
+	snap, snapErr := loadSnapshot(conn)
+	if snapErr != nil {
+		return snapErr
+	}
 
 	for _, r := range rules.rules {
-		existing, getRulesErr := conn.GetRules(r.Table, r.Chain)
+		existing, getRulesErr := snap.rulesOf(r.Chain)
 		if getRulesErr != nil {
 			return getRulesErr
 		}
 
-		unique := true
-		for _, er := range existing {
-			if equalExprs(r.Exprs, er.Exprs) {
-				unique = false
-				break
-			}
-		}
-
-		if unique {
+		if !containsRule(existing, r) {
 			conn.AddRule(r)
+			// Duplicates within rules are added once
+			snap.rules[keyOf(r.Chain)] = append(existing, r)
 		}
 	}
 
 	return conn.Flush()
 }
 
+// RemoveRules deletes the live rules equal to rules. Rules are looked up in
+// the kernel to get their handles; tagged rules only match the same tag.
 func RemoveRules(rules *Rules) error {
-	conn := getConnection()
+	return Host().RemoveRules(rules)
+}
+
+// RemoveRules deletes the live rules of the namespace equal to rules
+func (f *Firewall) RemoveRules(rules *Rules) error {
+	unlock, lockErr := lock.Acquire()
+	if lockErr != nil {
+		return lockErr
+	}
+	defer unlock()
+
+	conn := f.conn
+	snap, snapErr := loadSnapshot(conn)
+	if snapErr != nil {
+		return snapErr
+	}
+
 	for _, rule := range rules.rules {
-		if err := conn.DelRule(rule); err != nil {
-			return err
+		existing, getRulesErr := snap.rulesOf(rule.Chain)
+		if getRulesErr != nil {
+			return getRulesErr
+		}
+
+		var kept []*nftables.Rule
+		for _, er := range existing {
+			if !sameMatch(rule.Exprs, er.Exprs) || !ownedBy(er, rule) {
+				kept = append(kept, er)
+				continue
+			}
+			if err := conn.DelRule(er); err != nil {
+				return err
+			}
 		}
+		// A live rule matching several of rules is deleted once
+		snap.rules[keyOf(rule.Chain)] = kept
 	}
 
 	return conn.Flush()
@@ -117,6 +188,31 @@ func exprEqual(a, b expr.Any) bool {
 		_, ok := b.(*expr.Masq)
 		return ok
 
+	case *expr.Log:
+		y, ok := b.(*expr.Log)
+		return ok &&
+			x.Key == y.Key &&
+			x.Group == y.Group &&
+			bytes.Equal(x.Data, y.Data)
+
+	case *expr.Lookup:
+		y, ok := b.(*expr.Lookup)
+		return ok &&
+			x.SourceRegister == y.SourceRegister &&
+			x.DestRegister == y.DestRegister &&
+			x.IsDestRegSet == y.IsDestRegSet &&
+			x.SetName == y.SetName &&
+			x.Invert == y.Invert
+
+	case *expr.FlowOffload:
+		y, ok := b.(*expr.FlowOffload)
+		return ok && x.Name == y.Name
+
+	case *expr.Counter:
+		// Counter values change with traffic and never take part in equality
+		_, ok := b.(*expr.Counter)
+		return ok
+
 	case *expr.Payload:
 		y, ok := b.(*expr.Payload)
 		return ok &&
@@ -125,6 +221,39 @@ func exprEqual(a, b expr.Any) bool {
 			x.Offset == y.Offset &&
 			x.Len == y.Len
 
+	case *expr.Immediate:
+		y, ok := b.(*expr.Immediate)
+		return ok &&
+			x.Register == y.Register &&
+			bytes.Equal(x.Data, y.Data)
+
+	case *expr.NAT:
+		y, ok := b.(*expr.NAT)
+		return ok && *x == *y
+
+	case *expr.Fib:
+		y, ok := b.(*expr.Fib)
+		return ok && *x == *y
+
+	case *expr.Limit:
+		y, ok := b.(*expr.Limit)
+		return ok && *x == *y
+
+	case *expr.Connlimit:
+		y, ok := b.(*expr.Connlimit)
+		return ok && *x == *y
+
+	case *expr.Dynset:
+		y, ok := b.(*expr.Dynset)
+		return ok &&
+			x.SrcRegKey == y.SrcRegKey &&
+			x.SrcRegData == y.SrcRegData &&
+			x.SetName == y.SetName &&
+			x.Operation == y.Operation &&
+			x.Timeout == y.Timeout &&
+			x.Invert == y.Invert &&
+			equalExprs(x.Exprs, y.Exprs)
+
 	default:
 		return false
 	}
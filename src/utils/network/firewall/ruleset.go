@@ -0,0 +1,741 @@
+//go:build linux
+
+package firewall
+
+import (
+	"bytes"
+	"cmp"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/q-controller/network-utils/src/utils/network/lock"
+	"golang.org/x/sys/unix"
+)
+
+// errNotExist is wrapped by the errors of chains and tables that do not exist
+var errNotExist = errors.New("does not exist")
+
+// ErrUnavailable is returned when the kernel has no nftables, so there is no
+// ruleset to read or change
+var ErrUnavailable = errors.New("nftables is not available")
+
+// Jump describes a jump rule from one chain into another chain of the same table
+type Jump struct {
+	From  string
+	To    string
+	Table string
+}
+
+// Ruleset describes the desired state of the firewall: the tables and chains
+// that must exist, the jumps into custom chains, the rules that must be present
+// and the rules that must be absent. Live rules with a tag matched by Prune are
+// deleted unless they are part of Present.
+//
+// Elements are added to or removed from named sets after the rules, so map
+// elements can refer to chains created by the same plan.
+//
+// Flowtables are created with the tables. Absent flowtables are deleted at the
+// end, together with the rules offloading to them. Absent sets are deleted
+// last, once the rules using them are gone.
+//
+// The target chains of Retire are deleted together with the jumps into them
+// once the plan leaves them without rules. With Purge their remaining rules
+// are deleted as well.
+type Ruleset struct {
+	Tables     []TableConfig
+	Sets       []SetConfig
+	Flowtables []FlowtableConfig
+	Jumps      []Jump
+	Present    []NewRule
+	Absent     []NewRule
+	Prune      []Tag
+	Elements   []SetElements
+	Retire     []Jump
+	Purge      bool
+}
+
+// OperationKind identifies a single change of a Plan
+type OperationKind int
+
+const (
+	OpAddTable OperationKind = iota
+	OpAddChain
+	OpInsertRule
+	OpAddRule
+	OpDeleteRule
+	OpDeleteChain
+	OpAddSet
+	OpAddElements
+	OpDeleteElements
+	OpAddFlowtable
+	OpDeleteFlowtable
+	OpDeleteSet
+)
+
+func (k OperationKind) String() string {
+	switch k {
+	case OpAddTable:
+		return "add table"
+	case OpAddChain:
+		return "add chain"
+	case OpInsertRule:
+		return "insert rule"
+	case OpAddRule:
+		return "add rule"
+	case OpDeleteRule:
+		return "delete rule"
+	case OpDeleteChain:
+		return "delete chain"
+	case OpAddSet:
+		return "add set"
+	case OpAddElements:
+		return "add element"
+	case OpDeleteElements:
+		return "delete element"
+	case OpAddFlowtable:
+		return "add flowtable"
+	case OpDeleteFlowtable:
+		return "delete flowtable"
+	case OpDeleteSet:
+		return "delete set"
+	default:
+		return fmt.Sprintf("operation(%d)", int(k))
+	}
+}
+
+// Operation is a single change against the live ruleset. Depending on Kind
+// only one of Table, Chain, Rule, Set or Flowtable is set; element operations
+// also carry the Elements of their Set.
+type Operation struct {
+	Kind      OperationKind
+	Table     *nftables.Table
+	Chain     *nftables.Chain
+	Rule      *nftables.Rule
+	Set       *nftables.Set
+	Elements  []nftables.SetElement
+	Flowtable *nftables.Flowtable
+}
+
+// Plan is the diff between a Ruleset and the live ruleset
+type Plan struct {
+	Operations []Operation
+
+	conn Conn
+}
+
+// Reconcile brings the live ruleset to the desired state in a single atomic
+// batch: either every change is committed or nothing is.
+func Reconcile(desired *Ruleset) error {
+	return Host().Reconcile(desired)
+}
+
+// Reconcile brings the ruleset of the namespace to the desired state. The
+// host-wide lock is held from the snapshot to the commit, so no other process
+// changes the ruleset the plan was computed from.
+func (f *Firewall) Reconcile(desired *Ruleset) error {
+	unlock, lockErr := lock.Acquire()
+	if lockErr != nil {
+		return lockErr
+	}
+	defer unlock()
+
+	plan, planErr := f.Plan(desired)
+	if planErr != nil {
+		return planErr
+	}
+	return plan.Apply()
+}
+
+// Plan computes the operations needed to bring the live ruleset to the desired state
+func (rs *Ruleset) Plan() (*Plan, error) {
+	return Host().Plan(rs)
+}
+
+// Plan computes the operations needed to bring the ruleset of the namespace to
+// the desired state
+func (f *Firewall) Plan(rs *Ruleset) (*Plan, error) {
+	snap, snapErr := loadSnapshot(f.conn)
+	if snapErr != nil {
+		return nil, snapErr
+	}
+	plan, planErr := snap.plan(rs)
+	if planErr != nil {
+		return nil, planErr
+	}
+	plan.conn = f.conn
+	return plan, nil
+}
+
+// Apply queues every operation of the plan and commits them with a single Flush
+func (p *Plan) Apply() error {
+	if len(p.Operations) == 0 {
+		return nil
+	}
+
+	// DelRule refuses rules without a handle; check upfront so a bad plan does
+	// not leave half of its messages buffered on the shared connection.
+	for _, op := range p.Operations {
+		if op.Kind == OpDeleteRule && op.Rule.Handle == 0 {
+			return fmt.Errorf("cannot delete rule without handle in chain %s", op.Rule.Chain.Name)
+		}
+	}
+
+	conn := p.conn
+	if conn == nil {
+		conn = getConnection()
+	}
+	for _, op := range p.Operations {
+		switch op.Kind {
+		case OpAddTable:
+			conn.AddTable(op.Table)
+		case OpAddChain:
+			conn.AddChain(op.Chain)
+		case OpInsertRule:
+			conn.InsertRule(op.Rule)
+		case OpAddRule:
+			conn.AddRule(op.Rule)
+		case OpDeleteRule:
+			if err := conn.DelRule(op.Rule); err != nil {
+				return err
+			}
+		case OpDeleteChain:
+			conn.DelChain(op.Chain)
+		case OpAddSet:
+			if err := conn.AddSet(op.Set, nil); err != nil {
+				return err
+			}
+		case OpAddElements:
+			if err := conn.SetAddElements(op.Set, op.Elements); err != nil {
+				return err
+			}
+		case OpDeleteElements:
+			if err := conn.SetDeleteElements(op.Set, op.Elements); err != nil {
+				return err
+			}
+		case OpAddFlowtable:
+			conn.AddFlowtable(op.Flowtable)
+		case OpDeleteFlowtable:
+			conn.DelFlowtable(op.Flowtable)
+		case OpDeleteSet:
+			conn.DelSet(op.Set)
+		}
+	}
+
+	return conn.Flush()
+}
+
+type chainKey struct {
+	family nftables.TableFamily
+	table  string
+	chain  string
+}
+
+func keyOf(chain *nftables.Chain) chainKey {
+	return chainKey{family: chain.Table.Family, table: chain.Table.Name, chain: chain.Name}
+}
+
+// tableKeyOf returns the key of a table, which has no chain name
+func tableKeyOf(table *nftables.Table) chainKey {
+	return chainKey{family: table.Family, table: table.Name}
+}
+
+// snapshot is an in-memory view of the live tables, chains and rules that a
+// plan is computed against. Rules are fetched lazily, once per chain.
+type snapshot struct {
+	conn       Conn
+	tables     []*nftables.Table
+	chains     []*nftables.Chain
+	rules      map[chainKey][]*nftables.Rule
+	sets       map[chainKey][]*nftables.Set
+	elements   map[setKey][]nftables.SetElement
+	flowtables map[chainKey][]*nftables.Flowtable
+	live       map[chainKey]bool
+	families   map[string]nftables.TableFamily
+}
+
+// unavailable wraps err with ErrUnavailable if netlink has no nftables
+// subsystem: without nfnetlink the socket is refused, and without nf_tables
+// the messages are rejected as invalid
+func unavailable(err error) error {
+	for _, errno := range []error{unix.EPROTONOSUPPORT, unix.EAFNOSUPPORT, unix.EINVAL, unix.EOPNOTSUPP} {
+		if errors.Is(err, errno) {
+			return fmt.Errorf("%w: %w", ErrUnavailable, err)
+		}
+	}
+	return err
+}
+
+func loadSnapshot(conn Conn) (*snapshot, error) {
+	tables, tablesErr := conn.ListTables()
+	if tablesErr != nil {
+		return nil, unavailable(tablesErr)
+	}
+	chains, chainsErr := conn.ListChains()
+	if chainsErr != nil {
+		return nil, chainsErr
+	}
+	return newSnapshot(conn, tables, chains), nil
+}
+
+func newSnapshot(conn Conn, tables []*nftables.Table, chains []*nftables.Chain) *snapshot {
+	s := &snapshot{
+		conn:       conn,
+		tables:     tables,
+		chains:     chains,
+		rules:      map[chainKey][]*nftables.Rule{},
+		sets:       map[chainKey][]*nftables.Set{},
+		elements:   map[setKey][]nftables.SetElement{},
+		flowtables: map[chainKey][]*nftables.Flowtable{},
+		live:       map[chainKey]bool{},
+		families:   map[string]nftables.TableFamily{},
+	}
+	for _, table := range tables {
+		s.live[tableKeyOf(table)] = true
+	}
+	for _, chain := range chains {
+		s.live[keyOf(chain)] = true
+	}
+	return s
+}
+
+func (s *snapshot) table(name string, family nftables.TableFamily) *nftables.Table {
+	for _, t := range s.tables {
+		if t.Name == name && t.Family == family {
+			return t
+		}
+	}
+	return nil
+}
+
+func (s *snapshot) chain(table *nftables.Table, name string) *nftables.Chain {
+	for _, ch := range s.chains {
+		if ch.Name == name && ch.Table.Name == table.Name && ch.Table.Family == table.Family {
+			return ch
+		}
+	}
+	return nil
+}
+
+// resolve finds a chain by its name and the name of its table in the family
+// the ruleset declares for that table, or in the only family that has one
+func (s *snapshot) resolve(chainName, tableName string) (*nftables.Chain, *nftables.Table, error) {
+	return s.resolveIn(0, tableName, chainName)
+}
+
+// tablesNamed returns the tables a chain of tableName is looked up in: the one
+// of family, or if family is zero the one declared by the ruleset, or else
+// every table of that name
+func (s *snapshot) tablesNamed(family nftables.TableFamily, tableName string) []*nftables.Table {
+	if family == 0 {
+		family = s.families[tableName]
+	}
+	var tables []*nftables.Table
+	for _, table := range s.tables {
+		if table.Name == tableName && (family == 0 || table.Family == family) {
+			tables = append(tables, table)
+		}
+	}
+	return tables
+}
+
+// resolveIn finds a chain by family, table and chain name. A zero family is
+// resolved by tablesNamed; chains of that name in tables of several families
+// are ambiguous.
+func (s *snapshot) resolveIn(family nftables.TableFamily, tableName, chainName string) (*nftables.Chain, *nftables.Table, error) {
+	tables := s.tablesNamed(family, tableName)
+	if len(tables) == 0 {
+		return nil, nil, fmt.Errorf("table %s %w", tableName, errNotExist)
+	}
+	var chain *nftables.Chain
+	var table *nftables.Table
+	for _, t := range tables {
+		ch := s.chain(t, chainName)
+		if ch == nil {
+			continue
+		}
+		if chain != nil {
+			return nil, nil, fmt.Errorf("chain %s is in table %s of several families, the family must be given", chainName, tableName)
+		}
+		chain, table = ch, t
+	}
+	if chain == nil {
+		return nil, nil, fmt.Errorf("chain %s %w in table %s", chainName, errNotExist, tableName)
+	}
+	return chain, table, nil
+}
+
+// ensureChain resolves the chain of config. If it does not exist and config
+// asks for it, its creation is added to p in the table of config, which must
+// be unambiguous.
+func (s *snapshot) ensureChain(p *Plan, config ChainConfig) (*nftables.Chain, *nftables.Table, error) {
+	chain, table, resolveErr := s.resolveIn(config.Family, config.Table, config.Name)
+	if resolveErr == nil || !config.Create || !errors.Is(resolveErr, errNotExist) {
+		return chain, table, resolveErr
+	}
+	tables := s.tablesNamed(config.Family, config.Table)
+	switch len(tables) {
+	case 0:
+		return nil, nil, resolveErr
+	case 1:
+		chain = chainFromConfig(tables[0], config)
+		s.chains = append(s.chains, chain)
+		p.Operations = append(p.Operations, Operation{Kind: OpAddChain, Chain: chain})
+		return chain, tables[0], nil
+	}
+	return nil, nil, fmt.Errorf("table %s exists in several families, the family of chain %s must be given", config.Table, config.Name)
+}
+
+func (s *snapshot) rulesOf(chain *nftables.Chain) ([]*nftables.Rule, error) {
+	key := keyOf(chain)
+	if rules, ok := s.rules[key]; ok {
+		return rules, nil
+	}
+
+	var rules []*nftables.Rule
+	if s.live[key] && s.conn != nil {
+		listed, rulesErr := s.conn.GetRules(chain.Table, chain)
+		if rulesErr != nil {
+			return nil, rulesErr
+		}
+		rules = listed
+	}
+	s.rules[key] = rules
+	return rules, nil
+}
+
+func (s *snapshot) build(newRules []NewRule) ([]*nftables.Rule, error) {
+	r := &Rules{resolve: s.resolve}
+	for _, rule := range newRules {
+		if err := rule(r); err != nil {
+			return nil, err
+		}
+	}
+	return r.rules, nil
+}
+
+// buildAbsent builds rules that must be absent. Rules of chains that do not
+// exist are absent already and skipped.
+func (s *snapshot) buildAbsent(newRules []NewRule) ([]*nftables.Rule, error) {
+	var result []*nftables.Rule
+	for _, rule := range newRules {
+		built, buildErr := s.build([]NewRule{rule})
+		if errors.Is(buildErr, errNotExist) {
+			continue
+		}
+		if buildErr != nil {
+			return nil, buildErr
+		}
+		result = append(result, built...)
+	}
+	return result, nil
+}
+
+func (s *snapshot) plan(rs *Ruleset) (*Plan, error) {
+	p := &Plan{}
+
+	for _, tc := range rs.Tables {
+		s.families[tc.Name] = tc.Family
+		table := s.table(tc.Name, tc.Family)
+		if table == nil {
+			table = &nftables.Table{Name: tc.Name, Family: tc.Family}
+			s.tables = append(s.tables, table)
+			p.Operations = append(p.Operations, Operation{Kind: OpAddTable, Table: table})
+		}
+
+		for _, cc := range tc.Chains {
+			if s.chain(table, cc.Name) != nil {
+				continue
+			}
+			chain := chainFromConfig(table, cc)
+			s.chains = append(s.chains, chain)
+			p.Operations = append(p.Operations, Operation{Kind: OpAddChain, Chain: chain})
+		}
+	}
+
+	for _, sc := range rs.Sets {
+		if sc.Absent {
+			continue
+		}
+		if err := s.addSet(p, sc); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, fc := range rs.Flowtables {
+		if fc.Absent {
+			continue
+		}
+		if err := s.addFlowtable(p, fc); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, jump := range rs.Jumps {
+		from, table, fromErr := s.resolve(jump.From, jump.Table)
+		if fromErr != nil {
+			return nil, fmt.Errorf("failed to get chain %s: %w", jump.From, fromErr)
+		}
+		if _, _, toErr := s.resolve(jump.To, jump.Table); toErr != nil {
+			return nil, fmt.Errorf("failed to get chain %s: %w", jump.To, toErr)
+		}
+
+		existing, rulesErr := s.rulesOf(from)
+		if rulesErr != nil {
+			return nil, rulesErr
+		}
+		if hasJump(existing, jump.To) {
+			continue
+		}
+
+		// Inserting without a position puts the jump at the head of the chain
+		rule := &nftables.Rule{
+			Table: table,
+			Chain: from,
+			Exprs: []expr.Any{
+				&expr.Counter{},
+				&expr.Verdict{Kind: expr.VerdictJump, Chain: jump.To},
+			},
+			UserData: Tag{Role: RoleJump}.userData(),
+		}
+		s.rules[keyOf(from)] = append([]*nftables.Rule{rule}, existing...)
+		p.Operations = append(p.Operations, Operation{Kind: OpInsertRule, Rule: rule})
+	}
+
+	present, presentErr := s.build(rs.Present)
+	if presentErr != nil {
+		return nil, presentErr
+	}
+	absent, absentErr := s.buildAbsent(rs.Absent)
+	if absentErr != nil {
+		return nil, absentErr
+	}
+
+	for _, rule := range absent {
+		if containsRule(present, rule) {
+			continue
+		}
+		if err := s.deleteWhere(p, rule.Chain, func(er *nftables.Rule) bool {
+			return sameMatch(rule.Exprs, er.Exprs) && ownedBy(er, rule)
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(rs.Prune) > 0 {
+		for _, chain := range s.chains {
+			if !s.live[keyOf(chain)] {
+				continue
+			}
+			if err := s.deleteWhere(p, chain, func(er *nftables.Rule) bool {
+				tag, ok := RuleTag(er)
+				return ok && matchesAny(rs.Prune, tag) && !containsRule(present, er)
+			}); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// Catch-all drop rules are added last so they stay at the end of their chains
+	slices.SortStableFunc(present, func(a, b *nftables.Rule) int {
+		return cmp.Compare(boolInt(isTailRule(a)), boolInt(isTailRule(b)))
+	})
+	for k, rule := range present {
+		existing, rulesErr := s.rulesOf(rule.Chain)
+		if rulesErr != nil {
+			return nil, rulesErr
+		}
+		if containsRule(existing, rule) {
+			continue
+		}
+
+		// A rule goes in front of the live rule following it in rs, e.g. a
+		// log rule in front of its drop rule, and other rules in front of a
+		// live tail rule
+		at := len(existing)
+		if i := nextLive(existing, rule, present[k+1:]); i >= 0 {
+			at = i
+			rule.Position = existing[i].Handle
+		} else if !isTailRule(rule) {
+			if i := slices.IndexFunc(existing, isTailRule); i >= 0 && existing[i].Handle != 0 {
+				at = i
+				rule.Position = existing[i].Handle
+			}
+		}
+		s.rules[keyOf(rule.Chain)] = slices.Insert(existing, at, rule)
+		if at < len(existing) {
+			p.Operations = append(p.Operations, Operation{Kind: OpInsertRule, Rule: rule})
+		} else {
+			p.Operations = append(p.Operations, Operation{Kind: OpAddRule, Rule: rule})
+		}
+	}
+
+	for _, se := range rs.Elements {
+		if err := s.updateElements(p, se); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, jump := range rs.Retire {
+		if err := s.retire(p, jump, rs.Purge); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, fc := range rs.Flowtables {
+		if !fc.Absent {
+			continue
+		}
+		if err := s.deleteFlowtable(p, fc); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, sc := range rs.Sets {
+		if !sc.Absent {
+			continue
+		}
+		if err := s.deleteSet(p, sc); err != nil {
+			return nil, err
+		}
+	}
+
+	return p, nil
+}
+
+// retire plans the deletion of the target chain of jump and of the jumps into
+// it, unless the chain still has rules. Missing chains are already retired.
+func (s *snapshot) retire(p *Plan, jump Jump, purge bool) error {
+	to, table, toErr := s.resolve(jump.To, jump.Table)
+	if toErr != nil {
+		return nil
+	}
+
+	if purge {
+		if err := s.deleteWhere(p, to, func(*nftables.Rule) bool { return true }); err != nil {
+			return err
+		}
+	}
+	remaining, rulesErr := s.rulesOf(to)
+	if rulesErr != nil {
+		return rulesErr
+	}
+	if len(remaining) > 0 {
+		return nil
+	}
+
+	for _, from := range s.chains {
+		if from.Table.Name != table.Name || from.Table.Family != table.Family {
+			continue
+		}
+		if err := s.deleteWhere(p, from, func(er *nftables.Rule) bool {
+			return hasJump([]*nftables.Rule{er}, jump.To)
+		}); err != nil {
+			return err
+		}
+	}
+
+	p.Operations = append(p.Operations, Operation{Kind: OpDeleteChain, Chain: to})
+	s.chains = slices.DeleteFunc(s.chains, func(ch *nftables.Chain) bool { return ch == to })
+	delete(s.live, keyOf(to))
+	delete(s.rules, keyOf(to))
+	return nil
+}
+
+// deleteWhere plans the deletion of every live rule of chain matched by match
+func (s *snapshot) deleteWhere(p *Plan, chain *nftables.Chain, match func(*nftables.Rule) bool) error {
+	existing, rulesErr := s.rulesOf(chain)
+	if rulesErr != nil {
+		return rulesErr
+	}
+	kept := existing[:0:0]
+	for _, er := range existing {
+		if er.Handle != 0 && match(er) {
+			p.Operations = append(p.Operations, Operation{Kind: OpDeleteRule, Rule: er})
+			continue
+		}
+		kept = append(kept, er)
+	}
+	s.rules[keyOf(chain)] = kept
+	return nil
+}
+
+func chainFromConfig(table *nftables.Table, config ChainConfig) *nftables.Chain {
+	chain := &nftables.Chain{
+		Name:     config.Name,
+		Table:    table,
+		Hooknum:  config.Hook,
+		Priority: config.Priority,
+		Policy:   config.Policy,
+	}
+	if config.Type != nil {
+		chain.Type = *config.Type
+	}
+	return chain
+}
+
+func hasJump(rules []*nftables.Rule, toChain string) bool {
+	for _, r := range rules {
+		for _, e := range r.Exprs {
+			if jump, ok := e.(*expr.Verdict); ok && jump.Kind == expr.VerdictJump && jump.Chain == toChain {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// containsRule reports whether an equivalent rule with the same tag is part of
+// rules. Rules listed from the kernel carry their table on the rule, not on the
+// chain.
+func containsRule(rules []*nftables.Rule, rule *nftables.Rule) bool {
+	return slices.ContainsFunc(rules, func(r *nftables.Rule) bool {
+		return r.Table.Name == rule.Table.Name &&
+			r.Table.Family == rule.Table.Family &&
+			r.Chain.Name == rule.Chain.Name &&
+			bytes.Equal(r.UserData, rule.UserData) &&
+			equalExprs(rule.Exprs, r.Exprs)
+	})
+}
+
+// nextLive returns the index in existing of the first live rule of following
+// in the chain of rule, or -1 if there is none
+func nextLive(existing []*nftables.Rule, rule *nftables.Rule, following []*nftables.Rule) int {
+	for _, next := range following {
+		if keyOf(next.Chain) != keyOf(rule.Chain) {
+			continue
+		}
+		if i := slices.IndexFunc(existing, func(r *nftables.Rule) bool {
+			return r.Handle != 0 && containsRule([]*nftables.Rule{r}, next)
+		}); i >= 0 {
+			return i
+		}
+	}
+	return -1
+}
+
+// ownedBy reports whether a live rule belongs to the owner of rule. Untagged
+// rules predate tagging and are claimed by any owner.
+func ownedBy(live, rule *nftables.Rule) bool {
+	liveTag, tagged := RuleTag(live)
+	if !tagged {
+		return true
+	}
+	ruleTag, _ := RuleTag(rule)
+	return liveTag == ruleTag
+}
+
+func matchesAny(tags []Tag, tag Tag) bool {
+	return slices.ContainsFunc(tags, func(t Tag) bool {
+		return t.Matches(tag)
+	})
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
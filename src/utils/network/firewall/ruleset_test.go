@@ -0,0 +1,106 @@
+//go:build linux
+
+package firewall
+
+import (
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/stretchr/testify/require"
+)
+
+func kinds(p *Plan) []OperationKind {
+	var result []OperationKind
+	for _, op := range p.Operations {
+		result = append(result, op.Kind)
+	}
+	return result
+}
+
+// commit pretends the planned rules were committed and got handles
+func commit(snap *snapshot) {
+	handle := uint64(1000)
+	for key, rules := range snap.rules {
+		snap.live[key] = true
+		for _, r := range rules {
+			if r.Handle == 0 {
+				r.Handle = handle
+				handle++
+			}
+		}
+	}
+}
+
+func TestPlan_EmptyRuleset(t *testing.T) {
+	snap := newSnapshot(nil, nil, nil)
+	plan, err := snap.plan(BridgeRuleset(DefaultPrefix, "eth0", "br0"))
+	require.NoError(t, err)
+
+	// 2 tables, 6 standard chains, 2 custom chains, 2 jumps, 9 rules
+	require.Len(t, plan.Operations, 21)
+	require.Equal(t, OpAddTable, plan.Operations[0].Kind)
+	require.Equal(t, FilterTable, plan.Operations[0].Table.Name)
+	require.Equal(t, OpInsertRule, plan.Operations[10].Kind)
+	require.Equal(t, OpInsertRule, plan.Operations[11].Kind)
+	for _, op := range plan.Operations[12:] {
+		require.Equal(t, OpAddRule, op.Kind)
+	}
+}
+
+func TestPlan_Idempotent(t *testing.T) {
+	snap := newSnapshot(nil, nil, nil)
+	desired := BridgeRuleset(DefaultPrefix, "eth0", "br0")
+	_, err := snap.plan(desired)
+	require.NoError(t, err)
+
+	plan, err := snap.plan(desired)
+	require.NoError(t, err)
+	require.Empty(t, plan.Operations)
+}
+
+func TestPlan_SwitchInterface(t *testing.T) {
+	snap := newSnapshot(nil, nil, nil)
+	_, err := snap.plan(BridgeRuleset(DefaultPrefix, "eth0", "br0"))
+	require.NoError(t, err)
+
+	commit(snap)
+
+	desired := &Ruleset{
+		Tables:  bridgeTables(DefaultPrefix),
+		Jumps:   bridgeJumps(DefaultPrefix),
+		Absent:  BridgeRules(DefaultPrefix, "eth0", "br0"),
+		Present: BridgeRules(DefaultPrefix, "wlan0", "br0"),
+	}
+	plan, err := snap.plan(desired)
+	require.NoError(t, err)
+
+	// Port rules are shared by both interfaces and stay untouched
+	require.Equal(t, []OperationKind{
+		OpDeleteRule, OpDeleteRule, OpDeleteRule,
+		OpAddRule, OpAddRule, OpAddRule,
+	}, kinds(plan))
+}
+
+func TestPlan_MissingTable(t *testing.T) {
+	snap := newSnapshot(nil, nil, nil)
+	_, err := snap.plan(&Ruleset{
+		Present: []NewRule{MasqueradeRule(PostRoutingChain, NATTable, "eth0")},
+	})
+	require.EqualError(t, err, "table nat does not exist")
+}
+
+func TestPlan_ExistingJump(t *testing.T) {
+	table := &nftables.Table{Name: FilterTable, Family: nftables.TableFamilyINet}
+	forward := &nftables.Chain{Name: ForwardChain, Table: table}
+	custom := &nftables.Chain{Name: "QEMU-FORWARD", Table: table}
+	snap := newSnapshot(nil, []*nftables.Table{table}, []*nftables.Chain{forward, custom})
+
+	desired := &Ruleset{Jumps: []Jump{{From: ForwardChain, To: "QEMU-FORWARD", Table: FilterTable}}}
+	plan, err := snap.plan(desired)
+	require.NoError(t, err)
+	require.Equal(t, []OperationKind{OpInsertRule}, kinds(plan))
+
+	plan, err = snap.plan(desired)
+	require.NoError(t, err)
+	require.Empty(t, plan.Operations)
+}
@@ -0,0 +1,421 @@
+//go:build linux
+
+package firewall
+
+import (
+	"fmt"
+	"maps"
+	"net"
+	"slices"
+	"strings"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/q-controller/network-utils/src/utils/network/lock"
+	"golang.org/x/sys/unix"
+)
+
+// SecurityRule allows traffic by transport protocol, destination port and
+// address prefix. Empty fields match any traffic. CIDR is the source of
+// inbound and the destination of outbound traffic.
+type SecurityRule struct {
+	Proto string `json:"proto,omitempty"`
+	Port  uint16 `json:"port,omitempty"`
+	CIDR  string `json:"cidr,omitempty"`
+}
+
+// SecurityGroup is a named set of rules for the traffic to (Inbound) and from
+// (Outbound) a tap device
+type SecurityGroup struct {
+	Name     string         `json:"name"`
+	Inbound  []SecurityRule `json:"inbound,omitempty"`
+	Outbound []SecurityRule `json:"outbound,omitempty"`
+}
+
+// SecurityGroups holds named groups and the names of the groups attached to
+// each tap. A tap with groups only sends and receives the traffic allowed by
+// one of them, replies to allowed traffic, ARP, DHCP and neighbor discovery.
+type SecurityGroups struct {
+	Groups      []SecurityGroup     `json:"groups"`
+	Attachments map[string][]string `json:"attachments"`
+}
+
+// tapChains returns the chains holding the inbound and outbound rules of tap
+func tapChains(prefix, tap string) (string, string) {
+	return prefix + "SG-" + tap + "-IN", prefix + "SG-" + tap + "-OUT"
+}
+
+// tapMaps returns the verdict maps from the output and input interface of a
+// frame to the inbound and outbound chain of its tap
+func tapMaps(prefix string) (string, string) {
+	return prefix + "TAP-IN", prefix + "TAP-OUT"
+}
+
+// ifnameKey returns the set key of an interface name
+func ifnameKey(name string) []byte {
+	key := make([]byte, unix.IFNAMSIZ)
+	copy(key, name)
+	return key
+}
+
+// InterfaceMapRule jumps to the chain mapped to the interface key of a frame
+// by the verdict map mapName. Frames of unmapped interfaces continue.
+func InterfaceMapRule(chainName, tableName string, key expr.MetaKey, mapName string) NewRule {
+	return func(rules *Rules) error {
+		chain, table, chainErr := rules.chain(chainName, tableName)
+		if chainErr != nil {
+			return chainErr
+		}
+
+		rules.rules = append(rules.rules, &nftables.Rule{
+			Table: table,
+			Chain: chain,
+			Exprs: []expr.Any{
+				// [ meta load iifname/oifname => reg 1 ]
+				&expr.Meta{Key: key, Register: 1},
+				// [ lookup reg 1 set mapName dreg 0 ]
+				&expr.Lookup{SourceRegister: 1, SetName: mapName, IsDestRegSet: true, DestRegister: 0},
+			},
+		})
+		return nil
+	}
+}
+
+// etherPrefix returns the expressions matching the source or destination
+// address of a bridged frame against prefix
+func etherPrefix(prefix *net.IPNet, source bool) ([]expr.Any, error) {
+	etherType := uint16(unix.ETH_P_IP)
+	offset := uint32(16) // dst IP offset (IPv4)
+	if source {
+		offset = 12 // src IP offset (IPv4)
+	}
+	ip := prefix.IP.To4()
+	if ip == nil || len(prefix.Mask) != net.IPv4len {
+		etherType = unix.ETH_P_IPV6
+		offset = 24 // dst IP offset (IPv6)
+		if source {
+			offset = 8 // src IP offset (IPv6)
+		}
+		ip = prefix.IP.To16()
+		if ip == nil || len(prefix.Mask) != net.IPv6len {
+			return nil, fmt.Errorf("invalid prefix %s", prefix)
+		}
+	}
+	size := uint32(len(ip))
+
+	return []expr.Any{
+		// [ meta load protocol => reg 1 ]
+		&expr.Meta{Key: expr.MetaKeyPROTOCOL, Register: 1},
+		// [ cmp eq reg 1 ether type ]
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: htons(etherType)},
+		// [ payload load IP => reg 1 ]
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: offset, Len: size},
+		// [ bitwise reg 1 = (reg 1 & mask) ^ 0 ]
+		&expr.Bitwise{
+			SourceRegister: 1,
+			DestRegister:   1,
+			Len:            size,
+			Mask:           []byte(prefix.Mask),
+			Xor:            make([]byte, size),
+		},
+		// [ cmp eq reg 1 network ]
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: ip.Mask(prefix.Mask)},
+	}, nil
+}
+
+// etherType returns the expressions matching the ether type of a frame
+func etherType(etherType uint16) []expr.Any {
+	return []expr.Any{
+		// [ meta load protocol => reg 1 ]
+		&expr.Meta{Key: expr.MetaKeyPROTOCOL, Register: 1},
+		// [ cmp eq reg 1 ether type ]
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: htons(etherType)},
+	}
+}
+
+// securityMatch returns the expressions matching the traffic allowed by rule
+func securityMatch(rule SecurityRule, inbound bool) ([]expr.Any, error) {
+	var exprs []expr.Any
+	if rule.CIDR != "" {
+		_, prefix, parseErr := net.ParseCIDR(rule.CIDR)
+		if parseErr != nil {
+			return nil, parseErr
+		}
+		match, matchErr := etherPrefix(prefix, inbound)
+		if matchErr != nil {
+			return nil, matchErr
+		}
+		exprs = append(exprs, match...)
+	}
+
+	switch {
+	case rule.Port != 0:
+		match, matchErr := destinationPort(rule.Proto, rule.Port)
+		if matchErr != nil {
+			return nil, fmt.Errorf("port %d needs protocol tcp or udp: %w", rule.Port, matchErr)
+		}
+		exprs = append(exprs, match...)
+	case rule.Proto != "":
+		var protoNum byte
+		switch rule.Proto {
+		case "icmp":
+			protoNum = unix.IPPROTO_ICMP
+		case "icmpv6":
+			protoNum = unix.IPPROTO_ICMPV6
+		default:
+			protoNum = protocolNumber(rule.Proto)
+		}
+		if protoNum == 0 {
+			return nil, fmt.Errorf("unsupported protocol %s", rule.Proto)
+		}
+		exprs = append(exprs,
+			// [ meta load l4proto => reg 1 ]
+			&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+			// [ cmp eq reg 1 protocol number ]
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{protoNum}},
+		)
+	}
+	return exprs, nil
+}
+
+// returnRule returns the frames matched by match to the calling chain
+func returnRule(chainName, tableName string, match []expr.Any) NewRule {
+	return func(rules *Rules) error {
+		chain, table, chainErr := rules.chain(chainName, tableName)
+		if chainErr != nil {
+			return chainErr
+		}
+
+		exprs := slices.Clone(match)
+		// [ immediate verdict RETURN ]
+		exprs = append(exprs, &expr.Verdict{Kind: expr.VerdictReturn})
+
+		rules.rules = append(rules.rules, &nftables.Rule{
+			Table: table,
+			Chain: chain,
+			Exprs: exprs,
+		})
+		return nil
+	}
+}
+
+// SecurityGroupRule returns the traffic allowed by rule to the calling chain.
+// It belongs into the inbound chain of a tap if inbound is set, into the
+// outbound chain otherwise.
+func SecurityGroupRule(chainName, tableName string, rule SecurityRule, inbound bool) NewRule {
+	return func(rules *Rules) error {
+		match, matchErr := securityMatch(rule, inbound)
+		if matchErr != nil {
+			return matchErr
+		}
+		return returnRule(chainName, tableName, match)(rules)
+	}
+}
+
+// TapDropRule drops every frame that reaches it
+func TapDropRule(chainName, tableName string) NewRule {
+	return func(rules *Rules) error {
+		chain, table, chainErr := rules.chain(chainName, tableName)
+		if chainErr != nil {
+			return chainErr
+		}
+
+		rules.rules = append(rules.rules, &nftables.Rule{
+			Table: table,
+			Chain: chain,
+			Exprs: []expr.Any{
+				// [ immediate verdict DROP ]
+				&expr.Verdict{Kind: expr.VerdictDrop},
+			},
+		})
+		return nil
+	}
+}
+
+// tapDispatchRules returns the rules sending frames to and from taps with
+// security groups through the verdict maps of prefix. Frames from a tap are
+// bridged (forward) or go to the host (input); frames to a tap are bridged
+// (forward) or come from the host (output).
+func tapDispatchRules(prefix string) []NewRule {
+	inMap, outMap := tapMaps(prefix)
+	tag := func(rule NewRule) NewRule {
+		return Tagged(Tag{Role: RoleTapDispatch}, rule)
+	}
+	return []NewRule{
+		tag(InterfaceMapRule(ForwardChain, TapTable, expr.MetaKeyIIFNAME, outMap)),
+		tag(InterfaceMapRule(InputChain, TapTable, expr.MetaKeyIIFNAME, outMap)),
+		tag(InterfaceMapRule(ForwardChain, TapTable, expr.MetaKeyOIFNAME, inMap)),
+		tag(InterfaceMapRule(OutputChain, TapTable, expr.MetaKeyOIFNAME, inMap)),
+	}
+}
+
+func (g *SecurityGroups) group(name string) (*SecurityGroup, bool) {
+	i := slices.IndexFunc(g.Groups, func(group SecurityGroup) bool { return group.Name == name })
+	if i < 0 {
+		return nil, false
+	}
+	return &g.Groups[i], true
+}
+
+// TapsUsing returns the sorted names of the taps group is attached to
+func (g *SecurityGroups) TapsUsing(group string) []string {
+	var taps []string
+	for tap, names := range g.Attachments {
+		if slices.Contains(names, group) {
+			taps = append(taps, tap)
+		}
+	}
+	slices.Sort(taps)
+	return taps
+}
+
+// TapRules returns the rules of the inbound and outbound chain of tap. Every
+// rule is tagged with tap and its role.
+func (g *SecurityGroups) TapRules(prefix, tap string) ([]NewRule, error) {
+	inChain, outChain := tapChains(prefix, tap)
+	tag := func(role string, rule NewRule) NewRule {
+		return Tagged(Tag{Tap: tap, Role: role}, rule)
+	}
+
+	rules := []NewRule{
+		tag(RoleSecurityGroup, returnRule(inChain, TapTable, ctState(expr.CtStateBitESTABLISHED|expr.CtStateBitRELATED))),
+		tag(RoleSecurityGroup, returnRule(inChain, TapTable, etherType(unix.ETH_P_ARP))),
+		tag(RoleSecurityGroup, returnRule(inChain, TapTable, neighborDiscovery(true))),
+		tag(RoleSecurityGroup, SecurityGroupRule(inChain, TapTable, SecurityRule{Proto: "udp", Port: 68}, true)),
+		tag(RoleSecurityGroup, SecurityGroupRule(inChain, TapTable, SecurityRule{Proto: "udp", Port: 546}, true)),
+		tag(RoleSecurityGroup, returnRule(outChain, TapTable, ctState(expr.CtStateBitESTABLISHED|expr.CtStateBitRELATED))),
+		tag(RoleSecurityGroup, returnRule(outChain, TapTable, etherType(unix.ETH_P_ARP))),
+		tag(RoleSecurityGroup, returnRule(outChain, TapTable, neighborDiscovery(false))),
+		tag(RoleSecurityGroup, SecurityGroupRule(outChain, TapTable, SecurityRule{Proto: "udp", Port: 67}, false)),
+		tag(RoleSecurityGroup, SecurityGroupRule(outChain, TapTable, SecurityRule{Proto: "udp", Port: 547}, false)),
+	}
+	for _, name := range g.Attachments[tap] {
+		group, ok := g.group(name)
+		if !ok {
+			return nil, fmt.Errorf("security group %s of tap %s does not exist", name, tap)
+		}
+		for _, rule := range group.Inbound {
+			rules = append(rules, tag(RoleSecurityGroup, SecurityGroupRule(inChain, TapTable, rule, true)))
+		}
+		for _, rule := range group.Outbound {
+			rules = append(rules, tag(RoleSecurityGroup, SecurityGroupRule(outChain, TapTable, rule, false)))
+		}
+	}
+	return append(rules,
+		tag(RoleTapDrop, TapDropRule(inChain, TapTable)),
+		tag(RoleTapDrop, TapDropRule(outChain, TapTable)),
+	), nil
+}
+
+// Ruleset returns the desired state of the chains of taps. Only these chains
+// are compiled, so after a change of a group only the taps returned by
+// TapsUsing need to be passed. Taps without groups are detached: their
+// chains and map elements are removed.
+func (g *SecurityGroups) Ruleset(prefix string, taps ...string) (*Ruleset, error) {
+	table := StandardTapTable
+	table.Chains = slices.Clone(StandardTapTable.Chains)
+	inMap, outMap := tapMaps(prefix)
+	rs := &Ruleset{
+		Sets: []SetConfig{
+			{Name: inMap, Table: TapTable, KeyType: nftables.TypeIFName, DataType: nftables.TypeVerdict, IsMap: true},
+			{Name: outMap, Table: TapTable, KeyType: nftables.TypeIFName, DataType: nftables.TypeVerdict, IsMap: true},
+		},
+		Present: tapDispatchRules(prefix),
+	}
+
+	attachedIn := SetElements{Set: inMap, Table: TapTable}
+	attachedOut := SetElements{Set: outMap, Table: TapTable}
+	detachedIn := SetElements{Set: inMap, Table: TapTable, Absent: true}
+	detachedOut := SetElements{Set: outMap, Table: TapTable, Absent: true}
+	for _, tap := range taps {
+		inChain, outChain := tapChains(prefix, tap)
+		rs.Prune = append(rs.Prune, Tag{Tap: tap, Role: RoleSecurityGroup}, Tag{Tap: tap, Role: RoleTapDrop})
+
+		if len(g.Attachments[tap]) == 0 {
+			detachedIn.Elements = append(detachedIn.Elements, nftables.SetElement{Key: ifnameKey(tap)})
+			detachedOut.Elements = append(detachedOut.Elements, nftables.SetElement{Key: ifnameKey(tap)})
+			rs.Retire = append(rs.Retire, Jump{To: inChain, Table: TapTable}, Jump{To: outChain, Table: TapTable})
+			continue
+		}
+
+		rules, rulesErr := g.TapRules(prefix, tap)
+		if rulesErr != nil {
+			return nil, rulesErr
+		}
+		rs.Present = append(rs.Present, rules...)
+		table.Chains = append(table.Chains,
+			ChainConfig{Name: inChain, Table: TapTable, Create: true},
+			ChainConfig{Name: outChain, Table: TapTable, Create: true},
+		)
+		attachedIn.Elements = append(attachedIn.Elements, nftables.SetElement{
+			Key:         ifnameKey(tap),
+			VerdictData: &expr.Verdict{Kind: expr.VerdictJump, Chain: inChain},
+		})
+		attachedOut.Elements = append(attachedOut.Elements, nftables.SetElement{
+			Key:         ifnameKey(tap),
+			VerdictData: &expr.Verdict{Kind: expr.VerdictJump, Chain: outChain},
+		})
+	}
+
+	rs.Tables = []TableConfig{table}
+	rs.Elements = []SetElements{attachedIn, attachedOut, detachedIn, detachedOut}
+	return rs, nil
+}
+
+// ApplySecurityGroups compiles the chains of taps in the host namespace
+func ApplySecurityGroups(prefix string, groups *SecurityGroups, taps ...string) error {
+	return Host().ApplySecurityGroups(prefix, groups, taps...)
+}
+
+// ApplySecurityGroups compiles the chains of taps in the namespace. Without
+// taps every attached tap is compiled and taps that have chains but are no
+// longer attached are detached.
+func (f *Firewall) ApplySecurityGroups(prefix string, groups *SecurityGroups, taps ...string) error {
+	unlock, lockErr := lock.Acquire()
+	if lockErr != nil {
+		return lockErr
+	}
+	defer unlock()
+
+	if len(taps) == 0 {
+		live, liveErr := f.securedTaps(prefix)
+		if liveErr != nil {
+			return liveErr
+		}
+		taps = slices.Sorted(maps.Keys(groups.Attachments))
+		for _, tap := range live {
+			if !slices.Contains(taps, tap) {
+				taps = append(taps, tap)
+			}
+		}
+	}
+
+	desired, desiredErr := groups.Ruleset(prefix, taps...)
+	if desiredErr != nil {
+		return desiredErr
+	}
+	return f.Reconcile(desired)
+}
+
+// securedTaps returns the taps with security group chains of prefix
+func (f *Firewall) securedTaps(prefix string) ([]string, error) {
+	chains, chainsErr := f.conn.ListChains()
+	if chainsErr != nil {
+		return nil, chainsErr
+	}
+
+	var taps []string
+	for _, chain := range chains {
+		if chain.Table.Name != TapTable || chain.Table.Family != nftables.TableFamilyBridge {
+			continue
+		}
+		tap, ok := strings.CutPrefix(chain.Name, prefix+"SG-")
+		if !ok {
+			continue
+		}
+		if tap, ok = strings.CutSuffix(tap, "-OUT"); ok {
+			taps = append(taps, tap)
+		}
+	}
+	return taps, nil
+}
@@ -0,0 +1,124 @@
+//go:build linux
+
+package firewall
+
+import (
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/stretchr/testify/require"
+)
+
+func testGroups() *SecurityGroups {
+	return &SecurityGroups{
+		Groups: []SecurityGroup{
+			{Name: "web", Inbound: []SecurityRule{{Proto: "tcp", Port: 80}, {Proto: "tcp", Port: 443, CIDR: "10.0.0.0/8"}}},
+			{Name: "ssh", Inbound: []SecurityRule{{Proto: "tcp", Port: 22}}, Outbound: []SecurityRule{{CIDR: "0.0.0.0/0"}}},
+		},
+		Attachments: map[string][]string{
+			"tap0": {"web", "ssh"},
+			"tap1": {"ssh"},
+		},
+	}
+}
+
+func mapTargets(t *testing.T, conn Conn, mapName string) map[string]string {
+	sets, err := conn.GetSets(&nftables.Table{Name: TapTable, Family: nftables.TableFamilyBridge})
+	require.NoError(t, err)
+	result := map[string]string{}
+	for _, set := range sets {
+		if set.Name != mapName {
+			continue
+		}
+		elements, elementsErr := conn.GetSetElements(set)
+		require.NoError(t, elementsErr)
+		for _, e := range elements {
+			result[string(e.Key[:4])] = e.VerdictData.Chain
+		}
+	}
+	return result
+}
+
+func TestApplySecurityGroups(t *testing.T) {
+	conn := useFakeConn(t)
+	groups := testGroups()
+	require.NoError(t, ApplySecurityGroups(DefaultPrefix, groups))
+
+	inMap, outMap := tapMaps(DefaultPrefix)
+	in0, out0 := tapChains(DefaultPrefix, "tap0")
+	in1, out1 := tapChains(DefaultPrefix, "tap1")
+	require.Equal(t, map[string]string{"tap0": in0, "tap1": in1}, mapTargets(t, conn, inMap))
+	require.Equal(t, map[string]string{"tap0": out0, "tap1": out1}, mapTargets(t, conn, outMap))
+	require.Len(t, liveRules(t, conn, ForwardChain, TapTable), 2)
+
+	// 5 implicit rules, 3 group rules and the drop
+	inbound := liveRules(t, conn, in0, TapTable)
+	require.Len(t, inbound, 9)
+	last := inbound[len(inbound)-1].Exprs
+	require.Equal(t, &expr.Verdict{Kind: expr.VerdictDrop}, last[len(last)-1])
+	require.Len(t, liveRules(t, conn, in1, TapTable), 7)
+
+	// Applying again changes nothing
+	flushes := conn.Flushes
+	require.NoError(t, ApplySecurityGroups(DefaultPrefix, groups))
+	require.Equal(t, flushes, conn.Flushes)
+}
+
+func TestSecurityGroups_RecompileAffectedTaps(t *testing.T) {
+	conn := useFakeConn(t)
+	groups := testGroups()
+	require.NoError(t, ApplySecurityGroups(DefaultPrefix, groups))
+
+	groups.Groups[0].Inbound = append(groups.Groups[0].Inbound, SecurityRule{Proto: "udp", Port: 5353})
+	taps := groups.TapsUsing("web")
+	require.Equal(t, []string{"tap0"}, taps)
+
+	desired, err := groups.Ruleset(DefaultPrefix, taps...)
+	require.NoError(t, err)
+	plan, err := desired.Plan()
+	require.NoError(t, err)
+	in0, _ := tapChains(DefaultPrefix, "tap0")
+	require.Len(t, plan.Operations, 1)
+	require.Equal(t, OpInsertRule, plan.Operations[0].Kind)
+	require.Equal(t, in0, plan.Operations[0].Rule.Chain.Name)
+	require.NoError(t, plan.Apply())
+
+	// The new rule goes in front of the drop
+	inbound := liveRules(t, conn, in0, TapTable)
+	require.Len(t, inbound, 10)
+	last := inbound[len(inbound)-1].Exprs
+	require.Equal(t, &expr.Verdict{Kind: expr.VerdictDrop}, last[len(last)-1])
+}
+
+func TestSecurityGroups_Detach(t *testing.T) {
+	conn := useFakeConn(t)
+	groups := testGroups()
+	require.NoError(t, ApplySecurityGroups(DefaultPrefix, groups))
+
+	delete(groups.Attachments, "tap0")
+	require.NoError(t, ApplySecurityGroups(DefaultPrefix, groups))
+
+	in0, out0 := tapChains(DefaultPrefix, "tap0")
+	in1, _ := tapChains(DefaultPrefix, "tap1")
+	require.NotContains(t, chainNames(t, conn), in0)
+	require.NotContains(t, chainNames(t, conn), out0)
+	inMap, _ := tapMaps(DefaultPrefix)
+	require.Equal(t, map[string]string{"tap1": in1}, mapTargets(t, conn, inMap))
+
+	// Detaching again is a no-op
+	flushes := conn.Flushes
+	require.NoError(t, ApplySecurityGroups(DefaultPrefix, groups, "tap0"))
+	require.Equal(t, flushes, conn.Flushes)
+}
+
+func TestSecurityGroups_Invalid(t *testing.T) {
+	useFakeConn(t)
+	groups := testGroups()
+	groups.Attachments["tap2"] = []string{"db"}
+	require.Error(t, ApplySecurityGroups(DefaultPrefix, groups, "tap2"))
+
+	groups = testGroups()
+	groups.Groups[0].Inbound = append(groups.Groups[0].Inbound, SecurityRule{Proto: "icmp", Port: 8})
+	require.Error(t, ApplySecurityGroups(DefaultPrefix, groups, "tap0"))
+}
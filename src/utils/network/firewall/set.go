@@ -0,0 +1,406 @@
+//go:build linux
+
+package firewall
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"slices"
+	"time"
+
+	"github.com/google/nftables"
+)
+
+// SetConfig describes a named set of a table. Its elements are managed at
+// runtime or through the Elements of a Ruleset. A map also has a DataType.
+// Rules add the elements of a Dynamic set, which expire after Timeout if it is
+// set. With Absent the set must not exist.
+type SetConfig struct {
+	Name     string
+	Table    string
+	KeyType  nftables.SetDatatype
+	DataType nftables.SetDatatype
+	Interval bool
+	IsMap    bool
+	Dynamic  bool
+	Timeout  time.Duration
+	Absent   bool
+}
+
+// SetElements describes elements of the named set Set that must be present, or
+// absent with Absent. Present map elements with another value are replaced.
+type SetElements struct {
+	Set      string
+	Table    string
+	Elements []nftables.SetElement
+	Absent   bool
+}
+
+type setKey struct {
+	table chainKey
+	name  string
+}
+
+// resolveTable finds a table by name. Tables declared by the ruleset take
+// precedence over same-named tables of other families.
+func (s *snapshot) resolveTable(tableName string) (*nftables.Table, error) {
+	if family, ok := s.families[tableName]; ok {
+		return s.table(tableName, family), nil
+	}
+	for _, table := range s.tables {
+		if table.Name == tableName {
+			return table, nil
+		}
+	}
+	return nil, fmt.Errorf("table %s %w", tableName, errNotExist)
+}
+
+func (s *snapshot) setsOf(table *nftables.Table) ([]*nftables.Set, error) {
+	key := tableKeyOf(table)
+	if sets, ok := s.sets[key]; ok {
+		return sets, nil
+	}
+
+	var sets []*nftables.Set
+	if s.live[key] && s.conn != nil {
+		listed, setsErr := s.conn.GetSets(table)
+		if setsErr != nil {
+			return nil, setsErr
+		}
+		sets = listed
+	}
+	s.sets[key] = sets
+	return sets, nil
+}
+
+// addSet plans the creation of a set unless a set with its name exists
+func (s *snapshot) addSet(p *Plan, config SetConfig) error {
+	table, tableErr := s.resolveTable(config.Table)
+	if tableErr != nil {
+		return tableErr
+	}
+	sets, setsErr := s.setsOf(table)
+	if setsErr != nil {
+		return setsErr
+	}
+	if slices.ContainsFunc(sets, func(set *nftables.Set) bool { return set.Name == config.Name }) {
+		return nil
+	}
+
+	set := &nftables.Set{
+		Table:      table,
+		Name:       config.Name,
+		KeyType:    config.KeyType,
+		DataType:   config.DataType,
+		Interval:   config.Interval,
+		IsMap:      config.IsMap,
+		Dynamic:    config.Dynamic,
+		HasTimeout: config.Timeout > 0,
+		Timeout:    config.Timeout,
+	}
+	s.sets[tableKeyOf(table)] = append(sets, set)
+	s.elements[setKey{table: tableKeyOf(table), name: set.Name}] = nil
+	p.Operations = append(p.Operations, Operation{Kind: OpAddSet, Set: set})
+	return nil
+}
+
+// deleteSet plans the deletion of a set. Missing sets are deleted already.
+func (s *snapshot) deleteSet(p *Plan, config SetConfig) error {
+	set, setErr := s.findSet(config.Table, config.Name)
+	if errors.Is(setErr, errNotExist) {
+		return nil
+	}
+	if setErr != nil {
+		return setErr
+	}
+
+	p.Operations = append(p.Operations, Operation{Kind: OpDeleteSet, Set: set})
+	key := tableKeyOf(set.Table)
+	s.sets[key] = slices.DeleteFunc(slices.Clone(s.sets[key]), func(other *nftables.Set) bool { return other == set })
+	delete(s.elements, setKey{table: key, name: set.Name})
+	return nil
+}
+
+// findSet returns the set name of the table tableName
+func (s *snapshot) findSet(tableName, name string) (*nftables.Set, error) {
+	table, tableErr := s.resolveTable(tableName)
+	if tableErr != nil {
+		return nil, tableErr
+	}
+	sets, setsErr := s.setsOf(table)
+	if setsErr != nil {
+		return nil, setsErr
+	}
+	for _, set := range sets {
+		if set.Name == name {
+			return set, nil
+		}
+	}
+	return nil, fmt.Errorf("set %s %w in table %s", name, errNotExist, tableName)
+}
+
+func (s *snapshot) elementsOf(set *nftables.Set) ([]nftables.SetElement, error) {
+	key := setKey{table: tableKeyOf(set.Table), name: set.Name}
+	if elements, ok := s.elements[key]; ok {
+		return elements, nil
+	}
+
+	var elements []nftables.SetElement
+	if s.conn != nil {
+		listed, elementsErr := s.conn.GetSetElements(set)
+		if elementsErr != nil {
+			return nil, elementsErr
+		}
+		elements = listed
+	}
+	s.elements[key] = elements
+	return elements, nil
+}
+
+// updateElements plans the changes that bring the elements of a set to desired.
+// Elements of a missing set are absent already.
+func (s *snapshot) updateElements(p *Plan, desired SetElements) error {
+	set, setErr := s.findSet(desired.Table, desired.Set)
+	if desired.Absent && errors.Is(setErr, errNotExist) {
+		return nil
+	}
+	if setErr != nil {
+		return setErr
+	}
+	live, elementsErr := s.elementsOf(set)
+	if elementsErr != nil {
+		return elementsErr
+	}
+
+	var added, deleted []nftables.SetElement
+	for _, element := range desired.Elements {
+		i := slices.IndexFunc(live, func(e nftables.SetElement) bool { return sameElementKey(e, element) })
+		switch {
+		case desired.Absent && i >= 0:
+			deleted = append(deleted, live[i])
+		case desired.Absent:
+		case i >= 0 && sameElementValue(live[i], element):
+		case i >= 0:
+			deleted = append(deleted, live[i])
+			added = append(added, element)
+		default:
+			added = append(added, element)
+		}
+	}
+
+	if len(deleted) > 0 {
+		p.Operations = append(p.Operations, Operation{Kind: OpDeleteElements, Set: set, Elements: deleted})
+		live = slices.DeleteFunc(slices.Clone(live), func(e nftables.SetElement) bool {
+			return slices.ContainsFunc(deleted, func(d nftables.SetElement) bool { return sameElementKey(d, e) })
+		})
+	}
+	if len(added) > 0 {
+		p.Operations = append(p.Operations, Operation{Kind: OpAddElements, Set: set, Elements: added})
+		live = append(live, added...)
+	}
+	s.elements[setKey{table: tableKeyOf(set.Table), name: set.Name}] = live
+	return nil
+}
+
+func sameElementKey(a, b nftables.SetElement) bool {
+	return bytes.Equal(a.Key, b.Key) && a.IntervalEnd == b.IntervalEnd
+}
+
+// sameElementValue reports whether two map elements map to the same value
+func sameElementValue(a, b nftables.SetElement) bool {
+	if (a.VerdictData == nil) != (b.VerdictData == nil) {
+		return false
+	}
+	if a.VerdictData != nil && !exprEqual(a.VerdictData, b.VerdictData) {
+		return false
+	}
+	return bytes.Equal(a.Val, b.Val)
+}
+
+// lookupSet returns the live set name of table
+func (f *Firewall) lookupSet(tableName, name string) (*nftables.Set, error) {
+	snap, snapErr := loadSnapshot(f.conn)
+	if snapErr != nil {
+		return nil, snapErr
+	}
+	return snap.findSet(tableName, name)
+}
+
+// prefixElements returns the interval set elements covering prefix, IPv4 or
+// IPv6: its first address and the address following its last one.
+func prefixElements(prefix *net.IPNet) ([]nftables.SetElement, error) {
+	start := prefix.IP.To4()
+	if start == nil || len(prefix.Mask) != net.IPv4len {
+		start = prefix.IP.To16()
+		if start == nil || len(prefix.Mask) != net.IPv6len {
+			return nil, fmt.Errorf("invalid prefix %s", prefix)
+		}
+	}
+	start = start.Mask(prefix.Mask)
+
+	elements := []nftables.SetElement{{Key: start}}
+	last := make(net.IP, len(start))
+	for i := range start {
+		last[i] = start[i] | ^prefix.Mask[i]
+	}
+	// The end of an interval reaching the last address is implicit
+	if !slices.ContainsFunc(last, func(b byte) bool { return b != 0xff }) {
+		return elements, nil
+	}
+	end := new(big.Int).Add(new(big.Int).SetBytes(last), big.NewInt(1)).FillBytes(make([]byte, len(start)))
+	return append(elements, nftables.SetElement{Key: end, IntervalEnd: true}), nil
+}
+
+// interval holds the addresses from start up to, but not including, end
+type interval struct {
+	start, end *big.Int
+}
+
+// addressBits returns the size in bytes and bits of IPv4 or IPv6 addresses
+func addressBits(ipv6 bool) (int, int) {
+	if ipv6 {
+		return net.IPv6len, net.IPv6len * 8
+	}
+	return net.IPv4len, net.IPv4len * 8
+}
+
+// prefixInterval returns the interval of prefix
+func prefixInterval(prefix *net.IPNet) (interval, error) {
+	elements, elementsErr := prefixElements(prefix)
+	if elementsErr != nil {
+		return interval{}, elementsErr
+	}
+	return elementIntervals(elements, len(elements[0].Key) == net.IPv6len)[0], nil
+}
+
+// elementIntervals returns the intervals of the elements of an interval set
+// without overlaps, IPv6 ones if ipv6 is set. Every start is paired with the
+// first end following it.
+func elementIntervals(elements []nftables.SetElement, ipv6 bool) []interval {
+	var starts, ends []*big.Int
+	for _, e := range elements {
+		if e.IntervalEnd {
+			ends = append(ends, new(big.Int).SetBytes(e.Key))
+		} else {
+			starts = append(starts, new(big.Int).SetBytes(e.Key))
+		}
+	}
+	slices.SortFunc(starts, (*big.Int).Cmp)
+	slices.SortFunc(ends, (*big.Int).Cmp)
+
+	_, bits := addressBits(ipv6)
+	limit := new(big.Int).Lsh(big.NewInt(1), uint(bits))
+	var result []interval
+	for _, start := range starts {
+		end := limit
+		if i := slices.IndexFunc(ends, func(e *big.Int) bool { return e.Cmp(start) > 0 }); i >= 0 {
+			end = ends[i]
+		}
+		result = append(result, interval{start: start, end: end})
+	}
+	return result
+}
+
+// mergeIntervals returns the union of a and b, sorted, with overlapping and
+// adjacent intervals joined, as the kernel refuses overlapping elements
+func mergeIntervals(a, b []interval) []interval {
+	all := slices.Concat(a, b)
+	slices.SortFunc(all, func(a, b interval) int { return a.start.Cmp(b.start) })
+	var result []interval
+	for _, iv := range all {
+		if n := len(result); n > 0 && iv.start.Cmp(result[n-1].end) <= 0 {
+			if iv.end.Cmp(result[n-1].end) > 0 {
+				result[n-1].end = iv.end
+			}
+			continue
+		}
+		result = append(result, iv)
+	}
+	return result
+}
+
+// subtractIntervals returns the addresses of intervals that are not in
+// removed, splitting the intervals removed cuts in two
+func subtractIntervals(intervals, removed []interval) []interval {
+	result := mergeIntervals(intervals, nil)
+	for _, cut := range mergeIntervals(removed, nil) {
+		var next []interval
+		for _, iv := range result {
+			if cut.end.Cmp(iv.start) <= 0 || cut.start.Cmp(iv.end) >= 0 {
+				next = append(next, iv)
+				continue
+			}
+			if iv.start.Cmp(cut.start) < 0 {
+				next = append(next, interval{start: iv.start, end: cut.start})
+			}
+			if cut.end.Cmp(iv.end) < 0 {
+				next = append(next, interval{start: cut.end, end: iv.end})
+			}
+		}
+		result = next
+	}
+	return result
+}
+
+// intervalElements returns the interval set elements of intervals, which must
+// not overlap
+func intervalElements(intervals []interval, ipv6 bool) []nftables.SetElement {
+	size, bits := addressBits(ipv6)
+	limit := new(big.Int).Lsh(big.NewInt(1), uint(bits))
+	var elements []nftables.SetElement
+	for _, iv := range intervals {
+		elements = append(elements, nftables.SetElement{Key: iv.start.FillBytes(make([]byte, size))})
+		// The end of an interval reaching the last address is implicit
+		if iv.end.Cmp(limit) < 0 {
+			elements = append(elements, nftables.SetElement{Key: iv.end.FillBytes(make([]byte, size)), IntervalEnd: true})
+		}
+	}
+	return elements
+}
+
+// intervalPrefixes returns the fewest prefixes covering exactly iv
+func intervalPrefixes(iv interval, ipv6 bool) []*net.IPNet {
+	size, bits := addressBits(ipv6)
+	var result []*net.IPNet
+	start := new(big.Int).Set(iv.start)
+	for start.Cmp(iv.end) < 0 {
+		// The largest block aligned on start that ends within iv
+		host := int(start.TrailingZeroBits())
+		if start.Sign() == 0 {
+			host = bits
+		}
+		remaining := new(big.Int).Sub(iv.end, start)
+		for host > 0 && new(big.Int).Lsh(big.NewInt(1), uint(host)).Cmp(remaining) > 0 {
+			host--
+		}
+		result = append(result, &net.IPNet{
+			IP:   net.IP(start.FillBytes(make([]byte, size))),
+			Mask: net.CIDRMask(bits-host, bits),
+		})
+		start.Add(start, new(big.Int).Lsh(big.NewInt(1), uint(host)))
+	}
+	return result
+}
+
+// elementPrefixes returns the prefixes covering the elements of an interval
+// set, IPv6 prefixes if ipv6 is set. An interval that is not a single prefix,
+// e.g. two adjacent prefixes merged, is covered by several.
+func elementPrefixes(elements []nftables.SetElement, ipv6 bool) []*net.IPNet {
+	var result []*net.IPNet
+	for _, iv := range elementIntervals(elements, ipv6) {
+		result = append(result, intervalPrefixes(iv, ipv6)...)
+	}
+	return result
+}
+
+// portElements returns the set elements of ports
+func portElements(ports []uint16) []nftables.SetElement {
+	var elements []nftables.SetElement
+	for _, port := range ports {
+		elements = append(elements, nftables.SetElement{Key: htons(port)})
+	}
+	return elements
+}
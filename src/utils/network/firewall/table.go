@@ -2,7 +2,10 @@
 
 package firewall
 
-import "github.com/google/nftables"
+import (
+	"github.com/google/nftables"
+	"github.com/q-controller/network-utils/src/utils/network/lock"
+)
 
 // TableConfig defines the configuration for a complete table
 type TableConfig struct {
@@ -14,6 +17,7 @@ type TableConfig struct {
 const (
 	FilterTable      = "filter"
 	NATTable         = "nat"
+	TapTable         = "taps"
 	InputChain       = "INPUT"
 	ForwardChain     = "FORWARD"
 	OutputChain      = "OUTPUT"
@@ -57,6 +61,50 @@ var (
 		},
 	}
 
+	// StandardTapTable sees the frames bridged to and from single tap devices
+	StandardTapTable = TableConfig{
+		Name:   TapTable,
+		Family: nftables.TableFamilyBridge,
+		Chains: []ChainConfig{
+			{
+				Name:     PreroutingChain,
+				Table:    TapTable,
+				Create:   true,
+				Type:     &[]nftables.ChainType{nftables.ChainTypeFilter}[0],
+				Hook:     nftables.ChainHookPrerouting,
+				Priority: nftables.ChainPriorityFilter,
+				Policy:   getChainPolicyAccept(),
+			},
+			{
+				Name:     InputChain,
+				Table:    TapTable,
+				Create:   true,
+				Type:     &[]nftables.ChainType{nftables.ChainTypeFilter}[0],
+				Hook:     nftables.ChainHookInput,
+				Priority: nftables.ChainPriorityFilter,
+				Policy:   getChainPolicyAccept(),
+			},
+			{
+				Name:     ForwardChain,
+				Table:    TapTable,
+				Create:   true,
+				Type:     &[]nftables.ChainType{nftables.ChainTypeFilter}[0],
+				Hook:     nftables.ChainHookForward,
+				Priority: nftables.ChainPriorityFilter,
+				Policy:   getChainPolicyAccept(),
+			},
+			{
+				Name:     OutputChain,
+				Table:    TapTable,
+				Create:   true,
+				Type:     &[]nftables.ChainType{nftables.ChainTypeFilter}[0],
+				Hook:     nftables.ChainHookOutput,
+				Priority: nftables.ChainPriorityFilter,
+				Policy:   getChainPolicyAccept(),
+			},
+		},
+	}
+
 	StandardNATTable = TableConfig{
 		Name:   NATTable,
 		Family: nftables.TableFamilyIPv4,
@@ -70,6 +118,15 @@ var (
 				Priority: nftables.ChainPriorityNATDest,
 				Policy:   getChainPolicyAccept(),
 			},
+			{
+				Name:     OutputChain,
+				Table:    NATTable,
+				Create:   true,
+				Type:     &[]nftables.ChainType{nftables.ChainTypeNAT}[0],
+				Hook:     nftables.ChainHookOutput,
+				Priority: nftables.ChainPriorityNATDest,
+				Policy:   getChainPolicyAccept(),
+			},
 			{
 				Name:     PostRoutingChain,
 				Table:    NATTable,
@@ -84,94 +141,62 @@ var (
 )
 
 // CreateTableFromConfig creates a table and its chains based on the provided configuration
-func CreateTableFromConfig(conn *nftables.Conn, config TableConfig) error {
-	// Check if table already exists
-	tables, tablesErr := conn.ListTables()
-	if tablesErr != nil {
-		return tablesErr
+func CreateTableFromConfig(conn Conn, config TableConfig) error {
+	unlock, lockErr := lock.Acquire()
+	if lockErr != nil {
+		return lockErr
 	}
+	defer unlock()
 
-	var table *nftables.Table
-	for _, t := range tables {
-		if t.Name == config.Name && t.Family == config.Family {
-			table = t
-			break
-		}
+	snap, snapErr := loadSnapshot(conn)
+	if snapErr != nil {
+		return snapErr
 	}
 
+	plan := &Plan{conn: conn}
+
 	// Create table if it doesn't exist
+	table := snap.table(config.Name, config.Family)
 	if table == nil {
 		table = &nftables.Table{
 			Name:   config.Name,
 			Family: config.Family,
 		}
-		conn.AddTable(table)
+		snap.tables = append(snap.tables, table)
+		plan.Operations = append(plan.Operations, Operation{Kind: OpAddTable, Table: table})
 	}
-
-	// Create chains
-	if err := createChainsFromConfig(conn, table, config.Chains); err != nil {
-		return err
+	for _, chainConfig := range config.Chains {
+		// Chains are looked up in this table only, not in same-named tables of
+		// other families
+		chainConfig.Table = table.Name
+		chainConfig.Family = table.Family
+		if _, _, err := snap.ensureChain(plan, chainConfig); err != nil {
+			return err
+		}
 	}
 
-	// Flush all changes
-	return conn.Flush()
+	// Commit all changes at once
+	return plan.Apply()
 }
 
 // CreateStandardFilterTable creates the standard filter table with INPUT, FORWARD, OUTPUT chains
-func CreateStandardFilterTable(conn *nftables.Conn) error {
+func CreateStandardFilterTable(conn Conn) error {
 	return CreateTableFromConfig(conn, StandardFilterTable)
 }
 
-// CreateStandardNATTable creates the standard NAT table with PREROUTING, POSTROUTING chains
-func CreateStandardNATTable(conn *nftables.Conn) error {
+// CreateStandardNATTable creates the standard NAT table with PREROUTING, OUTPUT, POSTROUTING chains
+func CreateStandardNATTable(conn Conn) error {
 	return CreateTableFromConfig(conn, StandardNATTable)
 }
 
 // EnsureStandardFirewallInfrastructure creates both filter and NAT tables
-func EnsureStandardFirewallInfrastructure(conn *nftables.Conn) error {
+func EnsureStandardFirewallInfrastructure(conn Conn) error {
 	if err := CreateStandardFilterTable(conn); err != nil {
 		return err
 	}
 	return CreateStandardNATTable(conn)
 }
 
-// createChainsFromConfig creates chains using the awesome NewChain function
-func createChainsFromConfig(conn *nftables.Conn, table *nftables.Table, chainConfigs []ChainConfig) error {
-	// Use the awesome NewChain function for each chain
-	for _, chainConfig := range chainConfigs {
-		// Convert ChainConfig to NewChain options
-		opts := []Option{
-			WithName(chainConfig.Name),
-			WithinTable(table.Name),
-		}
-
-		// Add creation options if this is for chain creation
-		if chainConfig.Create {
-			opts = append(opts, Create())
-			if chainConfig.Type != nil {
-				opts = append(opts, WithChainType(*chainConfig.Type))
-			}
-			if chainConfig.Hook != nil {
-				opts = append(opts, WithHook(chainConfig.Hook))
-			}
-			if chainConfig.Priority != nil {
-				opts = append(opts, WithPriority(chainConfig.Priority))
-			}
-			if chainConfig.Policy != nil {
-				opts = append(opts, WithPolicy(chainConfig.Policy))
-			}
-		}
-
-		// Use the awesome NewChain function!
-		_, _, err := NewChain(opts...)
-		if err != nil {
-			return err
-		}
-	}
-
-	return nil
-}
-
 // getChainPolicyAccept returns a pointer to ChainPolicyAccept
 func getChainPolicyAccept() *nftables.ChainPolicy {
 	policy := nftables.ChainPolicyAccept
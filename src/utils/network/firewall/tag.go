@@ -0,0 +1,169 @@
+//go:build linux
+
+package firewall
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/userdata"
+)
+
+// tagOwner is the owner every tag written by this tool starts with
+const tagOwner = "network-utils"
+
+// Roles of the rules created by this package
+const (
+	RoleJump          = "jump"
+	RoleForwardOut    = "forward-out"
+	RoleForwardReturn = "forward-return"
+	RoleForwardDrop   = "forward-drop"
+	RoleMasquerade    = "masq"
+	RoleSNAT          = "snat"
+	RoleDNS           = "dns"
+	RoleDHCP          = "dhcp"
+	RoleDHCPv6        = "dhcpv6"
+	RoleND            = "nd"
+	RolePortForward   = "port-forward"
+	RoleLog           = "log"
+	RoleLogTail       = "log-tail"
+	RoleEgress        = "egress"
+	RoleTapDispatch   = "tap-dispatch"
+	RoleSecurityGroup = "secgroup"
+	RoleTapDrop       = "tap-drop"
+	RoleGuard         = "guard"
+	RoleGuardDrop     = "guard-drop"
+	RoleFlowOffload   = "offload"
+	RoleLimit         = "limit"
+)
+
+// Tag identifies the owner and purpose of a rule. It is stored as the rule's
+// comment, e.g. "network-utils:bridge=br0:role=masq", so rules can be found
+// again by their kernel handle after a restart. Rules of a single tap device
+// also carry its name.
+type Tag struct {
+	Bridge string
+	Tap    string
+	Role   string
+}
+
+func (t Tag) String() string {
+	var sb strings.Builder
+	sb.WriteString(tagOwner)
+	if t.Bridge != "" {
+		sb.WriteString(":bridge=" + t.Bridge)
+	}
+	if t.Tap != "" {
+		sb.WriteString(":tap=" + t.Tap)
+	}
+	if t.Role != "" {
+		sb.WriteString(":role=" + t.Role)
+	}
+	return sb.String()
+}
+
+// Matches reports whether other is covered by t. Empty fields of t match any value.
+func (t Tag) Matches(other Tag) bool {
+	return (t.Bridge == "" || t.Bridge == other.Bridge) &&
+		(t.Tap == "" || t.Tap == other.Tap) &&
+		(t.Role == "" || t.Role == other.Role)
+}
+
+// ParseTag parses a comment written by Tag.String
+func ParseTag(comment string) (Tag, error) {
+	parts := strings.Split(comment, ":")
+	if parts[0] != tagOwner {
+		return Tag{}, fmt.Errorf("comment %q is not a %s tag", comment, tagOwner)
+	}
+
+	var tag Tag
+	for _, part := range parts[1:] {
+		key, value, found := strings.Cut(part, "=")
+		if !found {
+			return Tag{}, fmt.Errorf("malformed tag field %q", part)
+		}
+		switch key {
+		case "bridge":
+			tag.Bridge = value
+		case "tap":
+			tag.Tap = value
+		case "role":
+			tag.Role = value
+		default:
+			return Tag{}, fmt.Errorf("unknown tag field %q", key)
+		}
+	}
+	return tag, nil
+}
+
+func (t Tag) userData() []byte {
+	return userdata.AppendString(nil, userdata.TypeComment, t.String())
+}
+
+// RuleTag returns the tag of a rule. The second value is false for rules that
+// were not created by this tool.
+func RuleTag(rule *nftables.Rule) (Tag, bool) {
+	comment, ok := userdata.GetString(rule.UserData, userdata.TypeComment)
+	if !ok {
+		return Tag{}, false
+	}
+	tag, tagErr := ParseTag(comment)
+	if tagErr != nil {
+		return Tag{}, false
+	}
+	return tag, true
+}
+
+// Tagged marks every rule built by rule with tag and adds a counter to it
+func Tagged(tag Tag, rule NewRule) NewRule {
+	return func(rules *Rules) error {
+		start := len(rules.rules)
+		if err := rule(rules); err != nil {
+			return err
+		}
+		for _, r := range rules.rules[start:] {
+			r.UserData = tag.userData()
+			r.Exprs = withCounter(r.Exprs)
+		}
+		return nil
+	}
+}
+
+// ListTaggedRules returns every rule whose tag is matched by tag, together with
+// its kernel handle.
+func ListTaggedRules(tag Tag) ([]*nftables.Rule, error) {
+	return Host().ListTaggedRules(tag)
+}
+
+// ListTaggedRules returns the rules of the namespace whose tag is matched by tag
+func (f *Firewall) ListTaggedRules(tag Tag) ([]*nftables.Rule, error) {
+	snap, snapErr := loadSnapshot(f.conn)
+	if snapErr != nil {
+		return nil, snapErr
+	}
+	return snap.tagged(tag)
+}
+
+// tagged returns the live rules of every chain whose tag is matched by tag
+func (s *snapshot) tagged(tag Tag) ([]*nftables.Rule, error) {
+	var result []*nftables.Rule
+	for _, chain := range s.chains {
+		if !s.live[keyOf(chain)] {
+			continue
+		}
+		rules, rulesErr := s.rulesOf(chain)
+		if rulesErr != nil {
+			return nil, rulesErr
+		}
+		for _, r := range rules {
+			if r.Handle == 0 {
+				continue
+			}
+			if rt, ok := RuleTag(r); ok && tag.Matches(rt) {
+				result = append(result, r)
+			}
+		}
+	}
+	return result, nil
+}
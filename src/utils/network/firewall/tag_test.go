@@ -0,0 +1,79 @@
+//go:build linux
+
+package firewall
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTag_RoundTrip(t *testing.T) {
+	tests := []struct {
+		tag      Tag
+		expected string
+	}{
+		{Tag{Bridge: "br0", Role: RoleMasquerade}, "network-utils:bridge=br0:role=masq"},
+		{Tag{Role: RoleJump}, "network-utils:role=jump"},
+		{Tag{Bridge: "br0", Tap: "tap0", Role: RoleSecurityGroup}, "network-utils:bridge=br0:tap=tap0:role=secgroup"},
+		{Tag{}, "network-utils"},
+	}
+
+	for _, tt := range tests {
+		require.Equal(t, tt.expected, tt.tag.String())
+		parsed, err := ParseTag(tt.expected)
+		require.NoError(t, err)
+		require.Equal(t, tt.tag, parsed)
+	}
+}
+
+func TestParseTag_Invalid(t *testing.T) {
+	for _, comment := range []string{"", "ufw", "network-utils:bridge", "network-utils:owner=me"} {
+		_, err := ParseTag(comment)
+		require.Error(t, err, comment)
+	}
+}
+
+func TestTag_Matches(t *testing.T) {
+	masq := Tag{Bridge: "br0", Role: RoleMasquerade}
+	require.True(t, Tag{}.Matches(masq))
+	require.True(t, Tag{Bridge: "br0"}.Matches(masq))
+	require.True(t, masq.Matches(masq))
+	require.False(t, Tag{Bridge: "br1"}.Matches(masq))
+	require.False(t, Tag{Bridge: "br0", Role: RoleDNS}.Matches(masq))
+}
+
+func TestPlan_PruneByTag(t *testing.T) {
+	snap := newSnapshot(nil, nil, nil)
+	_, err := snap.plan(BridgeRuleset(DefaultPrefix, "eth0", "br0"))
+	require.NoError(t, err)
+	_, err = snap.plan(&Ruleset{Present: BridgeRules(DefaultPrefix, "eth0", "br1")})
+	require.NoError(t, err)
+
+	commit(snap)
+
+	// The old interface is unknown, the tags still identify the rules of br0
+	plan, err := snap.plan(&Ruleset{
+		Present: BridgeRules(DefaultPrefix, "wlan0", "br0"),
+		Prune:   bridgeTags("br0"),
+	})
+	require.NoError(t, err)
+
+	var deleted []Tag
+	for _, op := range plan.Operations {
+		if op.Kind == OpDeleteRule {
+			tag, ok := RuleTag(op.Rule)
+			require.True(t, ok)
+			deleted = append(deleted, tag)
+		}
+	}
+	require.ElementsMatch(t, []Tag{
+		{Bridge: "br0", Role: RoleForwardOut},
+		{Bridge: "br0", Role: RoleForwardReturn},
+		{Bridge: "br0", Role: RoleMasquerade},
+	}, deleted)
+	require.Equal(t, []OperationKind{
+		OpDeleteRule, OpDeleteRule, OpDeleteRule,
+		OpAddRule, OpAddRule, OpAddRule,
+	}, kinds(plan))
+}
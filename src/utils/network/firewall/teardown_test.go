@@ -0,0 +1,80 @@
+//go:build linux
+
+package firewall
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func chainNames(t *testing.T, conn Conn) []string {
+	chains, err := conn.ListChains()
+	require.NoError(t, err)
+	var names []string
+	for _, ch := range chains {
+		names = append(names, ch.Name)
+	}
+	return names
+}
+
+func TestBridgeTeardown_KeepsOtherBridges(t *testing.T) {
+	conn := useFakeConn(t)
+	require.NoError(t, Reconcile(BridgeRuleset(DefaultPrefix, "eth0", "br0")))
+	require.NoError(t, Reconcile(BridgeRuleset(DefaultPrefix, "eth0", "br1")))
+
+	require.NoError(t, Reconcile(BridgeTeardown(DefaultPrefix, "eth0", "br0")))
+	tagged, err := ListTaggedRules(Tag{Bridge: "br0"})
+	require.NoError(t, err)
+	require.Empty(t, tagged)
+	tagged, err = ListTaggedRules(Tag{Bridge: "br1"})
+	require.NoError(t, err)
+	require.Len(t, tagged, 9)
+	require.Contains(t, chainNames(t, conn), DefaultPrefix+ForwardChain)
+
+	require.NoError(t, Reconcile(BridgeTeardown(DefaultPrefix, "eth0", "br1")))
+	require.NotContains(t, chainNames(t, conn), DefaultPrefix+ForwardChain)
+	require.NotContains(t, chainNames(t, conn), DefaultPrefix+InputChain)
+	require.Empty(t, liveRules(t, conn, ForwardChain, FilterTable))
+	require.Empty(t, liveRules(t, conn, InputChain, FilterTable))
+
+	// Tearing down twice is a no-op
+	flushes := conn.Flushes
+	require.NoError(t, Reconcile(BridgeTeardown(DefaultPrefix, "eth0", "br1")))
+	require.Equal(t, flushes, conn.Flushes)
+}
+
+func TestBridgeTeardown_PublishedPorts(t *testing.T) {
+	conn := useFakeConn(t)
+	require.NoError(t, Reconcile(BridgeRuleset(DefaultPrefix, "eth0", "br0")))
+	_, subnet, err := net.ParseCIDR("192.168.26.0/24")
+	require.NoError(t, err)
+	require.NoError(t, Reconcile(PortForwardRuleset(DefaultPrefix, "br0", subnet, 2222, net.ParseIP("192.168.26.10"), 22, "tcp")))
+
+	require.NoError(t, Reconcile(BridgeTeardown(DefaultPrefix, "eth0", "br0")))
+	tagged, err := ListTaggedRules(Tag{Bridge: "br0", Role: RolePortForward})
+	require.NoError(t, err)
+	require.Empty(t, tagged)
+	require.NotContains(t, chainNames(t, conn), DefaultPrefix+ForwardChain)
+}
+
+func TestPurgePrefix(t *testing.T) {
+	conn := useFakeConn(t)
+	require.NoError(t, Reconcile(BridgeRuleset(DefaultPrefix, "eth0", "br0")))
+	require.NoError(t, Reconcile(BridgeRuleset("OTHER-", "eth0", "br1")))
+	_, subnet, err := net.ParseCIDR("192.168.26.0/24")
+	require.NoError(t, err)
+	require.NoError(t, Reconcile(PortForwardRuleset(DefaultPrefix, "br0", subnet, 2222, net.ParseIP("192.168.26.10"), 22, "tcp")))
+
+	require.NoError(t, PurgePrefix(DefaultPrefix))
+	require.NotContains(t, chainNames(t, conn), DefaultPrefix+ForwardChain)
+	tagged, err := ListTaggedRules(Tag{Bridge: "br0"})
+	require.NoError(t, err)
+	require.Empty(t, tagged)
+
+	tagged, err = ListTaggedRules(Tag{Bridge: "br1"})
+	require.NoError(t, err)
+	require.Len(t, tagged, 9)
+	require.Len(t, liveRules(t, conn, ForwardChain, FilterTable), 1)
+}
@@ -9,9 +9,17 @@ import (
 	"log/slog"
 	"net"
 	"syscall"
+
+	"github.com/q-controller/network-utils/src/utils/network/lock"
 )
 
 func CreateBridgeWithManager(mgr LinkManager, name string, gatewayCidr string, disableTxOffloading bool) error {
+	unlock, lockErr := lock.Acquire()
+	if lockErr != nil {
+		return lockErr
+	}
+	defer unlock()
+
 	ip, ipnet, ipErr := net.ParseCIDR(gatewayCidr)
 	if ipErr != nil {
 		return fmt.Errorf("invalid CIDR format: %v", ipErr)
@@ -5,13 +5,29 @@ package ifc
 import (
 	"errors"
 	"net"
+	"os"
+	"path/filepath"
 	"syscall"
 	"testing"
 
+	"github.com/q-controller/network-utils/src/utils/network/lock"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
 )
 
+// TestMain points the host-wide lock to a temporary file, so the tests need no
+// access to /run
+func TestMain(m *testing.M) {
+	dir, dirErr := os.MkdirTemp("", "ifc-lock")
+	if dirErr != nil {
+		panic(dirErr)
+	}
+	lock.SetPath(filepath.Join(dir, "network-utils.lock"))
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
 // LinkManagerMock uses testify's mock.Mock
 type LinkManagerMock struct {
 	mock.Mock
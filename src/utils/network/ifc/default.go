@@ -45,6 +45,9 @@ func (s *InterfaceSubscription) Stop() {
 	})
 }
 
+// SubscribeDefaultInterfaceChanges sends the name of the default interface on
+// InterfaceCh, and again whenever it changes, until Stop is called. An empty
+// name means that there is no default route.
 func SubscribeDefaultInterfaceChanges() (*InterfaceSubscription, error) {
 	stopCh := make(chan struct{})
 	ifcCh := make(chan string, 1) // Buffered to prevent blocking on initial send
@@ -53,6 +56,13 @@ func SubscribeDefaultInterfaceChanges() (*InterfaceSubscription, error) {
 	if subscribeErr := netlink.LinkSubscribe(updates, stopCh); subscribeErr != nil {
 		return nil, subscribeErr
 	}
+	// The default route may move without any link changing, e.g. when DHCP
+	// completes on a second uplink
+	routeUpdates := make(chan netlink.RouteUpdate)
+	if subscribeErr := netlink.RouteSubscribe(routeUpdates, stopCh); subscribeErr != nil {
+		close(stopCh)
+		return nil, subscribeErr
+	}
 
 	subscription := &InterfaceSubscription{
 		InterfaceCh: ifcCh,
@@ -62,10 +72,10 @@ func SubscribeDefaultInterfaceChanges() (*InterfaceSubscription, error) {
 	go func() {
 		defer close(ifcCh)
 
+		// Without a default route the host starts disconnected, sent as ""
 		currentDefaultInterface, defaultInterfaceErr := GetDefaultInterface()
 		if defaultInterfaceErr != nil {
 			slog.Debug("Failed to get initial default interface", "error", defaultInterfaceErr)
-			return
 		}
 
 		// Send initial interface
@@ -78,28 +88,30 @@ func SubscribeDefaultInterfaceChanges() (*InterfaceSubscription, error) {
 		for {
 			select {
 			case <-updates:
-				newDefaultInterface := ""
-				if defaultInterface, defaultInterfaceErr := GetDefaultInterface(); defaultInterfaceErr == nil {
-					newDefaultInterface = defaultInterface
+			case <-routeUpdates:
+			case <-stopCh:
+				return
+			}
+
+			newDefaultInterface := ""
+			if defaultInterface, defaultInterfaceErr := GetDefaultInterface(); defaultInterfaceErr == nil {
+				newDefaultInterface = defaultInterface
+			}
+
+			if currentDefaultInterface != newDefaultInterface {
+				if newDefaultInterface == "" {
+					slog.Debug("Got disconnected from the internet")
+				} else {
+					slog.Debug("New default interface was configured", "interface", newDefaultInterface)
 				}
+				currentDefaultInterface = newDefaultInterface
 
-				if currentDefaultInterface != newDefaultInterface {
-					if newDefaultInterface == "" {
-						slog.Debug("Got disconnected from the internet")
-					} else {
-						slog.Debug("New default interface was configured", "interface", newDefaultInterface)
-					}
-					currentDefaultInterface = newDefaultInterface
-
-					// Send updated interface only when it changes
-					select {
-					case ifcCh <- currentDefaultInterface:
-					case <-stopCh:
-						return
-					}
+				// Send updated interface only when it changes
+				select {
+				case ifcCh <- currentDefaultInterface:
+				case <-stopCh:
+					return
 				}
-			case <-stopCh:
-				return
 			}
 		}
 	}()
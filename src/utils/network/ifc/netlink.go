@@ -3,14 +3,22 @@
 package ifc
 
 import (
+	"errors"
 	"fmt"
 	"net"
 	"os/exec"
 
+	"github.com/q-controller/network-utils/src/utils/network/firewall"
+	"github.com/q-controller/network-utils/src/utils/network/lock"
 	"github.com/vishvananda/netlink"
 	"github.com/vishvananda/netlink/nl"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
 )
 
+// ErrNoIPv4Address is returned for the network of a link without IPv4 address
+var ErrNoIPv4Address = errors.New("no IPv4 address")
+
 type NetlinkBridgeManager struct{}
 
 func (NetlinkBridgeManager) AddLink(name string, linkType LinkType) error {
@@ -108,6 +116,77 @@ func (NetlinkBridgeManager) DisableTxOffloading(name string) error {
 	return cmd.Run()
 }
 
-func DeleteLink(name string) error {
-	return NetlinkBridgeManager{}.DeleteLink(name)
+// DeleteLink deletes the link name and, if it is a tap or already gone, the
+// rules pinning it to its guest and limiting it. WithFirewall selects the
+// firewall the tap was created with; other options are ignored. A host
+// without nftables has no such rules, which is not an error.
+func DeleteLink(name string, opts ...TapOption) error {
+	unlock, lockErr := lock.Acquire()
+	if lockErr != nil {
+		return lockErr
+	}
+	defer unlock()
+
+	config := &TapConfig{}
+	for _, opt := range opts {
+		opt(config)
+	}
+
+	// A tap removed by its owner, e.g. QEMU, may still have rules
+	tap := true
+	link, linkErr := netlink.LinkByName(name)
+	if linkErr == nil {
+		tap = link.Type() == "tuntap"
+	} else if _, ok := linkErr.(netlink.LinkNotFoundError); !ok {
+		return linkErr
+	}
+
+	if err := (NetlinkBridgeManager{}).DeleteLink(name); err != nil {
+		return err
+	}
+	if !tap {
+		return nil
+	}
+	if err := tapFirewall(config).Reconcile(firewall.TapTeardown(firewall.DefaultPrefix, name)); err != nil && !errors.Is(err, firewall.ErrUnavailable) {
+		return err
+	}
+	return nil
+}
+
+// GetIPv4Network returns the IPv4 network of the first address assigned to the link
+func GetIPv4Network(name string) (*net.IPNet, error) {
+	return ipv4Network(&netlink.Handle{}, name)
+}
+
+// GetIPv4NetworkInNetNS is like GetIPv4Network for a link of the named network
+// namespace
+func GetIPv4NetworkInNetNS(nsName, name string) (*net.IPNet, error) {
+	ns, nsErr := netns.GetFromName(nsName)
+	if nsErr != nil {
+		return nil, fmt.Errorf("failed to open network namespace %s: %w", nsName, nsErr)
+	}
+	defer ns.Close()
+
+	handle, handleErr := netlink.NewHandleAt(ns, unix.NETLINK_ROUTE)
+	if handleErr != nil {
+		return nil, handleErr
+	}
+	defer handle.Close()
+	return ipv4Network(handle, name)
+}
+
+func ipv4Network(handle *netlink.Handle, name string) (*net.IPNet, error) {
+	link, linkErr := handle.LinkByName(name)
+	if linkErr != nil {
+		return nil, linkErr
+	}
+	addresses, addrErr := handle.AddrList(link, nl.FAMILY_V4)
+	if addrErr != nil {
+		return nil, addrErr
+	}
+	if len(addresses) == 0 {
+		return nil, fmt.Errorf("%w assigned to %s", ErrNoIPv4Address, name)
+	}
+	ipNet := addresses[0].IPNet
+	return &net.IPNet{IP: ipNet.IP.Mask(ipNet.Mask), Mask: ipNet.Mask}, nil
 }
@@ -0,0 +1,166 @@
+//go:build linux
+
+package ifc
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/q-controller/network-utils/src/utils/network/lock"
+	"github.com/q-controller/network-utils/src/utils/network/sysctl"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+// RouteProtocol marks the guest routes added by EnableRouting, so
+// DisableRouting finds them again. It is unassigned in iproute2's rt_protos.
+const RouteProtocol netlink.RouteProtocol = 241
+
+// routingOwner is the sysctl owner of the parameters EnableRouting sets for
+// bridgeName, apart from those of configuring the bridge
+func routingOwner(bridgeName string) string {
+	return bridgeName + "/routed"
+}
+
+// routingSysctls returns the sysctls routed guests of bridgeName need:
+// forwarding, and proxy ARP on the bridge and on hostIf, which answers for
+// the guests on the uplink and for the uplink towards the guests. IPv6 guests
+// also need proxy NDP on hostIf.
+func routingSysctls(bridgeName, hostIf string, ipv6 bool) []sysctl.Param {
+	params := append(sysctl.ForwardingParams(hostIf, ipv6),
+		sysctl.Param{Path: sysctl.Conf("ipv4", hostIf, "proxy_arp"), Value: "1"},
+		sysctl.Param{Path: sysctl.Conf("ipv4", bridgeName, "proxy_arp"), Value: "1"},
+	)
+	if ipv6 {
+		params = append(params, sysctl.Param{Path: sysctl.Conf("ipv6", hostIf, "proxy_ndp"), Value: "1"})
+	}
+	return params
+}
+
+// isIPv6Host reports whether dst holds a single IPv6 address, which proxy
+// NDP can announce
+func isIPv6Host(dst *net.IPNet) bool {
+	ones, bits := dst.Mask.Size()
+	return dst.IP.To4() == nil && ones == 128 && bits == 128
+}
+
+// RoutingParams returns the sysctls EnableRouting sets for the guests of
+// bridgeName
+func RoutingParams(bridgeName, hostIf string, guests []*net.IPNet) []sysctl.Param {
+	ipv6 := false
+	for _, guest := range guests {
+		ipv6 = ipv6 || guest.IP.To4() == nil
+	}
+	return routingSysctls(bridgeName, hostIf, ipv6)
+}
+
+// RoutingCommands returns the ip(8) commands adding the guest routes and
+// proxy NDP entries EnableRouting adds, e.g. to print them in a dry run
+func RoutingCommands(bridgeName, hostIf string, guests []*net.IPNet) []string {
+	var commands []string
+	for _, guest := range guests {
+		commands = append(commands, fmt.Sprintf("ip route replace %s dev %s scope link proto %d", guest, bridgeName, RouteProtocol))
+		if isIPv6Host(guest) {
+			commands = append(commands, fmt.Sprintf("ip -6 neigh replace proxy %s dev %s", guest.IP, hostIf))
+		}
+	}
+	return commands
+}
+
+// EnableRouting lets the guests of bridgeName keep their addresses on the
+// network of hostIf. Forwarding and proxy ARP are enabled, and the prefixes
+// of guests are routed through the bridge, e.g. the LAN addresses of the
+// guests when the bridge has no address in their subnet. Single IPv6
+// addresses are announced on hostIf with proxy NDP; wider IPv6 prefixes need
+// a route on the LAN router instead.
+func EnableRouting(bridgeName, hostIf string, guests []*net.IPNet) error {
+	unlock, lockErr := lock.Acquire()
+	if lockErr != nil {
+		return lockErr
+	}
+	defer unlock()
+
+	if err := sysctl.Apply(routingOwner(bridgeName), RoutingParams(bridgeName, hostIf, guests)); err != nil {
+		return err
+	}
+	if len(guests) == 0 {
+		return nil
+	}
+
+	bridge, bridgeErr := netlink.LinkByName(bridgeName)
+	if bridgeErr != nil {
+		return fmt.Errorf("failed to get bridge %s: %w", bridgeName, bridgeErr)
+	}
+	host, hostErr := netlink.LinkByName(hostIf)
+	if hostErr != nil {
+		return fmt.Errorf("failed to get interface %s: %w", hostIf, hostErr)
+	}
+	for _, guest := range guests {
+		route := &netlink.Route{
+			LinkIndex: bridge.Attrs().Index,
+			Dst:       guest,
+			Scope:     netlink.SCOPE_LINK,
+			Protocol:  RouteProtocol,
+		}
+		if err := netlink.RouteReplace(route); err != nil {
+			return fmt.Errorf("failed to route %s through bridge %s: %w", guest, bridgeName, err)
+		}
+		if isIPv6Host(guest) {
+			if err := netlink.NeighSet(&netlink.Neigh{
+				LinkIndex: host.Attrs().Index,
+				Family:    unix.AF_INET6,
+				Flags:     netlink.NTF_PROXY,
+				IP:        guest.IP,
+			}); err != nil {
+				return fmt.Errorf("failed to announce %s on %s: %w", guest.IP, hostIf, err)
+			}
+		}
+	}
+	return nil
+}
+
+// DisableRouting removes the guest routes of bridgeName and their proxy NDP
+// entries on hostIf and restores the sysctls EnableRouting changed, unless
+// another bridge still needs them. Missing links are skipped.
+func DisableRouting(bridgeName, hostIf string) error {
+	unlock, lockErr := lock.Acquire()
+	if lockErr != nil {
+		return lockErr
+	}
+	defer unlock()
+
+	var host netlink.Link
+	if hostIf != "" {
+		if link, linkErr := netlink.LinkByName(hostIf); linkErr == nil {
+			host = link
+		}
+	}
+
+	if bridge, bridgeErr := netlink.LinkByName(bridgeName); bridgeErr == nil {
+		routes, routesErr := netlink.RouteListFiltered(nl.FAMILY_ALL,
+			&netlink.Route{LinkIndex: bridge.Attrs().Index, Protocol: RouteProtocol},
+			netlink.RT_FILTER_OIF|netlink.RT_FILTER_PROTOCOL)
+		if routesErr != nil {
+			return fmt.Errorf("failed to list routes of bridge %s: %w", bridgeName, routesErr)
+		}
+		for _, route := range routes {
+			if err := netlink.RouteDel(&route); err != nil {
+				return fmt.Errorf("failed to delete route %s of bridge %s: %w", route.Dst, bridgeName, err)
+			}
+			if host != nil && route.Dst != nil && isIPv6Host(route.Dst) {
+				if err := netlink.NeighDel(&netlink.Neigh{
+					LinkIndex: host.Attrs().Index,
+					Family:    unix.AF_INET6,
+					Flags:     netlink.NTF_PROXY,
+					IP:        route.Dst.IP,
+				}); err != nil && !errors.Is(err, unix.ENOENT) {
+					return fmt.Errorf("failed to withdraw %s from %s: %w", route.Dst.IP, hostIf, err)
+				}
+			}
+		}
+	}
+
+	return sysctl.Restore(routingOwner(bridgeName))
+}
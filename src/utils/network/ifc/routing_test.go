@@ -0,0 +1,48 @@
+//go:build linux
+
+package ifc
+
+import (
+	"net"
+	"testing"
+
+	"github.com/q-controller/network-utils/src/utils/network/sysctl"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRoutingSysctls(t *testing.T) {
+	require.Equal(t, []sysctl.Param{
+		{Path: "net/ipv4/ip_forward", Value: "1"},
+		{Path: "net/ipv4/conf/eth0/proxy_arp", Value: "1"},
+		{Path: "net/ipv4/conf/br0/proxy_arp", Value: "1"},
+	}, routingSysctls("br0", "eth0", false))
+	require.Contains(t, routingSysctls("br0", "eth0", true), sysctl.Param{Path: "net/ipv6/conf/eth0/proxy_ndp", Value: "1"})
+}
+
+func TestIsIPv6Host(t *testing.T) {
+	for cidr, want := range map[string]bool{
+		"2001:db8::10/128": true,
+		"2001:db8::/64":    false,
+		"192.168.1.200/32": false,
+		"192.168.1.192/28": false,
+	} {
+		_, dst, err := net.ParseCIDR(cidr)
+		require.NoError(t, err)
+		require.Equal(t, want, isIPv6Host(dst), cidr)
+	}
+}
+
+func TestRoutingCommands(t *testing.T) {
+	var guests []*net.IPNet
+	for _, cidr := range []string{"192.168.1.200/32", "2001:db8::10/128"} {
+		_, dst, err := net.ParseCIDR(cidr)
+		require.NoError(t, err)
+		guests = append(guests, dst)
+	}
+	require.Equal(t, []string{
+		"ip route replace 192.168.1.200/32 dev br0 scope link proto 241",
+		"ip route replace 2001:db8::10/128 dev br0 scope link proto 241",
+		"ip -6 neigh replace proxy 2001:db8::10 dev eth0",
+	}, RoutingCommands("br0", "eth0", guests))
+	require.Contains(t, RoutingParams("br0", "eth0", guests), sysctl.Param{Path: "net/ipv6/conf/eth0/proxy_ndp", Value: "1"})
+}
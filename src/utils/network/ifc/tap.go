@@ -3,11 +3,61 @@
 package ifc
 
 import (
+	"errors"
 	"fmt"
 	"log/slog"
+	"net"
+
+	"github.com/q-controller/network-utils/src/utils/network/firewall"
+	"github.com/q-controller/network-utils/src/utils/network/lock"
 )
 
-func CreateTapWithManager(mgr LinkManager, name string, bridgeName string) error {
+// TapConfig holds the optional behavior of CreateTap
+type TapConfig struct {
+	Guest    *firewall.Guest
+	Limits   firewall.Limits
+	Firewall *firewall.Firewall
+}
+
+type TapOption func(*TapConfig)
+
+// WithGuest pins the tap to the MAC address and the IP addresses of its guest.
+// Frames with a forged source MAC or IP and spoofed ARP packets are dropped.
+func WithGuest(mac net.HardwareAddr, addrs ...net.IP) TapOption {
+	return func(config *TapConfig) {
+		config.Guest = &firewall.Guest{MAC: mac, Addrs: addrs}
+	}
+}
+
+// WithLimits caps the rate and the concurrent connections of the traffic the
+// guest sends through the tap, whatever its destination, see
+// firewall.TapLimitRules
+func WithLimits(limits firewall.Limits) TapOption {
+	return func(config *TapConfig) {
+		config.Limits = limits
+	}
+}
+
+// WithFirewall installs the rules of the tap with fw instead of the firewall
+// of the host namespace
+func WithFirewall(fw *firewall.Firewall) TapOption {
+	return func(config *TapConfig) {
+		config.Firewall = fw
+	}
+}
+
+func CreateTapWithManager(mgr LinkManager, name string, bridgeName string, opts ...TapOption) error {
+	unlock, lockErr := lock.Acquire()
+	if lockErr != nil {
+		return lockErr
+	}
+	defer unlock()
+
+	config := &TapConfig{}
+	for _, opt := range opts {
+		opt(config)
+	}
+
 	exists, existsErr := mgr.Exists(name)
 	if existsErr != nil {
 		return fmt.Errorf("unexpected error checking link: %v", existsErr)
@@ -31,10 +81,56 @@ func CreateTapWithManager(mgr LinkManager, name string, bridgeName string) error
 		return fmt.Errorf("failed to bring tap %s up: %v", name, err)
 	}
 
+	if config.Guest != nil {
+		if err := guardTap(config, name); err != nil {
+			if delErr := removeTap(mgr, config, name); delErr != nil {
+				return fmt.Errorf("failed to pin tap %s to its guest: %v, failed to delete tap: %v", name, err, delErr)
+			}
+			return fmt.Errorf("failed to pin tap %s to its guest: %v", name, err)
+		}
+	}
+
+	if !config.Limits.IsZero() {
+		if err := tapFirewall(config).Reconcile(firewall.TapLimitRuleset(firewall.DefaultPrefix, name, config.Limits)); err != nil {
+			if delErr := removeTap(mgr, config, name); delErr != nil {
+				return fmt.Errorf("failed to limit tap %s: %v, failed to delete tap: %v", name, err, delErr)
+			}
+			return fmt.Errorf("failed to limit tap %s: %v", name, err)
+		}
+	}
+
 	slog.Debug("successfully added tap", "tap", name, "bridge", bridgeName)
 	return nil
 }
 
-func CreateTap(name string, bridgeName string) error {
-	return CreateTapWithManager(NetlinkBridgeManager{}, name, bridgeName)
+func guardTap(config *TapConfig, name string) error {
+	desired, desiredErr := firewall.GuardRuleset(firewall.DefaultPrefix, name, *config.Guest)
+	if desiredErr != nil {
+		return desiredErr
+	}
+	return tapFirewall(config).Reconcile(desired)
+}
+
+// removeTap deletes the tap and the guard and limit state already added for
+// it, so a failed CreateTap leaves neither the link nor its rules behind
+func removeTap(mgr LinkManager, config *TapConfig, name string) error {
+	if err := mgr.DeleteLink(name); err != nil {
+		return err
+	}
+	if err := tapFirewall(config).Reconcile(firewall.TapTeardown(firewall.DefaultPrefix, name)); err != nil && !errors.Is(err, firewall.ErrUnavailable) {
+		return err
+	}
+	return nil
+}
+
+// tapFirewall returns the firewall the rules of the tap are installed with
+func tapFirewall(config *TapConfig) *firewall.Firewall {
+	if config.Firewall != nil {
+		return config.Firewall
+	}
+	return firewall.Host()
+}
+
+func CreateTap(name string, bridgeName string, opts ...TapOption) error {
+	return CreateTapWithManager(NetlinkBridgeManager{}, name, bridgeName, opts...)
 }
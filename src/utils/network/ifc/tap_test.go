@@ -7,6 +7,9 @@ import (
 	"net"
 	"testing"
 
+	"github.com/google/nftables"
+	"github.com/q-controller/network-utils/src/utils/network/firewall"
+	"github.com/q-controller/network-utils/src/utils/network/firewall/fake"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
 )
@@ -113,3 +116,101 @@ func TestCreateTapWithManager_BringUpError_DeleteError(t *testing.T) {
 	err := CreateTapWithManager(mgr, "tap0", "br0")
 	require.EqualError(t, err, "failed to bring tap tap0 up: bring up failed, failed to delete tap: delete failed")
 }
+
+func TestCreateTapWithManager_WithGuest(t *testing.T) {
+	conn := fake.NewConn()
+	fw, fwErr := firewall.New(firewall.WithConnection(conn))
+	require.NoError(t, fwErr)
+	mac, macErr := net.ParseMAC("2e:c8:40:59:7d:16")
+	require.NoError(t, macErr)
+
+	mgr := &TapLinkManagerMock{}
+	mgr.On("Exists", "tap0").Return(true, nil)
+	mgr.On("BringUp", "tap0").Return(nil)
+	err := CreateTapWithManager(mgr, "tap0", "br0", WithGuest(mac, net.ParseIP("192.168.26.10")), WithFirewall(fw))
+	require.NoError(t, err)
+
+	rules, rulesErr := fw.ListTaggedRules(firewall.Tag{Tap: "tap0", Role: firewall.RoleGuard})
+	require.NoError(t, rulesErr)
+	require.NotEmpty(t, rules)
+}
+
+func TestCreateTapWithManager_WithLimits(t *testing.T) {
+	conn := fake.NewConn()
+	fw, fwErr := firewall.New(firewall.WithConnection(conn))
+	require.NoError(t, fwErr)
+
+	mgr := &TapLinkManagerMock{}
+	mgr.On("Exists", "tap0").Return(true, nil)
+	mgr.On("BringUp", "tap0").Return(nil)
+	err := CreateTapWithManager(mgr, "tap0", "br0", WithLimits(firewall.Limits{Packets: 1000, Connections: 64}), WithFirewall(fw))
+	require.NoError(t, err)
+
+	rules, rulesErr := fw.ListTaggedRules(firewall.Tag{Tap: "tap0", Role: firewall.RoleLimit})
+	require.NoError(t, rulesErr)
+	require.Len(t, rules, 2)
+}
+
+func TestCreateTapWithManager_WithGuest_InvalidMAC(t *testing.T) {
+	fw, fwErr := firewall.New(firewall.WithConnection(fake.NewConn()))
+	require.NoError(t, fwErr)
+
+	mgr := &TapLinkManagerMock{}
+	mgr.On("Exists", "tap0").Return(true, nil)
+	mgr.On("BringUp", "tap0").Return(nil)
+	mgr.On("DeleteLink", "tap0").Return(nil)
+	err := CreateTapWithManager(mgr, "tap0", "br0", WithGuest(nil), WithFirewall(fw))
+	require.ErrorContains(t, err, "failed to pin tap tap0 to its guest")
+	mgr.AssertCalled(t, "DeleteLink", "tap0")
+}
+
+// failingConn fails the listing of the tables on its fail-th call, e.g. the
+// one of a later Reconcile
+type failingConn struct {
+	*fake.Conn
+	calls int
+	fail  int
+}
+
+func (c *failingConn) ListTables() ([]*nftables.Table, error) {
+	c.calls++
+	if c.calls == c.fail {
+		return nil, errors.New("list failed")
+	}
+	return c.Conn.ListTables()
+}
+
+func TestCreateTapWithManager_WithLimits_ErrorTearsDownGuard(t *testing.T) {
+	conn := &failingConn{Conn: fake.NewConn(), fail: 2}
+	fw, fwErr := firewall.New(firewall.WithConnection(conn))
+	require.NoError(t, fwErr)
+	mac, macErr := net.ParseMAC("2e:c8:40:59:7d:16")
+	require.NoError(t, macErr)
+
+	mgr := &TapLinkManagerMock{}
+	mgr.On("Exists", "tap0").Return(true, nil)
+	mgr.On("BringUp", "tap0").Return(nil)
+	mgr.On("DeleteLink", "tap0").Return(nil)
+	err := CreateTapWithManager(mgr, "tap0", "br0", WithGuest(mac, net.ParseIP("192.168.26.10")), WithLimits(firewall.Limits{Packets: 1000}), WithFirewall(fw))
+	require.EqualError(t, err, "failed to limit tap tap0: list failed")
+	mgr.AssertCalled(t, "DeleteLink", "tap0")
+
+	// The guard of the deleted tap is gone as well
+	rules, rulesErr := fw.ListTaggedRules(firewall.Tag{Tap: "tap0"})
+	require.NoError(t, rulesErr)
+	require.Empty(t, rules)
+	chains, chainsErr := conn.ListChains()
+	require.NoError(t, chainsErr)
+	for _, chain := range chains {
+		require.NotEqual(t, firewall.DefaultPrefix+"GUARD-tap0", chain.Name)
+		if chain.Name == firewall.PreroutingChain {
+			sets, setsErr := conn.GetSets(chain.Table)
+			require.NoError(t, setsErr)
+			for _, set := range sets {
+				elements, elementsErr := conn.GetSetElements(set)
+				require.NoError(t, elementsErr)
+				require.Empty(t, elements, set.Name)
+			}
+		}
+	}
+}
@@ -0,0 +1,181 @@
+//go:build linux
+
+// Package lock serializes the changes of concurrent network-utils processes
+// to the links and the nftables ruleset of the host with an advisory flock on
+// a well-known runtime file.
+package lock
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// DefaultPath is the runtime file every process locks
+	DefaultPath = "/run/network-utils.lock"
+	// DefaultTimeout is how long Acquire waits for another process
+	DefaultTimeout = 30 * time.Second
+)
+
+// pollInterval is how often Acquire retries a lock held by another process
+const pollInterval = 50 * time.Millisecond
+
+var (
+	mu      sync.Mutex
+	path    = DefaultPath
+	timeout = DefaultTimeout
+	held    *os.File
+	depth   int
+)
+
+// HeldError reports that the lock is still held by another process after
+// waiting for Timeout. PID is 0 if the holder could not be identified.
+type HeldError struct {
+	Path    string
+	Timeout time.Duration
+	PID     int
+	Command string
+}
+
+func (e *HeldError) Error() string {
+	holder := "another process"
+	if e.PID > 0 {
+		holder = "process " + strconv.Itoa(e.PID)
+		if e.Command != "" {
+			holder += " (" + e.Command + ")"
+		}
+	}
+	return fmt.Sprintf("lock %s is held by %s, gave up after %s", e.Path, holder, e.Timeout)
+}
+
+// SetPath replaces the file locked by Acquire, e.g. with a temporary file in
+// tests. It returns the previous path.
+func SetPath(p string) string {
+	mu.Lock()
+	defer mu.Unlock()
+	previous := path
+	path = p
+	return previous
+}
+
+// SetTimeout sets how long Acquire waits for another process. A zero timeout
+// fails at once. It returns the previous timeout.
+func SetTimeout(t time.Duration) time.Duration {
+	mu.Lock()
+	defer mu.Unlock()
+	previous := timeout
+	timeout = t
+	return previous
+}
+
+// Acquire takes the host-wide lock and returns the function releasing it.
+// The lock is reentrant within a process: nested operations share the hold of
+// the outermost one, which must release it last. Goroutines of one process
+// are not serialized against each other.
+func Acquire() (func(), error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if depth == 0 {
+		f, lockErr := lockFile(path, timeout)
+		if lockErr != nil {
+			return nil, lockErr
+		}
+		held = f
+	}
+	depth++
+
+	var once sync.Once
+	return func() {
+		once.Do(release)
+	}, nil
+}
+
+func release() {
+	mu.Lock()
+	defer mu.Unlock()
+
+	depth--
+	if depth > 0 {
+		return
+	}
+	// Clear the record first so a holder without one, like flock(1), is not
+	// mistaken for this process. Closing the file releases the flock.
+	if err := held.Truncate(0); err != nil {
+		slog.Debug("failed to clear holder of lock", "path", held.Name(), "error", err)
+	}
+	if err := held.Close(); err != nil {
+		slog.Debug("failed to release lock", "path", held.Name(), "error", err)
+	}
+	held = nil
+}
+
+// lockFile opens and locks the file at p, waiting up to wait for its holder,
+// and records the current process as the holder
+func lockFile(p string, wait time.Duration) (*os.File, error) {
+	f, openErr := os.OpenFile(p, os.O_RDWR|os.O_CREATE|unix.O_CLOEXEC, 0o644)
+	if openErr != nil {
+		return nil, fmt.Errorf("failed to open lock %s: %w", p, openErr)
+	}
+
+	deadline := time.Now().Add(wait)
+	logged := false
+	for {
+		flockErr := unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+		if flockErr == nil {
+			break
+		}
+		if errors.Is(flockErr, unix.EINTR) {
+			continue
+		}
+		if !errors.Is(flockErr, unix.EWOULDBLOCK) {
+			f.Close()
+			return nil, fmt.Errorf("failed to lock %s: %w", p, flockErr)
+		}
+		pid, command := holder(f)
+		if time.Now().After(deadline) {
+			f.Close()
+			return nil, &HeldError{Path: p, Timeout: wait, PID: pid, Command: command}
+		}
+		if !logged {
+			slog.Info("waiting for lock", "path", p, "pid", pid, "command", command)
+			logged = true
+		}
+		time.Sleep(pollInterval)
+	}
+
+	if err := f.Truncate(0); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to record holder of lock %s: %w", p, err)
+	}
+	record := strconv.Itoa(os.Getpid()) + "\n" + strings.Join(os.Args, " ") + "\n"
+	if _, err := f.WriteAt([]byte(record), 0); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to record holder of lock %s: %w", p, err)
+	}
+	return f, nil
+}
+
+// holder reads the process id and the command line the holder of f recorded.
+// A record left by a process that died holding the lock is ignored.
+func holder(f *os.File) (int, string) {
+	buf := make([]byte, 4096)
+	n, _ := f.ReadAt(buf, 0)
+	pidLine, command, _ := strings.Cut(string(buf[:n]), "\n")
+	pid, pidErr := strconv.Atoi(strings.TrimSpace(pidLine))
+	if pidErr != nil || pid <= 0 {
+		return 0, ""
+	}
+	if err := unix.Kill(pid, 0); errors.Is(err, unix.ESRCH) {
+		return 0, ""
+	}
+	return pid, strings.TrimSpace(command)
+}
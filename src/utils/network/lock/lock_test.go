@@ -0,0 +1,103 @@
+//go:build linux
+
+package lock
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func useTempLock(t *testing.T) string {
+	p := filepath.Join(t.TempDir(), "network-utils.lock")
+	previousPath := SetPath(p)
+	previousTimeout := SetTimeout(100 * time.Millisecond)
+	t.Cleanup(func() {
+		SetPath(previousPath)
+		SetTimeout(previousTimeout)
+	})
+	return p
+}
+
+// holdElsewhere locks p through its own open file, like another process would
+func holdElsewhere(t *testing.T, p string, record string) *os.File {
+	f, err := os.OpenFile(p, os.O_RDWR|os.O_CREATE, 0o644)
+	require.NoError(t, err)
+	require.NoError(t, unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB))
+	_, err = f.WriteString(record)
+	require.NoError(t, err)
+	t.Cleanup(func() { f.Close() })
+	return f
+}
+
+func TestAcquire_RecordsHolder(t *testing.T) {
+	p := useTempLock(t)
+
+	unlock, err := Acquire()
+	require.NoError(t, err)
+	content, err := os.ReadFile(p)
+	require.NoError(t, err)
+	require.Contains(t, string(content), strconv.Itoa(os.Getpid())+"\n")
+	unlock()
+
+	// Released, so another holder gets it at once
+	holdElsewhere(t, p, "")
+}
+
+func TestAcquire_Reentrant(t *testing.T) {
+	p := useTempLock(t)
+
+	outer, err := Acquire()
+	require.NoError(t, err)
+	inner, err := Acquire()
+	require.NoError(t, err)
+	inner()
+	inner()
+
+	// Still held by the outer hold
+	f, err := os.OpenFile(p, os.O_RDWR, 0)
+	require.NoError(t, err)
+	defer f.Close()
+	require.ErrorIs(t, unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB), unix.EWOULDBLOCK)
+
+	outer()
+	require.NoError(t, unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB))
+}
+
+func TestAcquire_ReportsHolderAfterTimeout(t *testing.T) {
+	p := useTempLock(t)
+	pid := strconv.Itoa(os.Getpid())
+	holder := holdElsewhere(t, p, pid+"\nnetwork-utils configure-bridge --name br0\n")
+
+	_, err := Acquire()
+	var heldErr *HeldError
+	require.True(t, errors.As(err, &heldErr))
+	require.Equal(t, os.Getpid(), heldErr.PID)
+	require.Equal(t, "network-utils configure-bridge --name br0", heldErr.Command)
+	require.EqualError(t, err, "lock "+p+" is held by process "+pid+" (network-utils configure-bridge --name br0), gave up after 100ms")
+
+	// Waits for the holder to finish
+	SetTimeout(5 * time.Second)
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		holder.Close()
+	}()
+	unlock, err := Acquire()
+	require.NoError(t, err)
+	unlock()
+}
+
+func TestAcquire_IgnoresRecordOfDeadProcess(t *testing.T) {
+	p := useTempLock(t)
+	// No process id exceeds PID_MAX_LIMIT, 4194304
+	holdElsewhere(t, p, "4194305\nnetwork-utils create-tap\n")
+
+	_, err := Acquire()
+	require.EqualError(t, err, "lock "+p+" is held by another process, gave up after 100ms")
+}
@@ -15,6 +15,7 @@ type NetworkConfig struct {
 	GatewayIp   net.IP
 	BridgeIp    net.IP
 	LinkManager ifc.LinkManager
+	Stateful    bool
 }
 
 type NetworkOption func(*NetworkConfig) error
@@ -54,6 +55,15 @@ func WithLinkManager(manager ifc.LinkManager) NetworkOption {
 	}
 }
 
+// WithStatefulForwarding makes Connect accept only return traffic of
+// connections opened from the network and drop new inbound connections.
+func WithStatefulForwarding() NetworkOption {
+	return func(n *NetworkConfig) error {
+		n.Stateful = true
+		return nil
+	}
+}
+
 func (n *NetworkConfig) validate() error {
 	if len(n.Name) == 0 {
 		return fmt.Errorf("network name is required")
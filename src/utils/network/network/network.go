@@ -1,10 +1,23 @@
+//go:build linux
+
 package network
 
+import "github.com/q-controller/network-utils/src/utils/network/firewall"
+
 type Network interface {
 	Destroy() error
 
 	Execute(func() error) error
 
+	// Firewall manages the nftables ruleset inside the namespace of the network
+	Firewall() *firewall.Firewall
+
 	Connect(iface string, masquerade bool) error
 	Disconnect(iface string, masquerade bool) error
+
+	// ConnectRouted forwards the traffic of the network through iface with
+	// the addresses of the network instead of translating them. Forwarding is
+	// stateful and the subnet is announced on iface with proxy ARP.
+	ConnectRouted(iface string) error
+	DisconnectRouted(iface string) error
 }
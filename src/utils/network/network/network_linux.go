@@ -7,6 +7,8 @@ import (
 
 	"github.com/q-controller/network-utils/src/utils/network/firewall"
 	"github.com/q-controller/network-utils/src/utils/network/ifc"
+	"github.com/q-controller/network-utils/src/utils/network/lock"
+	"github.com/q-controller/network-utils/src/utils/network/sysctl"
 	"github.com/vishvananda/netlink"
 	"golang.org/x/sys/unix"
 )
@@ -19,24 +21,49 @@ func netName(name string) string {
 	return name + "-net"
 }
 
-func getRulesForInterface(iface, hostLink string, masquerade bool) (*firewall.Rules, error) {
+func getRulesForInterface(name, iface, hostLink string, masquerade, stateful bool) []firewall.NewRule {
+	tag := func(role string, rule firewall.NewRule) firewall.NewRule {
+		return firewall.Tagged(firewall.Tag{Bridge: name, Role: role}, rule)
+	}
 	newRules := []firewall.NewRule{
-		firewall.ForwardOutboundRule("FORWARD", "filter", iface, hostLink),
-		firewall.ForwardReturnTrafficRule("FORWARD", "filter", iface, hostLink),
+		tag(firewall.RoleForwardOut, firewall.ForwardOutboundRule("FORWARD", "filter", iface, hostLink)),
+	}
+	if stateful {
+		newRules = append(newRules,
+			tag(firewall.RoleForwardReturn, firewall.ForwardEstablishedRule("FORWARD", "filter", iface, hostLink)),
+			tag(firewall.RoleForwardDrop, firewall.ForwardDropInvalidRule("FORWARD", "filter", iface, hostLink)),
+			tag(firewall.RoleForwardDrop, firewall.ForwardDropNewRule("FORWARD", "filter", iface, hostLink)),
+		)
+	} else {
+		newRules = append(newRules, tag(firewall.RoleForwardReturn, firewall.ForwardReturnTrafficRule("FORWARD", "filter", iface, hostLink)))
 	}
 	if masquerade {
-		newRules = append(newRules, firewall.MasqueradeRule("POSTROUTING", "nat", iface))
+		newRules = append(newRules, tag(firewall.RoleMasquerade, firewall.MasqueradeRule("POSTROUTING", "nat", iface)))
 	}
-	return firewall.NewRules(newRules...)
+	return newRules
 }
 
 type networkLinux struct {
-	config *NetworkConfig
+	config   *NetworkConfig
+	firewall *firewall.Firewall
 }
 
 func (n *networkLinux) Destroy() error {
+	unlock, lockErr := lock.Acquire()
+	if lockErr != nil {
+		return lockErr
+	}
+	defer unlock()
+
 	var errs []error
 
+	if n.firewall != nil {
+		if err := n.firewall.Close(); err != nil {
+			errs = append(errs, err)
+		}
+		n.firewall = nil
+	}
+
 	if delLinkErr := n.config.LinkManager.DeleteLink(hostName(n.config.Name)); delLinkErr != nil {
 		errs = append(errs, delLinkErr)
 	}
@@ -45,6 +72,10 @@ func (n *networkLinux) Destroy() error {
 		errs = append(errs, err)
 	}
 
+	if err := sysctl.Restore(hostName(n.config.Name)); err != nil {
+		errs = append(errs, err)
+	}
+
 	return errors.Join(errs...)
 }
 
@@ -58,31 +89,48 @@ func (n *networkLinux) Execute(fn func() error) error {
 	return fn()
 }
 
-func (n *networkLinux) Connect(iface string, masquerade bool) error {
-	rules, rulesErr := getRulesForInterface(iface, hostName(n.config.Name), masquerade)
-	if rulesErr != nil {
-		return rulesErr
-	}
-	if addedRules := firewall.AddRules(rules); addedRules != nil {
-		return addedRules
-	}
+func (n *networkLinux) Firewall() *firewall.Firewall {
+	return n.firewall
+}
 
-	return nil
+func (n *networkLinux) Connect(iface string, masquerade bool) error {
+	return firewall.Reconcile(&firewall.Ruleset{
+		Present: getRulesForInterface(n.config.Name, iface, hostName(n.config.Name), masquerade, n.config.Stateful),
+	})
 }
 
 func (n *networkLinux) Disconnect(iface string, masquerade bool) error {
-	rules, rulesErr := getRulesForInterface(iface, hostName(n.config.Name), masquerade)
-	if rulesErr != nil {
-		return rulesErr
-	}
-	if delRules := firewall.RemoveRules(rules); delRules != nil {
-		return delRules
+	return firewall.Reconcile(&firewall.Ruleset{
+		Absent: getRulesForInterface(n.config.Name, iface, hostName(n.config.Name), masquerade, n.config.Stateful),
+	})
+}
+
+func (n *networkLinux) ConnectRouted(iface string) error {
+	if err := firewall.Reconcile(&firewall.Ruleset{
+		Present: getRulesForInterface(n.config.Name, iface, hostName(n.config.Name), false, true),
+	}); err != nil {
+		return err
 	}
+	// The subnet is reachable through the host side of the veth pair already
+	return ifc.EnableRouting(hostName(n.config.Name), iface, nil)
+}
 
-	return nil
+func (n *networkLinux) DisconnectRouted(iface string) error {
+	if err := firewall.Reconcile(&firewall.Ruleset{
+		Absent: getRulesForInterface(n.config.Name, iface, hostName(n.config.Name), false, true),
+	}); err != nil {
+		return err
+	}
+	return ifc.DisableRouting(hostName(n.config.Name), iface)
 }
 
 func NewNetwork(opts ...NetworkOption) (Network, error) {
+	unlock, lockErr := lock.Acquire()
+	if lockErr != nil {
+		return nil, lockErr
+	}
+	defer unlock()
+
 	config := &NetworkConfig{}
 	for _, opt := range opts {
 		if err := opt(config); err != nil {
@@ -105,6 +153,21 @@ func NewNetwork(opts ...NetworkOption) (Network, error) {
 	}
 	defer unix.Close(nsFd)
 
+	nsFirewall, firewallErr := firewall.New(firewall.WithNetNS(nsFd))
+	if firewallErr != nil {
+		deleteNamespace(config.Name)
+		return nil, firewallErr
+	}
+	network.firewall = nsFirewall
+	// Destroy closes the firewall of a network torn down on failure; the
+	// remaining error paths close it here
+	created := false
+	defer func() {
+		if !created && network.firewall != nil {
+			network.firewall.Close()
+		}
+	}()
+
 	// Create veth pair
 	vethAttrs := netlink.NewLinkAttrs()
 	vethAttrs.Name = hostName(config.Name)
@@ -133,6 +196,12 @@ func NewNetwork(opts ...NetworkOption) (Network, error) {
 		return nil, err
 	}
 
+	// The host forwards between the veth pair and the uplinks
+	if err := sysctl.Apply(hostName(config.Name), sysctl.ForwardingParams("", false)); err != nil {
+		network.Destroy()
+		return nil, err
+	}
+
 	// Configure namespace side of veth pair
 	if err := network.Execute(func() error {
 		cidr := &net.IPNet{
@@ -155,11 +224,20 @@ func NewNetwork(opts ...NetworkOption) (Network, error) {
 			return fmt.Errorf("failed to set default route: %w", err)
 		}
 
+		// The namespace forwards between its bridge and the veth pair. It is
+		// deleted on teardown, so nothing needs restoring.
+		for _, p := range sysctl.ForwardingParams("", false) {
+			if err := sysctl.Write(p.Path, p.Value); err != nil {
+				return err
+			}
+		}
+
 		return nil
 	}); err != nil {
 		network.Destroy()
 		return nil, err
 	}
 
+	created = true
 	return network, nil
 }
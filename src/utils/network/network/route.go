@@ -6,10 +6,17 @@ import (
 	"fmt"
 	"net"
 
+	"github.com/q-controller/network-utils/src/utils/network/lock"
 	"github.com/vishvananda/netlink"
 )
 
 func SetDefaultRoute(iface string, gatewayIp net.IP) error {
+	unlock, lockErr := lock.Acquire()
+	if lockErr != nil {
+		return lockErr
+	}
+	defer unlock()
+
 	link, err := netlink.LinkByName(iface)
 	if err != nil {
 		return fmt.Errorf("failed to get link: %w", err)
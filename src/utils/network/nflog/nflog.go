@@ -0,0 +1,277 @@
+//go:build linux
+
+// Package nflog reads packets that nftables `log group N` rules send to
+// userspace and reports them as structured slog events.
+package nflog
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// Constants of linux/netfilter/nfnetlink_log.h
+const (
+	nfulnlMsgPacket = 0
+	nfulnlMsgConfig = 1
+
+	nfulaCfgCmd  = 1
+	nfulaCfgMode = 2
+
+	nfulnlCfgCmdBind   = 1
+	nfulnlCfgCmdUnbind = 2
+	nfulnlCopyPacket   = 2
+
+	nfulaIfindexIndev  = 4
+	nfulaIfindexOutdev = 5
+	nfulaPayload       = 9
+	nfulaPrefix        = 10
+)
+
+// copyRange is the number of payload bytes requested per packet, enough for
+// the network and transport headers
+const copyRange = 128
+
+// Packet is a packet logged by a log rule. Prefix is the prefix of the rule,
+// for the rules of the firewall package the chain and the reason of the drop,
+// e.g. "QEMU-FORWARD drop new".
+type Packet struct {
+	Prefix   string
+	InDev    string
+	OutDev   string
+	Protocol string
+	Src      netip.Addr
+	Dst      netip.Addr
+	SrcPort  uint16
+	DstPort  uint16
+}
+
+// Attrs returns the fields of the packet as slog attributes
+func (p Packet) Attrs() []slog.Attr {
+	attrs := []slog.Attr{
+		slog.String("prefix", p.Prefix),
+		slog.String("in", p.InDev),
+		slog.String("out", p.OutDev),
+		slog.String("proto", p.Protocol),
+		slog.String("src", p.Src.String()),
+		slog.String("dst", p.Dst.String()),
+	}
+	if p.SrcPort != 0 || p.DstPort != 0 {
+		attrs = append(attrs, slog.Int("sport", int(p.SrcPort)), slog.Int("dport", int(p.DstPort)))
+	}
+	return attrs
+}
+
+// Reader receives the packets of one NFLOG group
+type Reader struct {
+	conn  *netlink.Conn
+	group uint16
+}
+
+func msgType(msg uint16) netlink.HeaderType {
+	return netlink.HeaderType(unix.NFNL_SUBSYS_ULOG<<8 | msg)
+}
+
+// nfgenmsg returns the netfilter header addressing group
+func nfgenmsg(group uint16) []byte {
+	b := []byte{unix.AF_UNSPEC, unix.NFNETLINK_V0, 0, 0}
+	binary.BigEndian.PutUint16(b[2:], group)
+	return b
+}
+
+func (r *Reader) config(attrs []netlink.Attribute) error {
+	data, dataErr := netlink.MarshalAttributes(attrs)
+	if dataErr != nil {
+		return dataErr
+	}
+	_, err := r.conn.Execute(netlink.Message{
+		Header: netlink.Header{
+			Type:  msgType(nfulnlMsgConfig),
+			Flags: netlink.Request | netlink.Acknowledge,
+		},
+		Data: append(nfgenmsg(r.group), data...),
+	})
+	return err
+}
+
+// Open binds to NFLOG group. Only one process can be bound to a group.
+func Open(group uint16) (*Reader, error) {
+	conn, dialErr := netlink.Dial(unix.NETLINK_NETFILTER, nil)
+	if dialErr != nil {
+		return nil, dialErr
+	}
+	r := &Reader{conn: conn, group: group}
+
+	mode := make([]byte, 6)
+	binary.BigEndian.PutUint32(mode, copyRange)
+	mode[4] = nfulnlCopyPacket
+	if err := r.config([]netlink.Attribute{
+		{Type: nfulaCfgCmd, Data: []byte{nfulnlCfgCmdBind}},
+		{Type: nfulaCfgMode, Data: mode},
+	}); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to bind to NFLOG group %d: %w", group, err)
+	}
+	return r, nil
+}
+
+// Read blocks until packets arrive and returns them
+func (r *Reader) Read() ([]Packet, error) {
+	msgs, recvErr := r.conn.Receive()
+	if recvErr != nil {
+		return nil, recvErr
+	}
+
+	var packets []Packet
+	for _, msg := range msgs {
+		if msg.Header.Type != msgType(nfulnlMsgPacket) {
+			continue
+		}
+		packet, parseErr := parsePacket(msg.Data, interfaceName)
+		if parseErr != nil {
+			return nil, parseErr
+		}
+		packets = append(packets, packet)
+	}
+	return packets, nil
+}
+
+// Close unbinds from the group and closes the socket
+func (r *Reader) Close() error {
+	unbindErr := r.config([]netlink.Attribute{
+		{Type: nfulaCfgCmd, Data: []byte{nfulnlCfgCmdUnbind}},
+	})
+	return errors.Join(unbindErr, r.conn.Close())
+}
+
+// Run logs every packet of group with logger until ctx is done
+func Run(ctx context.Context, group uint16, logger *slog.Logger) error {
+	r, openErr := Open(group)
+	if openErr != nil {
+		return openErr
+	}
+	defer r.Close()
+
+	stop := context.AfterFunc(ctx, func() {
+		r.conn.SetReadDeadline(time.Now())
+	})
+	defer stop()
+
+	for {
+		packets, readErr := r.Read()
+		if readErr != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if errors.Is(readErr, os.ErrDeadlineExceeded) {
+				continue
+			}
+			return readErr
+		}
+		for _, p := range packets {
+			logger.LogAttrs(ctx, slog.LevelInfo, "packet logged", p.Attrs()...)
+		}
+	}
+}
+
+func interfaceName(index uint32) string {
+	ifc, err := net.InterfaceByIndex(int(index))
+	if err != nil {
+		return strconv.Itoa(int(index))
+	}
+	return ifc.Name
+}
+
+// parsePacket parses a NFULNL_MSG_PACKET message without its netlink header
+func parsePacket(data []byte, ifname func(uint32) string) (Packet, error) {
+	if len(data) < 4 {
+		return Packet{}, fmt.Errorf("NFLOG message too short")
+	}
+	ad, adErr := netlink.NewAttributeDecoder(data[4:])
+	if adErr != nil {
+		return Packet{}, adErr
+	}
+	ad.ByteOrder = binary.BigEndian
+
+	var p Packet
+	var payload []byte
+	for ad.Next() {
+		switch ad.Type() {
+		case nfulaPrefix:
+			p.Prefix = ad.String()
+		case nfulaIfindexIndev:
+			p.InDev = ifname(ad.Uint32())
+		case nfulaIfindexOutdev:
+			p.OutDev = ifname(ad.Uint32())
+		case nfulaPayload:
+			payload = ad.Bytes()
+		}
+	}
+	if err := ad.Err(); err != nil {
+		return Packet{}, err
+	}
+
+	parsePayload(&p, payload)
+	return p, nil
+}
+
+// parsePayload fills in addresses, protocol and ports from the network header
+// at the start of payload. Truncated headers leave the fields empty.
+func parsePayload(p *Packet, payload []byte) {
+	if len(payload) == 0 {
+		return
+	}
+
+	var proto byte
+	var transport []byte
+	switch payload[0] >> 4 {
+	case 4:
+		if len(payload) < 20 {
+			return
+		}
+		p.Src = netip.AddrFrom4([4]byte(payload[12:16]))
+		p.Dst = netip.AddrFrom4([4]byte(payload[16:20]))
+		proto = payload[9]
+		if ihl := int(payload[0]&0x0f) * 4; ihl >= 20 && len(payload) >= ihl {
+			transport = payload[ihl:]
+		}
+	case 6:
+		if len(payload) < 40 {
+			return
+		}
+		p.Src = netip.AddrFrom16([16]byte(payload[8:24]))
+		p.Dst = netip.AddrFrom16([16]byte(payload[24:40]))
+		proto = payload[6]
+		transport = payload[40:]
+	default:
+		return
+	}
+
+	switch proto {
+	case unix.IPPROTO_TCP:
+		p.Protocol = "tcp"
+	case unix.IPPROTO_UDP:
+		p.Protocol = "udp"
+	case unix.IPPROTO_ICMP:
+		p.Protocol = "icmp"
+	case unix.IPPROTO_ICMPV6:
+		p.Protocol = "icmpv6"
+	default:
+		p.Protocol = strconv.Itoa(int(proto))
+	}
+
+	if (proto == unix.IPPROTO_TCP || proto == unix.IPPROTO_UDP) && len(transport) >= 4 {
+		p.SrcPort = binary.BigEndian.Uint16(transport[0:2])
+		p.DstPort = binary.BigEndian.Uint16(transport[2:4])
+	}
+}
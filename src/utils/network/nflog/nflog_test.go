@@ -0,0 +1,49 @@
+//go:build linux
+
+package nflog
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"strconv"
+	"testing"
+
+	"github.com/mdlayher/netlink"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePacket_IPv4TCP(t *testing.T) {
+	payload := []byte{
+		0x45, 0, 0, 40, 0, 0, 0, 0, 64, 6, 0, 0,
+		192, 168, 26, 10,
+		1, 1, 1, 1,
+		0xc3, 0x50, 0x01, 0xbb,
+	}
+	ae := netlink.NewAttributeEncoder()
+	ae.ByteOrder = binary.BigEndian
+	ae.String(nfulaPrefix, "QEMU-FORWARD")
+	ae.Uint32(nfulaIfindexIndev, 7)
+	ae.Bytes(nfulaPayload, payload)
+	attrs, err := ae.Encode()
+	require.NoError(t, err)
+
+	p, err := parsePacket(append(nfgenmsg(100), attrs...), func(index uint32) string {
+		return "if" + strconv.Itoa(int(index))
+	})
+	require.NoError(t, err)
+	require.Equal(t, Packet{
+		Prefix:   "QEMU-FORWARD",
+		InDev:    "if7",
+		Protocol: "tcp",
+		Src:      netip.MustParseAddr("192.168.26.10"),
+		Dst:      netip.MustParseAddr("1.1.1.1"),
+		SrcPort:  50000,
+		DstPort:  443,
+	}, p)
+}
+
+func TestParsePayload_TruncatedIPv6(t *testing.T) {
+	p := Packet{}
+	parsePayload(&p, []byte{0x60, 0, 0, 0})
+	require.Equal(t, Packet{}, p)
+}
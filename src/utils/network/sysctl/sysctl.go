@@ -0,0 +1,411 @@
+//go:build linux
+
+// Package sysctl reads and sets the kernel parameters below /proc/sys that
+// guest networking depends on. Apply records the values it replaces in a
+// state file, so Restore can put them back when the last owner is torn down.
+package sysctl
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/q-controller/network-utils/src/utils/network/lock"
+	"github.com/vishvananda/netns"
+)
+
+// DefaultStatePath is the runtime file recording the replaced values
+const DefaultStatePath = "/run/network-utils.sysctl.json"
+
+var (
+	mu        sync.Mutex
+	root      = "/proc/sys"
+	statePath = DefaultStatePath
+)
+
+// SetRoot replaces the directory the parameters are read from and written
+// to, e.g. with a temporary directory in tests. It returns the previous root.
+func SetRoot(p string) string {
+	mu.Lock()
+	defer mu.Unlock()
+	previous := root
+	root = p
+	return previous
+}
+
+// SetStatePath replaces the file recording the replaced values. It returns
+// the previous path.
+func SetStatePath(p string) string {
+	mu.Lock()
+	defer mu.Unlock()
+	previous := statePath
+	statePath = p
+	return previous
+}
+
+func paths() (string, string) {
+	mu.Lock()
+	defer mu.Unlock()
+	return root, statePath
+}
+
+// Param is a kernel parameter and the value guests need
+type Param struct {
+	// Path is relative to /proc/sys, e.g. net/ipv4/ip_forward. Interface
+	// names may contain dots, so paths are not derived from dotted names.
+	Path  string
+	Value string
+	// Optional parameters may be missing, e.g. those of a module that is not
+	// loaded
+	Optional bool
+}
+
+// Name returns the dotted name of p as sysctl(8) shows it, with dots within
+// a component, like in eth0.100, turned into slashes
+func (p Param) Name() string {
+	components := strings.Split(p.Path, "/")
+	for i, c := range components {
+		components[i] = strings.ReplaceAll(c, ".", "/")
+	}
+	return strings.Join(components, ".")
+}
+
+// Conf returns the path of the parameter key of the interface ifName, or of
+// all or default, in family, which is ipv4 or ipv6
+func Conf(family, ifName, key string) string {
+	return filepath.Join("net", family, "conf", ifName, key)
+}
+
+// ForwardingParams returns the parameters routing guest traffic between
+// interfaces. Enabling IPv6 forwarding stops interfaces with accept_ra 1 from
+// accepting router advertisements, so the uplink hostIf, unless empty, gets
+// accept_ra 2 to keep its default route.
+func ForwardingParams(hostIf string, ipv6 bool) []Param {
+	params := []Param{{Path: "net/ipv4/ip_forward", Value: "1"}}
+	if ipv6 {
+		params = append(params, Param{Path: Conf("ipv6", "all", "forwarding"), Value: "1"})
+		if hostIf != "" {
+			params = append(params, Param{Path: Conf("ipv6", hostIf, "accept_ra"), Value: "2"})
+		}
+	}
+	return params
+}
+
+// BridgeParams returns the parameters the guests of bridge need: forwarding
+// through hostIf and loose reverse path filtering on the bridge. The effective rp_filter of
+// an interface is the higher of its own and that of all, so the bridge is
+// loose even if all is strict.
+func BridgeParams(bridge, hostIf string, ipv6 bool) []Param {
+	return append(ForwardingParams(hostIf, ipv6), Param{Path: Conf("ipv4", bridge, "rp_filter"), Value: "2"})
+}
+
+// BridgeNetfilterParams returns the parameters keeping bridged frames out of
+// iptables, whose FORWARD policy other firewalls often set to drop. They are
+// host-wide and only exist with br_netfilter loaded, so they are checked and
+// reported but never applied.
+func BridgeNetfilterParams(ipv6 bool) []Param {
+	params := []Param{{Path: "net/bridge/bridge-nf-call-iptables", Value: "0", Optional: true}}
+	if ipv6 {
+		params = append(params, Param{Path: "net/bridge/bridge-nf-call-ip6tables", Value: "0", Optional: true})
+	}
+	return params
+}
+
+// Status is the current value of a parameter next to the one guests need
+type Status struct {
+	Param
+	// Current is empty if the parameter is missing
+	Current string
+}
+
+// OK reports whether the current value is the needed one, or whether an
+// optional parameter is missing
+func (s Status) OK() bool {
+	return s.Current == s.Value || (s.Current == "" && s.Optional)
+}
+
+// record is a parameter an owner changed and the value it had before
+type record struct {
+	Path     string `json:"path"`
+	Original string `json:"original"`
+}
+
+// state maps namespaces, empty for the host, to owners and their records
+type state map[string]map[string][]record
+
+func loadState(p string) (state, error) {
+	content, readErr := os.ReadFile(p)
+	if errors.Is(readErr, os.ErrNotExist) {
+		return state{}, nil
+	}
+	if readErr != nil {
+		return nil, fmt.Errorf("failed to read sysctl state %s: %w", p, readErr)
+	}
+	st := state{}
+	if err := json.Unmarshal(content, &st); err != nil {
+		return nil, fmt.Errorf("failed to parse sysctl state %s: %w", p, err)
+	}
+	return st, nil
+}
+
+func (st state) save(p string) error {
+	if len(st) == 0 {
+		if err := os.Remove(p); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to remove sysctl state %s: %w", p, err)
+		}
+		return nil
+	}
+	content, marshalErr := json.MarshalIndent(st, "", "  ")
+	if marshalErr != nil {
+		return marshalErr
+	}
+	if err := os.WriteFile(p, content, 0o644); err != nil {
+		return fmt.Errorf("failed to write sysctl state %s: %w", p, err)
+	}
+	return nil
+}
+
+// holder returns a record of path of any owner in owners
+func holder(owners map[string][]record, path string) (record, bool) {
+	for _, records := range owners {
+		for _, r := range records {
+			if r.Path == path {
+				return r, true
+			}
+		}
+	}
+	return record{}, false
+}
+
+// Namespace reads and sets the parameters of a network namespace
+type Namespace struct {
+	name string
+}
+
+// Host returns the Namespace of the calling thread, which is recorded as the
+// host namespace
+func Host() *Namespace {
+	return &Namespace{}
+}
+
+// NetNS returns the Namespace of the named network namespace
+func NetNS(name string) *Namespace {
+	return &Namespace{name: name}
+}
+
+// run calls fn with the calling thread in the namespace. The parameters below
+// /proc/sys/net belong to the namespace of the thread opening them.
+func (n *Namespace) run(fn func() error) error {
+	if n.name == "" {
+		return fn()
+	}
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	origNS, origNsErr := netns.Get()
+	if origNsErr != nil {
+		return origNsErr
+	}
+	defer origNS.Close()
+
+	targetNS, targetNsErr := netns.GetFromName(n.name)
+	if targetNsErr != nil {
+		return fmt.Errorf("failed to open network namespace %s: %w", n.name, targetNsErr)
+	}
+	defer targetNS.Close()
+
+	if err := netns.Set(targetNS); err != nil {
+		return err
+	}
+	defer netns.Set(origNS)
+
+	return fn()
+}
+
+func read(path string) (string, error) {
+	dir, _ := paths()
+	content, err := os.ReadFile(filepath.Join(dir, path))
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return strings.TrimSpace(string(content)), nil
+}
+
+func write(path, value string) error {
+	dir, _ := paths()
+	if err := os.WriteFile(filepath.Join(dir, path), []byte(value+"\n"), 0o644); err != nil {
+		return fmt.Errorf("failed to set %s to %s: %w", path, value, err)
+	}
+	return nil
+}
+
+// Read returns the value of the host parameter at path, relative to /proc/sys
+func Read(path string) (string, error) {
+	return Host().Read(path)
+}
+
+// Read returns the value of the parameter at path, relative to /proc/sys
+func (n *Namespace) Read(path string) (string, error) {
+	var value string
+	err := n.run(func() error {
+		var readErr error
+		value, readErr = read(path)
+		return readErr
+	})
+	return value, err
+}
+
+// Write sets the host parameter at path without recording its previous value
+func Write(path, value string) error {
+	return Host().Write(path, value)
+}
+
+// Write sets the parameter at path without recording its previous value, e.g.
+// in a namespace that is deleted on teardown
+func (n *Namespace) Write(path, value string) error {
+	return n.run(func() error {
+		return write(path, value)
+	})
+}
+
+// Check returns the current values of params in the host namespace
+func Check(params []Param) ([]Status, error) {
+	return Host().Check(params)
+}
+
+// Check returns the current values of params
+func (n *Namespace) Check(params []Param) ([]Status, error) {
+	var statuses []Status
+	err := n.run(func() error {
+		for _, p := range params {
+			current, readErr := read(p.Path)
+			if readErr != nil && !errors.Is(readErr, os.ErrNotExist) {
+				return readErr
+			}
+			statuses = append(statuses, Status{Param: p, Current: current})
+		}
+		return nil
+	})
+	return statuses, err
+}
+
+// Apply sets params of the host namespace on behalf of owner, see Namespace.Apply
+func Apply(owner string, params []Param) error {
+	return Host().Apply(owner, params)
+}
+
+// Apply sets params on behalf of owner, e.g. a bridge, and records the values
+// they replace. A parameter another owner changed keeps its first recorded
+// value, and one that already has the needed value is only recorded if
+// another owner changed it, so Restore leaves it to the last of them.
+// Missing optional parameters are skipped.
+func (n *Namespace) Apply(owner string, params []Param) error {
+	unlock, lockErr := lock.Acquire()
+	if lockErr != nil {
+		return lockErr
+	}
+	defer unlock()
+
+	_, stateFile := paths()
+	st, stateErr := loadState(stateFile)
+	if stateErr != nil {
+		return stateErr
+	}
+	owners := st[n.name]
+	if owners == nil {
+		owners = map[string][]record{}
+	}
+
+	applyErr := n.run(func() error {
+		for _, p := range params {
+			current, readErr := read(p.Path)
+			if errors.Is(readErr, os.ErrNotExist) && p.Optional {
+				continue
+			}
+			if readErr != nil {
+				return readErr
+			}
+
+			held, isHeld := holder(owners, p.Path)
+			if current == p.Value && !isHeld {
+				continue
+			}
+			if current != p.Value {
+				if err := write(p.Path, p.Value); err != nil {
+					return err
+				}
+			}
+			original := current
+			if isHeld {
+				original = held.Original
+			}
+			if !slices.ContainsFunc(owners[owner], func(r record) bool { return r.Path == p.Path }) {
+				owners[owner] = append(owners[owner], record{Path: p.Path, Original: original})
+			}
+		}
+		return nil
+	})
+	// Parameters set before a failure are recorded as well
+	if len(owners) > 0 {
+		st[n.name] = owners
+	}
+	if err := st.save(stateFile); err != nil {
+		return errors.Join(applyErr, err)
+	}
+	return applyErr
+}
+
+// Restore puts back the host parameters Apply changed for owner
+func Restore(owner string) error {
+	return Host().Restore(owner)
+}
+
+// Restore puts back the values the parameters of owner had before Apply,
+// unless another owner still needs them. Parameters of deleted links and
+// namespaces are skipped.
+func (n *Namespace) Restore(owner string) error {
+	unlock, lockErr := lock.Acquire()
+	if lockErr != nil {
+		return lockErr
+	}
+	defer unlock()
+
+	_, stateFile := paths()
+	st, stateErr := loadState(stateFile)
+	if stateErr != nil {
+		return stateErr
+	}
+	owners := st[n.name]
+	records, ok := owners[owner]
+	if !ok {
+		return nil
+	}
+	delete(owners, owner)
+
+	if err := n.run(func() error {
+		for _, r := range records {
+			if _, isHeld := holder(owners, r.Path); isHeld {
+				continue
+			}
+			if err := write(r.Path, r.Original); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+		}
+		return nil
+	}); err != nil && !errors.Is(err, os.ErrNotExist) {
+		// The parameters of a deleted namespace are gone with it
+		return err
+	}
+
+	if len(owners) == 0 {
+		delete(st, n.name)
+	}
+	return st.save(stateFile)
+}
@@ -0,0 +1,147 @@
+//go:build linux
+
+package sysctl
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/q-controller/network-utils/src/utils/network/lock"
+	"github.com/stretchr/testify/require"
+)
+
+// useTempRoot points the package at a temporary /proc/sys holding values,
+// keyed by path, and returns the state file
+func useTempRoot(t *testing.T, values map[string]string) string {
+	dir := t.TempDir()
+	for path, value := range values {
+		p := filepath.Join(dir, "sys", path)
+		require.NoError(t, os.MkdirAll(filepath.Dir(p), 0o755))
+		require.NoError(t, os.WriteFile(p, []byte(value+"\n"), 0o644))
+	}
+	stateFile := filepath.Join(dir, "sysctl.json")
+	previousRoot := SetRoot(filepath.Join(dir, "sys"))
+	previousState := SetStatePath(stateFile)
+	previousLock := lock.SetPath(filepath.Join(dir, "network-utils.lock"))
+	t.Cleanup(func() {
+		SetRoot(previousRoot)
+		SetStatePath(previousState)
+		lock.SetPath(previousLock)
+	})
+	return stateFile
+}
+
+func requireValue(t *testing.T, path, want string) {
+	value, err := Read(path)
+	require.NoError(t, err)
+	require.Equal(t, want, value, path)
+}
+
+func TestApplyRestore(t *testing.T) {
+	stateFile := useTempRoot(t, map[string]string{
+		"net/ipv4/ip_forward":         "0",
+		"net/ipv4/conf/br0/rp_filter": "1",
+	})
+
+	require.NoError(t, Apply("br0", BridgeParams("br0", "eth0", false)))
+	requireValue(t, "net/ipv4/ip_forward", "1")
+	requireValue(t, "net/ipv4/conf/br0/rp_filter", "2")
+
+	require.NoError(t, Restore("br0"))
+	requireValue(t, "net/ipv4/ip_forward", "0")
+	requireValue(t, "net/ipv4/conf/br0/rp_filter", "1")
+	require.NoFileExists(t, stateFile)
+
+	// Owners without records are ignored
+	require.NoError(t, Restore("br0"))
+}
+
+func TestRestore_SharedParam(t *testing.T) {
+	useTempRoot(t, map[string]string{"net/ipv4/ip_forward": "0"})
+
+	require.NoError(t, Apply("br0", ForwardingParams("eth0", false)))
+	require.NoError(t, Apply("br1", ForwardingParams("eth0", false)))
+
+	// Forwarding stays on until the last bridge is torn down
+	require.NoError(t, Restore("br0"))
+	requireValue(t, "net/ipv4/ip_forward", "1")
+	require.NoError(t, Restore("br1"))
+	requireValue(t, "net/ipv4/ip_forward", "0")
+}
+
+func TestForwardingParams_AcceptRA(t *testing.T) {
+	useTempRoot(t, map[string]string{
+		"net/ipv4/ip_forward":          "0",
+		"net/ipv6/conf/all/forwarding": "0",
+		"net/ipv6/conf/eth0/accept_ra": "1",
+	})
+
+	// The uplink keeps accepting router advertisements with forwarding on
+	require.NoError(t, Apply("br0", ForwardingParams("eth0", true)))
+	requireValue(t, "net/ipv6/conf/all/forwarding", "1")
+	requireValue(t, "net/ipv6/conf/eth0/accept_ra", "2")
+
+	require.NoError(t, Restore("br0"))
+	requireValue(t, "net/ipv6/conf/eth0/accept_ra", "1")
+}
+
+func TestApply_KeepsNeededValues(t *testing.T) {
+	stateFile := useTempRoot(t, map[string]string{"net/ipv4/ip_forward": "1"})
+
+	require.NoError(t, Apply("br0", ForwardingParams("eth0", false)))
+	require.NoFileExists(t, stateFile)
+
+	require.NoError(t, Restore("br0"))
+	requireValue(t, "net/ipv4/ip_forward", "1")
+}
+
+func TestApply_MissingParams(t *testing.T) {
+	useTempRoot(t, map[string]string{
+		"net/ipv4/ip_forward":         "0",
+		"net/ipv4/conf/br0/rp_filter": "0",
+	})
+
+	// bridge-nf-call-iptables is missing without br_netfilter
+	require.NoError(t, Apply("br0", BridgeNetfilterParams(false)))
+	// A missing bridge is not
+	require.ErrorIs(t, Apply("br1", BridgeParams("br1", "eth0", false)), os.ErrNotExist)
+}
+
+func TestCheck(t *testing.T) {
+	useTempRoot(t, map[string]string{
+		"net/ipv4/ip_forward":                "0",
+		"net/bridge/bridge-nf-call-iptables": "1",
+		"net/ipv4/conf/br0/rp_filter":        "2",
+	})
+
+	statuses, err := Check(append(BridgeParams("br0", "eth0", true), BridgeNetfilterParams(true)...))
+	require.NoError(t, err)
+	ok := map[string]bool{}
+	for _, s := range statuses {
+		ok[s.Name()] = s.OK()
+	}
+	require.Equal(t, map[string]bool{
+		"net.ipv4.ip_forward":                 false,
+		"net.ipv6.conf.all.forwarding":        false,
+		"net.ipv6.conf.eth0.accept_ra":        false,
+		"net.bridge.bridge-nf-call-iptables":  false,
+		"net.bridge.bridge-nf-call-ip6tables": true,
+		"net.ipv4.conf.br0.rp_filter":         true,
+	}, ok)
+}
+
+func TestBridgeParams_LeaveBridgeNetfilterAlone(t *testing.T) {
+	useTempRoot(t, map[string]string{
+		"net/ipv4/ip_forward":                "0",
+		"net/bridge/bridge-nf-call-iptables": "1",
+		"net/ipv4/conf/br0/rp_filter":        "1",
+	})
+
+	require.NoError(t, Apply("br0", BridgeParams("br0", "eth0", false)))
+	requireValue(t, "net/bridge/bridge-nf-call-iptables", "1")
+}
+
+func TestParam_Name(t *testing.T) {
+	require.Equal(t, "net.ipv4.conf.eth0/100.rp_filter", Param{Path: Conf("ipv4", "eth0.100", "rp_filter")}.Name())
+}